@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/u2takey/mysqlgate/pkg/config"
 	"github.com/u2takey/mysqlgate/pkg/log"
 	"github.com/u2takey/mysqlgate/pkg/server"
 	"github.com/u2takey/mysqlgate/pkg/sql"
@@ -19,6 +20,7 @@ var (
 	logLevel    = flag.String("log", "info", "set log level with debug|info|warn|error|fatal")
 	listenAddr  = flag.String("addr", "0.0.0.0:3316", "proxy listen address")
 	defaultDb   = flag.String("db", "root:root@tcp(127.0.0.1:3306)/mysql?charset=utf8&parseTime=True", "default db connection string")
+	configFile  = flag.String("config", "", "config file, overrides addr and db when set")
 )
 
 func main() {
@@ -29,7 +31,16 @@ func main() {
 	}
 	log.SetLogLevel(*logLevel)
 
-	svr, err := server.NewServer(*listenAddr, *defaultDb)
+	cfg := config.Default(*listenAddr, *defaultDb)
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			log.Error("msg", "load config failed", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	svr, err := server.NewServer(cfg)
 	if err != nil {
 		log.Error("msg", "init server failed", "err", err)
 		os.Exit(1)
@@ -6,4 +6,5 @@ require (
 	github.com/go-kit/log v0.2.1
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/u2takey/sqlparser v0.0.0-20220817031000-8cdd2a394900
+	golang.org/x/text v0.3.6
 )
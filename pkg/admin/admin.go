@@ -0,0 +1,112 @@
+// Package admin serves the http endpoints operators manage the proxy with.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/log"
+)
+
+var mLog = log.ModuleLogger("admin")
+
+type Config struct {
+	// Addr is the listen address of the admin server, off when empty. An
+	// address without host listens on loopback unless a token is set.
+	Addr string `json:"addr"`
+	// Token is the bearer token the requests must authorize with. Without
+	// it the admin server only listens on loopback.
+	Token string `json:"token,omitempty"`
+}
+
+// Server routes admin requests to the handlers features register.
+type Server struct {
+	addr  string
+	token string
+	mux   *http.ServeMux
+}
+
+func NewServer(cfg Config) (*Server, error) {
+	addr, err := listenAddr(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{addr: addr, token: cfg.Token, mux: http.NewServeMux()}, nil
+}
+
+// listenAddr returns the address of cfg, refusing to listen beyond loopback
+// without a token.
+func listenAddr(cfg Config) (string, error) {
+	host, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return "", fmt.Errorf("admin: %v", err)
+	}
+	if cfg.Token != "" {
+		return cfg.Addr, nil
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return "", errors.New("admin: listening beyond loopback needs a token")
+		}
+	}
+	return cfg.Addr, nil
+}
+
+// Handle registers the handler of pattern.
+func (s *Server) Handle(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// ServeHTTP serves the requests authorized with the token of s.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mysqlgate"`)
+			WriteError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Run serves until ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	srv := &http.Server{Addr: s.addr, Handler: s}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	mLog.Log("msg", "admin server listening", "addr", s.addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// WriteJSON answers v encoded as json.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		mLog.Error("msg", "writing response", "err", err)
+	}
+}
+
+// WriteError answers err as a json error.
+func WriteError(w http.ResponseWriter, status int, err error) {
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
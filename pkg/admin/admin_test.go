@@ -0,0 +1,68 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want string
+		err  bool
+	}{
+		{Config{Addr: ":8080"}, "127.0.0.1:8080", false},
+		{Config{Addr: "127.0.0.1:8080"}, "127.0.0.1:8080", false},
+		{Config{Addr: "localhost:8080"}, "localhost:8080", false},
+		{Config{Addr: "[::1]:8080"}, "[::1]:8080", false},
+		{Config{Addr: "0.0.0.0:8080"}, "", true},
+		{Config{Addr: "10.0.0.1:8080"}, "", true},
+		{Config{Addr: "admin.example.com:8080"}, "", true},
+		{Config{Addr: ":8080", Token: "secret"}, ":8080", false},
+		{Config{Addr: "0.0.0.0:8080", Token: "secret"}, "0.0.0.0:8080", false},
+		{Config{Addr: "8080"}, "", true},
+	}
+	for _, test := range tests {
+		got, err := listenAddr(test.cfg)
+		if (err != nil) != test.err {
+			t.Errorf("%+v: error %v", test.cfg, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.cfg, got, test.want)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	tests := []struct {
+		token  string
+		header string
+		status int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		s, err := NewServer(Config{Addr: "127.0.0.1:0", Token: test.token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Handle("/ping", func(w http.ResponseWriter, r *http.Request) {
+			WriteJSON(w, http.StatusOK, "pong")
+		})
+		r := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("token %q, header %q: got %d, want %d", test.token, test.header, w.Code, test.status)
+		}
+	}
+}
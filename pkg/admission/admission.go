@@ -0,0 +1,322 @@
+// Package admission limits the queries admitted to run, by rate with token
+// buckets and by concurrency, per user, database, client ip or digest.
+// Queries over a limit wait in a bounded queue or are rejected.
+package admission
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	KeyUser     = "user"
+	KeyDatabase = "database"
+	KeyClient   = "client"
+	KeyDigest   = "digest"
+
+	DefaultQueueTimeout = time.Second
+	// maxLimiters bounds the limiters of a rule, the idle ones are dropped
+	// past it.
+	maxLimiters = 10000
+)
+
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule limits the queries of each value of its key separately, a user
+// or a client ip for instance.
+type Rule struct {
+	Name string `json:"name"`
+	// Key is user, database, client or digest.
+	Key string `json:"key"`
+	// Values are the values of the key the rule applies to, all when
+	// empty.
+	Values []string `json:"values,omitempty"`
+	// QPS is the rate of queries admitted, with bursts of Burst queries,
+	// unlimited when zero.
+	QPS   float64 `json:"qps,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+	// MaxConcurrent bounds the queries running at once, unlimited when
+	// zero.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// QueueSize is the number of queries over a limit waiting for up to
+	// QueueTimeout, like "500ms", before they are rejected. The queries
+	// over a limit are rejected at once when zero.
+	QueueSize    int    `json:"queue_size,omitempty"`
+	QueueTimeout string `json:"queue_timeout,omitempty"`
+
+	queueTimeout time.Duration
+}
+
+// Request is a query asking to be admitted.
+type Request struct {
+	User     string
+	Database string
+	Client   string
+	Digest   string
+}
+
+func (r *Request) value(key string) string {
+	switch key {
+	case KeyUser:
+		return r.User
+	case KeyDatabase:
+		return r.Database
+	case KeyClient:
+		return r.Client
+	}
+	return r.Digest
+}
+
+// Rejected is the error of a query over a limit.
+type Rejected struct {
+	Rule string
+	// Rate is set when the query was over the rate, else it was over the
+	// concurrency.
+	Rate  bool
+	Value string
+}
+
+func (e *Rejected) Error() string {
+	if e.Rate {
+		return fmt.Sprintf("rate of queries of rule %s exceeded for %s", e.Rule, e.Value)
+	}
+	return fmt.Sprintf("concurrent queries of rule %s exceeded for %s", e.Rule, e.Value)
+}
+
+// Stats are the counters of a rule.
+type Stats struct {
+	Rule     string `json:"rule"`
+	Admitted int64  `json:"admitted"`
+	Queued   int64  `json:"queued"`
+	Rejected int64  `json:"rejected"`
+}
+
+type Controller struct {
+	rules []*rule
+}
+
+type rule struct {
+	Rule
+
+	mu       sync.Mutex // protects following fields
+	limiters map[string]*limiter
+	stats    Stats
+}
+
+// limiter limits the queries of a value of the key of a rule.
+type limiter struct {
+	// tokens is the token bucket, refilled at last. It goes negative when
+	// queued queries reserved tokens ahead.
+	tokens float64
+	last   time.Time
+	// slots hold a value per running query.
+	slots   chan struct{}
+	waiting int
+}
+
+func New(cfg Config) (*Controller, error) {
+	c := &Controller{}
+	for i, r := range cfg.Rules {
+		switch r.Key {
+		case KeyUser, KeyDatabase, KeyClient, KeyDigest:
+		default:
+			return nil, fmt.Errorf("admission: rule %d: unknown key %q", i, r.Key)
+		}
+		if r.QPS <= 0 && r.MaxConcurrent <= 0 {
+			return nil, fmt.Errorf("admission: rule %d limits nothing", i)
+		}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("%s-%d", r.Key, i)
+		}
+		if r.QPS > 0 && r.Burst <= 0 {
+			r.Burst = int(math.Ceil(r.QPS))
+		}
+		r.queueTimeout = DefaultQueueTimeout
+		if r.QueueTimeout != "" {
+			d, err := time.ParseDuration(r.QueueTimeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("admission: rule %d: bad queue timeout %q", i, r.QueueTimeout)
+			}
+			r.queueTimeout = d
+		}
+		c.rules = append(c.rules, &rule{Rule: r, limiters: map[string]*limiter{}, stats: Stats{Rule: r.Name}})
+	}
+	return c, nil
+}
+
+// Admit waits until r is admitted by every rule and returns the function
+// releasing it once the query ran, or the Rejected error.
+func (c *Controller) Admit(ctx context.Context, r *Request) (release func(), err error) {
+	var releases []func()
+	release = func() {
+		for _, f := range releases {
+			f()
+		}
+	}
+	for _, rl := range c.rules {
+		v := r.value(rl.Key)
+		if len(rl.Values) > 0 && !contains(rl.Values, v) {
+			continue
+		}
+		f, err := rl.admit(ctx, v)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, f)
+	}
+	return release, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) limiter(value string, now time.Time) *limiter {
+	l, ok := r.limiters[value]
+	if ok {
+		return l
+	}
+	if len(r.limiters) >= maxLimiters {
+		for v, l := range r.limiters {
+			if l.idle(r, now) {
+				delete(r.limiters, v)
+			}
+		}
+	}
+	l = &limiter{tokens: float64(r.Burst), last: now}
+	if r.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, r.MaxConcurrent)
+	}
+	r.limiters[value] = l
+	return l
+}
+
+// idle tells whether l is back to its initial state.
+func (l *limiter) idle(r *rule, now time.Time) bool {
+	l.refill(r, now)
+	return l.waiting == 0 && len(l.slots) == 0 && l.tokens >= float64(r.Burst)
+}
+
+func (l *limiter) refill(r *rule, now time.Time) {
+	l.tokens = math.Min(float64(r.Burst), l.tokens+now.Sub(l.last).Seconds()*r.QPS)
+	l.last = now
+}
+
+// refund gives back the token taken by a query that was not admitted.
+func (l *limiter) refund(r *rule) {
+	if r.QPS > 0 {
+		l.tokens = math.Min(float64(r.Burst), l.tokens+1)
+	}
+}
+
+func (r *rule) admit(ctx context.Context, value string) (func(), error) {
+	now := time.Now()
+	deadline := now.Add(r.queueTimeout)
+	r.mu.Lock()
+	l := r.limiter(value, now)
+	queued := false
+	if r.QPS > 0 {
+		l.refill(r, now)
+		if l.tokens < 1 {
+			wait := time.Duration((1 - l.tokens) / r.QPS * float64(time.Second))
+			if l.waiting >= r.QueueSize || wait > r.queueTimeout {
+				r.stats.Rejected++
+				r.mu.Unlock()
+				return nil, &Rejected{Rule: r.Name, Rate: true, Value: value}
+			}
+			// reserve the token and wait for it to be refilled
+			l.tokens--
+			l.waiting++
+			r.stats.Queued++
+			r.mu.Unlock()
+			err := sleep(ctx, wait)
+			r.mu.Lock()
+			l.waiting--
+			if err != nil {
+				l.refund(r)
+				r.mu.Unlock()
+				return nil, err
+			}
+			queued = true
+		} else {
+			l.tokens--
+		}
+	}
+	if l.slots == nil {
+		r.stats.Admitted++
+		r.mu.Unlock()
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		r.stats.Admitted++
+		r.mu.Unlock()
+		return func() { <-l.slots }, nil
+	default:
+	}
+	if l.waiting >= r.QueueSize {
+		r.stats.Rejected++
+		l.refund(r)
+		r.mu.Unlock()
+		return nil, &Rejected{Rule: r.Name, Value: value}
+	}
+	l.waiting++
+	if !queued {
+		r.stats.Queued++
+	}
+	r.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	var err error
+	select {
+	case l.slots <- struct{}{}:
+	case <-timer.C:
+		err = &Rejected{Rule: r.Name, Value: value}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l.waiting--
+	if err != nil {
+		r.stats.Rejected++
+		l.refund(r)
+		return nil, err
+	}
+	r.stats.Admitted++
+	return func() { <-l.slots }, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the counters of each rule.
+func (c *Controller) Stats() []Stats {
+	stats := make([]Stats, 0, len(c.rules))
+	for _, r := range c.rules {
+		r.mu.Lock()
+		stats = append(stats, r.stats)
+		r.mu.Unlock()
+	}
+	return stats
+}
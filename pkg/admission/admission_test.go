@@ -0,0 +1,108 @@
+package admission
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		err  bool
+	}{
+		{Rule{Key: KeyUser, QPS: 10}, false},
+		{Rule{Key: KeyDigest, MaxConcurrent: 2, QueueSize: 5, QueueTimeout: "200ms"}, false},
+		{Rule{Key: "table", QPS: 10}, true},
+		{Rule{Key: KeyUser}, true},
+		{Rule{Key: KeyClient, QPS: 1, QueueTimeout: "later"}, true},
+		{Rule{Key: KeyClient, QPS: 1, QueueTimeout: "0s"}, true},
+	}
+	for _, test := range tests {
+		if _, err := New(Config{Rules: []Rule{test.rule}}); (err != nil) != test.err {
+			t.Errorf("%+v: error %v", test.rule, err)
+		}
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		// requests are the users of the queries sent in order, none of
+		// them released.
+		requests []string
+		admitted []bool
+	}{
+		{"burst", Rule{Key: KeyUser, QPS: 0.001, Burst: 2}, []string{"a", "a", "a"}, []bool{true, true, false}},
+		{"rate per user", Rule{Key: KeyUser, QPS: 0.001, Burst: 1}, []string{"a", "b", "a", "b"}, []bool{true, true, false, false}},
+		{"concurrency", Rule{Key: KeyUser, MaxConcurrent: 2}, []string{"a", "a", "a", "b"}, []bool{true, true, false, true}},
+		{"values", Rule{Key: KeyUser, MaxConcurrent: 1, Values: []string{"a"}}, []string{"a", "a", "b", "b"}, []bool{true, false, true, true}},
+		{"queue timeout", Rule{Key: KeyUser, MaxConcurrent: 1, QueueSize: 1, QueueTimeout: "10ms"}, []string{"a", "a"}, []bool{true, false}},
+	}
+	for _, test := range tests {
+		c, err := New(Config{Rules: []Rule{test.rule}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, user := range test.requests {
+			_, err := c.Admit(context.Background(), &Request{User: user})
+			if (err == nil) != test.admitted[i] {
+				t.Errorf("%s: request %d of %s got %v, want admitted %v", test.name, i, user, err, test.admitted[i])
+			}
+			if _, ok := err.(*Rejected); err != nil && !ok {
+				t.Errorf("%s: request %d failed with %v", test.name, i, err)
+			}
+		}
+	}
+}
+
+func TestQueuedUntilRelease(t *testing.T) {
+	c, err := New(Config{Rules: []Rule{{Name: "one", Key: KeyDatabase, MaxConcurrent: 1, QueueSize: 1, QueueTimeout: "5s"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Request{Database: "shop"}
+	release, err := c.Admit(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admitted := make(chan error, 1)
+	go func() {
+		_, err := c.Admit(context.Background(), r)
+		admitted <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	if err := <-admitted; err != nil {
+		t.Fatalf("queued query got %v", err)
+	}
+	want := Stats{Rule: "one", Admitted: 2, Queued: 1}
+	if got := c.Stats(); len(got) != 1 || got[0] != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRejectReleasesEarlierRules(t *testing.T) {
+	c, err := New(Config{Rules: []Rule{
+		{Name: "user", Key: KeyUser, MaxConcurrent: 1},
+		{Name: "digest", Key: KeyDigest, MaxConcurrent: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Admit(context.Background(), &Request{User: "a", Digest: "d1"}); err != nil {
+		t.Fatal(err)
+	}
+	// rejected by the digest rule, the slot of b under the user rule is
+	// given back
+	if _, err = c.Admit(context.Background(), &Request{User: "b", Digest: "d1"}); err == nil {
+		t.Fatal("second query of d1 admitted")
+	}
+	if rejected, ok := err.(*Rejected); !ok || rejected.Rule != "digest" {
+		t.Fatalf("got %v, want rejected by digest", err)
+	}
+	if _, err := c.Admit(context.Background(), &Request{User: "b", Digest: "d2"}); err != nil {
+		t.Fatalf("slot of b not given back: %v", err)
+	}
+}
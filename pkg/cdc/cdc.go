@@ -0,0 +1,171 @@
+// Package cdc publishes the row changes of chosen tables, read from the
+// binlogs of the backends, to sinks.
+package cdc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/log"
+	"github.com/u2takey/mysqlgate/pkg/sql/mysql"
+)
+
+var mLog = log.ModuleLogger("cdc")
+
+const (
+	// DefaultServerID is the replica id of the first stream, the following
+	// streams take the next ids.
+	DefaultServerID = 2900
+	// checkpointInterval is how often the position of a stream is saved
+	// while it reads transactions without changes to publish.
+	checkpointInterval = time.Second
+	// maxPending is the number of changes of a transaction held before
+	// they are delivered, the rest follow as it goes on.
+	maxPending    = 1000
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+type Config struct {
+	// Checkpoints is the directory the positions of the streams are saved
+	// in, one file per stream.
+	Checkpoints string         `json:"checkpoints"`
+	ServerID    uint32         `json:"server_id,omitempty"`
+	Streams     []StreamConfig `json:"streams,omitempty"`
+}
+
+// StreamConfig publishes the changes of tables of a cluster to a sink.
+type StreamConfig struct {
+	Name    string `json:"name"`
+	Cluster string `json:"cluster"`
+	// Tables are patterns like "orders", "shop.orders" or "shop.*", a
+	// pattern without schema matches the table in any schema.
+	Tables []string   `json:"tables"`
+	Sink   SinkConfig `json:"sink"`
+	// ServerID overrides the replica id the binlog is read with.
+	ServerID uint32 `json:"server_id,omitempty"`
+}
+
+// Status is the progress of a stream.
+type Status struct {
+	Name    string `json:"name"`
+	Cluster string `json:"cluster"`
+	// Checkpoint is the position the stream resumes from, the changes
+	// before it were delivered.
+	Checkpoint mysql.BinlogPosition `json:"checkpoint"`
+	Delivered  int64                `json:"delivered"`
+	Error      string               `json:"error,omitempty"`
+	Updated    time.Time            `json:"updated,omitempty"`
+}
+
+// Manager runs the streams.
+type Manager struct {
+	streams []*stream
+}
+
+func NewManager(cfg Config, clusters *cluster.Registry) (*Manager, error) {
+	if cfg.Checkpoints == "" {
+		return nil, fmt.Errorf("cdc: no checkpoints directory")
+	}
+	if err := os.MkdirAll(cfg.Checkpoints, 0o700); err != nil {
+		return nil, fmt.Errorf("cdc: %v", err)
+	}
+	serverID := cfg.ServerID
+	if serverID == 0 {
+		serverID = DefaultServerID
+	}
+	m := &Manager{}
+	names := map[string]bool{}
+	for i, sc := range cfg.Streams {
+		if sc.Name == "" || names[sc.Name] {
+			m.Close()
+			return nil, fmt.Errorf("cdc: stream %d: missing or duplicate name %q", i, sc.Name)
+		}
+		if !validName(sc.Name) {
+			m.Close()
+			return nil, fmt.Errorf("cdc: stream %d: name %q may only have letters, digits, - and _", i, sc.Name)
+		}
+		names[sc.Name] = true
+		c, ok := clusters.Get(sc.Cluster)
+		if !ok {
+			m.Close()
+			return nil, fmt.Errorf("cdc: stream %s: unknown cluster %s", sc.Name, sc.Cluster)
+		}
+		filter, err := newFilter(sc.Tables)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("cdc: stream %s: %v", sc.Name, err)
+		}
+		sink, err := NewSink(sc.Sink)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("cdc: stream %s: %v", sc.Name, err)
+		}
+		s := &stream{
+			name:       sc.Name,
+			backend:    c.Primary(),
+			filter:     filter,
+			sink:       sink,
+			serverID:   sc.ServerID,
+			checkpoint: filepath.Join(cfg.Checkpoints, sc.Name+".json"),
+			columns:    map[string]*columns{},
+		}
+		if s.serverID == 0 {
+			s.serverID = serverID + uint32(i)
+		}
+		s.status.Name, s.status.Cluster = sc.Name, sc.Cluster
+		m.streams = append(m.streams, s)
+	}
+	return m, nil
+}
+
+// validName tells whether name can be used as the file name of the
+// checkpoint of a stream.
+func validName(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Run runs the streams until ctx is done. A stream failing starts again
+// from its checkpoint.
+func (m *Manager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range m.streams {
+		wg.Add(1)
+		go func(s *stream) {
+			defer wg.Done()
+			s.run(ctx)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// Streams returns the progress of the streams.
+func (m *Manager) Streams() []Status {
+	status := make([]Status, len(m.streams))
+	for i, s := range m.streams {
+		s.mu.Lock()
+		status[i] = s.status
+		s.mu.Unlock()
+	}
+	return status
+}
+
+func (m *Manager) Close() error {
+	var err error
+	for _, s := range m.streams {
+		if e := s.sink.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package cdc
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/u2takey/mysqlgate/pkg/atomicfile"
+	"github.com/u2takey/mysqlgate/pkg/sql/mysql"
+)
+
+// loadCheckpoint reads the position saved at path, ok is false when none
+// was saved yet.
+func loadCheckpoint(path string) (pos mysql.BinlogPosition, ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pos, false, nil
+	} else if err != nil {
+		return pos, false, err
+	}
+	if err := json.Unmarshal(data, &pos); err != nil {
+		return pos, false, err
+	}
+	return pos, true, nil
+}
+
+// saveCheckpoint durably replaces the position saved at path.
+func saveCheckpoint(path string, pos mysql.BinlogPosition) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0o600)
+}
@@ -0,0 +1,168 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	SinkFile    = "file"
+	SinkWebhook = "webhook"
+	SinkStdout  = "stdout"
+
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+type SinkConfig struct {
+	// Type is one of file, webhook or stdout.
+	Type string `json:"type"`
+	// Path is the json lines file of a file sink.
+	Path string `json:"path,omitempty"`
+	// URL is where a webhook sink posts the changes to, as a json array.
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Timeout bounds a webhook request, like "10s".
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// Sink publishes changes. Write returns once the changes are delivered,
+// changes it failed to deliver are written again.
+type Sink interface {
+	Write(ctx context.Context, changes []*Change) error
+	Close() error
+}
+
+func NewSink(cfg SinkConfig) (Sink, error) {
+	switch cfg.Type {
+	case SinkFile:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("file sink without path")
+		}
+		f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		return &fileSink{file: f}, nil
+	case SinkWebhook:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhook sink without url")
+		}
+		timeout := defaultWebhookTimeout
+		if cfg.Timeout != "" {
+			d, err := time.ParseDuration(cfg.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("webhook sink timeout: %v", err)
+			}
+			timeout = d
+		}
+		return &webhookSink{url: cfg.URL, headers: cfg.Headers, client: &http.Client{Timeout: timeout}}, nil
+	case SinkStdout:
+		return stdoutSink{}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+}
+
+// jsonLines encodes changes one per line.
+func jsonLines(changes []*Change) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, c := range changes {
+		if err := enc.Encode(c); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// fileSink appends changes to a json lines file, synced before Write
+// returns.
+type fileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (s *fileSink) Write(ctx context.Context, changes []*Change) error {
+	data, err := jsonLines(changes)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// webhookSink posts changes, any answer but 2xx fails the delivery.
+type webhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (s *webhookSink) Write(ctx context.Context, changes []*Change) error {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so the connection is reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// stdoutMu serializes the writes of the stdout sinks of all streams.
+var stdoutMu sync.Mutex
+
+// stdoutSink writes changes to the standard output as json lines.
+type stdoutSink struct{}
+
+func (stdoutSink) Write(ctx context.Context, changes []*Change) error {
+	data, err := jsonLines(changes)
+	if err != nil {
+		return err
+	}
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func (stdoutSink) Close() error {
+	return nil
+}
@@ -0,0 +1,340 @@
+package cdc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/sql/mysql"
+)
+
+// Change is a row change published to the sinks.
+type Change struct {
+	Stream string `json:"stream"`
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	// Op is insert, update or delete.
+	Op     string                 `json:"op"`
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+	// Time is when the change was made, in seconds.
+	Time time.Time `json:"time"`
+	// Position is the binlog position following the rows event, with Index
+	// it tells apart the changes delivered twice after a restart.
+	Position mysql.BinlogPosition `json:"position"`
+	Index    int                  `json:"index"`
+}
+
+// columns are the names of the columns of a table, binlog row images have
+// the values only.
+type columns struct {
+	names    []string
+	unsigned []bool
+}
+
+// stream reads the binlog of the primary of a cluster. The changes of a
+// transaction are delivered once it is committed, or by maxPending while it
+// is read, and its position saved once they are delivered, so a restart
+// delivers again the changes of the transaction it stopped in.
+type stream struct {
+	name       string
+	backend    *cluster.Backend
+	filter     filter
+	sink       Sink
+	serverID   uint32
+	checkpoint string
+	// columns are keyed by schema.table, dropped when a statement may have
+	// altered a table.
+	columns map[string]*columns
+
+	mu     sync.Mutex // protects status
+	status Status
+}
+
+func (s *stream) run(ctx context.Context) {
+	delay := minRetryDelay
+	for {
+		start := time.Now()
+		err := s.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		s.setError(err)
+		mLog.Error("msg", "stream failed", "stream", s.name, "err", err)
+		if time.Since(start) > maxRetryDelay {
+			delay = minRetryDelay
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// follow publishes the changes from the checkpoint on until the binlog
+// fails to be read or ctx is done.
+func (s *stream) follow(ctx context.Context) error {
+	pos, err := s.start(ctx)
+	if err != nil {
+		return err
+	}
+	binlog, err := mysql.OpenBinlog(ctx, s.backend.DSN, mysql.BinlogConfig{
+		ServerID: s.serverID,
+		File:     pos.File,
+		Position: pos.Position,
+		GTIDSet:  pos.GTIDSet,
+	})
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// unblocks Next
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = binlog.Close()
+	}()
+
+	var pending []*Change
+	saved := time.Now()
+	for {
+		ev, err := binlog.Next()
+		if err != nil {
+			return err
+		}
+		if ev.Query != nil && !strings.EqualFold(ev.Query.Query, "BEGIN") {
+			s.columns = map[string]*columns{}
+		}
+		if ev.Rows != nil && s.filter.match(ev.Rows.Table.Schema, ev.Rows.Table.Table) {
+			changes, err := s.changes(ctx, ev)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, changes...)
+		}
+		committed := binlog.Committed()
+		if committed == pos {
+			if len(pending) >= maxPending {
+				if err := s.deliverPending(ctx, pending); err != nil {
+					return err
+				}
+				pending = nil
+			}
+			continue
+		}
+		pos = committed
+		if len(pending) == 0 && time.Since(saved) < checkpointInterval {
+			continue
+		}
+		if err := s.deliverPending(ctx, pending); err != nil {
+			return err
+		}
+		pending = nil
+		if err := saveCheckpoint(s.checkpoint, pos); err != nil {
+			return err
+		}
+		saved = time.Now()
+		s.mu.Lock()
+		s.status.Checkpoint = pos
+		s.status.Error = ""
+		s.status.Updated = saved
+		s.mu.Unlock()
+	}
+}
+
+// deliverPending delivers pending and counts them.
+func (s *stream) deliverPending(ctx context.Context, pending []*Change) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := s.deliver(ctx, pending); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.status.Delivered += int64(len(pending))
+	s.mu.Unlock()
+	return nil
+}
+
+// start returns the checkpoint of the stream. A new stream starts at the
+// current position of the server, saved right away so changes made before
+// the first checkpoint are not missed by a restart.
+func (s *stream) start(ctx context.Context) (mysql.BinlogPosition, error) {
+	pos, ok, err := loadCheckpoint(s.checkpoint)
+	if err != nil || ok {
+		return pos, err
+	}
+	if pos, err = s.backend.BinlogStatus(ctx); err != nil {
+		return pos, err
+	}
+	if err := saveCheckpoint(s.checkpoint, pos); err != nil {
+		return pos, err
+	}
+	s.mu.Lock()
+	s.status.Checkpoint = pos
+	s.mu.Unlock()
+	return pos, nil
+}
+
+// deliver writes changes to the sink until it accepts them.
+func (s *stream) deliver(ctx context.Context, changes []*Change) error {
+	delay := minRetryDelay
+	for {
+		err := s.sink.Write(ctx, changes)
+		if err == nil {
+			return nil
+		}
+		s.setError(err)
+		mLog.Error("msg", "delivery failed", "stream", s.name, "changes", len(changes), "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (s *stream) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Error = err.Error()
+	s.status.Updated = time.Now()
+}
+
+// changes converts the rows of a rows event.
+func (s *stream) changes(ctx context.Context, ev *mysql.BinlogEvent) ([]*Change, error) {
+	tm := ev.Rows.Table
+	cols, err := s.tableColumns(ctx, tm)
+	if err != nil {
+		return nil, err
+	}
+	var op string
+	switch ev.Type {
+	case mysql.BinlogWriteRowsEvent, mysql.BinlogWriteRowsEventV1:
+		op = "insert"
+	case mysql.BinlogUpdateRowsEvent, mysql.BinlogUpdateRowsEventV1:
+		op = "update"
+	default:
+		op = "delete"
+	}
+	changes := make([]*Change, len(ev.Rows.Rows))
+	for i, row := range ev.Rows.Rows {
+		changes[i] = &Change{
+			Stream:   s.name,
+			Schema:   tm.Schema,
+			Table:    tm.Table,
+			Op:       op,
+			Before:   cols.image(tm, row.Before),
+			After:    cols.image(tm, row.After),
+			Time:     time.Unix(int64(ev.Timestamp), 0).UTC(),
+			Position: ev.Position,
+			Index:    i,
+		}
+	}
+	return changes, nil
+}
+
+// tableColumns returns the columns of the table of tm. When the table does
+// not have the columns of tm anymore, the columns are named by position
+// like @1, @2...
+func (s *stream) tableColumns(ctx context.Context, tm *mysql.TableMap) (*columns, error) {
+	key := tm.Schema + "." + tm.Table
+	if cols, ok := s.columns[key]; ok {
+		return cols, nil
+	}
+	cols := &columns{}
+	rows, err := s.backend.DB().QueryContext(ctx, "SELECT COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", tm.Schema, tm.Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		cols.names = append(cols.names, name)
+		cols.unsigned = append(cols.unsigned, strings.Contains(strings.ToLower(typ), "unsigned"))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(cols.names) != tm.Columns() {
+		cols = &columns{names: make([]string, tm.Columns()), unsigned: make([]bool, tm.Columns())}
+		for i := range cols.names {
+			cols.names[i] = "@" + strconv.Itoa(i+1)
+		}
+	}
+	s.columns[key] = cols
+	return cols, nil
+}
+
+// image maps the values of a row image to the column names, strings are
+// returned as text.
+func (c *columns) image(tm *mysql.TableMap, values []interface{}) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	image := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		switch x := v.(type) {
+		case []byte:
+			v = string(x)
+		case int64:
+			if c.unsigned[i] {
+				v = tm.Unsigned(i, x)
+			}
+		}
+		image[c.names[i]] = v
+	}
+	return image
+}
+
+// filter matches the tables a stream publishes the changes of.
+type filter []string
+
+func newFilter(patterns []string) (filter, error) {
+	if len(patterns) == 0 {
+		return nil, errors.New("no table")
+	}
+	f := make(filter, len(patterns))
+	for i, p := range patterns {
+		p = strings.ToLower(p)
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("table pattern %q: %v", p, err)
+		}
+		f[i] = p
+	}
+	return f, nil
+}
+
+func (f filter) match(schema, table string) bool {
+	schema, table = strings.ToLower(schema), strings.ToLower(table)
+	for _, p := range f {
+		name := table
+		if strings.Contains(p, ".") {
+			name = schema + "." + table
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
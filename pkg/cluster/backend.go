@@ -0,0 +1,201 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	_ "github.com/u2takey/mysqlgate/pkg/sql/mysql"
+)
+
+// ewmaDecay is the time constant of the latency moving average, a sample
+// older than ewmaDecay weighs about 1/e of a fresh one.
+const ewmaDecay = 10 * time.Second
+
+type BackendConfig struct {
+	Name         string `json:"name"`
+	DSN          string `json:"dsn"`
+	Weight       int    `json:"weight"`
+	MaxOpenConns int    `json:"max_open_conns"`
+	MaxIdleConns int    `json:"max_idle_conns"`
+	// PriorityAging is how long a request for a connection of the full
+	// pool waits before it is served as if of a higher priority, like
+	// "500ms".
+	PriorityAging string `json:"priority_aging,omitempty"`
+}
+
+// Backend is a single mysql server, with its connection pool and the load
+// figures balancers use to pick it.
+type Backend struct {
+	Name   string
+	Weight int
+	// DSN is kept for the clients opening connections of their own, like
+	// binlog readers.
+	DSN string
+	db  *sql.DB
+
+	outstanding int64 // queries in flight, accessed atomically
+
+	// breaker fails the queries fast while b is unhealthy, nil when the
+	// cluster has no breakers.
+	breaker *breaker
+
+	mu       sync.Mutex // protects following fields
+	ewma     float64    // latency moving average in nanoseconds
+	lastSeen time.Time
+}
+
+func NewBackend(cfg BackendConfig) (*Backend, error) {
+	db, err := sql.Open("mysql", cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.PriorityAging != "" {
+		d, err := time.ParseDuration(cfg.PriorityAging)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("backend %s: priority aging: %v", cfg.Name, err)
+		}
+		db.SetPriorityAging(d)
+	}
+	b := &Backend{
+		Name:   cfg.Name,
+		Weight: cfg.Weight,
+		DSN:    cfg.DSN,
+		db:     db,
+	}
+	if b.Weight <= 0 {
+		b.Weight = 1
+	}
+	return b, nil
+}
+
+func (b *Backend) DB() *sql.DB {
+	return b.db
+}
+
+func (b *Backend) Stats() sql.DBStats {
+	return b.db.Stats()
+}
+
+// Outstanding returns the number of queries currently running on b.
+func (b *Backend) Outstanding() int64 {
+	return atomic.LoadInt64(&b.outstanding)
+}
+
+// Latency returns the moving average of query latency on b, zero if b has
+// not served any query yet.
+func (b *Backend) Latency() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Duration(b.ewma)
+}
+
+// Start marks a query as running on b. The returned time must be handed to
+// Finish once the backend answered.
+func (b *Backend) Start() time.Time {
+	atomic.AddInt64(&b.outstanding, 1)
+	return time.Now()
+}
+
+// Finish records the latency of a query started with Start, and its outcome
+// for the breaker of b.
+func (b *Backend) Finish(start time.Time, err error) {
+	atomic.AddInt64(&b.outstanding, -1)
+	now := time.Now()
+	latency := float64(now.Sub(start))
+	if b.breaker != nil {
+		b.breaker.record(now.Sub(start), err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lastSeen.IsZero() {
+		b.ewma = latency
+	} else {
+		w := math.Exp(-float64(now.Sub(b.lastSeen)) / float64(ewmaDecay))
+		b.ewma = b.ewma*w + latency*(1-w)
+	}
+	b.lastSeen = now
+}
+
+// Allow returns a BreakerOpen error when the breaker of b fails queries
+// fast. A query allowed while the breaker is half open is one of its probes.
+func (b *Backend) Allow() error {
+	if b.breaker != nil && !b.breaker.allow() {
+		return &BreakerOpen{Backend: b.Name}
+	}
+	return nil
+}
+
+// Available tells whether the breaker of b would allow a query.
+func (b *Backend) Available() bool {
+	return b.breaker == nil || b.breaker.available()
+}
+
+// Fail records a failure to reach b outside of a query, like a connection
+// that could not be opened, for the breaker of b.
+func (b *Backend) Fail(err error) {
+	if b.breaker != nil {
+		b.breaker.record(0, err)
+	}
+}
+
+// Breaker returns the state of the breaker of b, ok is false when b has
+// none.
+func (b *Backend) Breaker() (stats BreakerStats, ok bool) {
+	if b.breaker == nil {
+		return BreakerStats{}, false
+	}
+	return b.breaker.stats(), true
+}
+
+// SetBreaker forces the breaker of b open or closed until it is set to
+// auto, which closes it and lets it follow the queries again.
+func (b *Backend) SetBreaker(state string) error {
+	if b.breaker == nil {
+		return fmt.Errorf("backend %s has no circuit breaker", b.Name)
+	}
+	switch state {
+	case StateOpen, StateClosed:
+		b.breaker.force(state)
+	case "auto":
+		b.breaker.reset()
+	default:
+		return fmt.Errorf("unknown circuit breaker state %q", state)
+	}
+	return nil
+}
+
+// saturated reports whether every connection of the pool is in use, so a new
+// query would have to wait for one.
+func (b *Backend) saturated() bool {
+	stats := b.db.Stats()
+	return stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections
+}
+
+func (b *Backend) Close() error {
+	return b.db.Close()
+}
+
+// Kill stops the query running on connection id of b. It connects on its
+// own, the pool being possibly full of the queries to kill.
+func (b *Backend) Kill(ctx context.Context, id uint32) error {
+	db, err := sql.Open("mysql", b.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", id))
+	return err
+}
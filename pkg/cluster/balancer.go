@@ -0,0 +1,113 @@
+package cluster
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BalancerRoundRobin       = "round_robin"
+	BalancerWeighted         = "weighted"
+	BalancerLeastOutstanding = "least_outstanding"
+	BalancerLeastEWMA        = "least_ewma"
+)
+
+// Balancer picks the backend a read query is sent to.
+type Balancer interface {
+	// Pick returns one of backends, backends is never empty.
+	Pick(backends []*Backend) *Backend
+}
+
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", BalancerRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case BalancerWeighted:
+		return &weightedBalancer{current: map[*Backend]int{}}, nil
+	case BalancerLeastOutstanding:
+		return &leastLoadBalancer{load: outstandingLoad}, nil
+	case BalancerLeastEWMA:
+		return &leastLoadBalancer{load: ewmaLoad}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancer %q", name)
+	}
+}
+
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (r *roundRobinBalancer) Pick(backends []*Backend) *Backend {
+	n := atomic.AddUint64(&r.next, 1)
+	return backends[n%uint64(len(backends))]
+}
+
+// weightedBalancer is the smooth weighted round robin of nginx: every pick
+// raises each backend by its weight and lowers the chosen one by the total,
+// which spreads picks evenly instead of in bursts.
+type weightedBalancer struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func (w *weightedBalancer) Pick(backends []*Backend) *Backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, b := range backends {
+		w.current[b] += b.Weight
+		total += b.Weight
+		if best == nil || w.current[b] > w.current[best] {
+			best = b
+		}
+	}
+	w.current[best] -= total
+	return best
+}
+
+// leastLoadBalancer picks the backend with the lowest load, skipping pools
+// that have no free connection while another one has. Ties are broken by
+// rotating the starting point.
+type leastLoadBalancer struct {
+	next uint64
+	load func(b *Backend) float64
+}
+
+func (l *leastLoadBalancer) Pick(backends []*Backend) *Backend {
+	start := int(atomic.AddUint64(&l.next, 1) % uint64(len(backends)))
+
+	var best *Backend
+	bestLoad, bestSaturated := math.Inf(1), true
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		saturated := b.saturated()
+		if saturated && !bestSaturated {
+			continue
+		}
+		load := l.load(b)
+		if best == nil || (bestSaturated && !saturated) || load < bestLoad {
+			best, bestLoad, bestSaturated = b, load, saturated
+		}
+	}
+	return best
+}
+
+// outstandingLoad counts queries in flight, or pool connections in use when
+// larger since pinned transactions hold connections between queries.
+func outstandingLoad(b *Backend) float64 {
+	load := b.Outstanding()
+	if inUse := int64(b.Stats().InUse); inUse > load {
+		load = inUse
+	}
+	return float64(load) / float64(b.Weight)
+}
+
+// ewmaLoad is the expected time to serve one more query. Backends that have
+// not been measured yet cost nothing, so they get probed first.
+func ewmaLoad(b *Backend) float64 {
+	return float64(b.Latency()) * float64(b.Outstanding()+1) / float64(b.Weight)
+}
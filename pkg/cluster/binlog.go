@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/u2takey/mysqlgate/pkg/sql/mysql"
+)
+
+// BinlogStatus returns the current binlog position of b, with its executed
+// gtids when gtids are on.
+func (b *Backend) BinlogStatus(ctx context.Context) (mysql.BinlogPosition, error) {
+	rows, err := b.DB().QueryContext(ctx, "SHOW MASTER STATUS")
+	if err != nil {
+		// renamed in mysql 8.4
+		if rows, err = b.DB().QueryContext(ctx, "SHOW BINARY LOG STATUS"); err != nil {
+			return mysql.BinlogPosition{}, err
+		}
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return mysql.BinlogPosition{}, err
+	}
+	if len(columns) < 2 {
+		return mysql.BinlogPosition{}, errors.New("unexpected binary log status")
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return mysql.BinlogPosition{}, err
+		}
+		return mysql.BinlogPosition{}, errors.New("binary log is off")
+	}
+	values := make([][]byte, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return mysql.BinlogPosition{}, err
+	}
+	n, err := strconv.ParseUint(string(values[1]), 10, 32)
+	if err != nil {
+		return mysql.BinlogPosition{}, err
+	}
+	pos := mysql.BinlogPosition{File: string(values[0]), Position: uint32(n)}
+	// File, Position, Binlog_Do_DB, Binlog_Ignore_DB, Executed_Gtid_Set
+	if len(values) > 4 && len(values[4]) > 0 {
+		set, err := mysql.ParseGTIDSet(string(values[4]))
+		if err != nil {
+			return pos, err
+		}
+		pos.GTIDSet = set.String()
+	}
+	return pos, nil
+}
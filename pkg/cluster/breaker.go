@@ -0,0 +1,376 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/log"
+	"github.com/u2takey/mysqlgate/pkg/sql/mysql"
+)
+
+var mLog = log.ModuleLogger("cluster")
+
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+
+	DefaultBreakerWindow      = 10 * time.Second
+	DefaultBreakerMinRequests = 20
+	DefaultBreakerErrorRate   = 0.5
+	DefaultBreakerOpenFor     = 30 * time.Second
+	DefaultBreakerProbes      = 3
+
+	// breakerBuckets is the number of buckets the window is counted in.
+	breakerBuckets = 10
+)
+
+// BreakerConfig configures the circuit breakers of the backends of a
+// cluster. A breaker opens when, over the window, the queries failing or
+// slower than SlowThreshold are too many; it then fails the queries fast
+// for OpenFor, and lets a few probes through before it closes again.
+type BreakerConfig struct {
+	Enabled bool `json:"enabled"`
+	// Window is the rolling window the rates are computed over, like
+	// "10s".
+	Window string `json:"window,omitempty"`
+	// MinRequests is the number of queries of the window below which the
+	// breaker does not open.
+	MinRequests int `json:"min_requests,omitempty"`
+	// ErrorRate is the rate of failed queries the breaker opens at.
+	ErrorRate float64 `json:"error_rate,omitempty"`
+	// SlowThreshold is the latency a query is slow above, like "2s", and
+	// SlowRate the rate of slow queries the breaker opens at. Latency is
+	// not considered when SlowThreshold is empty.
+	SlowThreshold string  `json:"slow_threshold,omitempty"`
+	SlowRate      float64 `json:"slow_rate,omitempty"`
+	// OpenFor is how long an open breaker fails the queries before it
+	// goes half open, like "30s".
+	OpenFor string `json:"open_for,omitempty"`
+	// HalfOpenProbes is the number of queries a half open breaker lets
+	// through, which must all succeed for it to close.
+	HalfOpenProbes int `json:"half_open_probes,omitempty"`
+}
+
+// breakerSettings is a parsed BreakerConfig.
+type breakerSettings struct {
+	window      time.Duration
+	minRequests int
+	errorRate   float64
+	slow        time.Duration
+	slowRate    float64
+	openFor     time.Duration
+	maxProbes   int
+}
+
+func parseBreaker(cfg BreakerConfig) (*breakerSettings, error) {
+	s := &breakerSettings{
+		window:      DefaultBreakerWindow,
+		minRequests: cfg.MinRequests,
+		errorRate:   cfg.ErrorRate,
+		slowRate:    cfg.SlowRate,
+		openFor:     DefaultBreakerOpenFor,
+		maxProbes:   cfg.HalfOpenProbes,
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{
+		{"window", cfg.Window, &s.window},
+		{"slow threshold", cfg.SlowThreshold, &s.slow},
+		{"open for", cfg.OpenFor, &s.openFor},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("breaker: bad %s %q", d.name, d.value)
+		}
+		*d.to = v
+	}
+	if s.minRequests <= 0 {
+		s.minRequests = DefaultBreakerMinRequests
+	}
+	if s.errorRate <= 0 {
+		s.errorRate = DefaultBreakerErrorRate
+	}
+	if s.slowRate <= 0 {
+		s.slowRate = DefaultBreakerErrorRate
+	}
+	if s.maxProbes <= 0 {
+		s.maxProbes = DefaultBreakerProbes
+	}
+	if s.errorRate > 1 || s.slowRate > 1 {
+		return nil, fmt.Errorf("breaker: rates must be at most 1")
+	}
+	return s, nil
+}
+
+// BreakerOpen is the error of a query failed fast by the open breaker of
+// a backend.
+type BreakerOpen struct {
+	Backend string
+}
+
+func (e *BreakerOpen) Error() string {
+	return fmt.Sprintf("circuit breaker of backend %s is open", e.Backend)
+}
+
+// BreakerStats are the state and counters of the breaker of a backend.
+type BreakerStats struct {
+	Backend string    `json:"backend"`
+	State   string    `json:"state"`
+	Since   time.Time `json:"since"`
+	// Forced is set when the state was set by an operator, it then does
+	// not change until reset.
+	Forced    bool    `json:"forced,omitempty"`
+	Requests  int64   `json:"requests"`
+	ErrorRate float64 `json:"error_rate"`
+	SlowRate  float64 `json:"slow_rate"`
+	// Rejected counts the queries failed fast.
+	Rejected int64 `json:"rejected"`
+	// Transitions counts the state changes, by "from->to".
+	Transitions map[string]int64 `json:"transitions"`
+}
+
+type bucket struct {
+	requests, failures, slow int64
+}
+
+type breaker struct {
+	backend string
+	*breakerSettings
+
+	mu     sync.Mutex // protects following fields
+	state  string
+	since  time.Time
+	forced bool
+	// buckets count the outcomes of the window, the one at head starting
+	// at headStart.
+	buckets   [breakerBuckets]bucket
+	head      int
+	headStart time.Time
+	// probes is the number of probes let through since the breaker went
+	// half open, succeeded the number of them that succeeded.
+	probes, succeeded int
+	rejected          int64
+	transitions       map[string]int64
+}
+
+func newBreaker(backend string, s *breakerSettings) *breaker {
+	now := time.Now()
+	return &breaker{
+		backend:         backend,
+		breakerSettings: s,
+		state:           StateClosed,
+		since:           now,
+		headStart:       now,
+		transitions:     map[string]int64{},
+	}
+}
+
+// advance moves the head of the window to now, emptying the buckets it
+// passes.
+func (br *breaker) advance(now time.Time) {
+	width := br.window / breakerBuckets
+	for i := 0; i < breakerBuckets && now.Sub(br.headStart) >= width; i++ {
+		br.head = (br.head + 1) % breakerBuckets
+		br.buckets[br.head] = bucket{}
+		br.headStart = br.headStart.Add(width)
+	}
+	if now.Sub(br.headStart) >= width {
+		br.headStart = now
+	}
+}
+
+func (br *breaker) counts() (total bucket) {
+	for _, b := range br.buckets {
+		total.requests += b.requests
+		total.failures += b.failures
+		total.slow += b.slow
+	}
+	return total
+}
+
+func (br *breaker) transition(to string, now time.Time) {
+	from := br.state
+	br.state, br.since = to, now
+	br.probes, br.succeeded = 0, 0
+	br.transitions[from+"->"+to]++
+	if to == StateClosed {
+		br.buckets = [breakerBuckets]bucket{}
+		br.head, br.headStart = 0, now
+	}
+	mLog.Log("msg", "circuit breaker "+to, "backend", br.backend, "from", from)
+}
+
+// update moves an open breaker to half open once OpenFor passed.
+func (br *breaker) update(now time.Time) {
+	if br.forced {
+		return
+	}
+	switch br.state {
+	case StateOpen:
+		if now.Sub(br.since) >= br.openFor {
+			br.transition(StateHalfOpen, now)
+		}
+	case StateHalfOpen:
+		// probes whose outcome never came, their connection failing to
+		// open for instance, are given up after OpenFor
+		if br.probes >= br.maxProbes && now.Sub(br.since) >= br.openFor {
+			br.since, br.probes, br.succeeded = now, 0, 0
+		}
+	}
+}
+
+// allow tells whether a query may run, counting it as a probe when the
+// breaker is half open.
+func (br *breaker) allow() bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.update(time.Now())
+	switch br.state {
+	case StateOpen:
+		br.rejected++
+		return false
+	case StateHalfOpen:
+		if br.probes >= br.maxProbes {
+			br.rejected++
+			return false
+		}
+		br.probes++
+	}
+	return true
+}
+
+// available tells whether a query would be allowed, without counting it.
+func (br *breaker) available() bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.update(time.Now())
+	switch br.state {
+	case StateOpen:
+		return false
+	case StateHalfOpen:
+		return br.probes < br.maxProbes
+	}
+	return true
+}
+
+func (br *breaker) record(latency time.Duration, err error) {
+	failed := failure(err)
+	slow := br.slow > 0 && latency > br.slow
+	now := time.Now()
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.forced {
+		return
+	}
+	br.update(now)
+	switch br.state {
+	case StateHalfOpen:
+		if failed || slow {
+			br.transition(StateOpen, now)
+			return
+		}
+		br.succeeded++
+		if br.succeeded >= br.maxProbes {
+			br.transition(StateClosed, now)
+		}
+		return
+	case StateOpen:
+		return
+	}
+	br.advance(now)
+	b := &br.buckets[br.head]
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if slow {
+		b.slow++
+	}
+	total := br.counts()
+	if total.requests < int64(br.minRequests) {
+		return
+	}
+	if float64(total.failures) >= br.errorRate*float64(total.requests) ||
+		(br.slow > 0 && float64(total.slow) >= br.slowRate*float64(total.requests)) {
+		br.transition(StateOpen, now)
+	}
+}
+
+// failure tells whether err means the backend is unhealthy, rather than
+// the query being wrong or the client gone. Queries stopped at their
+// execution time limit, killed by the proxy or by the backend itself, are
+// not failures, their latency counts as slow.
+func failure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		switch me.Number {
+		case 1040, // too many connections
+			1053: // server shutdown
+			return true
+		}
+		return false
+	}
+	// bad connections, network errors and timeouts
+	return true
+}
+
+// force sets the state of the breaker, open or closed, until reset.
+func (br *breaker) force(state string) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.state != state {
+		br.transition(state, time.Now())
+	}
+	br.forced = true
+}
+
+// reset closes the breaker and lets its state follow the queries again.
+func (br *breaker) reset() {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.forced = false
+	if br.state != StateClosed {
+		br.transition(StateClosed, time.Now())
+	}
+}
+
+func (br *breaker) stats() BreakerStats {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	now := time.Now()
+	br.update(now)
+	if br.state == StateClosed {
+		br.advance(now)
+	}
+	total := br.counts()
+	s := BreakerStats{
+		Backend:     br.backend,
+		State:       br.state,
+		Since:       br.since,
+		Forced:      br.forced,
+		Requests:    total.requests,
+		Rejected:    br.rejected,
+		Transitions: make(map[string]int64, len(br.transitions)),
+	}
+	if total.requests > 0 {
+		s.ErrorRate = float64(total.failures) / float64(total.requests)
+		s.SlowRate = float64(total.slow) / float64(total.requests)
+	}
+	for k, v := range br.transitions {
+		s.Transitions[k] = v
+	}
+	return s
+}
@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/sql/mysql"
+)
+
+func newTestBreaker(t *testing.T, cfg BreakerConfig) *breaker {
+	t.Helper()
+	s, err := parseBreaker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newBreaker("db1", s)
+}
+
+// elapse moves the breaker as if d passed since its last transition.
+func elapse(br *breaker, d time.Duration) {
+	br.mu.Lock()
+	br.since = br.since.Add(-d)
+	br.mu.Unlock()
+}
+
+func TestBreakerStates(t *testing.T) {
+	br := newTestBreaker(t, BreakerConfig{MinRequests: 4, ErrorRate: 0.5, OpenFor: "1m", HalfOpenProbes: 2})
+	down := errors.New("connection refused")
+
+	// below min requests the breaker stays closed
+	br.record(time.Millisecond, down)
+	br.record(time.Millisecond, down)
+	br.record(time.Millisecond, nil)
+	if s := br.stats(); s.State != StateClosed {
+		t.Fatalf("opened below min requests: %+v", s)
+	}
+	br.record(time.Millisecond, down)
+	if s := br.stats(); s.State != StateOpen || s.ErrorRate != 0.75 {
+		t.Fatalf("not open at 3 failures of 4: %+v", s)
+	}
+	if br.allow() {
+		t.Fatal("open breaker allowed a query")
+	}
+
+	elapse(br, time.Minute)
+	if !br.allow() || !br.allow() {
+		t.Fatal("half open breaker refused its probes")
+	}
+	if br.allow() {
+		t.Fatal("half open breaker allowed more than its probes")
+	}
+	br.record(time.Millisecond, nil)
+	br.record(time.Millisecond, down)
+	if s := br.stats(); s.State != StateOpen {
+		t.Fatalf("failed probe did not open the breaker: %+v", s)
+	}
+
+	elapse(br, time.Minute)
+	br.allow()
+	br.allow()
+	br.record(time.Millisecond, nil)
+	br.record(time.Millisecond, nil)
+	s := br.stats()
+	if s.State != StateClosed || s.Requests != 0 {
+		t.Fatalf("succeeded probes did not close the breaker: %+v", s)
+	}
+	want := map[string]int64{"closed->open": 1, "open->half_open": 2, "half_open->open": 1, "half_open->closed": 1}
+	for k, v := range want {
+		if s.Transitions[k] != v {
+			t.Errorf("transitions %v, want %v", s.Transitions, want)
+			break
+		}
+	}
+	if s.Rejected != 2 {
+		t.Errorf("rejected %d, want 2", s.Rejected)
+	}
+}
+
+func TestBreakerSlow(t *testing.T) {
+	br := newTestBreaker(t, BreakerConfig{MinRequests: 2, SlowThreshold: "1s", SlowRate: 0.5})
+	br.record(2*time.Second, nil)
+	if br.stats().State != StateClosed {
+		t.Fatal("opened below min requests")
+	}
+	br.record(time.Millisecond, nil)
+	if s := br.stats(); s.State != StateOpen || s.SlowRate != 0.5 {
+		t.Fatalf("not open at half slow queries: %+v", s)
+	}
+}
+
+func TestBreakerForce(t *testing.T) {
+	br := newTestBreaker(t, BreakerConfig{MinRequests: 1})
+	br.force(StateOpen)
+	elapse(br, time.Hour)
+	if br.allow() {
+		t.Fatal("forced open breaker allowed a query")
+	}
+	br.reset()
+	br.record(time.Millisecond, nil)
+	if !br.allow() {
+		t.Fatal("reset breaker refused a query")
+	}
+}
+
+func TestFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("connection refused"), true},
+		{&mysql.MySQLError{Number: 1040}, true},
+		{&mysql.MySQLError{Number: 1053}, true},
+		{&mysql.MySQLError{Number: 1064}, false},
+		// killed by the proxy at the query time limit
+		{&mysql.MySQLError{Number: 1317}, false},
+		{&mysql.MySQLError{Number: 3024}, false},
+	}
+	for _, tt := range tests {
+		if got := failure(tt.err); got != tt.want {
+			t.Errorf("failure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+type Config struct {
+	Name     string          `json:"name"`
+	Primary  BackendConfig   `json:"primary"`
+	Replicas []BackendConfig `json:"replicas"`
+	// Balancer is the replica selection strategy, one of round_robin,
+	// weighted, least_outstanding or least_ewma. Defaults to round_robin.
+	Balancer string `json:"balancer"`
+	// Breaker configures the circuit breakers of the backends.
+	Breaker BreakerConfig `json:"breaker"`
+}
+
+// Cluster is a primary with its read replicas. Writes go to the primary and
+// reads are spread over the replicas by the cluster balancer.
+type Cluster struct {
+	Name     string
+	primary  *Backend
+	replicas []*Backend
+	balancer Balancer
+}
+
+func New(cfg Config) (*Cluster, error) {
+	balancer, err := NewBalancer(cfg.Balancer)
+	if err != nil {
+		return nil, fmt.Errorf("cluster %s: %w", cfg.Name, err)
+	}
+	var breakers *breakerSettings
+	if cfg.Breaker.Enabled {
+		if breakers, err = parseBreaker(cfg.Breaker); err != nil {
+			return nil, fmt.Errorf("cluster %s: %w", cfg.Name, err)
+		}
+	}
+	c := &Cluster{Name: cfg.Name, balancer: balancer}
+	if cfg.Primary.Name == "" {
+		cfg.Primary.Name = cfg.Name + "-primary"
+	}
+	if c.primary, err = NewBackend(cfg.Primary); err != nil {
+		return nil, fmt.Errorf("cluster %s: %w", cfg.Name, err)
+	}
+	if breakers != nil {
+		c.primary.breaker = newBreaker(c.primary.Name, breakers)
+	}
+	for i, rc := range cfg.Replicas {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("%s-replica-%d", cfg.Name, i)
+		}
+		r, err := NewBackend(rc)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("cluster %s: %w", cfg.Name, err)
+		}
+		if breakers != nil {
+			r.breaker = newBreaker(r.Name, breakers)
+		}
+		c.replicas = append(c.replicas, r)
+	}
+	return c, nil
+}
+
+func (c *Cluster) Primary() *Backend {
+	return c.primary
+}
+
+func (c *Cluster) Replicas() []*Backend {
+	return c.replicas
+}
+
+// Backends returns the primary followed by the replicas.
+func (c *Cluster) Backends() []*Backend {
+	return append([]*Backend{c.primary}, c.replicas...)
+}
+
+// PickReplica returns the replica a read should go to, or the primary when
+// the cluster has no replica. Reads are diverted from the replicas whose
+// breaker is open to the others, and to the primary when all are open.
+func (c *Cluster) PickReplica() *Backend {
+	if len(c.replicas) == 0 {
+		return c.primary
+	}
+	if c.primary.breaker == nil {
+		return c.balancer.Pick(c.replicas)
+	}
+	healthy := make([]*Backend, 0, len(c.replicas))
+	for _, r := range c.replicas {
+		if r.Available() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return c.primary
+	}
+	return c.balancer.Pick(healthy)
+}
+
+func (c *Cluster) Close() error {
+	var err error
+	for _, b := range c.Backends() {
+		if b == nil {
+			continue
+		}
+		if e := b.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Registry holds the clusters of a proxy, the first configured one is the
+// default cluster.
+type Registry struct {
+	clusters map[string]*Cluster
+	ordered  []*Cluster
+}
+
+func NewRegistry(cfgs []Config) (*Registry, error) {
+	if len(cfgs) == 0 {
+		return nil, fmt.Errorf("no cluster configured")
+	}
+	r := &Registry{clusters: map[string]*Cluster{}}
+	for _, cfg := range cfgs {
+		if _, ok := r.clusters[cfg.Name]; ok {
+			r.Close()
+			return nil, fmt.Errorf("duplicated cluster %s", cfg.Name)
+		}
+		c, err := New(cfg)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.clusters[c.Name] = c
+		r.ordered = append(r.ordered, c)
+	}
+	return r, nil
+}
+
+func (r *Registry) Get(name string) (*Cluster, bool) {
+	c, ok := r.clusters[name]
+	return c, ok
+}
+
+func (r *Registry) Default() *Cluster {
+	return r.ordered[0]
+}
+
+func (r *Registry) All() []*Cluster {
+	return r.ordered
+}
+
+func (r *Registry) Close() error {
+	var err error
+	for _, c := range r.ordered {
+		if e := c.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/u2takey/mysqlgate/pkg/admin"
+	"github.com/u2takey/mysqlgate/pkg/admission"
+	"github.com/u2takey/mysqlgate/pkg/cdc"
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/costguard"
+	"github.com/u2takey/mysqlgate/pkg/digest"
+	"github.com/u2takey/mysqlgate/pkg/firewall"
+	"github.com/u2takey/mysqlgate/pkg/guardrail"
+	"github.com/u2takey/mysqlgate/pkg/priority"
+	"github.com/u2takey/mysqlgate/pkg/qcache"
+	"github.com/u2takey/mysqlgate/pkg/reshard"
+	"github.com/u2takey/mysqlgate/pkg/resultlimit"
+	"github.com/u2takey/mysqlgate/pkg/retry"
+	"github.com/u2takey/mysqlgate/pkg/sequence"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/slowlog"
+	"github.com/u2takey/mysqlgate/pkg/timeout"
+	"github.com/u2takey/mysqlgate/pkg/xa"
+)
+
+// Config is the proxy configuration, loaded from a json file.
+type Config struct {
+	Addr string `json:"addr"`
+	// Users are the accounts clients log in to the proxy with, the
+	// policies keyed by user see these names. A single root user with
+	// password root when empty.
+	Users       []User                `json:"users,omitempty"`
+	Clusters    []cluster.Config      `json:"clusters"`
+	Sharding    sharding.Config       `json:"sharding"`
+	Sequences   []sequence.Config     `json:"sequences,omitempty"`
+	XA          xa.Config             `json:"xa"`
+	Admin       admin.Config          `json:"admin"`
+	Reshard     reshard.Config        `json:"reshard"`
+	CDC         cdc.Config            `json:"cdc"`
+	Cache       qcache.Config         `json:"cache"`
+	Coalesce    qcache.CoalesceConfig `json:"coalesce"`
+	Digest      digest.Config         `json:"digest"`
+	SlowLog     slowlog.Config        `json:"slow_log"`
+	Firewall    firewall.Config       `json:"firewall"`
+	Guardrail   guardrail.Config      `json:"guardrail"`
+	CostGuard   costguard.Config      `json:"cost_guard"`
+	ResultLimit resultlimit.Config    `json:"result_limit"`
+	Timeout     timeout.Config        `json:"timeout"`
+	Admission   admission.Config      `json:"admission"`
+	Priority    priority.Config       `json:"priority"`
+	Retry       retry.Config          `json:"retry"`
+}
+
+// User is an account of the proxy.
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Default returns the configuration of a proxy in front of a single mysql
+// server.
+func Default(addr, dsn string) *Config {
+	return &Config{
+		Addr: addr,
+		Clusters: []cluster.Config{{
+			Name:    "default",
+			Primary: cluster.BackendConfig{DSN: dsn},
+		}},
+	}
+}
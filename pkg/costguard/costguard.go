@@ -0,0 +1,211 @@
+// Package costguard estimates the cost of selects from their EXPLAIN and
+// rejects or warns about the ones examining too many rows or scanning a
+// large table. Explains are cached per digest.
+package costguard
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ActionReject = "reject"
+	ActionWarn   = "warn"
+
+	DefaultTTL        = 5 * time.Minute
+	DefaultMaxEntries = 10000
+)
+
+type Config struct {
+	// Users are the users whose selects are explained, the guard is off
+	// when empty.
+	Users []string `json:"users"`
+	// MaxRows is the estimated rows examined past which a select is
+	// expensive, unchecked when zero.
+	MaxRows int64 `json:"max_rows,omitempty"`
+	// LargeTableRows is the estimated rows of a table from which a full
+	// scan of it is expensive, unchecked when zero.
+	LargeTableRows int64 `json:"large_table_rows,omitempty"`
+	// Action is reject, the default, or warn which logs the select only.
+	Action string `json:"action,omitempty"`
+	// TTL is how long the explain of a digest is cached, like "5m".
+	TTL        string `json:"ttl,omitempty"`
+	MaxEntries int    `json:"max_entries,omitempty"`
+}
+
+// Row is a row of the traditional EXPLAIN output.
+type Row struct {
+	ID    string
+	Table string
+	// Type is the join type, ALL for a full scan.
+	Type     string
+	Rows     int64
+	Filtered float64
+}
+
+// Plan is the estimated cost of a select.
+type Plan struct {
+	// Rows is the estimated rows examined.
+	Rows      int64
+	FullScans []Scan
+}
+
+// Scan is a full scan of a table.
+type Scan struct {
+	Table string
+	Rows  int64
+}
+
+// Estimate sums up the rows of an EXPLAIN: the tables of a select are
+// joined in nested loops, each examining its rows for every row the
+// previous ones passed on.
+func Estimate(rows []Row) *Plan {
+	p := &Plan{}
+	var ids []string
+	selects := map[string][]Row{}
+	for _, r := range rows {
+		if _, ok := selects[r.ID]; !ok {
+			ids = append(ids, r.ID)
+		}
+		selects[r.ID] = append(selects[r.ID], r)
+	}
+	for _, id := range ids {
+		passed := 1.0
+		for _, r := range selects[id] {
+			p.Rows += int64(passed * float64(r.Rows))
+			filtered := r.Filtered
+			if filtered <= 0 {
+				filtered = 100
+			}
+			passed *= float64(r.Rows) * filtered / 100
+			if passed < 1 {
+				passed = 1
+			}
+			if r.Type == "ALL" {
+				p.FullScans = append(p.FullScans, Scan{Table: r.Table, Rows: r.Rows})
+			}
+		}
+	}
+	return p
+}
+
+// Violation is why a select is expensive.
+type Violation struct {
+	Action string
+	Reason string
+}
+
+type cachedPlan struct {
+	plan    *Plan
+	expires time.Time
+}
+
+type Guard struct {
+	users      map[string]bool
+	maxRows    int64
+	largeRows  int64
+	action     string
+	ttl        time.Duration
+	maxEntries int
+
+	mu    sync.Mutex // protects plans
+	plans map[string]cachedPlan
+}
+
+func New(cfg Config) (*Guard, error) {
+	g := &Guard{
+		users:      map[string]bool{},
+		maxRows:    cfg.MaxRows,
+		largeRows:  cfg.LargeTableRows,
+		action:     cfg.Action,
+		ttl:        DefaultTTL,
+		maxEntries: cfg.MaxEntries,
+		plans:      map[string]cachedPlan{},
+	}
+	for _, u := range cfg.Users {
+		g.users[u] = true
+	}
+	switch g.action {
+	case "":
+		g.action = ActionReject
+	case ActionReject, ActionWarn:
+	default:
+		return nil, fmt.Errorf("cost guard: unknown action %q", cfg.Action)
+	}
+	if g.maxRows <= 0 && g.largeRows <= 0 {
+		return nil, fmt.Errorf("cost guard: neither max_rows nor large_table_rows set")
+	}
+	if cfg.TTL != "" {
+		d, err := time.ParseDuration(cfg.TTL)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("cost guard: bad ttl %q", cfg.TTL)
+		}
+		g.ttl = d
+	}
+	if g.maxEntries <= 0 {
+		g.maxEntries = DefaultMaxEntries
+	}
+	return g, nil
+}
+
+// Guards tells whether the selects of user are explained.
+func (g *Guard) Guards(user string) bool {
+	return g.users[user]
+}
+
+// Plan returns the plan cached under key, the digest of a select and the
+// database it runs in.
+func (g *Guard) Plan(key string) (*Plan, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.plans[key]
+	if !ok || time.Now().After(c.expires) {
+		return nil, false
+	}
+	return c.plan, true
+}
+
+// Store caches the plan of key, dropping the expired plans or else the
+// ones closest to expiring when the cache is full.
+func (g *Guard) Store(key string, p *Plan) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.plans) >= g.maxEntries {
+		for k, c := range g.plans {
+			if now.After(c.expires) {
+				delete(g.plans, k)
+			}
+		}
+	}
+	if len(g.plans) >= g.maxEntries {
+		keys := make([]string, 0, len(g.plans))
+		for k := range g.plans {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return g.plans[keys[i]].expires.Before(g.plans[keys[j]].expires)
+		})
+		for _, k := range keys[:len(keys)-g.maxEntries/2] {
+			delete(g.plans, k)
+		}
+	}
+	g.plans[key] = cachedPlan{plan: p, expires: now.Add(g.ttl)}
+}
+
+// Check returns why p is expensive, nil when it is not.
+func (g *Guard) Check(p *Plan) *Violation {
+	if g.maxRows > 0 && p.Rows > g.maxRows {
+		return &Violation{Action: g.action, Reason: fmt.Sprintf("about %d rows examined, more than %d", p.Rows, g.maxRows)}
+	}
+	if g.largeRows > 0 {
+		for _, s := range p.FullScans {
+			if s.Rows >= g.largeRows {
+				return &Violation{Action: g.action, Reason: fmt.Sprintf("full scan of %s with about %d rows", s.Table, s.Rows)}
+			}
+		}
+	}
+	return nil
+}
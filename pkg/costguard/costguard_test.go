@@ -0,0 +1,111 @@
+package costguard
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rows  []Row
+		want  int64
+		scans []Scan
+	}{
+		{"empty", nil, 0, nil},
+		{"single lookup", []Row{{ID: "1", Table: "orders", Type: "ref", Rows: 3, Filtered: 100}}, 3, nil},
+		{"join", []Row{
+			{ID: "1", Table: "orders", Type: "ALL", Rows: 1000, Filtered: 10},
+			{ID: "1", Table: "items", Type: "ref", Rows: 5, Filtered: 100},
+		}, 1500, []Scan{{Table: "orders", Rows: 1000}}},
+		{"unknown filtered", []Row{
+			{ID: "1", Table: "a", Type: "ALL", Rows: 10},
+			{ID: "1", Table: "b", Type: "eq_ref", Rows: 1},
+		}, 20, []Scan{{Table: "a", Rows: 10}}},
+		{"nothing passed", []Row{
+			{ID: "1", Table: "a", Type: "range", Rows: 10, Filtered: 1},
+			{ID: "1", Table: "b", Type: "ref", Rows: 7, Filtered: 100},
+		}, 17, nil},
+		{"subquery", []Row{
+			{ID: "1", Table: "a", Type: "ref", Rows: 2, Filtered: 100},
+			{ID: "2", Table: "b", Type: "ALL", Rows: 50, Filtered: 100},
+		}, 52, []Scan{{Table: "b", Rows: 50}}},
+	}
+	for _, test := range tests {
+		p := Estimate(test.rows)
+		if p.Rows != test.want || !reflect.DeepEqual(p.FullScans, test.scans) {
+			t.Errorf("%s: got %d rows, scans %v, want %d, %v", test.name, p.Rows, p.FullScans, test.want, test.scans)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		cfg Config
+		err bool
+	}{
+		{Config{MaxRows: 10}, false},
+		{Config{LargeTableRows: 10, Action: ActionWarn, TTL: "1m"}, false},
+		{Config{}, true},
+		{Config{MaxRows: 10, Action: "block"}, true},
+		{Config{MaxRows: 10, TTL: "soon"}, true},
+		{Config{MaxRows: 10, TTL: "-1s"}, true},
+	}
+	for _, test := range tests {
+		if _, err := New(test.cfg); (err != nil) != test.err {
+			t.Errorf("%+v: error %v", test.cfg, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	g, err := New(Config{Users: []string{"app"}, MaxRows: 1000, LargeTableRows: 500, Action: ActionWarn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Guards("app") || g.Guards("admin") {
+		t.Error("guards the wrong users")
+	}
+	tests := []struct {
+		plan Plan
+		want string
+	}{
+		{Plan{Rows: 10}, ""},
+		{Plan{Rows: 1000}, ""},
+		{Plan{Rows: 1001}, "about 1001 rows examined, more than 1000"},
+		{Plan{Rows: 499, FullScans: []Scan{{Table: "t", Rows: 499}}}, ""},
+		{Plan{Rows: 500, FullScans: []Scan{{Table: "t", Rows: 500}}}, "full scan of t with about 500 rows"},
+	}
+	for _, test := range tests {
+		var got string
+		if v := g.Check(&test.plan); v != nil {
+			if v.Action != ActionWarn {
+				t.Errorf("%+v: action %s", test.plan, v.Action)
+			}
+			got = v.Reason
+		}
+		if got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.plan, got, test.want)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	g, err := New(Config{MaxRows: 10, MaxEntries: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		g.Store(fmt.Sprint(i), &Plan{Rows: int64(i)})
+		if len(g.plans) > 4 {
+			t.Fatalf("%d plans cached, at most 4", len(g.plans))
+		}
+	}
+	if p, ok := g.Plan("9"); !ok || p.Rows != 9 {
+		t.Errorf("latest plan got %v, %v", p, ok)
+	}
+	if _, ok := g.Plan("0"); ok {
+		t.Error("oldest plan still cached")
+	}
+}
@@ -0,0 +1,190 @@
+// Package digest aggregates the statements the proxy runs by normalized
+// text, user and database, like the digest summary of performance_schema.
+package digest
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	parser "github.com/u2takey/sqlparser"
+)
+
+const (
+	DefaultMaxDigests = 5000
+	// maxTextLen bounds the normalized text kept per digest.
+	maxTextLen = 1024
+	// Other is the digest the statements are counted in once the store is
+	// full.
+	Other = "other"
+)
+
+// Buckets are the upper bounds of the latency histogram buckets, the last
+// bucket counts the statements slower than all of them.
+var Buckets = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+type Config struct {
+	Enabled bool `json:"enabled"`
+	// MaxDigests bounds the digests kept, the statements of new ones are
+	// counted in the other digest past it.
+	MaxDigests int `json:"max_digests,omitempty"`
+}
+
+// Entry are the figures of a digest run by a user on a database.
+type Entry struct {
+	Digest       string    `json:"digest"`
+	Text         string    `json:"text"`
+	User         string    `json:"user"`
+	Database     string    `json:"database"`
+	Count        int64     `json:"count"`
+	Errors       int64     `json:"errors"`
+	RowsSent     int64     `json:"rows_sent"`
+	RowsAffected int64     `json:"rows_affected"`
+	TotalLatency int64     `json:"total_latency_us"`
+	MaxLatency   int64     `json:"max_latency_us"`
+	P50          int64     `json:"p50_us"`
+	P95          int64     `json:"p95_us"`
+	P99          int64     `json:"p99_us"`
+	Histogram    []int64   `json:"histogram"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+type key struct {
+	digest, user, database string
+}
+
+// Store keeps the entries of the digests.
+type Store struct {
+	max int
+
+	mu      sync.Mutex // protects entries
+	entries map[key]*Entry
+}
+
+func NewStore(cfg Config) *Store {
+	s := &Store{max: cfg.MaxDigests, entries: map[key]*Entry{}}
+	if s.max <= 0 {
+		s.max = DefaultMaxDigests
+	}
+	return s
+}
+
+// Record counts a statement, normalized like parser.Normalize.
+func (s *Store) Record(normalized, user, database string, latency time.Duration, failed bool, rowsSent, rowsAffected int64) {
+	k := key{digest: parser.DigestNormalized(normalized).String(), user: user, database: database}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[k]
+	if !ok {
+		if len(s.entries) >= s.max {
+			k = key{digest: Other}
+			normalized = ""
+		}
+		if e, ok = s.entries[k]; !ok {
+			if len(normalized) > maxTextLen {
+				normalized = normalized[:maxTextLen]
+			}
+			e = &Entry{
+				Digest:    k.digest,
+				Text:      normalized,
+				User:      k.user,
+				Database:  k.database,
+				Histogram: make([]int64, len(Buckets)+1),
+				FirstSeen: now,
+			}
+			s.entries[k] = e
+		}
+	}
+	e.Count++
+	if failed {
+		e.Errors++
+	}
+	e.RowsSent += rowsSent
+	e.RowsAffected += rowsAffected
+	us := latency.Microseconds()
+	e.TotalLatency += us
+	if us > e.MaxLatency {
+		e.MaxLatency = us
+	}
+	e.Histogram[sort.Search(len(Buckets), func(i int) bool { return latency <= Buckets[i] })]++
+	e.LastSeen = now
+}
+
+// Entries returns a copy of the entries, the slowest in total first.
+func (s *Store) Entries() []*Entry {
+	s.mu.Lock()
+	entries := make([]*Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		c := *e
+		c.Histogram = append([]int64(nil), e.Histogram...)
+		entries = append(entries, &c)
+	}
+	s.mu.Unlock()
+	for _, e := range entries {
+		e.P50, e.P95, e.P99 = percentile(e, 0.50), percentile(e, 0.95), percentile(e, 0.99)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].TotalLatency > entries[j].TotalLatency
+	})
+	return entries
+}
+
+// percentile estimates the latency under which a fraction q of the
+// statements ran, as the upper bound of its bucket.
+func percentile(e *Entry, q float64) int64 {
+	rank := int64(q*float64(e.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range e.Histogram {
+		if seen += n; seen >= rank {
+			if i < len(Buckets) && Buckets[i].Microseconds() < e.MaxLatency {
+				return Buckets[i].Microseconds()
+			}
+			break
+		}
+	}
+	return e.MaxLatency
+}
+
+// Reset drops every entry.
+func (s *Store) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = map[key]*Entry{}
+}
+
+// WriteCSV writes entries as csv with a header line, the histogram left
+// out.
+func WriteCSV(w io.Writer, entries []*Entry) error {
+	cw := csv.NewWriter(w)
+	header := []string{"digest", "text", "user", "database", "count", "errors", "rows_sent", "rows_affected",
+		"total_latency_us", "max_latency_us", "p50_us", "p95_us", "p99_us", "first_seen", "last_seen"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+	for _, e := range entries {
+		record := []string{e.Digest, e.Text, e.User, e.Database, itoa(e.Count), itoa(e.Errors),
+			itoa(e.RowsSent), itoa(e.RowsAffected), itoa(e.TotalLatency), itoa(e.MaxLatency),
+			itoa(e.P50), itoa(e.P95), itoa(e.P99),
+			e.FirstSeen.Format(time.RFC3339), e.LastSeen.Format(time.RFC3339)}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
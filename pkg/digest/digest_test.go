@@ -0,0 +1,106 @@
+package digest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	s := NewStore(Config{Enabled: true})
+	s.Record("select * from t where id = ?", "app", "shop", time.Millisecond, false, 1, 0)
+	s.Record("select * from t where id = ?", "app", "shop", 3*time.Millisecond, true, 0, 0)
+	s.Record("select * from t where id = ?", "report", "shop", time.Millisecond, false, 1, 0)
+	s.Record("update t set a = ? where id = ?", "app", "shop", 10*time.Millisecond, false, 0, 2)
+
+	tests := []struct {
+		text, user    string
+		count, errors int64
+		rowsSent      int64
+		rowsAffected  int64
+		total, max    int64
+	}{
+		{"update t set a = ? where id = ?", "app", 1, 0, 0, 2, 10000, 10000},
+		{"select * from t where id = ?", "app", 2, 1, 1, 0, 4000, 3000},
+		{"select * from t where id = ?", "report", 1, 0, 1, 0, 1000, 1000},
+	}
+	entries := s.Entries()
+	if len(entries) != len(tests) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(tests))
+	}
+	for i, test := range tests {
+		e := entries[i]
+		if e.Text != test.text || e.User != test.user || e.Count != test.count || e.Errors != test.errors ||
+			e.RowsSent != test.rowsSent || e.RowsAffected != test.rowsAffected ||
+			e.TotalLatency != test.total || e.MaxLatency != test.max {
+			t.Errorf("entry %d: got %+v, want %+v", i, e, test)
+		}
+	}
+	if entries[1].Digest != entries[2].Digest {
+		t.Error("same statement of two users got different digests")
+	}
+
+	s.Reset()
+	if len(s.Entries()) != 0 {
+		t.Error("entries left after reset")
+	}
+}
+
+func TestOther(t *testing.T) {
+	s := NewStore(Config{Enabled: true, MaxDigests: 2})
+	for _, text := range []string{"select ?", "select ? from a", "select ? from b", "select ? from c"} {
+		s.Record(text, "app", "shop", time.Millisecond, false, 0, 0)
+	}
+	counts := map[string]int64{}
+	for _, e := range s.Entries() {
+		counts[e.Digest] += e.Count
+	}
+	if len(counts) != 3 || counts[Other] != 2 {
+		t.Errorf("got %v, want 2 digests and 2 statements in other", counts)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name          string
+		latencies     map[time.Duration]int
+		p50, p95, p99 int64
+	}{
+		{"single", map[time.Duration]int{150 * time.Microsecond: 1}, 150, 150, 150},
+		{"spread", map[time.Duration]int{
+			200 * time.Microsecond: 90,
+			3 * time.Millisecond:   9,
+			2 * time.Second:        1,
+		}, 250, 5000, 5000},
+		{"slower than every bucket", map[time.Duration]int{20 * time.Second: 2}, 20000000, 20000000, 20000000},
+	}
+	for _, test := range tests {
+		s := NewStore(Config{Enabled: true})
+		for latency, n := range test.latencies {
+			for i := 0; i < n; i++ {
+				s.Record("select ?", "app", "shop", latency, false, 0, 0)
+			}
+		}
+		e := s.Entries()[0]
+		if e.P50 != test.p50 || e.P95 != test.p95 || e.P99 != test.p99 {
+			t.Errorf("%s: got %d %d %d, want %d %d %d", test.name, e.P50, e.P95, e.P99, test.p50, test.p95, test.p99)
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	s := NewStore(Config{Enabled: true})
+	s.Record("select a, b from t", "app", "shop", time.Millisecond, false, 3, 0)
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, s.Entries()); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0][0] != "digest" || records[1][1] != "select a, b from t" || records[1][6] != "3" {
+		t.Errorf("got %q", records)
+	}
+}
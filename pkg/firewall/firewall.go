@@ -0,0 +1,532 @@
+// Package firewall allows the statements of each user by digest, learned
+// while learning and enforced while enforcing, and denies the statements
+// matching deny rules.
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/atomicfile"
+	"github.com/u2takey/mysqlgate/pkg/log"
+	"github.com/u2takey/sqlparser/ast"
+)
+
+var mLog = log.ModuleLogger("firewall")
+
+const (
+	ModeOff       = "off"
+	ModeLearning  = "learning"
+	ModeEnforcing = "enforcing"
+
+	// reloadInterval is how often the rules file is checked for changes
+	// and the learned digests saved.
+	reloadInterval = 2 * time.Second
+)
+
+type Config struct {
+	// Mode is off, learning or enforcing, the mode of the rules file
+	// overrides it.
+	Mode string `json:"mode"`
+	// Rules is the json file of the rules, reloaded when it changes. The
+	// digests learned are saved to it.
+	Rules string `json:"rules"`
+	// Audit is the json lines file the blocked statements are written to.
+	Audit string `json:"audit,omitempty"`
+	// Applications name the clients by address, the digests of a user
+	// are allowed per application with principals like "app/billing".
+	Applications []Application `json:"applications,omitempty"`
+}
+
+// Application is the clients connecting from Networks, like "10.1.0.0/16"
+// or "10.1.2.3".
+type Application struct {
+	Name     string   `json:"name"`
+	Networks []string `json:"networks"`
+
+	networks []*net.IPNet
+}
+
+func (a *Application) contains(ip net.IP) bool {
+	for _, n := range a.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules are the content of the rules file.
+type Rules struct {
+	Mode string `json:"mode,omitempty"`
+	// Allow are the digests allowed per principal, a user or a user and
+	// the application its client connects from, like "app/billing".
+	Allow map[string][]string `json:"allow,omitempty"`
+	Deny  []DenyRule          `json:"deny,omitempty"`
+}
+
+// DenyRule denies statements by shape, whatever the mode.
+type DenyRule struct {
+	Name string `json:"name"`
+	// Statements are the kinds of statements denied, like drop_table or
+	// truncate, see Kind. Any kind when empty.
+	Statements []string `json:"statements,omitempty"`
+	// WithoutWhere denies the updates and deletes without where clause
+	// only.
+	WithoutWhere bool `json:"without_where,omitempty"`
+	// Users are the users the rule applies to, all when empty.
+	Users []string `json:"users,omitempty"`
+}
+
+func (r *DenyRule) matches(user string, stmt ast.StmtNode) bool {
+	if len(r.Users) > 0 && !contains(r.Users, user) {
+		return false
+	}
+	if len(r.Statements) > 0 && !contains(r.Statements, Kind(stmt)) {
+		return false
+	}
+	if r.WithoutWhere {
+		switch s := stmt.(type) {
+		case *ast.UpdateStmt:
+			return s.Where == nil
+		case *ast.DeleteStmt:
+			return s.Where == nil
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Kind names the kind of stmt for deny rules.
+func Kind(stmt ast.StmtNode) string {
+	switch s := stmt.(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt:
+		return "select"
+	case *ast.InsertStmt:
+		if s.IsReplace {
+			return "replace"
+		}
+		return "insert"
+	case *ast.UpdateStmt:
+		return "update"
+	case *ast.DeleteStmt:
+		return "delete"
+	case *ast.DropTableStmt:
+		if s.IsView {
+			return "drop_view"
+		}
+		return "drop_table"
+	case *ast.DropDatabaseStmt:
+		return "drop_database"
+	case *ast.TruncateTableStmt:
+		return "truncate"
+	case *ast.AlterTableStmt:
+		return "alter_table"
+	case *ast.CreateTableStmt:
+		return "create_table"
+	case *ast.RenameTableStmt:
+		return "rename_table"
+	case *ast.CreateIndexStmt:
+		return "create_index"
+	case *ast.DropIndexStmt:
+		return "drop_index"
+	case *ast.GrantStmt:
+		return "grant"
+	case *ast.RevokeStmt:
+		return "revoke"
+	case *ast.CreateUserStmt:
+		return "create_user"
+	case *ast.DropUserStmt:
+		return "drop_user"
+	case *ast.LoadDataStmt:
+		return "load_data"
+	case *ast.CallStmt:
+		return "call"
+	case *ast.SetStmt:
+		return "set"
+	}
+	return "other"
+}
+
+// Request is a query checked by the firewall.
+type Request struct {
+	// User is the authenticated user, Client the address of its client.
+	User   string
+	Client string
+	// Program is the program name the client sent, it is audited but not
+	// trusted.
+	Program  string
+	Database string
+	Digest   string
+	Query    string
+	Stmts    []ast.StmtNode
+}
+
+// Blocked is the error of a blocked query.
+type Blocked struct {
+	// Rule is the deny rule that matched, empty when the digest is not
+	// allowed.
+	Rule string
+}
+
+func (b *Blocked) Error() string {
+	if b.Rule == "" {
+		return "statement not in the allowlist"
+	}
+	return "statement denied by rule " + b.Rule
+}
+
+// auditEntry is a line of the audit file.
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Mode        string    `json:"mode"`
+	User        string    `json:"user"`
+	Application string    `json:"application,omitempty"`
+	Program     string    `json:"program,omitempty"`
+	Client      string    `json:"client"`
+	Database    string    `json:"database,omitempty"`
+	Digest      string    `json:"digest"`
+	Query       string    `json:"query"`
+	Rule        string    `json:"rule,omitempty"`
+}
+
+// Status is the state of the firewall.
+type Status struct {
+	Mode       string `json:"mode"`
+	Principals int    `json:"principals"`
+	Digests    int    `json:"digests"`
+	DenyRules  int    `json:"deny_rules"`
+	Blocked    int64  `json:"blocked"`
+}
+
+type Firewall struct {
+	path         string
+	defaultMode  string
+	applications []Application
+	blocked      int64 // accessed atomically
+
+	mu    sync.RWMutex // protects following fields
+	mode  string
+	allow map[string]map[string]bool
+	deny  []DenyRule
+	// learned are the digests learned since the rules were saved.
+	learned map[string][]string
+	modTime time.Time
+
+	auditMu sync.Mutex
+	audit   *os.File
+}
+
+func New(cfg Config) (*Firewall, error) {
+	f := &Firewall{path: cfg.Rules, defaultMode: cfg.Mode, learned: map[string][]string{}}
+	if f.defaultMode == "" {
+		f.defaultMode = ModeOff
+	}
+	if err := checkMode(f.defaultMode); err != nil {
+		return nil, err
+	}
+	if f.path == "" {
+		return nil, fmt.Errorf("firewall: no rules file")
+	}
+	for _, a := range cfg.Applications {
+		if a.Name == "" || len(a.Networks) == 0 {
+			return nil, fmt.Errorf("firewall: application %q needs a name and networks", a.Name)
+		}
+		for _, network := range a.Networks {
+			if !strings.Contains(network, "/") {
+				if strings.Contains(network, ":") {
+					network += "/128"
+				} else {
+					network += "/32"
+				}
+			}
+			_, n, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("firewall: application %s: %v", a.Name, err)
+			}
+			a.networks = append(a.networks, n)
+		}
+		f.applications = append(f.applications, a)
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	if cfg.Audit != "" {
+		audit, err := os.OpenFile(cfg.Audit, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("firewall: %v", err)
+		}
+		f.audit = audit
+	}
+	return f, nil
+}
+
+func checkMode(mode string) error {
+	switch mode {
+	case ModeOff, ModeLearning, ModeEnforcing:
+		return nil
+	}
+	return fmt.Errorf("firewall: unknown mode %q", mode)
+}
+
+// Reload reads the rules file again, a missing file has no rule. The
+// digests learned and not saved yet are kept.
+func (f *Firewall) Reload() error {
+	var rules Rules
+	var modTime time.Time
+	fi, err := os.Stat(f.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("firewall: %v", err)
+	default:
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return fmt.Errorf("firewall: %v", err)
+		}
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return fmt.Errorf("firewall: %s: %v", f.path, err)
+		}
+		modTime = fi.ModTime()
+	}
+	mode := rules.Mode
+	if mode == "" {
+		mode = f.defaultMode
+	}
+	if err := checkMode(mode); err != nil {
+		return err
+	}
+	allow := map[string]map[string]bool{}
+	for principal, digests := range rules.Allow {
+		allow[principal] = map[string]bool{}
+		for _, d := range digests {
+			allow[principal][d] = true
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for principal, digests := range f.learned {
+		if allow[principal] == nil {
+			allow[principal] = map[string]bool{}
+		}
+		for _, d := range digests {
+			allow[principal][d] = true
+		}
+	}
+	f.mode, f.allow, f.deny, f.modTime = mode, allow, rules.Deny, modTime
+	return nil
+}
+
+// application returns the application client connects from, empty when
+// none is configured for it.
+func (f *Firewall) application(client string) string {
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		host = client
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	for i := range f.applications {
+		if f.applications[i].contains(ip) {
+			return f.applications[i].Name
+		}
+	}
+	return ""
+}
+
+// Check returns a *Blocked error when the firewall blocks r. Deny rules
+// apply in every mode, the allowlist only while learning or enforcing.
+func (f *Firewall) Check(r *Request) error {
+	application := f.application(r.Client)
+	principal := r.User
+	if application != "" {
+		principal += "/" + application
+	}
+	f.mu.RLock()
+	mode := f.mode
+	var blocked *Blocked
+	for i := range f.deny {
+		for _, stmt := range r.Stmts {
+			if f.deny[i].matches(r.User, stmt) {
+				blocked = &Blocked{Rule: f.deny[i].Name}
+				break
+			}
+		}
+		if blocked != nil {
+			break
+		}
+	}
+	allowed := f.allow[principal][r.Digest] || f.allow[r.User][r.Digest]
+	f.mu.RUnlock()
+
+	if blocked == nil && !allowed {
+		switch mode {
+		case ModeLearning:
+			f.learn(principal, r.Digest)
+		case ModeEnforcing:
+			blocked = &Blocked{}
+		}
+	}
+	if blocked == nil {
+		return nil
+	}
+	atomic.AddInt64(&f.blocked, 1)
+	f.writeAudit(&auditEntry{
+		Time:        time.Now(),
+		Mode:        mode,
+		User:        r.User,
+		Application: application,
+		Program:     r.Program,
+		Client:      r.Client,
+		Database:    r.Database,
+		Digest:      r.Digest,
+		Query:       r.Query,
+		Rule:        blocked.Rule,
+	})
+	return blocked
+}
+
+func (f *Firewall) learn(principal, digest string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.allow[principal] == nil {
+		f.allow[principal] = map[string]bool{}
+	}
+	if f.allow[principal][digest] {
+		return
+	}
+	f.allow[principal][digest] = true
+	f.learned[principal] = append(f.learned[principal], digest)
+}
+
+func (f *Firewall) writeAudit(e *auditEntry) {
+	if f.audit == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	f.auditMu.Lock()
+	defer f.auditMu.Unlock()
+	if _, err := f.audit.Write(append(data, '\n')); err != nil {
+		mLog.Error("msg", "writing audit", "err", err)
+	}
+}
+
+// Run reloads the rules when their file changes and saves the digests
+// learned, until ctx is done.
+func (f *Firewall) Run(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := f.save(); err != nil {
+				mLog.Error("msg", "saving learned digests", "err", err)
+			}
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(f.path)
+		f.mu.RLock()
+		changed := err == nil && !fi.ModTime().Equal(f.modTime)
+		f.mu.RUnlock()
+		if changed {
+			if err := f.Reload(); err != nil {
+				mLog.Error("msg", "reloading rules", "err", err)
+			} else {
+				mLog.Log("msg", "rules reloaded", "path", f.path)
+			}
+		}
+		if err := f.save(); err != nil {
+			mLog.Error("msg", "saving learned digests", "err", err)
+		}
+	}
+}
+
+// save writes the rules with the digests learned to the rules file.
+func (f *Firewall) save() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.learned) == 0 {
+		return nil
+	}
+	// keep what the file has, it may have changed since the last reload
+	var rules Rules
+	if data, err := os.ReadFile(f.path); err == nil {
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if rules.Allow == nil {
+		rules.Allow = map[string][]string{}
+	}
+	for principal, digests := range f.learned {
+		all := append(rules.Allow[principal], digests...)
+		sort.Strings(all)
+		// the file may have been given some of them meanwhile
+		unique := all[:0]
+		for i, d := range all {
+			if i == 0 || d != all[i-1] {
+				unique = append(unique, d)
+			}
+		}
+		rules.Allow[principal] = unique
+	}
+	data, err := json.MarshalIndent(&rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(f.path, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.learned, f.modTime = map[string][]string{}, fi.ModTime()
+	return nil
+}
+
+func (f *Firewall) Status() Status {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	s := Status{Mode: f.mode, Principals: len(f.allow), DenyRules: len(f.deny), Blocked: atomic.LoadInt64(&f.blocked)}
+	for _, digests := range f.allow {
+		s.Digests += len(digests)
+	}
+	return s
+}
+
+func (f *Firewall) Close() error {
+	f.auditMu.Lock()
+	defer f.auditMu.Unlock()
+	if f.audit == nil {
+		return nil
+	}
+	return f.audit.Close()
+}
@@ -0,0 +1,68 @@
+package firewall
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u2takey/sqlparser/ast"
+)
+
+func newTestFirewall(t *testing.T, rules string, cfg Config) *Firewall {
+	t.Helper()
+	cfg.Rules = filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(cfg.Rules, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestDenyInEveryMode(t *testing.T) {
+	for _, mode := range []string{ModeOff, ModeLearning, ModeEnforcing} {
+		f := newTestFirewall(t, `{"mode":"`+mode+`","deny":[{"name":"no_drop","statements":["drop_table"]}]}`, Config{})
+		err := f.Check(&Request{User: "app", Client: "10.0.0.1:1234", Digest: "d1", Stmts: []ast.StmtNode{&ast.DropTableStmt{}}})
+		if b, ok := err.(*Blocked); !ok || b.Rule != "no_drop" {
+			t.Errorf("%s: drop table got %v, want denied by no_drop", mode, err)
+		}
+	}
+}
+
+func TestApplicationPrincipal(t *testing.T) {
+	f := newTestFirewall(t, `{"mode":"enforcing","allow":{"app/billing":["d1"],"app":["d2"]}}`, Config{
+		Applications: []Application{{Name: "billing", Networks: []string{"10.1.0.0/16", "192.168.0.7"}}},
+	})
+	tests := []struct {
+		client, program, digest string
+		allowed                 bool
+	}{
+		{"10.1.2.3:5000", "", "d1", true},
+		{"192.168.0.7:5000", "", "d1", true},
+		{"10.2.0.1:5000", "", "d1", false},
+		// the program name the client sends is not trusted
+		{"10.2.0.1:5000", "billing", "d1", false},
+		{"10.2.0.1:5000", "", "d2", true},
+		{"10.1.2.3:5000", "", "d2", true},
+	}
+	for _, tt := range tests {
+		err := f.Check(&Request{User: "app", Client: tt.client, Program: tt.program, Digest: tt.digest, Stmts: []ast.StmtNode{&ast.SelectStmt{}}})
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s %q %s: got %v, want allowed %v", tt.client, tt.program, tt.digest, err, tt.allowed)
+		}
+	}
+}
+
+func TestLearnPerApplication(t *testing.T) {
+	f := newTestFirewall(t, `{"mode":"learning"}`, Config{
+		Applications: []Application{{Name: "billing", Networks: []string{"10.1.0.0/16"}}},
+	})
+	if err := f.Check(&Request{User: "app", Client: "10.1.0.1:5000", Digest: "d1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !f.allow["app/billing"]["d1"] || f.allow["app"]["d1"] {
+		t.Fatalf("learned %v, want d1 for app/billing only", f.allow)
+	}
+}
@@ -0,0 +1,240 @@
+// Package guardrail checks the statements that can destroy data at once:
+// updates and deletes without where or limit, drops, truncates and alters
+// of large tables. Policies chosen by user and database reject them,
+// require the session to opt in or log them.
+package guardrail
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/u2takey/sqlparser/ast"
+)
+
+const (
+	// Checks are the kinds of dangerous statements.
+	CheckUnboundedWrite = "unbounded_write"
+	CheckDrop           = "drop"
+	CheckTruncate       = "truncate"
+	CheckAlterLarge     = "alter_large"
+
+	// Actions are what a policy does with a dangerous statement.
+	ActionAllow  = "allow"
+	ActionLog    = "log"
+	ActionOptIn  = "opt_in"
+	ActionReject = "reject"
+
+	DefaultLargeTableRows = 1000000
+	// rowsTTL is how long the row count of a table is cached.
+	rowsTTL = time.Minute
+)
+
+type Config struct {
+	// Policies are matched in order, the first matching the user and
+	// database of a statement and setting an action for its check
+	// applies. Dangerous statements matched by none are allowed.
+	Policies []Policy `json:"policies"`
+	// LargeTableRows is the estimated row count from which an alter is
+	// checked as alter_large.
+	LargeTableRows int64 `json:"large_table_rows,omitempty"`
+}
+
+// Policy sets the action of each check, allow, log, opt_in or reject,
+// for some users and databases. An empty action leaves the check to the
+// next policies.
+type Policy struct {
+	// Users and Databases are the users and default databases the policy
+	// applies to, all when empty.
+	Users     []string `json:"users,omitempty"`
+	Databases []string `json:"databases,omitempty"`
+
+	UnboundedWrite string `json:"unbounded_write,omitempty"`
+	Drop           string `json:"drop,omitempty"`
+	Truncate       string `json:"truncate,omitempty"`
+	AlterLarge     string `json:"alter_large,omitempty"`
+}
+
+func (p *Policy) matches(user, database string) bool {
+	return (len(p.Users) == 0 || contains(p.Users, user)) &&
+		(len(p.Databases) == 0 || contains(p.Databases, strings.ToLower(database)))
+}
+
+func (p *Policy) action(check string) string {
+	switch check {
+	case CheckUnboundedWrite:
+		return p.UnboundedWrite
+	case CheckDrop:
+		return p.Drop
+	case CheckTruncate:
+		return p.Truncate
+	case CheckAlterLarge:
+		return p.AlterLarge
+	}
+	return ""
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Table is a table a statement is checked against, Schema is empty when
+// the statement did not qualify it.
+type Table struct {
+	Schema string
+	Name   string
+}
+
+func (t Table) String() string {
+	if t.Schema == "" {
+		return t.Name
+	}
+	return t.Schema + "." + t.Name
+}
+
+// Request is a statement checked by the guard.
+type Request struct {
+	User     string
+	Database string
+	Stmt     ast.StmtNode
+	// TableRows estimates the rows of a table, for alter_large.
+	TableRows func(ctx context.Context, t Table) (int64, error)
+}
+
+// Violation is a check a statement failed and the action its policy takes.
+type Violation struct {
+	Check  string
+	Action string
+	// Reason tells what is dangerous about the statement.
+	Reason string
+}
+
+type cachedRows struct {
+	rows    int64
+	expires time.Time
+}
+
+type Guard struct {
+	policies  []Policy
+	largeRows int64
+
+	mu   sync.Mutex // protects rows
+	rows map[string]cachedRows
+}
+
+func New(cfg Config) (*Guard, error) {
+	g := &Guard{largeRows: cfg.LargeTableRows, rows: map[string]cachedRows{}}
+	if g.largeRows <= 0 {
+		g.largeRows = DefaultLargeTableRows
+	}
+	for i, p := range cfg.Policies {
+		for _, check := range []string{CheckUnboundedWrite, CheckDrop, CheckTruncate, CheckAlterLarge} {
+			switch a := p.action(check); a {
+			case "", ActionAllow, ActionLog, ActionOptIn, ActionReject:
+			default:
+				return nil, fmt.Errorf("guardrail: policy %d: unknown action %q for %s", i, a, check)
+			}
+		}
+		for j, db := range p.Databases {
+			p.Databases[j] = strings.ToLower(db)
+		}
+		g.policies = append(g.policies, p)
+	}
+	return g, nil
+}
+
+// Action returns the action of the first policy for user and database
+// setting one for check.
+func (g *Guard) Action(check, user, database string) string {
+	for i := range g.policies {
+		p := &g.policies[i]
+		if !p.matches(user, database) {
+			continue
+		}
+		if a := p.action(check); a != "" {
+			return a
+		}
+	}
+	return ActionAllow
+}
+
+// Check returns the violation of the statement of r, nil when it is safe
+// or allowed.
+func (g *Guard) Check(ctx context.Context, r *Request) (*Violation, error) {
+	check, reason := classify(r.Stmt)
+	if check == "" {
+		return nil, nil
+	}
+	action := g.Action(check, r.User, r.Database)
+	if action == ActionAllow {
+		return nil, nil
+	}
+	if check == CheckAlterLarge {
+		large, err := g.largeTable(ctx, r, r.Stmt.(*ast.AlterTableStmt))
+		if err != nil || large == "" {
+			return nil, err
+		}
+		reason = "alter of " + large
+	}
+	return &Violation{Check: check, Action: action, Reason: reason}, nil
+}
+
+// classify returns the check stmt falls under, empty when none.
+func classify(stmt ast.StmtNode) (check, reason string) {
+	switch s := stmt.(type) {
+	case *ast.UpdateStmt:
+		if s.Where == nil && s.Limit == nil {
+			return CheckUnboundedWrite, "update without where or limit"
+		}
+	case *ast.DeleteStmt:
+		if s.Where == nil && s.Limit == nil {
+			return CheckUnboundedWrite, "delete without where or limit"
+		}
+	case *ast.DropTableStmt:
+		if s.IsView {
+			return CheckDrop, "drop view"
+		}
+		return CheckDrop, "drop table"
+	case *ast.DropDatabaseStmt:
+		return CheckDrop, "drop database"
+	case *ast.TruncateTableStmt:
+		return CheckTruncate, "truncate table"
+	case *ast.AlterTableStmt:
+		return CheckAlterLarge, "alter table"
+	}
+	return "", ""
+}
+
+// largeTable returns a description of the table altered by stmt when it
+// has at least the large row count, empty when it is smaller.
+func (g *Guard) largeTable(ctx context.Context, r *Request, stmt *ast.AlterTableStmt) (string, error) {
+	t := Table{Schema: stmt.Table.Schema.L, Name: stmt.Table.Name.L}
+	key := t.String()
+	if t.Schema == "" {
+		key = strings.ToLower(r.Database) + "." + t.Name
+	}
+	g.mu.Lock()
+	c, ok := g.rows[key]
+	g.mu.Unlock()
+	if !ok || time.Now().After(c.expires) {
+		rows, err := r.TableRows(ctx, t)
+		if err != nil {
+			return "", fmt.Errorf("guardrail: counting rows of %s: %v", key, err)
+		}
+		c = cachedRows{rows: rows, expires: time.Now().Add(rowsTTL)}
+		g.mu.Lock()
+		g.rows[key] = c
+		g.mu.Unlock()
+	}
+	if c.rows < g.largeRows {
+		return "", nil
+	}
+	return fmt.Sprintf("%s with about %d rows", key, c.rows), nil
+}
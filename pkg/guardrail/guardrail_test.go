@@ -0,0 +1,106 @@
+package guardrail
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	parser "github.com/u2takey/sqlparser"
+	_ "github.com/u2takey/sqlparser/test_driver"
+)
+
+func TestNewRejectsUnknownAction(t *testing.T) {
+	if _, err := New(Config{Policies: []Policy{{Drop: "maybe"}}}); err == nil {
+		t.Fatal("unknown action accepted")
+	}
+}
+
+func TestAction(t *testing.T) {
+	g, err := New(Config{Policies: []Policy{
+		{Users: []string{"admin"}, Drop: ActionAllow},
+		{Databases: []string{"Prod"}, Drop: ActionReject, Truncate: ActionOptIn},
+		{Drop: ActionLog},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		check, user, database string
+		want                  string
+	}{
+		{CheckDrop, "admin", "prod", ActionAllow},
+		{CheckDrop, "app", "prod", ActionReject},
+		{CheckDrop, "app", "PROD", ActionReject},
+		{CheckDrop, "app", "test", ActionLog},
+		{CheckTruncate, "admin", "prod", ActionOptIn},
+		{CheckTruncate, "app", "test", ActionAllow},
+		{CheckUnboundedWrite, "app", "prod", ActionAllow},
+	}
+	for _, test := range tests {
+		if got := g.Action(test.check, test.user, test.database); got != test.want {
+			t.Errorf("%s by %s on %s: got %s, want %s", test.check, test.user, test.database, got, test.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	g, err := New(Config{LargeTableRows: 1000, Policies: []Policy{{
+		UnboundedWrite: ActionReject,
+		Drop:           ActionOptIn,
+		Truncate:       ActionLog,
+		AlterLarge:     ActionReject,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := map[string]int64{"shop.big": 5000, "shop.small": 10}
+	tableRows := func(ctx context.Context, t Table) (int64, error) {
+		if t.Schema == "" {
+			t.Schema = "shop"
+		}
+		n, ok := rows[t.String()]
+		if !ok {
+			return 0, errors.New("no such table")
+		}
+		return n, nil
+	}
+	tests := []struct {
+		query  string
+		check  string
+		action string
+		err    bool
+	}{
+		{"SELECT * FROM big", "", "", false},
+		{"UPDATE big SET a = 1", CheckUnboundedWrite, ActionReject, false},
+		{"UPDATE big SET a = 1 WHERE id = 1", "", "", false},
+		{"UPDATE big SET a = 1 LIMIT 10", "", "", false},
+		{"DELETE FROM big", CheckUnboundedWrite, ActionReject, false},
+		{"DELETE FROM big WHERE id > 3", "", "", false},
+		{"DROP TABLE big", CheckDrop, ActionOptIn, false},
+		{"DROP VIEW v", CheckDrop, ActionOptIn, false},
+		{"DROP DATABASE shop", CheckDrop, ActionOptIn, false},
+		{"TRUNCATE TABLE big", CheckTruncate, ActionLog, false},
+		{"ALTER TABLE big ADD COLUMN c INT", CheckAlterLarge, ActionReject, false},
+		{"ALTER TABLE shop.big ADD COLUMN c INT", CheckAlterLarge, ActionReject, false},
+		{"ALTER TABLE small ADD COLUMN c INT", "", "", false},
+		{"ALTER TABLE missing ADD COLUMN c INT", "", "", true},
+	}
+	for _, test := range tests {
+		stmt, err := parser.New().ParseOneStmt(test.query, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := g.Check(context.Background(), &Request{User: "app", Database: "shop", Stmt: stmt, TableRows: tableRows})
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.query, err)
+			continue
+		}
+		var check, action string
+		if v != nil {
+			check, action = v.Check, v.Action
+		}
+		if check != test.check || action != test.action {
+			t.Errorf("%s: got %s %s, want %s %s", test.query, check, action, test.check, test.action)
+		}
+	}
+}
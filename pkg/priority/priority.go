@@ -0,0 +1,82 @@
+// Package priority chooses the priority the queries of a connection wait
+// with for a backend connection, by user, by listener or by hint.
+package priority
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/u2takey/mysqlgate/pkg/sql"
+)
+
+// hint sets the priority of a query, like /*+ priority(reporting) */.
+var hint = regexp.MustCompile(`(?i)/\*\+[^*]*?\bpriority\s*\(\s*(\w+)\s*\)`)
+
+type Config struct {
+	// Users are the priorities of users: interactive, batch or reporting.
+	Users map[string]string `json:"users,omitempty"`
+	// Listeners are addresses the proxy listens on besides the main one,
+	// with the priority of the connections they accept.
+	Listeners []Listener `json:"listeners,omitempty"`
+}
+
+type Listener struct {
+	Addr     string `json:"addr"`
+	Priority string `json:"priority"`
+
+	priority sql.Priority
+}
+
+type Priorities struct {
+	users     map[string]sql.Priority
+	listeners []Listener
+}
+
+func New(cfg Config) (*Priorities, error) {
+	p := &Priorities{users: map[string]sql.Priority{}}
+	for user, s := range cfg.Users {
+		prio, err := sql.ParsePriority(s)
+		if err != nil {
+			return nil, fmt.Errorf("priority: user %s: %v", user, err)
+		}
+		p.users[user] = prio
+	}
+	for _, l := range cfg.Listeners {
+		var err error
+		if l.priority, err = sql.ParsePriority(l.Priority); err != nil {
+			return nil, fmt.Errorf("priority: listener %s: %v", l.Addr, err)
+		}
+		p.listeners = append(p.listeners, l)
+	}
+	return p, nil
+}
+
+// Listeners returns the addresses to listen on besides the main one, with
+// their priorities.
+func (p *Priorities) Listeners() map[string]sql.Priority {
+	listeners := map[string]sql.Priority{}
+	for _, l := range p.listeners {
+		listeners[l.Addr] = l.priority
+	}
+	return listeners
+}
+
+// Connection returns the priority of a connection of user accepted by a
+// listener of priority listener, the one of the user when it has one.
+func (p *Priorities) Connection(user string, listener sql.Priority) sql.Priority {
+	if prio, ok := p.users[user]; ok {
+		return prio
+	}
+	return listener
+}
+
+// Hint returns the priority hinted by query, ok is false without a valid
+// hint.
+func Hint(query string) (prio sql.Priority, ok bool) {
+	m := hint.FindStringSubmatch(query)
+	if m == nil {
+		return 0, false
+	}
+	prio, err := sql.ParsePriority(m[1])
+	return prio, err == nil
+}
@@ -0,0 +1,125 @@
+package qcache
+
+import (
+	"context"
+	"sync"
+)
+
+type CoalesceConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxResultSize bounds the bytes of a shared result, the waiters of a
+	// larger one run the query themselves.
+	MaxResultSize int64 `json:"max_result_size,omitempty"`
+}
+
+// CoalesceStats are the counters of a group.
+type CoalesceStats struct {
+	Leaders int64 `json:"leaders"`
+	Shared  int64 `json:"shared"`
+	// Fallbacks count the waiters that ran the query themselves because
+	// the leader failed or its result was too large.
+	Fallbacks int64 `json:"fallbacks"`
+}
+
+// Group coalesces identical queries in flight: the first runs and the ones
+// arriving meanwhile wait for its result.
+type Group struct {
+	maxSize int64
+
+	mu      sync.Mutex // protects following fields
+	flights map[string]*Flight
+	stats   CoalesceStats
+	// seq numbers the flights in the order they start.
+	seq uint64
+}
+
+// Flight is a query in flight.
+type Flight struct {
+	key  string
+	seq  uint64
+	done chan struct{}
+	// packets are the result, nil when the query failed.
+	packets [][]byte
+}
+
+func NewGroup(cfg CoalesceConfig) *Group {
+	g := &Group{maxSize: cfg.MaxResultSize, flights: map[string]*Flight{}}
+	if g.maxSize <= 0 {
+		g.maxSize = DefaultMaxEntrySize
+	}
+	return g
+}
+
+// MaxResultSize is the size past which a result is not shared.
+func (g *Group) MaxResultSize() int64 {
+	return g.maxSize
+}
+
+// Seq returns the number of the last flight started, the flights started
+// after it read what was written before.
+func (g *Group) Seq() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.seq
+}
+
+// Join returns the flight of key. The caller leads it when leader is true,
+// then it runs the query and must Finish the flight, else it waits for it.
+// A flight started up to after may miss a write of the caller, f is nil
+// then and the caller runs the query alone.
+func (g *Group) Join(key string, after uint64) (f *Flight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		if f.seq <= after {
+			return nil, false
+		}
+		return f, false
+	}
+	g.seq++
+	f = &Flight{key: key, seq: g.seq, done: make(chan struct{})}
+	g.flights[key] = f
+	g.stats.Leaders++
+	return f, true
+}
+
+// Finish hands the result of f to its waiters, nil when the query failed
+// or its result is too large to share.
+func (g *Group) Finish(f *Flight, packets [][]byte) {
+	var size int64
+	for _, p := range packets {
+		size += int64(len(p))
+	}
+	if size > g.maxSize {
+		packets = nil
+	}
+	g.mu.Lock()
+	delete(g.flights, f.key)
+	g.mu.Unlock()
+	f.packets = packets
+	close(f.done)
+}
+
+// Wait returns the result of f, nil when the caller has to run the query
+// itself.
+func (g *Group) Wait(ctx context.Context, f *Flight) ([][]byte, error) {
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f.packets == nil {
+		g.stats.Fallbacks++
+	} else {
+		g.stats.Shared++
+	}
+	return f.packets, nil
+}
+
+func (g *Group) Stats() CoalesceStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stats
+}
@@ -0,0 +1,36 @@
+package qcache
+
+import (
+	"context"
+	"testing"
+)
+
+func TestJoinAfterWrite(t *testing.T) {
+	g := NewGroup(CoalesceConfig{Enabled: true})
+	first, leader := g.Join("orders", 0)
+	if !leader {
+		t.Fatal("first query does not lead")
+	}
+	// the write of a session ends while the first flight runs
+	wroteAt := g.Seq()
+	if f, leader := g.Join("orders", wroteAt); f != nil || leader {
+		t.Fatal("session joined a flight started before its write")
+	}
+	if f, leader := g.Join("orders", 0); f != first || leader {
+		t.Fatal("session without write did not join the flight")
+	}
+	g.Finish(first, [][]byte{[]byte("rows")})
+
+	second, leader := g.Join("orders", wroteAt)
+	if !leader {
+		t.Fatal("query after the flight does not lead")
+	}
+	if f, _ := g.Join("orders", wroteAt); f != second {
+		t.Fatal("session did not join a flight started after its write")
+	}
+	g.Finish(second, [][]byte{[]byte("rows")})
+	packets, err := g.Wait(context.Background(), second)
+	if err != nil || len(packets) != 1 {
+		t.Fatalf("got %q, %v", packets, err)
+	}
+}
@@ -0,0 +1,315 @@
+// Package qcache caches the encoded results of selects. Entries are dropped
+// when the proxy sees a write to one of the tables they read, or when their
+// ttl expires.
+package qcache
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxSize      = 64 << 20
+	DefaultMaxEntrySize = 1 << 20
+	DefaultTTL          = time.Minute
+)
+
+type Config struct {
+	Enabled bool `json:"enabled"`
+	// MaxSize bounds the bytes of all entries, the least recently used are
+	// evicted past it. MaxEntrySize bounds the result of a query.
+	MaxSize      int64 `json:"max_size,omitempty"`
+	MaxEntrySize int64 `json:"max_entry_size,omitempty"`
+	// TTL is the ttl of the selects hinted with cache without a ttl, like
+	// "60s".
+	TTL string `json:"ttl,omitempty"`
+	// TTLOnly keeps entries until their ttl expires, writes do not drop
+	// them. Results may then be stale for up to the ttl.
+	TTLOnly bool   `json:"ttl_only,omitempty"`
+	Rules   []Rule `json:"rules,omitempty"`
+}
+
+// Rule chooses the selects cached without a hint. A select matches when it
+// reads from the tables of the rule only and its normalized text matches
+// Match, either being optional.
+type Rule struct {
+	// Tables are like "orders" or "shop.orders", a table without schema
+	// matches the table in any schema.
+	Tables []string `json:"tables,omitempty"`
+	Match  string   `json:"match,omitempty"`
+	TTL    string   `json:"ttl"`
+
+	match *regexp.Regexp
+	ttl   time.Duration
+}
+
+func (r *Rule) matches(normalized string, tables []string) bool {
+	if r.match != nil && !r.match.MatchString(normalized) {
+		return false
+	}
+	if len(r.Tables) > 0 && len(tables) == 0 {
+		return false
+	}
+	for _, t := range tables {
+		if len(r.Tables) > 0 && !containsTable(r.Tables, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsTable tells whether table, qualified, is one of names.
+func containsTable(names []string, table string) bool {
+	name := table[strings.IndexByte(table, '.')+1:]
+	for _, n := range names {
+		if n == table || n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats are the counters of a cache.
+type Stats struct {
+	Entries       int   `json:"entries"`
+	Size          int64 `json:"size"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Stores        int64 `json:"stores"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+type entry struct {
+	key     string
+	packets [][]byte
+	size    int64
+	expires time.Time
+	// tables are the tables the result was read from, versions their
+	// versions when the select started.
+	tables   []string
+	versions []uint64
+}
+
+// Cache is a size bounded lru of results.
+type Cache struct {
+	maxSize      int64
+	maxEntrySize int64
+	ttl          time.Duration
+	ttlOnly      bool
+	rules        []Rule
+
+	mu      sync.Mutex // protects following fields
+	entries map[string]*list.Element
+	lru     *list.List
+	// versions count the writes to each table, an entry read at older
+	// versions is stale. all counts the writes to unknown tables.
+	versions map[string]uint64
+	all      uint64
+	stats    Stats
+}
+
+func New(cfg Config) (*Cache, error) {
+	c := &Cache{
+		maxSize:      cfg.MaxSize,
+		maxEntrySize: cfg.MaxEntrySize,
+		ttl:          DefaultTTL,
+		ttlOnly:      cfg.TTLOnly,
+		entries:      map[string]*list.Element{},
+		lru:          list.New(),
+		versions:     map[string]uint64{},
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = DefaultMaxSize
+	}
+	if c.maxEntrySize <= 0 || c.maxEntrySize > c.maxSize {
+		c.maxEntrySize = DefaultMaxEntrySize
+	}
+	if cfg.TTL != "" {
+		ttl, err := ParseTTL(cfg.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("cache: %v", err)
+		}
+		c.ttl = ttl
+	}
+	for i, r := range cfg.Rules {
+		if len(r.Tables) == 0 && r.Match == "" {
+			return nil, fmt.Errorf("cache: rule %d matches every select", i)
+		}
+		var err error
+		if r.Match != "" {
+			if r.match, err = regexp.Compile(r.Match); err != nil {
+				return nil, fmt.Errorf("cache: rule %d: %v", i, err)
+			}
+		}
+		if r.ttl, err = ParseTTL(r.TTL); err != nil {
+			return nil, fmt.Errorf("cache: rule %d: %v", i, err)
+		}
+		for j, t := range r.Tables {
+			r.Tables[j] = strings.ToLower(t)
+		}
+		c.rules = append(c.rules, r)
+	}
+	return c, nil
+}
+
+// ParseTTL parses a ttl like "30s" or "30", in seconds.
+func ParseTTL(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 {
+			return 0, fmt.Errorf("bad ttl %q", s)
+		}
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad ttl %q", s)
+	}
+	return d, nil
+}
+
+// TTL is the ttl of hinted selects without a ttl of their own.
+func (c *Cache) TTL() time.Duration {
+	return c.ttl
+}
+
+// MaxEntrySize is the size past which a result is not cached.
+func (c *Cache) MaxEntrySize() int64 {
+	return c.maxEntrySize
+}
+
+// Match returns the ttl of the first rule matching a select, ok is false
+// when none does. tables are the qualified tables the select reads.
+func (c *Cache) Match(normalized string, tables []string) (ttl time.Duration, ok bool) {
+	for i := range c.rules {
+		if c.rules[i].matches(normalized, tables) {
+			return c.rules[i].ttl, true
+		}
+	}
+	return 0, false
+}
+
+// Versions returns the versions of tables, taken before a select runs and
+// given to Put with its result.
+func (c *Cache) Versions(tables []string) []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.versionsLocked(tables)
+}
+
+func (c *Cache) versionsLocked(tables []string) []uint64 {
+	versions := make([]uint64, len(tables)+1)
+	for i, t := range tables {
+		versions[i] = c.versions[t]
+	}
+	versions[len(tables)] = c.all
+	return versions
+}
+
+func (c *Cache) fresh(e *entry) bool {
+	if time.Now().After(e.expires) {
+		return false
+	}
+	if c.ttlOnly {
+		return true
+	}
+	for i, v := range c.versionsLocked(e.tables) {
+		if v != e.versions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the packets of the result cached under key.
+func (c *Cache) Get(key string) ([][]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !c.fresh(e) {
+		c.remove(el)
+		c.stats.Misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	return e.packets, true
+}
+
+// Put caches the packets of a result read from tables at versions. A
+// result some write raced with is dropped.
+func (c *Cache) Put(key string, tables []string, versions []uint64, ttl time.Duration, packets [][]byte) {
+	e := &entry{key: key, packets: packets, expires: time.Now().Add(ttl), tables: tables, versions: versions}
+	for _, p := range packets {
+		e.size += int64(len(p))
+	}
+	if e.size > c.maxEntrySize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.fresh(e) {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.stats.Size += e.size
+	c.stats.Stores++
+	for c.stats.Size > c.maxSize {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.key)
+	c.stats.Size -= e.size
+}
+
+// Invalidate drops the results read from tables, or every result when
+// tables is empty because the written tables are unknown.
+func (c *Cache) Invalidate(tables []string) {
+	if c.ttlOnly {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(tables) == 0 {
+		c.all++
+	}
+	for _, t := range tables {
+		c.versions[t]++
+	}
+	c.stats.Invalidations++
+}
+
+// Flush drops every result.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.stats.Size = 0
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	return s
+}
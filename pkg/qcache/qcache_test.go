@@ -0,0 +1,109 @@
+package qcache
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, cfg Config) *Cache {
+	t.Helper()
+	cfg.Enabled = true
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func put(c *Cache, key string, tables ...string) {
+	c.Put(key, tables, c.Versions(tables), time.Minute, [][]byte{[]byte(key)})
+}
+
+func TestInvalidate(t *testing.T) {
+	c := newTestCache(t, Config{})
+	put(c, "orders", "shop.orders")
+	put(c, "users", "shop.users")
+	put(c, "join", "shop.orders", "shop.users")
+
+	c.Invalidate([]string{"shop.orders"})
+	for key, want := range map[string]bool{"orders": false, "users": true, "join": false} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("after writing orders, %s cached %v, want %v", key, ok, want)
+		}
+	}
+
+	// a write to unknown tables drops everything
+	put(c, "orders", "shop.orders")
+	c.Invalidate(nil)
+	for _, key := range []string{"orders", "users"} {
+		if _, ok := c.Get(key); ok {
+			t.Errorf("%s cached after a write to unknown tables", key)
+		}
+	}
+}
+
+func TestPutRacingWrite(t *testing.T) {
+	c := newTestCache(t, Config{})
+	tables := []string{"shop.orders"}
+	versions := c.Versions(tables)
+	// the write lands while the select runs
+	c.Invalidate(tables)
+	c.Put("orders", tables, versions, time.Minute, [][]byte{[]byte("stale")})
+	if _, ok := c.Get("orders"); ok {
+		t.Fatal("result read before a write was cached")
+	}
+}
+
+func TestTTLOnly(t *testing.T) {
+	c := newTestCache(t, Config{TTLOnly: true})
+	put(c, "orders", "shop.orders")
+	c.Invalidate([]string{"shop.orders"})
+	if _, ok := c.Get("orders"); !ok {
+		t.Fatal("ttl only entry dropped by a write")
+	}
+	c.Put("expired", nil, c.Versions(nil), -time.Second, [][]byte{[]byte("x")})
+	if _, ok := c.Get("expired"); ok {
+		t.Fatal("expired entry returned")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := newTestCache(t, Config{MaxSize: 10, MaxEntrySize: 4})
+	for _, key := range []string{"aaaa", "bbbb", "cccc"} {
+		put(c, key)
+	}
+	if _, ok := c.Get("aaaa"); ok {
+		t.Fatal("least recently used entry kept past the size")
+	}
+	put(c, "toolong")
+	if _, ok := c.Get("toolong"); ok {
+		t.Fatal("entry larger than max entry size cached")
+	}
+	if s := c.Stats(); s.Entries != 2 || s.Size != 8 || s.Evictions != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	c := newTestCache(t, Config{Rules: []Rule{
+		{Tables: []string{"Orders"}, TTL: "10"},
+		{Match: "^select \\* from config", TTL: "1m"},
+	}})
+	tests := []struct {
+		normalized string
+		tables     []string
+		ttl        time.Duration
+		ok         bool
+	}{
+		{"select * from orders", []string{"shop.orders"}, 10 * time.Second, true},
+		{"select * from orders join users", []string{"shop.orders", "shop.users"}, 0, false},
+		{"select * from config", []string{"shop.config"}, time.Minute, true},
+		{"select 1", nil, 0, false},
+	}
+	for _, tt := range tests {
+		ttl, ok := c.Match(tt.normalized, tt.tables)
+		if ttl != tt.ttl || ok != tt.ok {
+			t.Errorf("Match(%q) = %v %v, want %v %v", tt.normalized, ttl, ok, tt.ttl, tt.ok)
+		}
+	}
+}
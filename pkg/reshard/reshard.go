@@ -0,0 +1,216 @@
+package reshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/log"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+)
+
+var mLog = log.ModuleLogger("reshard")
+
+const (
+	DefaultServerID      = 2834
+	DefaultBatchSize     = 500
+	DefaultFreezeTimeout = 5 * time.Second
+)
+
+const (
+	StateCopying    = "copying"
+	StateCatchingUp = "catching_up"
+	StateCutover    = "cutover"
+	StateCleanup    = "cleanup"
+	StateDone       = "done"
+	StateFailed     = "failed"
+)
+
+type Config struct {
+	// ServerID is the replica id the binlogs of the shards are read with,
+	// it must differ from the server ids of the backends and their
+	// replicas.
+	ServerID uint32 `json:"server_id,omitempty"`
+	// BatchSize is the number of rows copied per statement.
+	BatchSize int `json:"batch_size,omitempty"`
+	// FreezeTimeout bounds the write freeze of a cutover, like "5s". A
+	// cutover not done in time thaws the writes and is tried again.
+	FreezeTimeout string `json:"freeze_timeout,omitempty"`
+	// ShardMap is the file the shards of split tables are saved to, they
+	// replace the shards of the sharding configuration at start. Splits
+	// are refused without it.
+	ShardMap string `json:"shard_map,omitempty"`
+}
+
+// Split moves the keys from At up of a range shard to a new shard.
+type Split struct {
+	Table string `json:"table"`
+	Shard string `json:"shard"`
+	At    int64  `json:"at"`
+	// To is the new shard, in a cluster without a shard of the table.
+	To sharding.ShardConfig `json:"to"`
+}
+
+// Job is the progress of a split.
+type Job struct {
+	ID     int64  `json:"id"`
+	Split  Split  `json:"split"`
+	State  string `json:"state"`
+	Copied int64  `json:"copied"`
+	// Applied is the number of binlog row changes applied to the new
+	// shard, Position the binlog position of the source they reach.
+	Applied  int64     `json:"applied"`
+	Position string    `json:"position,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	// Shards are the shards of the table once split, as saved to the
+	// shard map.
+	Shards []sharding.ShardConfig `json:"shards,omitempty"`
+}
+
+// Manager runs the splits, one at a time per table.
+type Manager struct {
+	router        *sharding.Router
+	clusters      *cluster.Registry
+	serverID      uint32
+	batchSize     int
+	freezeTimeout time.Duration
+	shardMapPath  string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex // protects following fields
+	next    int64
+	jobs    []*Job
+	running map[string]bool
+	// shards is the content of the shard map.
+	shards shardMap
+}
+
+func NewManager(cfg Config, router *sharding.Router, clusters *cluster.Registry) (*Manager, error) {
+	m := &Manager{
+		router:        router,
+		clusters:      clusters,
+		serverID:      cfg.ServerID,
+		batchSize:     cfg.BatchSize,
+		freezeTimeout: DefaultFreezeTimeout,
+		shardMapPath:  cfg.ShardMap,
+		running:       map[string]bool{},
+	}
+	if m.serverID == 0 {
+		m.serverID = DefaultServerID
+	}
+	if m.batchSize <= 0 {
+		m.batchSize = DefaultBatchSize
+	}
+	if cfg.FreezeTimeout != "" {
+		d, err := time.ParseDuration(cfg.FreezeTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("reshard: freeze timeout: %v", err)
+		}
+		m.freezeTimeout = d
+	}
+	if m.shardMapPath != "" {
+		var err error
+		if m.shards, err = loadShardMap(m.shardMapPath); err != nil {
+			return nil, err
+		}
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m, nil
+}
+
+// Start checks split and runs it in the background.
+func (m *Manager) Start(split Split) (*Job, error) {
+	if m.shardMapPath == "" {
+		return nil, errors.New("splits need the reshard shard map to survive a restart")
+	}
+	t, ok := m.router.Table(split.Table)
+	if !ok {
+		return nil, fmt.Errorf("table %s is not sharded", split.Table)
+	}
+	if err := t.CheckSplit(split.Shard, split.At, split.To); err != nil {
+		return nil, err
+	}
+	if _, ok := m.clusters.Get(split.To.Cluster); !ok {
+		return nil, fmt.Errorf("unknown cluster %s", split.To.Cluster)
+	}
+
+	key := strings.ToLower(t.Name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running[key] {
+		return nil, fmt.Errorf("table %s is being resharded", t.Name)
+	}
+	m.running[key] = true
+	m.next++
+	job := &Job{ID: m.next, Split: split, State: StateCopying, Started: time.Now()}
+	m.jobs = append(m.jobs, job)
+	go func() {
+		err := m.run(m.ctx, job)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.running, key)
+		job.Finished = time.Now()
+		if err != nil {
+			job.State, job.Error = StateFailed, err.Error()
+			mLog.Error("msg", "split failed", "job", job.ID, "table", split.Table, "err", err)
+			return
+		}
+		job.State = StateDone
+	}()
+	return job.copy(), nil
+}
+
+// Jobs returns a copy of the jobs, the latest first.
+func (m *Manager) Jobs() []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for i := len(m.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, m.jobs[i].copy())
+	}
+	return jobs
+}
+
+// update changes job under the lock of m.
+func (m *Manager) update(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f()
+}
+
+func (j *Job) copy() *Job {
+	c := *j
+	c.Shards = append([]sharding.ShardConfig(nil), j.Shards...)
+	return &c
+}
+
+// saveShards saves the shards of table to the shard map.
+func (m *Manager) saveShards(table string, shards []sharding.ShardConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved := shardMap{}
+	for name, s := range m.shards {
+		saved[name] = s
+	}
+	saved[strings.ToLower(table)] = shards
+	if err := saved.save(m.shardMapPath); err != nil {
+		return fmt.Errorf("saving shard map: %v", err)
+	}
+	m.shards = saved
+	return nil
+}
+
+// Close stops the running splits, a split stopped before its cutover
+// leaves the routing as it was.
+func (m *Manager) Close() error {
+	m.cancel()
+	return nil
+}
@@ -0,0 +1,182 @@
+package reshard
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/sqlparser/format"
+)
+
+// tableSchema is what a split needs to know of the columns of a table.
+type tableSchema struct {
+	name     string
+	columns  []string
+	unsigned []bool
+	// key is the index of the shard key column, primary the ones of the
+	// primary key.
+	key     int
+	primary []int
+}
+
+// loadSchema reads the columns of table in the default database of db.
+func loadSchema(ctx context.Context, db *sql.DB, table, key string) (*tableSchema, error) {
+	ts := &tableSchema{name: table, key: -1}
+	rows, err := db.QueryContext(ctx, "SELECT COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(name, key) {
+			ts.key = len(ts.columns)
+		}
+		ts.columns = append(ts.columns, name)
+		ts.unsigned = append(ts.unsigned, strings.Contains(strings.ToLower(typ), "unsigned"))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ts.columns) == 0 {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+	if ts.key < 0 {
+		return nil, fmt.Errorf("table %s has no column %s", table, key)
+	}
+
+	rows, err = db.QueryContext(ctx, "SELECT COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE "+
+		"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY' "+
+		"ORDER BY ORDINAL_POSITION", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		for i, c := range ts.columns {
+			if strings.EqualFold(c, name) {
+				ts.primary = append(ts.primary, i)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ts.primary) == 0 {
+		// binlog changes are applied by primary key
+		return nil, fmt.Errorf("table %s has no primary key", table)
+	}
+	return ts, nil
+}
+
+// keyRange writes the predicate selecting the keys from min up to max,
+// max excluded and unbounded when nil, and returns its arguments.
+func (ts *tableSchema) keyRange(ctx *format.RestoreCtx, min int64, max *int64) []interface{} {
+	ctx.WriteName(ts.columns[ts.key])
+	ctx.WritePlain(" >= ?")
+	if max == nil {
+		return []interface{}{min}
+	}
+	ctx.WriteKeyWord(" AND ")
+	ctx.WriteName(ts.columns[ts.key])
+	ctx.WritePlain(" < ?")
+	return []interface{}{min, *max}
+}
+
+// selectQuery returns the query reading the rows with keys from min up to
+// max.
+func (ts *tableSchema) selectQuery(min int64, max *int64) (string, []interface{}) {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	ctx.WriteKeyWord("SELECT ")
+	for i, c := range ts.columns {
+		if i > 0 {
+			ctx.WritePlain(",")
+		}
+		ctx.WriteName(c)
+	}
+	ctx.WriteKeyWord(" FROM ")
+	ctx.WriteName(ts.name)
+	ctx.WriteKeyWord(" WHERE ")
+	args := ts.keyRange(ctx, min, max)
+	return sb.String(), args
+}
+
+// deleteRangeQuery returns the query deleting up to limit rows with keys
+// from min up to max.
+func (ts *tableSchema) deleteRangeQuery(min int64, max *int64, limit int) (string, []interface{}) {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	ctx.WriteKeyWord("DELETE FROM ")
+	ctx.WriteName(ts.name)
+	ctx.WriteKeyWord(" WHERE ")
+	args := ts.keyRange(ctx, min, max)
+	ctx.WriteKeyWord(" LIMIT ")
+	ctx.WritePlain(strconv.Itoa(limit))
+	return sb.String(), args
+}
+
+// replaceQuery returns the query writing n rows.
+func (ts *tableSchema) replaceQuery(n int) string {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	ctx.WriteKeyWord("REPLACE INTO ")
+	ctx.WriteName(ts.name)
+	ctx.WritePlain("(")
+	for i, c := range ts.columns {
+		if i > 0 {
+			ctx.WritePlain(",")
+		}
+		ctx.WriteName(c)
+	}
+	ctx.WritePlain(")")
+	ctx.WriteKeyWord(" VALUES ")
+	row := "(" + strings.Repeat("?,", len(ts.columns)-1) + "?)"
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			ctx.WritePlain(",")
+		}
+		ctx.WritePlain(row)
+	}
+	return sb.String()
+}
+
+// deleteQuery returns the query deleting a row by primary key, with the
+// arguments taken from row.
+func (ts *tableSchema) deleteQuery(row []interface{}) (string, []interface{}) {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	ctx.WriteKeyWord("DELETE FROM ")
+	ctx.WriteName(ts.name)
+	ctx.WriteKeyWord(" WHERE ")
+	args := make([]interface{}, len(ts.primary))
+	for i, c := range ts.primary {
+		if i > 0 {
+			ctx.WriteKeyWord(" AND ")
+		}
+		ctx.WriteName(ts.columns[c])
+		ctx.WritePlain(" = ?")
+		args[i] = row[c]
+	}
+	return sb.String(), args
+}
+
+// samePrimary tells whether rows a and b have the same primary key.
+func (ts *tableSchema) samePrimary(a, b []interface{}) bool {
+	for _, c := range ts.primary {
+		if fmt.Sprint(a[c]) != fmt.Sprint(b[c]) {
+			return false
+		}
+	}
+	return true
+}
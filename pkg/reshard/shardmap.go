@@ -0,0 +1,58 @@
+package reshard
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/u2takey/mysqlgate/pkg/atomicfile"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+)
+
+// shardMap holds the shards of the tables split so far, by lower cased
+// table name. It is saved before the routing of a split switches, so a
+// restart routes the table like before it and the moved rows the cleanup
+// deletes from the source are never looked for there again.
+type shardMap map[string][]sharding.ShardConfig
+
+func loadShardMap(path string) (shardMap, error) {
+	m := shardMap{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("reshard: shard map %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// save durably replaces the shard map at path.
+func (m shardMap) save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0o600)
+}
+
+// ApplyShardMap replaces the shards of the tables of sc that splits changed
+// by those saved in the shard map of cfg.
+func ApplyShardMap(cfg Config, sc *sharding.Config) error {
+	if cfg.ShardMap == "" {
+		return nil
+	}
+	m, err := loadShardMap(cfg.ShardMap)
+	if err != nil {
+		return err
+	}
+	for i, t := range sc.Tables {
+		if shards, ok := m[strings.ToLower(t.Name)]; ok {
+			sc.Tables[i].Shards = shards
+		}
+	}
+	return nil
+}
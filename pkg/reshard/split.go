@@ -0,0 +1,463 @@
+package reshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/mysqlgate/pkg/sql/mysql"
+)
+
+// cutoverAttempts is the number of times a cutover is tried before the
+// split gives up.
+const cutoverAttempts = 5
+
+// splitRun is a split in progress. Rows with keys in [at, max) are copied
+// from the source shard to the new one, then the changes the source binlog
+// recorded since the copy started are applied until the new shard is close
+// behind. The cutover freezes the writes on the table, applies the last
+// changes, switches the routing and lets the writes go to the new shard.
+// The moved rows are deleted from the source last, until then reads
+// scattered over all shards may see them twice.
+type splitRun struct {
+	m   *Manager
+	ctx context.Context
+	job *Job
+	// table is the table as routed before the split.
+	table    *sharding.Table
+	src, dst *cluster.Backend
+	at       int64
+	max      *int64
+	schema   *tableSchema
+	// db is the database of the table on the source, binlog events of
+	// other databases are skipped.
+	db      string
+	dstConn *sql.Conn
+
+	stream *mysql.BinlogStreamer
+	events chan *mysql.BinlogEvent
+	errc   chan error
+	done   chan struct{}
+	// pos is the source position the new shard has caught up with.
+	pos mysql.BinlogPosition
+}
+
+func (m *Manager) run(ctx context.Context, job *Job) error {
+	s := &splitRun{m: m, ctx: ctx, job: job, at: job.Split.At, done: make(chan struct{})}
+	defer s.close()
+	if err := s.prepare(); err != nil {
+		return err
+	}
+	start, err := s.src.BinlogStatus(ctx)
+	if err != nil {
+		return err
+	}
+	mLog.Log("msg", "copying rows", "job", job.ID, "table", s.table.Name, "from", s.src.Name, "to", s.dst.Name, "position", start)
+	if err := s.copyRows(); err != nil {
+		return err
+	}
+
+	m.update(func() { job.State = StateCatchingUp })
+	if err := s.tail(start); err != nil {
+		return err
+	}
+	if err := s.catchUp(); err != nil {
+		return err
+	}
+	done := false
+	for attempt := 1; !done; attempt++ {
+		if attempt > cutoverAttempts {
+			return fmt.Errorf("cutover not done within %s in %d attempts", m.freezeTimeout, cutoverAttempts)
+		}
+		m.update(func() { job.State = StateCutover })
+		if done, err = s.cutover(); err != nil {
+			return err
+		}
+		if !done {
+			mLog.Log("msg", "cutover timed out, catching up", "job", job.ID, "attempt", attempt)
+			m.update(func() { job.State = StateCatchingUp })
+			if err := s.catchUp(); err != nil {
+				return err
+			}
+		}
+	}
+
+	m.update(func() { job.State = StateCleanup })
+	mLog.Log("msg", "split done, removing moved rows", "job", job.ID, "table", s.table.Name, "shard", job.Split.Shard)
+	if err := s.cleanup(); err != nil {
+		return err
+	}
+	return s.unstale()
+}
+
+// prepare checks the source and creates the table on the new shard.
+func (s *splitRun) prepare() error {
+	split := s.job.Split
+	t, ok := s.m.router.Table(split.Table)
+	if !ok {
+		return fmt.Errorf("table %s is not sharded", split.Table)
+	}
+	if err := t.CheckSplit(split.Shard, split.At, split.To); err != nil {
+		return err
+	}
+	s.table = t
+	for _, shard := range t.Shards {
+		if shard.Name == split.Shard {
+			_, s.max = shard.Range()
+			b, err := primary(s.m.clusters, shard.Cluster)
+			if err != nil {
+				return err
+			}
+			s.src = b
+		}
+	}
+	b, err := primary(s.m.clusters, split.To.Cluster)
+	if err != nil {
+		return err
+	}
+	s.dst = b
+
+	var (
+		logBin        int
+		format, image string
+	)
+	if err := s.src.DB().QueryRowContext(s.ctx, "SELECT @@global.log_bin, @@global.binlog_format, @@global.binlog_row_image").
+		Scan(&logBin, &format, &image); err != nil {
+		return err
+	}
+	if logBin != 1 || !strings.EqualFold(format, "ROW") || !strings.EqualFold(image, "FULL") {
+		return fmt.Errorf("shard %s needs log_bin=ON, binlog_format=ROW and binlog_row_image=FULL", split.Shard)
+	}
+	if err := s.src.DB().QueryRowContext(s.ctx, "SELECT DATABASE()").Scan(&s.db); err != nil {
+		return err
+	}
+	if s.schema, err = loadSchema(s.ctx, s.src.DB(), t.Name, t.Column); err != nil {
+		return err
+	}
+	if err := s.createTable(); err != nil {
+		return err
+	}
+	if s.dstConn, err = s.dst.DB().Conn(s.ctx); err != nil {
+		return err
+	}
+	// binlog timestamps are in utc
+	_, err = s.dstConn.ExecContext(s.ctx, "SET time_zone = '+00:00'")
+	return err
+}
+
+func primary(clusters *cluster.Registry, name string) (*cluster.Backend, error) {
+	c, ok := clusters.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %s", name)
+	}
+	return c.Primary(), nil
+}
+
+// createTable creates the table on the new shard like on the source, a
+// table already there must be empty.
+func (s *splitRun) createTable() error {
+	quoted := "`" + strings.ReplaceAll(s.table.Name, "`", "``") + "`"
+	var name, ddl string
+	if err := s.src.DB().QueryRowContext(s.ctx, "SHOW CREATE TABLE "+quoted).Scan(&name, &ddl); err != nil {
+		return err
+	}
+	_, err := s.dst.DB().ExecContext(s.ctx, ddl)
+	var merr *mysql.MySQLError
+	if !errors.As(err, &merr) || merr.Number != 1050 {
+		return err
+	}
+	var one int
+	err = s.dst.DB().QueryRowContext(s.ctx, "SELECT 1 FROM "+quoted+" LIMIT 1").Scan(&one)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("table %s is not empty in cluster %s", s.table.Name, s.job.Split.To.Cluster)
+	}
+	return err
+}
+
+// copyRows copies the moved rows to the new shard.
+func (s *splitRun) copyRows() error {
+	conn, err := s.src.DB().Conn(s.ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(s.ctx, "SET time_zone = '+00:00'"); err != nil {
+		return err
+	}
+	query, args := s.schema.selectQuery(s.at, s.max)
+	rows, err := conn.QueryContext(s.ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns := len(s.schema.columns)
+	batchSize := s.m.batchSize
+	if max := math.MaxUint16 / columns; batchSize > max {
+		// placeholders of a statement are counted on 16 bits
+		batchSize = max
+	}
+	batch := make([]interface{}, 0, batchSize*columns)
+	flush := func() error {
+		n := len(batch) / columns
+		if n == 0 {
+			return nil
+		}
+		if _, err := s.dstConn.ExecContext(s.ctx, s.schema.replaceQuery(n), batch...); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		s.m.update(func() { s.job.Copied += int64(n) })
+		return nil
+	}
+	dest := make([]interface{}, columns)
+	for rows.Next() {
+		values := make([][]byte, columns)
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for _, v := range values {
+			if v == nil {
+				batch = append(batch, nil)
+			} else {
+				batch = append(batch, v)
+			}
+		}
+		if len(batch) == batchSize*columns {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// tail starts reading the source binlog from position from.
+func (s *splitRun) tail(from mysql.BinlogPosition) error {
+	stream, err := mysql.OpenBinlog(s.ctx, s.src.DSN, mysql.BinlogConfig{
+		ServerID: s.m.serverID,
+		File:     from.File,
+		Position: from.Position,
+	})
+	if err != nil {
+		return err
+	}
+	s.stream, s.pos = stream, mysql.BinlogPosition{File: from.File, Position: from.Position}
+	s.events = make(chan *mysql.BinlogEvent, 256)
+	s.errc = make(chan error, 1)
+	go func() {
+		for {
+			ev, err := stream.Next()
+			if err != nil {
+				s.errc <- err
+				return
+			}
+			select {
+			case s.events <- ev:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// catchUp applies the source changes until applying those made meanwhile
+// takes less than half the freeze timeout.
+func (s *splitRun) catchUp() error {
+	for {
+		until, err := s.src.BinlogStatus(s.ctx)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		if err := s.applyUntil(s.ctx, until); err != nil {
+			return err
+		}
+		if time.Since(start) < s.m.freezeTimeout/2 {
+			return nil
+		}
+	}
+}
+
+// applyUntil applies the source changes up to position until, waiting for
+// them until ctx is done.
+func (s *splitRun) applyUntil(ctx context.Context, until mysql.BinlogPosition) error {
+	for s.pos.Compare(until) < 0 {
+		select {
+		case ev := <-s.events:
+			if err := s.apply(ev); err != nil {
+				return err
+			}
+			s.pos = ev.Position
+			s.m.update(func() { s.job.Position = s.pos.String() })
+		case err := <-s.errc:
+			return fmt.Errorf("reading binlog of shard %s: %v", s.job.Split.Shard, err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// apply applies the row changes of ev that touch the moved rows.
+func (s *splitRun) apply(ev *mysql.BinlogEvent) error {
+	if ev.Rows == nil {
+		return nil
+	}
+	tm := ev.Rows.Table
+	if !strings.EqualFold(tm.Schema, s.db) || !strings.EqualFold(tm.Table, s.schema.name) {
+		return nil
+	}
+	if tm.Columns() != len(s.schema.columns) {
+		return fmt.Errorf("table %s changed during the split", s.schema.name)
+	}
+	applied := 0
+	for _, change := range ev.Rows.Rows {
+		before, after := s.row(tm, change.Before), s.row(tm, change.After)
+		beforeMoved, afterMoved := before != nil && s.moved(before), after != nil && s.moved(after)
+		if beforeMoved && (!afterMoved || !s.schema.samePrimary(before, after)) {
+			query, args := s.schema.deleteQuery(before)
+			if _, err := s.dstConn.ExecContext(s.ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		if afterMoved {
+			if _, err := s.dstConn.ExecContext(s.ctx, s.schema.replaceQuery(1), after...); err != nil {
+				return err
+			}
+		}
+		if beforeMoved || afterMoved {
+			applied++
+		}
+	}
+	s.m.update(func() { s.job.Applied += int64(applied) })
+	return nil
+}
+
+// row fixes the unsigned integers of a binlog row image.
+func (s *splitRun) row(tm *mysql.TableMap, values []interface{}) []interface{} {
+	for i, v := range values {
+		if n, ok := v.(int64); ok && s.schema.unsigned[i] {
+			values[i] = tm.Unsigned(i, n)
+		}
+	}
+	return values
+}
+
+// moved tells whether the key of a binlog row is in the moved range.
+func (s *splitRun) moved(row []interface{}) bool {
+	var key int64
+	switch v := row[s.schema.key].(type) {
+	case int64:
+		key = v
+	case uint64:
+		if v > math.MaxInt64 {
+			return s.max == nil
+		}
+		key = int64(v)
+	default:
+		return false
+	}
+	return key >= s.at && (s.max == nil || key < *s.max)
+}
+
+// cutover freezes the writes on the table, applies the last changes and
+// switches the routing. It returns false when the freeze timed out, the
+// writes go on to the source then.
+func (s *splitRun) cutover() (bool, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.m.freezeTimeout)
+	defer cancel()
+	name := s.table.Name
+	defer s.m.router.Thaw(name)
+	timedOut := func(err error) (bool, error) {
+		if ctx.Err() == context.DeadlineExceeded && s.ctx.Err() == nil {
+			return false, nil
+		}
+		return false, err
+	}
+
+	start := time.Now()
+	if err := s.m.router.Freeze(ctx, name); err != nil {
+		return timedOut(err)
+	}
+	until, err := s.src.BinlogStatus(ctx)
+	if err != nil {
+		return timedOut(err)
+	}
+	if err := s.applyUntil(ctx, until); err != nil {
+		return timedOut(err)
+	}
+	// the new shards are saved before they are routed to, once routed the
+	// writes to the moved rows go to the new shard only
+	split := s.job.Split
+	t, err := s.table.Split(split.Shard, split.At, split.To)
+	if err != nil {
+		return false, err
+	}
+	shards := t.ShardConfigs()
+	if err := s.m.saveShards(name, shards); err != nil {
+		return false, err
+	}
+	if _, err := s.m.router.SplitShard(name, split.Shard, split.At, split.To); err != nil {
+		return false, err
+	}
+	s.m.update(func() { s.job.Shards = shards })
+	mLog.Log("msg", "cutover done", "job", s.job.ID, "table", name, "frozen", time.Since(start), "position", s.pos)
+	return true, nil
+}
+
+// cleanup deletes the moved rows from the source shard.
+func (s *splitRun) cleanup() error {
+	query, args := s.schema.deleteRangeQuery(s.at, s.max, s.m.batchSize)
+	for {
+		res, err := s.src.DB().ExecContext(s.ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// unstale stops filtering the moved rows out of the queries to the source
+// shard once the cleanup deleted them.
+func (s *splitRun) unstale() error {
+	name := s.table.Name
+	t, err := s.m.router.CleanShard(name, s.job.Split.Shard)
+	if err != nil {
+		return err
+	}
+	shards := t.ShardConfigs()
+	if err := s.m.saveShards(name, shards); err != nil {
+		return err
+	}
+	s.m.update(func() { s.job.Shards = shards })
+	return nil
+}
+
+func (s *splitRun) close() {
+	close(s.done)
+	if s.stream != nil {
+		_ = s.stream.Close()
+	}
+	if s.dstConn != nil {
+		_ = s.dstConn.Close()
+	}
+}
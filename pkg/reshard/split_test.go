@@ -0,0 +1,232 @@
+package reshard
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+)
+
+func int64p(v int64) *int64 {
+	return &v
+}
+
+func TestShardMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shards.json")
+	m, err := loadShardMap(path)
+	if err != nil || len(m) != 0 {
+		t.Fatalf("missing map loaded %v %v", m, err)
+	}
+	shards := []sharding.ShardConfig{
+		{Name: "s0", Cluster: "c0", Max: int64p(100)},
+		{Name: "s1", Cluster: "c1", Min: int64p(100)},
+	}
+	m["orders"] = shards
+	if err := m.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := sharding.Config{Tables: []sharding.TableConfig{
+		{Name: "Orders", Column: "id", Algorithm: sharding.AlgorithmRange, Shards: []sharding.ShardConfig{{Name: "s0", Cluster: "c0"}}},
+		{Name: "users", Column: "id", Algorithm: sharding.AlgorithmHash, Shards: []sharding.ShardConfig{{Name: "u0", Cluster: "c0"}}},
+	}}
+	if err := ApplyShardMap(Config{ShardMap: path}, &sc); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sc.Tables[0].Shards, shards) {
+		t.Fatalf("orders shards %+v, want %+v", sc.Tables[0].Shards, shards)
+	}
+	if len(sc.Tables[1].Shards) != 1 {
+		t.Fatalf("users shards changed to %+v", sc.Tables[1].Shards)
+	}
+}
+
+func TestStartNeedsShardMap(t *testing.T) {
+	router, err := sharding.NewRouter(sharding.Config{Tables: []sharding.TableConfig{
+		{Name: "t", Column: "id", Algorithm: sharding.AlgorithmRange, Shards: []sharding.ShardConfig{{Name: "s0", Cluster: "c0"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(Config{}, router, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if _, err := m.Start(Split{Table: "t", Shard: "s0", At: 10, To: sharding.ShardConfig{Name: "s1", Cluster: "c1"}}); err == nil {
+		t.Fatal("split started without a shard map")
+	}
+}
+
+// standinDSN is the dsn of the local mysql stand-in on port, see make
+// standins.
+func standinDSN(port int) string {
+	return fmt.Sprintf("root:root@tcp(127.0.0.1:%d)/test", port)
+}
+
+// TestSplitStandins splits a table of the stand-in on 3307 to the one on
+// 3308 while writes go on, it is skipped when they are not running.
+func TestSplitStandins(t *testing.T) {
+	ctx := context.Background()
+	clusters, err := cluster.NewRegistry([]cluster.Config{
+		{Name: "c0", Primary: cluster.BackendConfig{DSN: standinDSN(3307)}},
+		{Name: "c1", Primary: cluster.BackendConfig{DSN: standinDSN(3308)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clusters.Close()
+	src, _ := clusters.Get("c0")
+	dst, _ := clusters.Get("c1")
+	for _, c := range []*cluster.Cluster{src, dst} {
+		pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := c.Primary().DB().PingContext(pingCtx)
+		cancel()
+		if err != nil {
+			t.Skipf("mysql stand-ins not running: %v", err)
+		}
+	}
+
+	exec := func(db *sql.DB, query string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec(dst.Primary().DB(), "DROP TABLE IF EXISTS split_test")
+	exec(src.Primary().DB(), "DROP TABLE IF EXISTS split_test")
+	exec(src.Primary().DB(), "CREATE TABLE split_test (id BIGINT PRIMARY KEY, v VARCHAR(20))")
+	const rows = 1000
+	for i := 0; i < rows; i++ {
+		exec(src.Primary().DB(), "INSERT INTO split_test VALUES (?, 'initial')", i)
+	}
+
+	router, err := sharding.NewRouter(sharding.Config{Tables: []sharding.TableConfig{{
+		Name: "split_test", Column: "id", Algorithm: sharding.AlgorithmRange,
+		Shards: []sharding.ShardConfig{{Name: "s0", Cluster: "c0"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardMap := filepath.Join(t.TempDir(), "shards.json")
+	m, err := NewManager(Config{ShardMap: shardMap, BatchSize: 100}, router, clusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// routed writes go on during the split, want is what each row should
+	// end up with
+	want := map[int64]string{}
+	for i := int64(0); i < rows; i++ {
+		want[i] = "initial"
+	}
+	write := func(id int64, query string, args ...interface{}) error {
+		done, err := router.EnterWrite(ctx, "split_test", new(int))
+		if err != nil {
+			return err
+		}
+		defer done()
+		table, _ := router.Table("split_test")
+		shard, err := table.Shard(fmt.Sprint(id))
+		if err != nil {
+			return err
+		}
+		c, _ := clusters.Get(shard.Cluster)
+		_, err = c.Primary().DB().ExecContext(ctx, query, args...)
+		return err
+	}
+	stop := make(chan struct{})
+	var (
+		wg       sync.WaitGroup
+		writeErr error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := int64(0); ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id, v := (i*7)%rows, fmt.Sprint("v", i)
+			if err := write(id, "UPDATE split_test SET v = ? WHERE id = ?", v, id); err != nil {
+				writeErr = err
+				return
+			}
+			want[id] = v
+			id = rows + i
+			if err := write(id, "INSERT INTO split_test VALUES (?, 'inserted')", id); err != nil {
+				writeErr = err
+				return
+			}
+			want[id] = "inserted"
+		}
+	}()
+
+	job, err := m.Start(Split{Table: "split_test", Shard: "s0", At: rows / 2, To: sharding.ShardConfig{Name: "s1", Cluster: "c1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Minute)
+	for {
+		job = m.Jobs()[0]
+		if job.State == StateDone || job.State == StateFailed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	if job.State != StateDone {
+		t.Fatalf("split ended %s: %s", job.State, job.Error)
+	}
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	saved, err := loadShardMap(shardMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, _ := router.Table("split_test")
+	if !reflect.DeepEqual(saved["split_test"], table.ShardConfigs()) {
+		t.Fatalf("saved shards %+v, routed %+v", saved["split_test"], table.ShardConfigs())
+	}
+
+	got := map[int64]string{}
+	for _, c := range []*cluster.Cluster{src, dst} {
+		r, err := c.Primary().DB().QueryContext(ctx, "SELECT id, v FROM split_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+			var (
+				id int64
+				v  string
+			)
+			if err := r.Scan(&id, &v); err != nil {
+				t.Fatal(err)
+			}
+			if shard, _ := table.Shard(fmt.Sprint(id)); shard.Cluster != c.Name {
+				t.Errorf("row %d left in cluster %s", id, c.Name)
+			}
+			got[id] = v
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %d rows, want %d, or values differ", len(got), len(want))
+	}
+}
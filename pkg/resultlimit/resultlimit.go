@@ -0,0 +1,105 @@
+// Package resultlimit bounds the results the proxy streams: selects
+// without limit get a default one, and results past a number of rows or
+// bytes are ended with an error or cut with a warning.
+package resultlimit
+
+import (
+	"fmt"
+
+	"github.com/u2takey/sqlparser/ast"
+)
+
+type Config struct {
+	// Policies are matched in order, the first for the user of a
+	// connection applies.
+	Policies []Policy `json:"policies"`
+}
+
+type Policy struct {
+	// Users are the users the policy applies to, all when empty.
+	Users []string `json:"users,omitempty"`
+	// DefaultLimit is the limit added to the selects without one, none
+	// when zero.
+	DefaultLimit uint64 `json:"default_limit,omitempty"`
+	// MaxRows and MaxBytes cap the rows and the bytes of the rows of a
+	// result, uncapped when zero.
+	MaxRows  int64 `json:"max_rows,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// Truncate cuts a result at a cap and ends it with a warning, else it
+	// is ended with an error.
+	Truncate bool `json:"truncate,omitempty"`
+}
+
+// Capped tells whether a result with rows rows of size bytes went past a
+// cap of p.
+func (p *Policy) Capped(rows, size int64) bool {
+	return (p.MaxRows > 0 && rows > p.MaxRows) || (p.MaxBytes > 0 && size > p.MaxBytes)
+}
+
+// Reason describes the caps of p for the client.
+func (p *Policy) Reason() string {
+	switch {
+	case p.MaxRows > 0 && p.MaxBytes > 0:
+		return fmt.Sprintf("Result exceeded the cap of %d rows or %d bytes", p.MaxRows, p.MaxBytes)
+	case p.MaxRows > 0:
+		return fmt.Sprintf("Result exceeded the cap of %d rows", p.MaxRows)
+	}
+	return fmt.Sprintf("Result exceeded the cap of %d bytes", p.MaxBytes)
+}
+
+type Limiter struct {
+	policies []Policy
+}
+
+func New(cfg Config) (*Limiter, error) {
+	for i, p := range cfg.Policies {
+		if p.DefaultLimit == 0 && p.MaxRows <= 0 && p.MaxBytes <= 0 {
+			return nil, fmt.Errorf("result limit: policy %d limits nothing", i)
+		}
+	}
+	return &Limiter{policies: cfg.Policies}, nil
+}
+
+// Policy returns the policy of user, nil when none applies.
+func (l *Limiter) Policy(user string) *Policy {
+	for i := range l.policies {
+		p := &l.policies[i]
+		if len(p.Users) == 0 || contains(p.Users, user) {
+			return p
+		}
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// AddLimit adds a limit of n rows to stmt when it is a select reading
+// tables without a limit. Locking selects and selects into variables or
+// files are left as they are.
+func AddLimit(stmt ast.StmtNode, n uint64) bool {
+	switch s := stmt.(type) {
+	case *ast.SelectStmt:
+		if s.Limit != nil || s.From == nil || s.Kind != ast.SelectStmtKindSelect || s.SelectIntoOpt != nil {
+			return false
+		}
+		if s.LockInfo != nil && s.LockInfo.LockType != ast.SelectLockNone {
+			return false
+		}
+		s.Limit = &ast.Limit{Count: ast.NewValueExpr(n, "", "")}
+		return true
+	case *ast.SetOprStmt:
+		if s.Limit != nil {
+			return false
+		}
+		s.Limit = &ast.Limit{Count: ast.NewValueExpr(n, "", "")}
+		return true
+	}
+	return false
+}
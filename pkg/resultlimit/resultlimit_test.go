@@ -0,0 +1,101 @@
+package resultlimit
+
+import (
+	"strings"
+	"testing"
+
+	parser "github.com/u2takey/sqlparser"
+	"github.com/u2takey/sqlparser/format"
+	_ "github.com/u2takey/sqlparser/test_driver"
+)
+
+func TestPolicy(t *testing.T) {
+	if _, err := New(Config{Policies: []Policy{{Users: []string{"app"}}}}); err == nil {
+		t.Fatal("policy limiting nothing accepted")
+	}
+	l, err := New(Config{Policies: []Policy{
+		{Users: []string{"report"}, MaxRows: 100},
+		{DefaultLimit: 10},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user    string
+		maxRows int64
+		limit   uint64
+	}{
+		{"report", 100, 0},
+		{"app", 0, 10},
+	}
+	for _, test := range tests {
+		p := l.Policy(test.user)
+		if p == nil || p.MaxRows != test.maxRows || p.DefaultLimit != test.limit {
+			t.Errorf("%s: got %+v", test.user, p)
+		}
+	}
+	if l, _ := New(Config{Policies: []Policy{{Users: []string{"report"}, MaxRows: 1}}}); l.Policy("app") != nil {
+		t.Error("policy of another user applied")
+	}
+}
+
+func TestCapped(t *testing.T) {
+	tests := []struct {
+		policy     Policy
+		rows, size int64
+		capped     bool
+		reason     string
+	}{
+		{Policy{MaxRows: 10}, 10, 1 << 20, false, "Result exceeded the cap of 10 rows"},
+		{Policy{MaxRows: 10}, 11, 0, true, "Result exceeded the cap of 10 rows"},
+		{Policy{MaxBytes: 100}, 1000, 100, false, "Result exceeded the cap of 100 bytes"},
+		{Policy{MaxBytes: 100}, 1, 101, true, "Result exceeded the cap of 100 bytes"},
+		{Policy{MaxRows: 10, MaxBytes: 100}, 5, 101, true, "Result exceeded the cap of 10 rows or 100 bytes"},
+		{Policy{DefaultLimit: 10}, 1000, 1 << 20, false, ""},
+	}
+	for _, test := range tests {
+		if got := test.policy.Capped(test.rows, test.size); got != test.capped {
+			t.Errorf("%+v with %d rows of %d bytes: capped %v, want %v", test.policy, test.rows, test.size, got, test.capped)
+		}
+		if test.reason != "" && test.policy.Reason() != test.reason {
+			t.Errorf("%+v: reason %q, want %q", test.policy, test.policy.Reason(), test.reason)
+		}
+	}
+}
+
+func TestAddLimit(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM t", "SELECT * FROM `t` LIMIT 10"},
+		{"SELECT * FROM t LIMIT 5", ""},
+		{"SELECT 1", ""},
+		{"SELECT * FROM t FOR UPDATE", ""},
+		{"SELECT * FROM t INTO OUTFILE '/tmp/x'", ""},
+		{"SELECT a FROM t UNION SELECT a FROM u", "SELECT `a` FROM `t` UNION SELECT `a` FROM `u` LIMIT 10"},
+		{"SELECT a FROM t UNION SELECT a FROM u LIMIT 3", ""},
+		{"UPDATE t SET a = 1", ""},
+	}
+	for _, test := range tests {
+		stmt, err := parser.New().ParseOneStmt(test.query, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		added := AddLimit(stmt, 10)
+		if added != (test.want != "") {
+			t.Errorf("%s: added %v", test.query, added)
+			continue
+		}
+		if !added {
+			continue
+		}
+		var sb strings.Builder
+		if err := stmt.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err != nil {
+			t.Fatal(err)
+		}
+		if sb.String() != test.want {
+			t.Errorf("%s: got %s, want %s", test.query, sb.String(), test.want)
+		}
+	}
+}
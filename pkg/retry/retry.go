@@ -0,0 +1,146 @@
+// Package retry decides whether a statement that failed on a transient
+// error, a deadlock, a lock wait timeout or a connection broken before the
+// statement was sent, is run again, and how long after.
+package retry
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultMaxAttempts = 3
+	DefaultBackoff     = 20 * time.Millisecond
+	DefaultMaxBackoff  = time.Second
+
+	CodeLockWaitTimeout = 1205
+	CodeDeadlock        = 1213
+)
+
+// Config enables the retries, for the statements of Users, all when
+// empty. The rules without attempts or backoff of their own take those of
+// the config.
+type Config struct {
+	Enabled bool     `json:"enabled"`
+	Users   []string `json:"users,omitempty"`
+	// MaxAttempts bounds the runs of a statement, the first included.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Backoff is the wait before the first retry, like "20ms", doubled at
+	// each retry up to MaxBackoff. The wait is drawn at random below it.
+	Backoff    string `json:"backoff,omitempty"`
+	MaxBackoff string `json:"max_backoff,omitempty"`
+	// Rules are the errors retried, deadlocks, lock wait timeouts and bad
+	// connections when empty.
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// Rule retries the statements failed with one of its error codes, or with
+// a connection broken before the statement was sent when BadConn is set.
+type Rule struct {
+	Codes       []uint16 `json:"codes,omitempty"`
+	BadConn     bool     `json:"bad_conn,omitempty"`
+	MaxAttempts int      `json:"max_attempts,omitempty"`
+	Backoff     string   `json:"backoff,omitempty"`
+	MaxBackoff  string   `json:"max_backoff,omitempty"`
+
+	backoff, maxBackoff time.Duration
+}
+
+type Policy struct {
+	users map[string]bool
+	rules []Rule
+}
+
+func New(cfg Config) (*Policy, error) {
+	p := &Policy{users: map[string]bool{}}
+	for _, u := range cfg.Users {
+		p.users[u] = true
+	}
+	rules := cfg.Rules
+	if len(rules) == 0 {
+		rules = []Rule{{Codes: []uint16{CodeDeadlock, CodeLockWaitTimeout}, BadConn: true}}
+	}
+	defaults := Rule{MaxAttempts: cfg.MaxAttempts, Backoff: cfg.Backoff, MaxBackoff: cfg.MaxBackoff}
+	if err := defaults.parse(Rule{MaxAttempts: DefaultMaxAttempts, backoff: DefaultBackoff, maxBackoff: DefaultMaxBackoff}); err != nil {
+		return nil, fmt.Errorf("retry: %v", err)
+	}
+	for i, r := range rules {
+		if len(r.Codes) == 0 && !r.BadConn {
+			return nil, fmt.Errorf("retry: rule %d retries nothing", i)
+		}
+		if err := r.parse(defaults); err != nil {
+			return nil, fmt.Errorf("retry: rule %d: %v", i, err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// parse parses the backoffs of r, taking those of defaults when unset.
+func (r *Rule) parse(defaults Rule) error {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = defaults.MaxAttempts
+	}
+	r.backoff, r.maxBackoff = defaults.backoff, defaults.maxBackoff
+	for _, d := range []struct {
+		value string
+		to    *time.Duration
+	}{
+		{r.Backoff, &r.backoff},
+		{r.MaxBackoff, &r.maxBackoff},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("bad backoff %q", d.value)
+		}
+		*d.to = v
+	}
+	if r.maxBackoff < r.backoff {
+		r.maxBackoff = r.backoff
+	}
+	return nil
+}
+
+// Applies tells whether the statements of user are retried.
+func (p *Policy) Applies(user string) bool {
+	return len(p.users) == 0 || p.users[user]
+}
+
+// Delay returns how long to wait before running again a statement that
+// failed for the attempt-th time with the error code, or with a bad
+// connection when badConn is set. ok is false when it is not retried.
+func (p *Policy) Delay(code uint16, badConn bool, attempt int) (d time.Duration, ok bool) {
+	for _, r := range p.rules {
+		if !r.matches(code, badConn) {
+			continue
+		}
+		if attempt >= r.MaxAttempts {
+			return 0, false
+		}
+		d = r.backoff
+		for i := 1; i < attempt && d < r.maxBackoff; i++ {
+			d *= 2
+		}
+		if d > r.maxBackoff {
+			d = r.maxBackoff
+		}
+		return time.Duration(rand.Int63n(int64(d)) + 1), true
+	}
+	return 0, false
+}
+
+func (r *Rule) matches(code uint16, badConn bool) bool {
+	if badConn {
+		return r.BadConn
+	}
+	for _, c := range r.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package sequence
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/u2takey/mysqlgate/pkg/sql"
+)
+
+const (
+	// DefaultTable is the backing table of segment sequences, created with
+	//   CREATE TABLE mysqlgate_sequence (
+	//     name VARCHAR(64) NOT NULL PRIMARY KEY,
+	//     next_id BIGINT NOT NULL
+	//   )
+	DefaultTable = "mysqlgate_sequence"
+	DefaultBlock = 1000
+)
+
+// segment reserves blocks of ids in a backing table and hands them out from
+// memory. Ids of a block left unused when the proxy stops are lost.
+type segment struct {
+	name  string
+	table string
+	block int64
+	db    *sql.DB
+
+	mu      sync.Mutex
+	created bool
+	next    int64
+	max     int64
+}
+
+func newSegment(cfg Config, db *sql.DB) (*segment, error) {
+	s := &segment{name: cfg.Name, table: cfg.Table, block: cfg.Block, db: db}
+	if s.table == "" {
+		s.table = DefaultTable
+	}
+	if s.block <= 0 {
+		s.block = DefaultBlock
+	}
+	return s, nil
+}
+
+func (s *segment) Next(ctx context.Context, n int) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int64, 0, n)
+	for len(ids) < n {
+		if s.next >= s.max {
+			if err := s.reserve(ctx, int64(n-len(ids))); err != nil {
+				return nil, err
+			}
+		}
+		ids = append(ids, s.next)
+		s.next++
+	}
+	return ids, nil
+}
+
+// reserve takes the next block of at least n ids from the backing table.
+func (s *segment) reserve(ctx context.Context, n int64) error {
+	if !s.created {
+		query := fmt.Sprintf("INSERT IGNORE INTO `%s` (name, next_id) VALUES (?, 1)", s.table)
+		if _, err := s.db.ExecContext(ctx, query, s.name); err != nil {
+			return err
+		}
+		s.created = true
+	}
+	size := s.block
+	if n > size {
+		size = n
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var next int64
+	query := fmt.Sprintf("SELECT next_id FROM `%s` WHERE name = ? FOR UPDATE", s.table)
+	if err := tx.QueryRowContext(ctx, query, s.name).Scan(&next); err != nil {
+		return err
+	}
+	query = fmt.Sprintf("UPDATE `%s` SET next_id = ? WHERE name = ?", s.table)
+	if _, err := tx.ExecContext(ctx, query, next+size, s.name); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.next, s.max = next, next+size
+	return nil
+}
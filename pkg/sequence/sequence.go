@@ -0,0 +1,75 @@
+// Package sequence hands out ids unique across the shards of a table.
+package sequence
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+)
+
+const (
+	KindSegment   = "segment"
+	KindSnowflake = "snowflake"
+)
+
+type Config struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// Cluster and Table locate the backing table of a segment sequence,
+	// Table defaults to DefaultTable.
+	Cluster string `json:"cluster,omitempty"`
+	Table   string `json:"table,omitempty"`
+	// Block is the number of ids a segment sequence reserves at once.
+	Block int64 `json:"block,omitempty"`
+	// Worker identifies the proxy in snowflake ids, it must be unique among
+	// the proxies sharing a sequence.
+	Worker int64 `json:"worker,omitempty"`
+}
+
+// Sequence is a source of unique ids.
+type Sequence interface {
+	// Next returns n new ids in increasing order.
+	Next(ctx context.Context, n int) ([]int64, error)
+}
+
+// Registry holds the sequences by name.
+type Registry struct {
+	sequences map[string]Sequence
+}
+
+func NewRegistry(cfgs []Config, clusters *cluster.Registry) (*Registry, error) {
+	r := &Registry{sequences: map[string]Sequence{}}
+	for _, cfg := range cfgs {
+		if _, ok := r.sequences[cfg.Name]; ok {
+			return nil, fmt.Errorf("sequence %s: defined twice", cfg.Name)
+		}
+		var (
+			s   Sequence
+			err error
+		)
+		switch cfg.Kind {
+		case KindSegment, "":
+			c, ok := clusters.Get(cfg.Cluster)
+			if !ok {
+				return nil, fmt.Errorf("sequence %s: unknown cluster %s", cfg.Name, cfg.Cluster)
+			}
+			s, err = newSegment(cfg, c.Primary().DB())
+		case KindSnowflake:
+			s, err = newSnowflake(cfg)
+		default:
+			err = fmt.Errorf("sequence %s: unknown kind %q", cfg.Name, cfg.Kind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.sequences[cfg.Name] = s
+	}
+	return r, nil
+}
+
+// Get returns the sequence called name.
+func (r *Registry) Get(name string) (Sequence, bool) {
+	s, ok := r.sequences[name]
+	return s, ok
+}
@@ -0,0 +1,89 @@
+package sequence
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+)
+
+func TestNewRegistry(t *testing.T) {
+	tests := []struct {
+		name string
+		cfgs []Config
+		err  bool
+	}{
+		{"snowflake", []Config{{Name: "ids", Kind: KindSnowflake, Worker: 3}}, false},
+		{"duplicate", []Config{{Name: "ids", Kind: KindSnowflake}, {Name: "ids", Kind: KindSnowflake}}, true},
+		{"unknown kind", []Config{{Name: "ids", Kind: "uuid"}}, true},
+		{"unknown cluster", []Config{{Name: "ids", Cluster: "c9"}}, true},
+		{"worker too large", []Config{{Name: "ids", Kind: KindSnowflake, Worker: maxWorker + 1}}, true},
+		{"negative worker", []Config{{Name: "ids", Kind: KindSnowflake, Worker: -1}}, true},
+	}
+	for _, test := range tests {
+		r, err := NewRegistry(test.cfgs, &cluster.Registry{})
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if err == nil {
+			if _, ok := r.Get(test.cfgs[0].Name); !ok {
+				t.Errorf("%s: sequence not registered", test.name)
+			}
+		}
+	}
+}
+
+func TestSnowflake(t *testing.T) {
+	s, err := newSnowflake(Config{Name: "ids", Worker: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last int64
+	seen := map[int64]bool{}
+	for i := 0; i < 3; i++ {
+		// more ids than a millisecond holds
+		ids, err := s.Next(context.Background(), maxStep+10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			if id <= last || seen[id] {
+				t.Fatalf("id %d after %d", id, last)
+			}
+			if worker := id >> stepBits & maxWorker; worker != 5 {
+				t.Fatalf("id %d of worker %d", id, worker)
+			}
+			seen[id], last = true, id
+		}
+	}
+}
+
+func TestSegmentBlock(t *testing.T) {
+	s, err := newSegment(Config{Name: "ids"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.table != DefaultTable || s.block != DefaultBlock {
+		t.Errorf("got table %s, block %d", s.table, s.block)
+	}
+	// a block reserved already is handed out without the backing table
+	s.next, s.max = 10, 15
+	tests := []struct {
+		n    int
+		want []int64
+	}{
+		{2, []int64{10, 11}},
+		{3, []int64{12, 13, 14}},
+	}
+	for _, test := range tests {
+		ids, err := s.Next(context.Background(), test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("got %v, want %v", ids, test.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package sequence
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	workerBits = 10
+	stepBits   = 12
+	maxWorker  = 1<<workerBits - 1
+	maxStep    = 1<<stepBits - 1
+)
+
+// snowflakeEpoch is the start of the millisecond timestamps of ids.
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// snowflake makes ids of a millisecond timestamp, a worker id and a step
+// within the millisecond. It needs no backend but ids are only unique as
+// long as workers are.
+type snowflake struct {
+	worker int64
+
+	mu   sync.Mutex
+	last int64
+	step int64
+}
+
+func newSnowflake(cfg Config) (*snowflake, error) {
+	if cfg.Worker < 0 || cfg.Worker > maxWorker {
+		return nil, fmt.Errorf("sequence %s: worker must be within 0 and %d", cfg.Name, maxWorker)
+	}
+	return &snowflake{worker: cfg.Worker}, nil
+}
+
+func (s *snowflake) Next(ctx context.Context, n int) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int64, n)
+	for i := range ids {
+		now := time.Since(snowflakeEpoch).Milliseconds()
+		if now > s.last {
+			s.last, s.step = now, 0
+		} else if s.step++; s.step > maxStep {
+			// the millisecond is used up or the clock went back, borrow
+			// the next one rather than wait
+			s.last, s.step = s.last+1, 0
+		}
+		ids[i] = s.last<<(workerBits+stepBits) | s.worker<<stepBits | s.step
+	}
+	return ids, nil
+}
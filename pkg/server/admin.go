@@ -0,0 +1,408 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/admin"
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/digest"
+	"github.com/u2takey/mysqlgate/pkg/reshard"
+)
+
+func (s *Server) registerAdmin() {
+	s.admin.Handle("/sharding/checksum", s.checksum)
+	s.admin.Handle("/sharding/ddl", s.ddlJobs)
+	s.admin.Handle("/sharding/split", s.split)
+	s.admin.Handle("/cdc/streams", s.cdcStreams)
+	s.admin.Handle("/cache", s.cache)
+	s.admin.Handle("/coalesce", s.coalesce)
+	s.admin.Handle("/digests", s.digests)
+	s.admin.Handle("/slowlog", s.slowLog)
+	s.admin.Handle("/firewall", s.firewall)
+	s.admin.Handle("/admission", s.admission)
+	s.admin.Handle("/breakers", s.breakers)
+	s.admin.Handle("/metrics", s.metrics)
+}
+
+type shardChecksum struct {
+	Shard    string `json:"shard"`
+	Cluster  string `json:"cluster"`
+	Checksum string `json:"checksum,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// checksum compares the CHECKSUM TABLE of the copies of a reference table,
+// consistent is false when any copy differs or could not be checksummed.
+func (s *Server) checksum(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("table")
+	if s.rt.Router == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("no sharded table"))
+		return
+	}
+	t, ok := s.rt.Router.Table(name)
+	if !ok || !t.Reference {
+		admin.WriteError(w, http.StatusBadRequest, fmt.Errorf("%q is not a reference table", name))
+		return
+	}
+
+	results := make([]shardChecksum, len(t.Shards))
+	var wg sync.WaitGroup
+	for i, shard := range t.Shards {
+		results[i] = shardChecksum{Shard: shard.Name, Cluster: shard.Cluster}
+		wg.Add(1)
+		go func(res *shardChecksum) {
+			defer wg.Done()
+			sum, err := s.checksumTable(r.Context(), res.Cluster, t.Name)
+			if err != nil {
+				res.Error = err.Error()
+			}
+			res.Checksum = sum
+		}(&results[i])
+	}
+	wg.Wait()
+
+	consistent := true
+	for _, res := range results {
+		consistent = consistent && res.Error == "" && res.Checksum == results[0].Checksum
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"table":      t.Name,
+		"consistent": consistent,
+		"shards":     results,
+	})
+}
+
+func (s *Server) checksumTable(ctx context.Context, clusterName, table string) (string, error) {
+	c, ok := s.rt.Clusters.Get(clusterName)
+	if !ok {
+		return "", fmt.Errorf("unknown cluster %s", clusterName)
+	}
+	query := "CHECKSUM TABLE `" + strings.ReplaceAll(table, "`", "``") + "`"
+	var (
+		name string
+		sum  []byte
+	)
+	if err := c.Primary().DB().QueryRowContext(ctx, query).Scan(&name, &sum); err != nil {
+		return "", err
+	}
+	if sum == nil {
+		return "", fmt.Errorf("table %s does not exist", table)
+	}
+	return string(sum), nil
+}
+
+// ddlJobs lists the recent ddl jobs with the progress of each shard.
+func (s *Server) ddlJobs(w http.ResponseWriter, r *http.Request) {
+	if s.rt.DDL == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("no sharded table"))
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, s.rt.DDL.Jobs())
+}
+
+// split lists the shard splits on GET and starts one on POST, the body is a
+// reshard.Split.
+func (s *Server) split(w http.ResponseWriter, r *http.Request) {
+	if s.reshard == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("no sharded table"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		admin.WriteJSON(w, http.StatusOK, s.reshard.Jobs())
+	case http.MethodPost:
+		var split reshard.Split
+		if err := json.NewDecoder(r.Body).Decode(&split); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		job, err := s.reshard.Start(split)
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		admin.WriteJSON(w, http.StatusAccepted, job)
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	}
+}
+
+// cdcStreams lists the change streams with their checkpoints.
+func (s *Server) cdcStreams(w http.ResponseWriter, r *http.Request) {
+	if s.cdc == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("no change stream"))
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, s.cdc.Streams())
+}
+
+// cache shows the result cache counters on GET and drops every cached
+// result on DELETE.
+func (s *Server) cache(w http.ResponseWriter, r *http.Request) {
+	if s.rt.Cache == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("result cache is off"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		admin.WriteJSON(w, http.StatusOK, s.rt.Cache.Stats())
+	case http.MethodDelete:
+		s.rt.Cache.Flush()
+		admin.WriteJSON(w, http.StatusOK, s.rt.Cache.Stats())
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	}
+}
+
+// coalesce shows the counters of the coalesced selects.
+func (s *Server) coalesce(w http.ResponseWriter, r *http.Request) {
+	if s.rt.Coalesce == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("coalescing is off"))
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, s.rt.Coalesce.Stats())
+}
+
+// digests lists the statement digests on GET, the slowest in total first,
+// as json or as csv with format=csv, limit bounds their number. DELETE
+// resets them.
+func (s *Server) digests(w http.ResponseWriter, r *http.Request) {
+	if s.rt.Digests == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("digests are off"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		entries := s.rt.Digests.Entries()
+		if v := r.URL.Query().Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 0 {
+				admin.WriteError(w, http.StatusBadRequest, fmt.Errorf("bad limit %q", v))
+				return
+			}
+			if limit < len(entries) {
+				entries = entries[:limit]
+			}
+		}
+		if r.URL.Query().Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="digests.csv"`)
+			if err := digest.WriteCSV(w, entries); err != nil {
+				mLog.Error("msg", "writing digests", "err", err)
+			}
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, entries)
+	case http.MethodDelete:
+		s.rt.Digests.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	}
+}
+
+// slowLogSettings are the slow log settings changed at runtime.
+type slowLogSettings struct {
+	Threshold  string  `json:"threshold"`
+	SampleRate float64 `json:"sample_rate"`
+}
+
+// slowLog shows the slow log threshold and sample rate on GET and changes
+// them on PUT, a setting left out is kept.
+func (s *Server) slowLog(w http.ResponseWriter, r *http.Request) {
+	l := s.rt.SlowLog
+	if l == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("slow log is off"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var settings slowLogSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		var threshold time.Duration
+		if settings.Threshold != "" {
+			var err error
+			if threshold, err = time.ParseDuration(settings.Threshold); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if settings.SampleRate != 0 {
+			if err := l.SetSampleRate(settings.SampleRate); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if settings.Threshold != "" {
+			l.SetThreshold(threshold)
+		}
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, slowLogSettings{Threshold: l.Threshold().String(), SampleRate: l.SampleRate()})
+}
+
+// firewall shows the firewall state on GET and reloads its rules on POST.
+func (s *Server) firewall(w http.ResponseWriter, r *http.Request) {
+	f := s.rt.Firewall
+	if f == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("firewall is off"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := f.Reload(); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, f.Status())
+}
+
+// admission shows the counters of the admission rules.
+func (s *Server) admission(w http.ResponseWriter, r *http.Request) {
+	if s.rt.Admission == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("admission control is off"))
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, s.rt.Admission.Stats())
+}
+
+type clusterBreaker struct {
+	Cluster string `json:"cluster"`
+	cluster.BreakerStats
+}
+
+// breakers shows the circuit breakers of the backends. POST with backend
+// and state sets the breaker of a backend: open or closed keeps it so
+// until it is set to auto.
+func (s *Server) breakers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name, state := r.URL.Query().Get("backend"), r.URL.Query().Get("state")
+		b := s.backend(name)
+		if b == nil {
+			admin.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown backend %q", name))
+			return
+		}
+		if err := b.SetBreaker(state); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, s.breakerStats())
+}
+
+func (s *Server) breakerStats() []clusterBreaker {
+	breakers := []clusterBreaker{}
+	for _, c := range s.rt.Clusters.All() {
+		for _, b := range c.Backends() {
+			if stats, ok := b.Breaker(); ok {
+				breakers = append(breakers, clusterBreaker{Cluster: c.Name, BreakerStats: stats})
+			}
+		}
+	}
+	return breakers
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics exposes the circuit breakers in the prometheus text format: a
+// gauge per state set to 1 for the current one, the rates of the window
+// and the counts of rejected queries and transitions since the start.
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	breakers := s.breakerStats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	sample := func(name string, b clusterBreaker, value float64, labels ...string) {
+		fmt.Fprintf(w, "%s{cluster=\"%s\",backend=\"%s\"", name, labelEscaper.Replace(b.Cluster), labelEscaper.Replace(b.Backend))
+		for i := 0; i+1 < len(labels); i += 2 {
+			fmt.Fprintf(w, ",%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		fmt.Fprintf(w, "} %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	header("mysqlgate_breaker_state", "gauge", "Whether the circuit breaker of the backend is in the state.")
+	for _, b := range breakers {
+		for _, state := range []string{cluster.StateClosed, cluster.StateOpen, cluster.StateHalfOpen} {
+			v := 0.0
+			if b.State == state {
+				v = 1
+			}
+			sample("mysqlgate_breaker_state", b, v, "state", state)
+		}
+	}
+	header("mysqlgate_breaker_forced", "gauge", "Whether the state of the circuit breaker was set by an operator.")
+	for _, b := range breakers {
+		v := 0.0
+		if b.Forced {
+			v = 1
+		}
+		sample("mysqlgate_breaker_forced", b, v)
+	}
+	header("mysqlgate_breaker_window_requests", "gauge", "Queries counted in the window of the circuit breaker.")
+	for _, b := range breakers {
+		sample("mysqlgate_breaker_window_requests", b, float64(b.Requests))
+	}
+	header("mysqlgate_breaker_error_rate", "gauge", "Rate of the failed queries of the window.")
+	for _, b := range breakers {
+		sample("mysqlgate_breaker_error_rate", b, b.ErrorRate)
+	}
+	header("mysqlgate_breaker_slow_rate", "gauge", "Rate of the slow queries of the window.")
+	for _, b := range breakers {
+		sample("mysqlgate_breaker_slow_rate", b, b.SlowRate)
+	}
+	header("mysqlgate_breaker_rejected_total", "counter", "Queries failed fast by the circuit breaker.")
+	for _, b := range breakers {
+		sample("mysqlgate_breaker_rejected_total", b, float64(b.Rejected))
+	}
+	header("mysqlgate_breaker_transitions_total", "counter", "State changes of the circuit breaker.")
+	for _, b := range breakers {
+		transitions := make([]string, 0, len(b.Transitions))
+		for t := range b.Transitions {
+			transitions = append(transitions, t)
+		}
+		sort.Strings(transitions)
+		for _, t := range transitions {
+			fromTo := strings.SplitN(t, "->", 2)
+			if len(fromTo) == 2 {
+				sample("mysqlgate_breaker_transitions_total", b, float64(b.Transitions[t]), "from", fromTo[0], "to", fromTo[1])
+			}
+		}
+	}
+}
+
+// backend returns the backend called name, nil when there is none.
+func (s *Server) backend(name string) *cluster.Backend {
+	for _, c := range s.rt.Clusters.All() {
+		for _, b := range c.Backends() {
+			if b.Name == name {
+				return b
+			}
+		}
+	}
+	return nil
+}
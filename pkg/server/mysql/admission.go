@@ -0,0 +1,62 @@
+package mysql
+
+import (
+	"net"
+
+	"github.com/u2takey/mysqlgate/pkg/admission"
+	parser "github.com/u2takey/sqlparser"
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// admissionPlan admits the query before the plans running it, waiting
+// while it is over a limit. Ending a transaction is always admitted, it
+// releases the locks the queries waiting may need.
+type admissionPlan struct {
+}
+
+func (p *admissionPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *admissionPlan) Query(ctx *QueryContext) error {
+	c := ctx.rt.Admission
+	if c == nil {
+		return nil
+	}
+	if len(ctx.stmts) == 1 {
+		switch ctx.stmts[0].(type) {
+		case *ast.CommitStmt, *ast.RollbackStmt:
+			return nil
+		}
+	}
+	client, _, err := net.SplitHostPort(ctx.mc.netConn.RemoteAddr().String())
+	if err != nil {
+		client = ctx.mc.netConn.RemoteAddr().String()
+	}
+	release, err := c.Admit(ctx, &admission.Request{
+		User:     ctx.mc.cfg.User,
+		Database: ctx.mc.database,
+		Client:   client,
+		Digest:   parser.DigestNormalized(ctx.normalize()).String(),
+	})
+	if err != nil {
+		if r, ok := err.(*admission.Rejected); ok {
+			mLog.Log("msg", "query rejected", "user", ctx.mc.cfg.User, "client", client, "reason", r.Error())
+			if r.Rate {
+				return NewCustomError(ErUserLimitReached, "Too many queries: "+r.Error())
+			}
+			return NewCustomError(ErConCountError, "Too many concurrent queries: "+r.Error())
+		}
+		return err
+	}
+	ctx.release = release
+	return nil
+}
+
+// releaseAdmission releases the query admitted once it ran.
+func (q *QueryContext) releaseAdmission() {
+	if q.release != nil {
+		q.release()
+		q.release = nil
+	}
+}
@@ -0,0 +1,595 @@
+package mysql
+
+import (
+	"bufio"
+	"encoding/gob"
+	"hash/fnv"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/sqlparser/ast"
+	"golang.org/x/text/collate"
+)
+
+// spillPartitions is the number of files groups are spilled to, a partition
+// is merged in memory at once. A partition holding more than the groups
+// allowed in memory is split again into as many files, by the next
+// spillBits of the hash of the group keys, down to maxSpillLevel.
+const (
+	spillBits       = 4
+	spillPartitions = 1 << spillBits
+	maxSpillLevel   = 32 / spillBits
+)
+
+// aggValue is the merge state of a column of a group.
+type aggValue struct {
+	Set   bool
+	Null  bool
+	Raw   []byte
+	Sum   *big.Rat
+	Count int64
+	// Scale is the largest number of decimals of the summed partials.
+	Scale int
+}
+
+type aggGroup struct {
+	Key    string
+	Values []aggValue
+}
+
+// aggregator merges the partial aggregates of shards by group key. Groups
+// over maxGroups are spilled to hash partitioned temp files.
+type aggregator struct {
+	plan *sharding.AggregatePlan
+	// orders compare the values of the columns of the plan, groupOrders
+	// the group by values.
+	orders      []*valueOrder
+	groupOrders []*valueOrder
+	keyBuf      collate.Buffer
+	float       []bool
+	maxGroups   int
+	spillDir    string
+
+	groups     map[string]*aggGroup
+	dir        string
+	partitions []*spillFile
+	files      []*os.File
+	having     map[ast.ExprNode]int
+}
+
+type spillFile struct {
+	file *os.File
+	w    *bufio.Writer
+	enc  *gob.Encoder
+	// level is the number of times the groups of the file were
+	// partitioned.
+	level int
+}
+
+func newAggregator(plan *sharding.AggregatePlan, columnTypes []*sql.ColumnType, maxGroups int, spillDir string) *aggregator {
+	a := &aggregator{
+		plan:        plan,
+		orders:      make([]*valueOrder, len(plan.Columns)),
+		groupOrders: make([]*valueOrder, len(plan.GroupBy)),
+		float:       make([]bool, len(plan.Columns)),
+		maxGroups:   maxGroups,
+		spillDir:    spillDir,
+		groups:      map[string]*aggGroup{},
+		having:      map[ast.ExprNode]int{},
+	}
+	for i, col := range plan.Columns {
+		typeName := columnTypes[col.Index].DatabaseTypeName()
+		switch col.Kind {
+		case sharding.AggCount:
+			a.orders[i] = numericOrder
+		case sharding.AggSum, sharding.AggAvg:
+			a.orders[i] = numericOrder
+			a.float[i] = typeName == "DOUBLE" || typeName == "FLOAT"
+		default:
+			a.orders[i] = newValueOrder(columnTypes[col.Index])
+		}
+	}
+	for i, index := range plan.GroupBy {
+		a.groupOrders[i] = newValueOrder(columnTypes[index])
+	}
+	return a
+}
+
+func (a *aggregator) add(row [][]byte) error {
+	key := a.groupKey(row)
+	g, ok := a.groups[key]
+	if !ok {
+		g = &aggGroup{Key: key, Values: make([]aggValue, len(a.plan.Columns))}
+		a.groups[key] = g
+	}
+	for i, col := range a.plan.Columns {
+		if err := a.update(&g.Values[i], i, col, row); err != nil {
+			return err
+		}
+	}
+	if len(a.groups) > a.maxGroups {
+		return a.spill()
+	}
+	return nil
+}
+
+// update merges a partial value of a shard row into v.
+func (a *aggregator) update(v *aggValue, i int, col sharding.AggColumn, row [][]byte) error {
+	value := row[col.Index]
+	switch col.Kind {
+	case sharding.AggGroup, sharding.AggAny:
+		if !v.Set {
+			v.Set, v.Null, v.Raw = true, value == nil, append([]byte{}, value...)
+		}
+	case sharding.AggMin, sharding.AggMax:
+		if value == nil {
+			return nil
+		}
+		c := a.orders[i].compare(value, v.Raw)
+		if !v.Set || (col.Kind == sharding.AggMin && c < 0) || (col.Kind == sharding.AggMax && c > 0) {
+			v.Set, v.Raw = true, append([]byte{}, value...)
+		}
+	case sharding.AggCount:
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil && value != nil {
+			return err
+		}
+		v.Count += n
+	case sharding.AggSum, sharding.AggAvg:
+		if col.Kind == sharding.AggAvg {
+			n, err := strconv.ParseInt(string(row[col.CountIndex]), 10, 64)
+			if err != nil {
+				return err
+			}
+			v.Count += n
+		}
+		if value == nil {
+			return nil
+		}
+		r, ok := new(big.Rat).SetString(string(value))
+		if !ok {
+			return NewCustomError(ErUnknownError, "invalid partial sum "+string(value))
+		}
+		v.addSum(r, scale(value))
+	}
+	return nil
+}
+
+func (v *aggValue) addSum(r *big.Rat, scale int) {
+	if v.Sum == nil {
+		v.Sum = new(big.Rat)
+	}
+	v.Set = true
+	v.Sum.Add(v.Sum, r)
+	if scale > v.Scale {
+		v.Scale = scale
+	}
+}
+
+// merge merges the state o of a spilled group into v.
+func (a *aggregator) merge(v, o *aggValue, i int, col sharding.AggColumn) {
+	switch col.Kind {
+	case sharding.AggGroup, sharding.AggAny:
+		if !v.Set {
+			*v = *o
+		}
+	case sharding.AggMin, sharding.AggMax:
+		if !o.Set {
+			return
+		}
+		c := a.orders[i].compare(o.Raw, v.Raw)
+		if !v.Set || (col.Kind == sharding.AggMin && c < 0) || (col.Kind == sharding.AggMax && c > 0) {
+			*v = *o
+		}
+	case sharding.AggCount:
+		v.Count += o.Count
+	case sharding.AggSum, sharding.AggAvg:
+		v.Count += o.Count
+		if o.Set {
+			v.addSum(o.Sum, o.Scale)
+		}
+	}
+}
+
+// final returns the merged row of g.
+func (a *aggregator) final(g *aggGroup) [][]byte {
+	row := make([][]byte, len(g.Values))
+	for i, col := range a.plan.Columns {
+		v := &g.Values[i]
+		switch col.Kind {
+		case sharding.AggCount:
+			row[i] = strconv.AppendInt(nil, v.Count, 10)
+		case sharding.AggSum:
+			if v.Set {
+				row[i] = formatNumber(v.Sum, v.Scale, a.float[i])
+			}
+		case sharding.AggAvg:
+			if v.Set && v.Count > 0 {
+				avg := new(big.Rat).Quo(v.Sum, big.NewRat(v.Count, 1))
+				// mysql adds div_precision_increment decimals to averages
+				row[i] = formatNumber(avg, v.Scale+4, a.float[i])
+			}
+		default:
+			if v.Set && !v.Null {
+				row[i] = append([]byte{}, v.Raw...)
+			}
+		}
+	}
+	return row
+}
+
+// keep applies the having clause to a merged row.
+func (a *aggregator) keep(row [][]byte) (bool, error) {
+	if a.plan.Having == nil {
+		return true, nil
+	}
+	v, err := sharding.Eval(a.plan.Having, func(e ast.ExprNode) ([]byte, bool) {
+		i, ok := a.having[e]
+		if !ok {
+			if i, ok = a.plan.Resolve(e); !ok {
+				i = -1
+			}
+			a.having[e] = i
+		}
+		if i < 0 {
+			return nil, false
+		}
+		return row[i], true
+	})
+	if err != nil {
+		return false, NewCustomError(ErNotSupportedYet, err.Error())
+	}
+	return sharding.Truth(v), nil
+}
+
+// rows finalizes groups, filters them with having and sorts them by the
+// order by keys of the plan.
+func (a *aggregator) rows(groups map[string]*aggGroup) ([][][]byte, error) {
+	rows := make([][][]byte, 0, len(groups))
+	for _, g := range groups {
+		row := a.final(g)
+		ok, err := a.keep(row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rows = append(rows, row)
+		}
+	}
+	if keys := a.sortKeys(); len(keys) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool {
+			return compareRows(rows[i], rows[j], keys) < 0
+		})
+	}
+	return rows, nil
+}
+
+func (a *aggregator) sortKeys() []sortKey {
+	keys := make([]sortKey, len(a.plan.OrderBy))
+	for i, k := range a.plan.OrderBy {
+		keys[i] = sortKey{index: k.Index, desc: k.Desc, order: a.orders[k.Index]}
+	}
+	return keys
+}
+
+// result returns the merged rows once every shard row was added.
+func (a *aggregator) result() (rowStream, error) {
+	if len(a.partitions) == 0 {
+		if len(a.groups) == 0 && len(a.plan.GroupBy) == 0 {
+			// aggregates without group by answer one row even for no rows
+			a.groups[""] = &aggGroup{Values: make([]aggValue, len(a.plan.Columns))}
+		}
+		rows, err := a.rows(a.groups)
+		if err != nil {
+			return nil, err
+		}
+		return &sliceStream{rows: rows}, nil
+	}
+	if err := a.spill(); err != nil {
+		return nil, err
+	}
+	for _, p := range a.partitions {
+		if err := p.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	chunks := &partitionStream{a: a, pending: a.partitions}
+	if len(a.plan.OrderBy) == 0 {
+		return chunks, nil
+	}
+
+	// every chunk of groups is sorted into a run, the runs are merged
+	var runs []rowStream
+	for {
+		rows, err := chunks.chunk()
+		if err != nil {
+			return nil, err
+		}
+		if rows == nil {
+			break
+		}
+		f, err := a.createFile("run")
+		if err != nil {
+			return nil, err
+		}
+		w := bufio.NewWriter(f)
+		enc := gob.NewEncoder(w)
+		for _, row := range rows {
+			if err := enc.Encode(newSpillRow(row)); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		runs = append(runs, &runStream{dec: gob.NewDecoder(bufio.NewReader(f))})
+	}
+	return newMergeStream(runs, a.sortKeys()), nil
+}
+
+// spill moves the groups in memory to the partition files.
+func (a *aggregator) spill() error {
+	if a.partitions == nil {
+		dir, err := os.MkdirTemp(a.spillDir, "mysqlgate-agg-")
+		if err != nil {
+			return err
+		}
+		a.dir = dir
+		if a.partitions, err = a.createPartitions(0); err != nil {
+			return err
+		}
+		mLog.Log("msg", "spilling aggregation groups", "dir", dir, "groups", len(a.groups))
+	}
+	if err := spillGroups(a.groups, a.partitions); err != nil {
+		return err
+	}
+	a.groups = map[string]*aggGroup{}
+	return nil
+}
+
+func (a *aggregator) createPartitions(level int) ([]*spillFile, error) {
+	partitions := make([]*spillFile, spillPartitions)
+	for i := range partitions {
+		f, err := a.createFile("partition")
+		if err != nil {
+			return nil, err
+		}
+		w := bufio.NewWriter(f)
+		partitions[i] = &spillFile{file: f, w: w, enc: gob.NewEncoder(w), level: level}
+	}
+	return partitions, nil
+}
+
+// spillGroups writes groups to the partitions their key hashes to, each
+// level of partitions using other bits of the hash.
+func spillGroups(groups map[string]*aggGroup, partitions []*spillFile) error {
+	shift := uint(partitions[0].level * spillBits)
+	for _, g := range groups {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(g.Key))
+		if err := partitions[(h.Sum32()>>shift)%spillPartitions].enc.Encode(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPartition merges the groups spilled to p and returns their rows.
+// When they are more than the groups allowed in memory, they are
+// partitioned again and the new partitions are returned instead.
+func (a *aggregator) loadPartition(p *spillFile) ([][][]byte, []*spillFile, error) {
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	dec := gob.NewDecoder(bufio.NewReader(p.file))
+	groups := map[string]*aggGroup{}
+	var sub []*spillFile
+	for {
+		o := &aggGroup{}
+		if err := dec.Decode(o); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		g, ok := groups[o.Key]
+		if !ok {
+			groups[o.Key] = o
+		} else {
+			for j, col := range a.plan.Columns {
+				a.merge(&g.Values[j], &o.Values[j], j, col)
+			}
+		}
+		if len(groups) <= a.maxGroups {
+			continue
+		}
+		if p.level+1 >= maxSpillLevel {
+			return nil, nil, NewCustomError(ErUnknownError, "too many groups to merge")
+		}
+		if sub == nil {
+			var err error
+			if sub, err = a.createPartitions(p.level + 1); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := spillGroups(groups, sub); err != nil {
+			return nil, nil, err
+		}
+		groups = map[string]*aggGroup{}
+	}
+	// the partition is read, its space is given back
+	if err := p.file.Truncate(0); err != nil {
+		return nil, nil, err
+	}
+	if sub == nil {
+		rows, err := a.rows(groups)
+		return rows, nil, err
+	}
+	if err := spillGroups(groups, sub); err != nil {
+		return nil, nil, err
+	}
+	for _, p := range sub {
+		if err := p.w.Flush(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nil, sub, nil
+}
+
+func (a *aggregator) createFile(prefix string) (*os.File, error) {
+	f, err := os.CreateTemp(a.dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	a.files = append(a.files, f)
+	return f, nil
+}
+
+// close removes the spill files.
+func (a *aggregator) close() {
+	for _, f := range a.files {
+		_ = f.Close()
+	}
+	if a.dir != "" {
+		_ = os.RemoveAll(filepath.Clean(a.dir))
+	}
+}
+
+// groupKey encodes the group by values of row, telling NULL from empty.
+// Values equal in their collation, like 'a' and 'A' in a case insensitive
+// one, have the same key.
+func (a *aggregator) groupKey(row [][]byte) string {
+	var key []byte
+	for j, i := range a.plan.GroupBy {
+		if row[i] == nil {
+			key = append(key, 0)
+			continue
+		}
+		v := a.groupOrders[j].key(&a.keyBuf, row[i])
+		key = append(key, 1)
+		key = strconv.AppendInt(key, int64(len(v)), 10)
+		key = append(key, ':')
+		key = append(key, v...)
+	}
+	return string(key)
+}
+
+// scale returns the number of decimals of a number.
+func scale(value []byte) int {
+	for i, c := range value {
+		if c == '.' {
+			n := 0
+			for _, d := range value[i+1:] {
+				if d < '0' || d > '9' {
+					break
+				}
+				n++
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+func formatNumber(r *big.Rat, scale int, float bool) []byte {
+	if float {
+		f, _ := r.Float64()
+		return strconv.AppendFloat(nil, f, 'g', -1, 64)
+	}
+	return []byte(r.FloatString(scale))
+}
+
+type sliceStream struct {
+	rows [][][]byte
+}
+
+func (s *sliceStream) next() ([][]byte, error) {
+	if len(s.rows) == 0 {
+		return nil, nil
+	}
+	row := s.rows[0]
+	s.rows = s.rows[1:]
+	return row, nil
+}
+
+// partitionStream returns the merged rows of the spilled partitions, one
+// chunk of groups fitting in memory after the other.
+type partitionStream struct {
+	a       *aggregator
+	pending []*spillFile
+	rows    sliceStream
+}
+
+// chunk returns the rows of the next chunk, nil once every partition was
+// read.
+func (s *partitionStream) chunk() ([][][]byte, error) {
+	for len(s.pending) > 0 {
+		p := s.pending[0]
+		s.pending = s.pending[1:]
+		rows, sub, err := s.a.loadPartition(p)
+		if err != nil {
+			return nil, err
+		}
+		s.pending = append(sub, s.pending...)
+		if len(rows) > 0 {
+			return rows, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *partitionStream) next() ([][]byte, error) {
+	for len(s.rows.rows) == 0 {
+		rows, err := s.chunk()
+		if err != nil || rows == nil {
+			return nil, err
+		}
+		s.rows.rows = rows
+	}
+	return s.rows.next()
+}
+
+// spillRow is a row of a sorted run, gob does not tell nil from empty.
+type spillRow struct {
+	Values [][]byte
+	Nulls  []bool
+}
+
+func newSpillRow(row [][]byte) *spillRow {
+	r := &spillRow{Values: row, Nulls: make([]bool, len(row))}
+	for i, v := range row {
+		r.Nulls[i] = v == nil
+	}
+	return r
+}
+
+type runStream struct {
+	dec *gob.Decoder
+}
+
+func (s *runStream) next() ([][]byte, error) {
+	r := &spillRow{}
+	if err := s.dec.Decode(r); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	row := make([][]byte, len(r.Nulls))
+	for i := range row {
+		if !r.Nulls[i] {
+			row[i] = []byte{}
+			if i < len(r.Values) {
+				row[i] = append(row[i], r.Values[i]...)
+			}
+		}
+	}
+	return row, nil
+}
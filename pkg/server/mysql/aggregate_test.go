@@ -0,0 +1,161 @@
+package mysql
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+)
+
+// testAggregatePlan is SELECT k, COUNT(*), SUM(v), AVG(v), MIN(s) GROUP BY
+// k ORDER BY k, over shard rows of k, COUNT(v), SUM(v), s.
+func testAggregatePlan() *sharding.AggregatePlan {
+	return &sharding.AggregatePlan{
+		Columns: []sharding.AggColumn{
+			{Kind: sharding.AggGroup, Index: 0},
+			{Kind: sharding.AggCount, Index: 1},
+			{Kind: sharding.AggSum, Index: 2},
+			{Kind: sharding.AggAvg, Index: 2, CountIndex: 1},
+			{Kind: sharding.AggMin, Index: 3},
+		},
+		Visible: 5,
+		GroupBy: []int{0},
+		OrderBy: []sharding.OrderKey{{Index: 0}},
+	}
+}
+
+func testColumnTypes() []*sql.ColumnType {
+	return []*sql.ColumnType{
+		{RawType: columnDef("k", 63)},
+		{RawType: columnDef("c", 63)},
+		{RawType: columnDef("v", 63)},
+		{RawType: columnDef("s", 45)}, // utf8mb4_general_ci
+	}
+}
+
+func row(values ...string) [][]byte {
+	r := make([][]byte, len(values))
+	for i, v := range values {
+		r[i] = []byte(v)
+	}
+	return r
+}
+
+func TestAggregatorPartials(t *testing.T) {
+	for _, maxGroups := range []int{1000, 20, 3} {
+		t.Run(fmt.Sprint(maxGroups), func(t *testing.T) {
+			a := newAggregator(testAggregatePlan(), testColumnTypes(), maxGroups, t.TempDir())
+			defer a.close()
+			const groups = 200
+			// two shards answer partials of every group
+			for shard := 0; shard < 2; shard++ {
+				for i := 0; i < groups; i++ {
+					s := "b"
+					if shard == 1 {
+						s = "A"
+					}
+					if err := a.add(row(fmt.Sprintf("k%03d", i), "2", fmt.Sprintf("%d.5", i), s)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			stream, err := a.result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < groups; i++ {
+				r, err := stream.next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := []string{fmt.Sprintf("k%03d", i), "4", fmt.Sprintf("%d.0", 2*i+1), fmt.Sprintf("%.5f", float64(2*i+1)/4), "A"}
+				if r == nil {
+					t.Fatalf("row %d missing", i)
+				}
+				for j := range want {
+					if string(r[j]) != want[j] {
+						t.Fatalf("row %d: got %q, want %q", i, r, want)
+					}
+				}
+			}
+			if r, err := stream.next(); r != nil || err != nil {
+				t.Fatalf("extra row %q %v", r, err)
+			}
+		})
+	}
+}
+
+func TestAggregatorCollationGroups(t *testing.T) {
+	types := testColumnTypes()
+	types[0] = &sql.ColumnType{RawType: columnDef("k", 45)}
+	a := newAggregator(testAggregatePlan(), types, 1000, t.TempDir())
+	defer a.close()
+	for _, k := range []string{"abc", "ABC", "Abc "} {
+		if err := a.add(row(k, "1", "1", "x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream, err := a.result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := stream.next()
+	if err != nil || r == nil || string(r[1]) != "3" {
+		t.Fatalf("got %q %v, want one group of 3", r, err)
+	}
+	if r, _ := stream.next(); r != nil {
+		t.Fatalf("extra group %q", r)
+	}
+}
+
+func TestAggregatorNoRows(t *testing.T) {
+	plan := &sharding.AggregatePlan{
+		Columns: []sharding.AggColumn{{Kind: sharding.AggCount, Index: 0}, {Kind: sharding.AggSum, Index: 1}},
+		Visible: 2,
+	}
+	a := newAggregator(plan, testColumnTypes()[:2], 10, t.TempDir())
+	defer a.close()
+	stream, err := a.result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := stream.next()
+	if err != nil || r == nil || string(r[0]) != "0" || r[1] != nil {
+		t.Fatalf("got %q %v, want COUNT 0 and SUM NULL", r, err)
+	}
+}
+
+func TestAggregatorSpillUnordered(t *testing.T) {
+	plan := testAggregatePlan()
+	plan.OrderBy = nil
+	a := newAggregator(plan, testColumnTypes(), 2, t.TempDir())
+	defer a.close()
+	const groups = 500
+	for i := 0; i < 2*groups; i++ {
+		if err := a.add(row(fmt.Sprint(i%groups), "1", "1", "x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream, err := a.result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for {
+		r, err := stream.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil {
+			break
+		}
+		if seen[string(r[0])] || string(r[1]) != "2" {
+			t.Fatalf("group %q merged wrong", r)
+		}
+		seen[string(r[0])] = true
+	}
+	if len(seen) != groups {
+		t.Fatalf("got %d groups, want %d", len(seen), groups)
+	}
+}
@@ -0,0 +1,227 @@
+package mysql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/qcache"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	parser "github.com/u2takey/sqlparser"
+	"github.com/u2takey/sqlparser/ast"
+	"github.com/u2takey/sqlparser/format"
+)
+
+// cacheHint chooses a select for the result cache, with an optional ttl
+// like /*+ cache(30s) */. The parser drops the hints it does not know, so
+// it is looked for in the query text.
+var cacheHint = regexp.MustCompile(`(?i)/\*\+[^*]*?\bcache\b(?:\s*\(\s*([^)]*?)\s*\))?`)
+
+// cachePlan answers cached selects from the result cache and records the
+// results of the ones missed. Writes drop the results of the tables they
+// write to, once before they run and again when their transaction ends, a
+// select racing with them is not cached.
+type cachePlan struct {
+}
+
+// cacheFill is a select whose result is recorded for the cache.
+type cacheFill struct {
+	key      string
+	tables   []string
+	versions []uint64
+	ttl      time.Duration
+}
+
+// packetRecord keeps copies of the packets written to the client, until
+// they exceed max bytes.
+type packetRecord struct {
+	packets  [][]byte
+	size     int64
+	max      int64
+	overflow bool
+}
+
+func (r *packetRecord) add(payload []byte) {
+	if r.overflow {
+		return
+	}
+	if r.size += int64(len(payload)); r.size > r.max {
+		r.packets, r.overflow = nil, true
+		return
+	}
+	r.packets = append(r.packets, append([]byte(nil), payload...))
+}
+
+func (p *cachePlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *cachePlan) Query(ctx *QueryContext) error {
+	c := ctx.rt.Cache
+	if c == nil {
+		return nil
+	}
+	for _, stmt := range ctx.stmts {
+		if tables, ok := ctx.writtenTables(stmt); ok {
+			c.Invalidate(tables)
+			ctx.mc.session.writes = append(ctx.mc.session.writes, func() { c.Invalidate(tables) })
+		}
+	}
+	if len(ctx.stmts) != 1 || ctx.mc.inTransaction() || !isReadOnly(ctx.stmts) {
+		return nil
+	}
+
+	stmt := ctx.stmts[0]
+	tables := ctx.tables(stmt)
+	normalized := parser.Normalize(ctx.data)
+	var ttl time.Duration
+	if m := cacheHint.FindStringSubmatch(ctx.data); m != nil {
+		ttl = c.TTL()
+		if m[1] != "" {
+			var err error
+			if ttl, err = qcache.ParseTTL(m[1]); err != nil {
+				return NewCustomError(ErUnknownError, err.Error())
+			}
+		}
+	} else {
+		var ok bool
+		if ttl, ok = c.Match(normalized, tables); !ok {
+			return nil
+		}
+	}
+
+	key := ctx.cacheKey(stmt, normalized)
+	if packets, ok := c.Get(key); ok {
+		ctx.Abort()
+		return ctx.mc.replay(packets)
+	}
+	ctx.fill = &cacheFill{key: key, tables: tables, versions: c.Versions(tables), ttl: ttl}
+	ctx.startRecord(c.MaxEntrySize())
+	return nil
+}
+
+// startRecord records the packets written for the current query, up to max
+// bytes at least.
+func (q *QueryContext) startRecord(max int64) {
+	if q.mc.record == nil {
+		q.mc.record = &packetRecord{}
+	}
+	if max > q.mc.record.max {
+		q.mc.record.max = max
+	}
+}
+
+// shareResult caches the result recorded for the current select and hands
+// it to the queries waiting for it. Nothing is shared when the select
+// failed or did not return a result set.
+func (q *QueryContext) shareResult(err error) {
+	fill, flight, record := q.fill, q.flight, q.mc.record
+	q.fill, q.flight, q.mc.record = nil, nil, nil
+	var packets [][]byte
+	if record != nil && err == nil && !record.overflow && isResultSet(record.packets) {
+		packets = record.packets
+	}
+	if flight != nil {
+		q.rt.Coalesce.Finish(flight, packets)
+	}
+	if fill != nil && packets != nil {
+		q.rt.Cache.Put(fill.key, fill.tables, fill.versions, fill.ttl, packets)
+	}
+}
+
+// isResultSet tells whether packets are a complete result set: a column
+// count, not an ok or error packet, up to an eof packet.
+func isResultSet(packets [][]byte) bool {
+	if len(packets) < 2 || len(packets[0]) == 0 {
+		return false
+	}
+	if first := packets[0][0]; first == IOK || first == IERR {
+		return false
+	}
+	last := packets[len(packets)-1]
+	return len(last) > 0 && last[0] == IEOF && len(last) < 9
+}
+
+// replay writes a cached result, with the status of the connection in its
+// eof packets.
+func (mc *MysqlConn) replay(packets [][]byte) error {
+	// rows follow the eof packet ending the column definitions
+	rows := false
+	for _, p := range packets {
+		data := make([]byte, 4, 4+len(p))
+		data = append(data, p...)
+		if p[0] == IEOF && len(p) < 9 {
+			rows = true
+			if len(p) == 5 {
+				data[7], data[8] = byte(mc.status), byte(mc.status>>8)
+			}
+		} else if rows {
+			mc.rowsSent++
+		}
+		if err := mc.writePacket(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tables returns the tables stmt references, as lower case schema.table.
+func (q *QueryContext) tables(stmt ast.Node) []string {
+	refs := sharding.TableRefs(stmt)
+	tables := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		schema := ref.Schema
+		if schema == "" {
+			schema = q.mc.database
+		}
+		tables = append(tables, strings.ToLower(schema+"."+ref.Name))
+	}
+	return tables
+}
+
+// writtenTables returns the tables stmt may write to, ok is false when it
+// writes nothing. No table means any table may be written.
+func (q *QueryContext) writtenTables(stmt ast.StmtNode) (tables []string, ok bool) {
+	switch stmt.(type) {
+	case *ast.InsertStmt, *ast.UpdateStmt, *ast.DeleteStmt, *ast.LoadDataStmt, ast.DDLNode:
+		return q.tables(stmt), true
+	case *ast.CallStmt:
+		return nil, true
+	}
+	return nil, false
+}
+
+// cacheKey identifies the result of stmt: its normalized text, the values
+// normalization replaced, the database and the user.
+func (q *QueryContext) cacheKey(stmt ast.Node, normalized string) string {
+	h := sha256.New()
+	for _, s := range []string{q.mc.cfg.User, q.mc.database, normalized} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	if q.mc.capability&ClientProtocol41 > 0 {
+		h.Write([]byte{1})
+	}
+	stmt.Accept(&paramVisitor{ctx: format.NewRestoreCtx(format.DefaultRestoreFlags, h)})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// paramVisitor restores the values of a statement.
+type paramVisitor struct {
+	ctx *format.RestoreCtx
+}
+
+func (v *paramVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	if x, ok := n.(ast.ValueExpr); ok {
+		_ = x.Restore(v.ctx)
+		v.ctx.WritePlain("\x00")
+		return n, true
+	}
+	return n, false
+}
+
+func (v *paramVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
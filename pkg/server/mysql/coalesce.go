@@ -0,0 +1,59 @@
+package mysql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// coalescePlan runs an identical select once when several sessions send
+// it at the same time: the first runs it on a backend, the others wait and
+// replay its result. Selects are identical with the same text, database
+// and user, they are coalesced outside of transactions only. A session
+// does not join a flight started before its last write ended.
+type coalescePlan struct {
+}
+
+func (p *coalescePlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *coalescePlan) Query(ctx *QueryContext) error {
+	g := ctx.rt.Coalesce
+	if g == nil {
+		return nil
+	}
+	for _, stmt := range ctx.stmts {
+		if _, ok := ctx.writtenTables(stmt); ok {
+			mc := ctx.mc
+			mc.session.writes = append(mc.session.writes, func() { mc.wroteAt = g.Seq() })
+			break
+		}
+	}
+	if len(ctx.stmts) != 1 || ctx.mc.inTransaction() || !isReadOnly(ctx.stmts) {
+		return nil
+	}
+	h := sha256.New()
+	for _, s := range []string{ctx.mc.cfg.User, ctx.mc.database, ctx.data} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	if ctx.mc.capability&ClientProtocol41 > 0 {
+		h.Write([]byte{1})
+	}
+	flight, leader := g.Join(hex.EncodeToString(h.Sum(nil)), ctx.mc.wroteAt)
+	if flight == nil {
+		return nil
+	}
+	if leader {
+		ctx.flight = flight
+		ctx.startRecord(g.MaxResultSize())
+		return nil
+	}
+	packets, err := g.Wait(ctx, flight)
+	if err != nil || packets == nil {
+		// the leader failed, run the select as usual
+		return err
+	}
+	ctx.Abort()
+	return ctx.mc.replay(packets)
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/u2takey/mysqlgate/pkg/resultlimit"
 )
 
 type MysqlConn struct {
@@ -17,6 +18,12 @@ type MysqlConn struct {
 	sequence     uint8
 	capability   ClientFlag
 	database     string
+	// attrs are the connection attributes the client sent, like
+	// program_name.
+	attrs map[string]string
+	// allowUnsafe is set by the client to run the statements the
+	// guardrails require an opt-in for.
+	allowUnsafe bool
 
 	// config
 	cfg              *Config
@@ -25,7 +32,28 @@ type MysqlConn struct {
 	writeTimeout     time.Duration
 
 	// backend
-	plan QueryPlan
+	plan    QueryPlan
+	session *session
+	// rowsSent, rowsAffected and bytesSent count what the current command
+	// sent, writeTime is the time it spent writing.
+	rowsSent     int64
+	rowsAffected int64
+	bytesSent    int64
+	writeTime    time.Duration
+	// record copies the packets written while a result is cached or
+	// shared.
+	record *packetRecord
+	// wroteAt is the flight sequence of the coalesced selects when the last
+	// write of the connection ended, the flights up to it may miss it.
+	wroteAt uint64
+	// resultCap caps the results of the current query, resultRows and
+	// resultBytes count the current result. warning is the warning of a
+	// result cut at its cap, lastWarning the one of the previous query.
+	resultCap   *resultlimit.Policy
+	resultRows  int64
+	resultBytes int64
+	warning     string
+	lastWarning string
 }
 
 func (mc *MysqlConn) handshake(ctx context.Context) error {
@@ -58,6 +86,7 @@ func (mc *MysqlConn) Run(ctx *QueryContext) error {
 	//}()
 
 	mc.plan = NewQueryPlan()
+	mc.session = newSession()
 	ctx = ctx.WithConn(mc)
 
 	for {
@@ -68,6 +97,7 @@ func (mc *MysqlConn) Run(ctx *QueryContext) error {
 		default:
 			data, err := mc.readPacket()
 			if err != nil {
+				mc.cleanup()
 				return err
 			}
 			cmd := data[0]
@@ -86,7 +116,13 @@ func (mc *MysqlConn) HandleCommand(ctx *QueryContext) (err error) {
 		// todo
 		err = mc.writeOK(nil)
 	case ComQuery:
-		err = mc.plan.Query(ctx)
+		mc.rowsSent, mc.rowsAffected, mc.bytesSent, mc.writeTime = 0, 0, 0, 0
+		mc.resultCap, mc.warning, mc.lastWarning = nil, "", mc.warning
+		err = ctx.stopTimeout(mc.plan.Query(ctx))
+		ctx.releaseAdmission()
+		ctx.shareResult(err)
+		ctx.recordDigest(err)
+		ctx.logSlow(err)
 	case ComPing:
 		err = mc.writeOK(nil)
 	case ComSetOption:
@@ -115,10 +151,22 @@ func (mc *MysqlConn) HandleCommand(ctx *QueryContext) (err error) {
 		mc.cleanup()
 		return err
 	}
+	mc.session.release(mc.inTransaction())
 	mc.sequence = 0
 	return nil
 }
 
-func (mc *MysqlConn) cleanup() {
+// inTransaction reports whether the backend session is inside a transaction,
+// either explicit or implicit because autocommit is off.
+func (mc *MysqlConn) inTransaction() bool {
+	if mc.session != nil && mc.session.xa != nil {
+		return true
+	}
+	return mc.status&StatusInTrans != 0 || mc.status&StatusInAutocommit == 0
+}
 
+func (mc *MysqlConn) cleanup() {
+	if mc.session != nil {
+		mc.session.close()
+	}
 }
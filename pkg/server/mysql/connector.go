@@ -24,6 +24,7 @@ func (c *MysqlConnector) OnConnect(ctx context.Context, conn net.Conn) (Conn, er
 		maxWriteSize:     maxPacketSize - 1,
 		cfg:              c.cfg,
 		buf:              newBuffer(conn),
+		status:           StatusInAutocommit,
 	}
 	return m, m.handshake(ctx)
 }
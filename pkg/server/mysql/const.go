@@ -1274,6 +1274,11 @@ const (
 	ErMustChangePasswordLogin                                      = 1862
 	ErRowInWrongPartition                                          = 1863
 	ErErrorLast                                                    = 1863
+	ErQueryTimeout                                                 = 3024
+
+	// ErBackendUnavailable is the proxy error of a query failed fast before
+	// reaching its backend, which clients can retry.
+	ErBackendUnavailable = 9001
 )
 
 var MySQLErrName = map[uint16]string{
@@ -2141,4 +2146,6 @@ var MySQLErrName = map[uint16]string{
 	ErAlterOperationNotSupportedReasonNotNull:               "cannot silently convert NULL values, as required in this SQL_MODE",
 	ErMustChangePasswordLogin:                               "Your password has expired. To log in you must change it using a client that supports expired passwords.",
 	ErRowInWrongPartition:                                   "Found a row in wrong partition %s",
+	ErQueryTimeout:                                          "Query execution was interrupted, maximum statement execution time exceeded",
+	ErBackendUnavailable:                                    "Circuit breaker of backend %s is open, retry later",
 }
@@ -0,0 +1,123 @@
+package mysql
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/costguard"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	parser "github.com/u2takey/sqlparser"
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// costPlan explains the selects of the guarded users on the backend they
+// run on before running them, and rejects or logs the expensive ones.
+// Selects over sharded tables are not explained, their text is not the one
+// the shards run.
+type costPlan struct {
+}
+
+func (p *costPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *costPlan) Query(ctx *QueryContext) error {
+	g := ctx.rt.CostGuard
+	if g == nil || len(ctx.stmts) != 1 || !g.Guards(ctx.mc.cfg.User) {
+		return nil
+	}
+	switch ctx.stmts[0].(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt:
+	default:
+		return nil
+	}
+	refs := sharding.TableRefs(ctx.stmts[0])
+	if len(refs) == 0 {
+		return nil
+	}
+	if ctx.rt.Router != nil {
+		for _, ref := range refs {
+			if _, ok := ctx.rt.Router.Table(ref.Name); ok {
+				return nil
+			}
+		}
+	}
+
+	key := parser.DigestNormalized(ctx.normalize()).String() + "\x00" + ctx.mc.database
+	plan, ok := g.Plan(key)
+	if !ok {
+		var err error
+		if plan, err = ctx.explain(ctx.backend()); err != nil {
+			// the select fails the same way or runs unguarded
+			mLog.Error("method", "costPlan.Query", "msg", "explain failed", "err", err.Error())
+			return nil
+		}
+		g.Store(key, plan)
+	}
+	v := g.Check(plan)
+	if v == nil {
+		return nil
+	}
+	mLog.Log("msg", "expensive select", "action", v.Action, "reason", v.Reason,
+		"user", ctx.mc.cfg.User, "database", ctx.mc.database, "query", ctx.data)
+	if v.Action == costguard.ActionReject {
+		return NewCustomError(ErTooBigSelect, "Query was blocked by cost guard: "+v.Reason)
+	}
+	return nil
+}
+
+// explain runs EXPLAIN of the current select on b with the session
+// connection, and estimates its cost.
+func (q *QueryContext) explain(b *cluster.Backend) (*costguard.Plan, error) {
+	conn, err := q.mc.session.conn(q, b)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContextExtend(q, "EXPLAIN "+q.data)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return explainPlan(rows)
+}
+
+// explainPlan reads the rows of a traditional EXPLAIN.
+func explainPlan(rows *sql.ExtendedRows) (*costguard.Plan, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]int{}
+	for i, c := range columns {
+		index[strings.ToLower(c)] = i
+	}
+	value := func(r [][]byte, name string) string {
+		if i, ok := index[name]; ok {
+			return string(r[i])
+		}
+		return ""
+	}
+	var explained []costguard.Row
+	row := newScanRow(len(columns))
+	for rows.Next() {
+		if err := rows.Scan(row.dest...); err != nil {
+			return nil, err
+		}
+		r := row.values()
+		n, _ := strconv.ParseInt(value(r, "rows"), 10, 64)
+		filtered, _ := strconv.ParseFloat(value(r, "filtered"), 64)
+		explained = append(explained, costguard.Row{
+			ID:       value(r, "id"),
+			Table:    value(r, "table"),
+			Type:     value(r, "type"),
+			Rows:     n,
+			Filtered: filtered,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return costguard.Estimate(explained), nil
+}
@@ -0,0 +1,44 @@
+package mysql
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	parser "github.com/u2takey/sqlparser"
+)
+
+// singleIn is an in list of one value, normalized apart from the longer
+// lists.
+var singleIn = regexp.MustCompile(`\bin \( \? \)`)
+
+// recordDigest counts the current query in the digest store, err is the
+// error it failed with.
+func (q *QueryContext) recordDigest(err error) {
+	if q.rt.Digests == nil {
+		return
+	}
+	q.rt.Digests.Record(q.normalize(), q.mc.cfg.User, q.mc.database, time.Since(q.trace.start), err != nil,
+		q.mc.rowsSent, q.mc.rowsAffected)
+}
+
+// normalize returns the text of the current query with its values replaced
+// by ? and its in lists collapsed.
+func (q *QueryContext) normalize() string {
+	if q.normalized != "" {
+		return q.normalized
+	}
+	var normalized string
+	if len(q.stmts) == 0 {
+		// not parsed
+		normalized = parser.Normalize(q.data)
+	} else {
+		texts := make([]string, len(q.stmts))
+		for i, stmt := range q.stmts {
+			texts[i] = strings.TrimRight(parser.Normalize(stmt.Text()), "; ")
+		}
+		normalized = strings.Join(texts, "; ")
+	}
+	q.normalized = singleIn.ReplaceAllString(normalized, "in ( ... )")
+	return q.normalized
+}
@@ -61,6 +61,10 @@ type Config struct {
 	ParseTime               bool   // Parse time values to time.Time
 	RejectReadOnly          bool   // Reject read-only connections
 	Salt                    []byte // 20 length
+	// Users are the passwords of the users clients log in as, by name.
+	// Only User with Passwd is accepted when nil. The user logged in is
+	// set in User.
+	Users map[string]string
 }
 
 // NewConfig creates a new Config and sets default values.
@@ -0,0 +1,35 @@
+package mysql
+
+import (
+	"github.com/u2takey/mysqlgate/pkg/firewall"
+	parser "github.com/u2takey/sqlparser"
+)
+
+// firewallPlan rejects the queries the firewall blocks, with the error the
+// mysql enterprise firewall returns.
+type firewallPlan struct {
+}
+
+func (p *firewallPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *firewallPlan) Query(ctx *QueryContext) error {
+	f := ctx.rt.Firewall
+	if f == nil {
+		return nil
+	}
+	err := f.Check(&firewall.Request{
+		User:     ctx.mc.cfg.User,
+		Client:   ctx.mc.netConn.RemoteAddr().String(),
+		Program:  ctx.mc.attrs["program_name"],
+		Database: ctx.mc.database,
+		Digest:   parser.DigestNormalized(ctx.normalize()).String(),
+		Query:    ctx.data,
+		Stmts:    ctx.stmts,
+	})
+	if err != nil {
+		return NewCustomError(ErAccessDeniedError, "Statement was blocked by Firewall: "+err.Error())
+	}
+	return nil
+}
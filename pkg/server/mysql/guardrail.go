@@ -0,0 +1,168 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/u2takey/mysqlgate/pkg/guardrail"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// allowUnsafeVar is the session variable opting in to the statements the
+// guardrails require an opt-in for.
+const allowUnsafeVar = "mysqlgate.allow_unsafe"
+
+// guardrailPlan checks the dangerous statements against the guardrail
+// policies, and answers the set of the mysqlgate session variables.
+type guardrailPlan struct {
+}
+
+func (p *guardrailPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *guardrailPlan) Query(ctx *QueryContext) error {
+	if len(ctx.stmts) == 1 {
+		if set, ok := ctx.stmts[0].(*ast.SetStmt); ok && setsProxyVariable(set) {
+			ctx.Abort()
+			if err := ctx.mc.setProxyVariables(set); err != nil {
+				return err
+			}
+			return ctx.mc.writeOK(nil)
+		}
+	}
+	g := ctx.rt.Guardrail
+	if g == nil {
+		return nil
+	}
+	for _, stmt := range ctx.stmts {
+		v, err := g.Check(ctx, &guardrail.Request{
+			User:      ctx.mc.cfg.User,
+			Database:  ctx.mc.database,
+			Stmt:      stmt,
+			TableRows: ctx.tableRows,
+		})
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			continue
+		}
+		switch {
+		case v.Action == guardrail.ActionReject:
+			mLog.Log("msg", "unsafe statement rejected", "check", v.Check, "user", ctx.mc.cfg.User, "query", ctx.data)
+			return NewCustomError(ErOptionPreventsStatement, "Statement was blocked by guardrail "+v.Check+": "+v.Reason)
+		case v.Action == guardrail.ActionOptIn && !ctx.mc.allowUnsafe:
+			mLog.Log("msg", "unsafe statement rejected", "check", v.Check, "user", ctx.mc.cfg.User, "query", ctx.data)
+			return NewCustomError(ErOptionPreventsStatement, fmt.Sprintf(
+				"Statement was blocked by guardrail %s: %s, SET @@%s=1 to run it", v.Check, v.Reason, allowUnsafeVar))
+		default:
+			mLog.Log("msg", "unsafe statement", "check", v.Check, "action", v.Action,
+				"user", ctx.mc.cfg.User, "database", ctx.mc.database, "query", ctx.data)
+		}
+	}
+	return nil
+}
+
+// setsProxyVariable tells whether set assigns a mysqlgate variable.
+func setsProxyVariable(set *ast.SetStmt) bool {
+	for _, v := range set.Variables {
+		if v.IsSystem && strings.HasPrefix(strings.ToLower(v.Name), "mysqlgate.") {
+			return true
+		}
+	}
+	return false
+}
+
+// setProxyVariables applies a set of mysqlgate variables, which the
+// backends do not know of.
+func (mc *MysqlConn) setProxyVariables(set *ast.SetStmt) error {
+	for _, v := range set.Variables {
+		name := strings.ToLower(v.Name)
+		if !v.IsSystem || !strings.HasPrefix(name, "mysqlgate.") {
+			return NewFormattedError(ErNotSupportedYet, "setting mysqlgate variables together with other variables")
+		}
+		if name != allowUnsafeVar {
+			return NewFormattedError(ErUnknownSystemVariable, v.Name)
+		}
+		if v.IsGlobal {
+			return NewFormattedError(ErLocalVariable, v.Name)
+		}
+		on, ok := boolValue(v.Value)
+		if !ok {
+			value, _ := sharding.Restore(v.Value)
+			return NewFormattedError(ErWrongValueForVar, v.Name, value)
+		}
+		mc.allowUnsafe = on
+	}
+	return nil
+}
+
+// boolValue reads the value of a boolean variable, default being off.
+func boolValue(e ast.ExprNode) (on bool, ok bool) {
+	if _, ok := e.(*ast.DefaultExpr); ok {
+		return false, true
+	}
+	x, ok := e.(ast.ValueExpr)
+	if !ok {
+		return false, false
+	}
+	switch v := x.GetValue().(type) {
+	case int64:
+		return v != 0, v == 0 || v == 1
+	case uint64:
+		return v != 0, v == 0 || v == 1
+	case string:
+		switch strings.ToLower(v) {
+		case "on", "true":
+			return true, true
+		case "off", "false":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// tableRows estimates the rows of t from information_schema, summed over
+// the shards of a sharded table. Shards keep the table name, the copies of
+// a reference table are counted once.
+func (q *QueryContext) tableRows(ctx context.Context, t guardrail.Table) (int64, error) {
+	if q.rt.Router != nil {
+		if table, ok := q.rt.Router.Table(t.Name); ok {
+			shards := table.Shards
+			if table.Reference {
+				shards = shards[:1]
+			}
+			var total int64
+			for _, s := range shards {
+				b, err := q.shardBackend(s, false)
+				if err != nil {
+					return 0, err
+				}
+				n, err := countRows(ctx, b.DB(), "", table.Name)
+				if err != nil {
+					return 0, err
+				}
+				total += n
+			}
+			return total, nil
+		}
+	}
+	schema := t.Schema
+	if schema == "" {
+		schema = q.mc.database
+	}
+	return countRows(ctx, q.cluster.Primary().DB(), schema, t.Name)
+}
+
+// countRows returns the estimated rows of a table of schema, the default
+// database of db when empty.
+func countRows(ctx context.Context, db *sql.DB, schema, table string) (int64, error) {
+	var rows int64
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(SUM(TABLE_ROWS), 0) FROM information_schema.TABLES "+
+		"WHERE TABLE_SCHEMA = COALESCE(NULLIF(?, ''), DATABASE()) AND TABLE_NAME = ?", schema, table).Scan(&rows)
+	return rows, err
+}
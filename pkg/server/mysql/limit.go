@@ -0,0 +1,87 @@
+package mysql
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/u2takey/mysqlgate/pkg/resultlimit"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// errResultCut stops writing the rows of a result cut at a cap.
+var errResultCut = errors.New("result cut at cap")
+
+// limitPlan adds the default limit of the user to the selects without
+// one, and caps the results of the query. It answers SHOW WARNINGS after a
+// result was cut, the backend knowing nothing of the warning.
+type limitPlan struct {
+}
+
+func (p *limitPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *limitPlan) Query(ctx *QueryContext) error {
+	l := ctx.rt.Limits
+	if l == nil || len(ctx.stmts) != 1 {
+		return nil
+	}
+	if show, ok := ctx.stmts[0].(*ast.ShowStmt); ok && show.Tp == ast.ShowWarnings && ctx.mc.lastWarning != "" {
+		ctx.Abort()
+		return ctx.showWarning(ctx.mc.lastWarning)
+	}
+	policy := l.Policy(ctx.mc.cfg.User)
+	if policy == nil {
+		return nil
+	}
+	ctx.mc.resultCap = policy
+	if policy.DefaultLimit > 0 && resultlimit.AddLimit(ctx.stmts[0], policy.DefaultLimit) {
+		query, err := sharding.Restore(ctx.stmts[0])
+		if err != nil {
+			return err
+		}
+		ctx.data = query
+	}
+	return nil
+}
+
+// warningColumns are the columns of SHOW WARNINGS.
+var warningColumns = []*sql.ColumnType{
+	{RawType: columnDefinition("Level", fieldTypeVarString, uint16(collations["utf8_general_ci"]), 21)},
+	{RawType: columnDefinition("Code", fieldTypeLong, uint16(collations[binaryCollation]), 4)},
+	{RawType: columnDefinition("Message", fieldTypeVarString, uint16(collations["utf8_general_ci"]), 1536)},
+}
+
+// showWarning answers SHOW WARNINGS with the warning of the previous
+// query.
+func (q *QueryContext) showWarning(warning string) error {
+	code := strconv.Itoa(int(ErUnknownError))
+	return q.mc.writeStream(warningColumns, &sliceStream{rows: [][][]byte{
+		{[]byte("Warning"), []byte(code), []byte(warning)},
+	}})
+}
+
+// capResult ends the result going past the cap of p: cut with a warning,
+// or with an error. The rest of a cut result is not read outside of a
+// transaction, the backend connections sending it are closed instead.
+func (mc *MysqlConn) capResult(p *resultlimit.Policy) error {
+	mLog.Log("msg", "result capped", "user", mc.cfg.User, "rows", mc.resultRows, "bytes", mc.resultBytes, "truncate", p.Truncate)
+	if p.Truncate {
+		mc.warning = p.Reason() + ", the rest of the rows was cut"
+		if !mc.inTransaction() {
+			mc.session.discard()
+		}
+		return errResultCut
+	}
+	return NewCustomError(ErUnknownError, p.Reason()+", add a LIMIT or a narrower WHERE")
+}
+
+// warningCount is the warning count sent in eof packets.
+func (mc *MysqlConn) warningCount() uint16 {
+	if mc.warning != "" {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,224 @@
+package mysql
+
+import (
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// resolveLookup narrows a route found through a lookup column to the shards
+// the lookup table maps its values to. The mappings are read from the
+// primary, a lagging replica would miss those of the rows just written and
+// send the query to the wrong shard.
+func (q *QueryContext) resolveLookup(route *sharding.Route) error {
+	b, err := q.clusterBackend(route.Lookup.Cluster, false)
+	if err != nil {
+		return err
+	}
+	rows, err := q.queryBackend(b, route.Lookup.SelectQuery(route.LookupValues))
+	if err != nil {
+		return err
+	}
+	keys, err := readKeys(rows)
+	_ = rows.Close()
+	if err != nil {
+		return err
+	}
+	if !q.mc.inTransaction() {
+		// a write of the route may run in a transaction of its own, it
+		// starts without connections
+		q.mc.session.drop(b)
+	}
+	return route.Narrow(keys)
+}
+
+func readKeys(rows *sql.ExtendedRows) ([]string, error) {
+	var keys []string
+	stream := newRowsStream(rows, 1)
+	for {
+		row, err := stream.next()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			return keys, nil
+		}
+		if row[0] != nil {
+			keys = append(keys, string(row[0]))
+		}
+	}
+}
+
+// lookupWrite keeps the lookup tables of a dml statement up to date. New
+// mappings are added before the statement runs and stale ones removed after
+// it, so a lookup never misses a row that exists. It runs in the
+// transaction of the statement, which holds the locks of the rows read.
+type lookupWrite struct {
+	route   *sharding.Route
+	lookups []*sharding.Lookup
+	added   map[*sharding.Lookup][]sharding.LookupRow
+	removed map[*sharding.Lookup][]sharding.LookupRow
+	// inserted are the lookups whose added mappings were written.
+	inserted []*sharding.Lookup
+}
+
+// prepareLookups reads the lookup values stmt changes and adds the new
+// mappings.
+func (q *QueryContext) prepareLookups(stmt ast.StmtNode, route *sharding.Route) (*lookupWrite, error) {
+	lw := &lookupWrite{
+		route:   route,
+		lookups: route.Table.Lookups,
+		added:   map[*sharding.Lookup][]sharding.LookupRow{},
+		removed: map[*sharding.Lookup][]sharding.LookupRow{},
+	}
+	for l, rows := range route.LookupInserts {
+		lw.added[l] = rows
+	}
+	query, lookups, err := route.LookupSelect(stmt)
+	if err != nil {
+		return nil, err
+	}
+	if query != "" {
+		if err := q.readLookups(stmt, route, query, lookups, lw); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, l := range lw.lookups {
+		if len(lw.added[l]) == 0 {
+			continue
+		}
+		if err := q.execCluster(l.Cluster, l.InsertQuery(lw.added[l])); err != nil {
+			lw.rollback(q)
+			return nil, err
+		}
+		lw.inserted = append(lw.inserted, l)
+	}
+	return lw, nil
+}
+
+// readLookups reads the current lookup values of the rows stmt changes.
+func (q *QueryContext) readLookups(stmt ast.StmtNode, route *sharding.Route, query string, lookups []*sharding.Lookup, lw *lookupWrite) error {
+	results, err := q.queryShards(route.Table, route.Shards, query, false)
+	if err != nil {
+		return err
+	}
+	defer closeRows(results)
+	_, isDelete := stmt.(*ast.DeleteStmt)
+	for _, r := range results {
+		stream := newRowsStream(r, len(lookups)+1)
+		for {
+			row, err := stream.next()
+			if err != nil {
+				return err
+			}
+			if row == nil {
+				break
+			}
+			key := row[len(lookups)]
+			if key == nil {
+				continue
+			}
+			for i, l := range lookups {
+				old := row[i]
+				if isDelete {
+					if old != nil {
+						lw.removed[l] = append(lw.removed[l], sharding.LookupRow{Value: string(old), Key: string(key)})
+					}
+					continue
+				}
+				value := route.LookupUpdates[l]
+				if value != nil && old != nil && *value == string(old) {
+					continue
+				}
+				if old != nil {
+					lw.removed[l] = append(lw.removed[l], sharding.LookupRow{Value: string(old), Key: string(key)})
+				}
+				if value != nil {
+					lw.added[l] = append(lw.added[l], sharding.LookupRow{Value: *value, Key: string(key)})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// commit removes the stale mappings once the statement succeeded, but the
+// ones of non unique lookups other rows still have.
+func (lw *lookupWrite) commit(q *QueryContext) error {
+	for _, l := range lw.lookups {
+		removed := lw.removed[l]
+		if len(removed) > 0 && !l.Unique {
+			var err error
+			if removed, err = lw.unused(q, l, removed); err != nil {
+				return err
+			}
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		if err := q.execCluster(l.Cluster, l.DeleteQuery(removed)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unused returns the mappings of rows no row of the shards of the
+// statement has anymore.
+func (lw *lookupWrite) unused(q *QueryContext, l *sharding.Lookup, rows []sharding.LookupRow) ([]sharding.LookupRow, error) {
+	results, err := q.queryShards(lw.route.Table, lw.route.Shards, l.RemainingQuery(lw.route.Table.Name, rows), false)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(results)
+	remaining := map[sharding.LookupRow]bool{}
+	for _, r := range results {
+		stream := newRowsStream(r, 2)
+		for {
+			row, err := stream.next()
+			if err != nil {
+				return nil, err
+			}
+			if row == nil {
+				break
+			}
+			remaining[sharding.LookupRow{Value: string(row[0]), Key: string(row[1])}] = true
+		}
+	}
+	unused := rows[:0:0]
+	for _, r := range rows {
+		if !remaining[r] {
+			unused = append(unused, r)
+		}
+	}
+	return unused, nil
+}
+
+// rollback removes the mappings added for a statement that failed. Only
+// unique lookups are sure to have created them, a mapping left behind in
+// the others just costs a useless shard lookup.
+func (lw *lookupWrite) rollback(q *QueryContext) {
+	for _, l := range lw.inserted {
+		if !l.Unique {
+			continue
+		}
+		if err := q.execCluster(l.Cluster, l.DeleteQuery(lw.added[l])); err != nil {
+			mLog.Error("msg", "removing lookup rows", "table", l.Table, "err", err)
+		}
+	}
+}
+
+// execCluster runs a statement without result set on the primary of the
+// cluster called name.
+func (q *QueryContext) execCluster(name, query string) error {
+	b, err := q.clusterBackend(name, false)
+	if err != nil {
+		return err
+	}
+	rows, err := q.queryBackend(b, query)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
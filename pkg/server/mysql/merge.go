@@ -0,0 +1,357 @@
+package mysql
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/sqlparser/charset"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// scanRow is the scan destination of a text row.
+type scanRow struct {
+	dest []interface{}
+}
+
+func newScanRow(n int) *scanRow {
+	r := &scanRow{dest: make([]interface{}, n)}
+	for i := range r.dest {
+		var b []byte
+		r.dest[i] = &b
+	}
+	return r
+}
+
+func (r *scanRow) values() [][]byte {
+	values := make([][]byte, len(r.dest))
+	for i := range r.dest {
+		values[i] = *r.dest[i].(*[]byte)
+	}
+	return values
+}
+
+// rowStream is a source of rows, next returns a nil row at the end.
+type rowStream interface {
+	next() ([][]byte, error)
+}
+
+type rowsStream struct {
+	rows *sql.ExtendedRows
+	row  *scanRow
+}
+
+func newRowsStream(rows *sql.ExtendedRows, columns int) *rowsStream {
+	return &rowsStream{rows: rows, row: newScanRow(columns)}
+}
+
+func (s *rowsStream) next() ([][]byte, error) {
+	if !s.rows.Next() {
+		return nil, s.rows.Err()
+	}
+	if err := s.rows.Scan(s.row.dest...); err != nil {
+		return nil, err
+	}
+	return s.row.values(), nil
+}
+
+// concatStream returns the rows of its streams one stream after the other.
+type concatStream struct {
+	streams []rowStream
+}
+
+func (s *concatStream) next() ([][]byte, error) {
+	for len(s.streams) > 0 {
+		row, err := s.streams[0].next()
+		if err != nil || row != nil {
+			return row, err
+		}
+		s.streams = s.streams[1:]
+	}
+	return nil, nil
+}
+
+// sortKey is a resolved order by key of a merge.
+type sortKey struct {
+	index int
+	desc  bool
+	order *valueOrder
+}
+
+// resolveSortKeys maps the order by keys of plan to the columns of the
+// shard results.
+func resolveSortKeys(keys []sharding.OrderKey, columnTypes []*sql.ColumnType) ([]sortKey, error) {
+	resolved := make([]sortKey, 0, len(keys))
+	for _, k := range keys {
+		index := k.Index
+		if k.Name != "" {
+			index = -1
+			for i, ct := range columnTypes {
+				if strings.EqualFold(ct.Name(), k.Name) {
+					index = i
+					break
+				}
+			}
+		} else if index < 0 {
+			index += len(columnTypes)
+		}
+		if index < 0 || index >= len(columnTypes) {
+			return nil, NewCustomError(ErUnknownError, "order by column not found in shard results")
+		}
+		resolved = append(resolved, sortKey{
+			index: index,
+			desc:  k.Desc,
+			order: newValueOrder(columnTypes[index]),
+		})
+	}
+	return resolved, nil
+}
+
+func isNumericType(name string) bool {
+	switch name {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR", "DECIMAL", "FLOAT", "DOUBLE":
+		return true
+	}
+	return false
+}
+
+// valueOrder compares the values of a column the way mysql does: numbers
+// by value and strings by the collation of the column, bytes for binary
+// collations. A collator is not safe for concurrent use, nor is the order
+// holding it.
+type valueOrder struct {
+	numeric bool
+	// collator is nil for binary collations.
+	collator *collate.Collator
+	// padSpace ignores trailing spaces, as collations older than the 0900
+	// ones do.
+	padSpace bool
+}
+
+var binaryOrder = &valueOrder{}
+
+// numericOrder compares numbers.
+var numericOrder = &valueOrder{numeric: true}
+
+func newValueOrder(ct *sql.ColumnType) *valueOrder {
+	if isNumericType(ct.DatabaseTypeName()) {
+		return numericOrder
+	}
+	id, ok := columnCollation(ct.RawType)
+	if !ok {
+		return binaryOrder
+	}
+	co, err := charset.GetCollationByID(int(id))
+	if err != nil || co.Name == charset.CollationBin {
+		return binaryOrder
+	}
+	return collationOrder(co.Name)
+}
+
+// collationOrder returns the order of the collation called name.
+func collationOrder(name string) *valueOrder {
+	o := &valueOrder{padSpace: !strings.Contains(name, "_0900_")}
+	switch {
+	case strings.HasSuffix(name, "_bin"):
+	case strings.HasSuffix(name, "_as_ci"):
+		o.collator = collate.New(language.Und, collate.IgnoreCase)
+	case strings.HasSuffix(name, "_ci"):
+		o.collator = collate.New(language.Und, collate.IgnoreCase, collate.IgnoreDiacritics)
+	default:
+		o.collator = collate.New(language.Und)
+	}
+	return o
+}
+
+// columnCollation returns the collation id of a column definition packet.
+func columnCollation(def []byte) (id uint16, ok bool) {
+	pos := 0
+	// catalog, schema, table, org_table, name and org_name
+	for i := 0; i < 6; i++ {
+		n, err := skipLengthEncodedString(def[pos:])
+		if err != nil {
+			return 0, false
+		}
+		pos += n
+	}
+	// length of the fixed length fields
+	pos++
+	if pos+2 > len(def) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint16(def[pos:]), true
+}
+
+// compare orders a and b, NULL first.
+func (o *valueOrder) compare(a, b []byte) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if o.numeric {
+		if x, err := strconv.ParseInt(string(a), 10, 64); err == nil {
+			if y, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+				switch {
+				case x < y:
+					return -1
+				case x > y:
+					return 1
+				}
+				return 0
+			}
+		}
+		x, errX := strconv.ParseFloat(string(a), 64)
+		y, errY := strconv.ParseFloat(string(b), 64)
+		if errX == nil && errY == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if o.padSpace {
+		a, b = bytes.TrimRight(a, " "), bytes.TrimRight(b, " ")
+	}
+	if o.collator != nil {
+		return o.collator.Compare(a, b)
+	}
+	return bytes.Compare(a, b)
+}
+
+// key returns a value equal for the values the order finds equal.
+func (o *valueOrder) key(buf *collate.Buffer, v []byte) []byte {
+	if o.padSpace {
+		v = bytes.TrimRight(v, " ")
+	}
+	if o.collator == nil {
+		return v
+	}
+	buf.Reset()
+	return o.collator.Key(buf, v)
+}
+
+// compareRows orders rows by keys.
+func compareRows(a, b [][]byte, keys []sortKey) int {
+	for _, k := range keys {
+		c := k.order.compare(a[k.index], b[k.index])
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// mergeStream merges streams sorted by keys into one sorted stream.
+type mergeStream struct {
+	keys    []sortKey
+	streams []rowStream
+	heads   mergeHeap
+	started bool
+}
+
+func newMergeStream(streams []rowStream, keys []sortKey) *mergeStream {
+	return &mergeStream{keys: keys, streams: streams, heads: mergeHeap{keys: keys}}
+}
+
+func (m *mergeStream) next() ([][]byte, error) {
+	if !m.started {
+		m.started = true
+		for i, s := range m.streams {
+			row, err := s.next()
+			if err != nil {
+				return nil, err
+			}
+			if row != nil {
+				m.heads.items = append(m.heads.items, mergeItem{row: row, stream: i})
+			}
+		}
+		heap.Init(&m.heads)
+	}
+	if len(m.heads.items) == 0 {
+		return nil, nil
+	}
+	top := m.heads.items[0]
+	row, err := m.streams[top.stream].next()
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		heap.Pop(&m.heads)
+	} else {
+		m.heads.items[0].row = row
+		heap.Fix(&m.heads, 0)
+	}
+	return top.row, nil
+}
+
+type mergeItem struct {
+	row    [][]byte
+	stream int
+}
+
+type mergeHeap struct {
+	keys  []sortKey
+	items []mergeItem
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	c := compareRows(h.items[i].row, h.items[j].row, h.keys)
+	if c == 0 {
+		return h.items[i].stream < h.items[j].stream
+	}
+	return c < 0
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(mergeItem))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// limitStream skips offset rows of its stream and stops after count rows.
+type limitStream struct {
+	stream rowStream
+	offset uint64
+	count  uint64
+}
+
+func (s *limitStream) next() ([][]byte, error) {
+	for ; s.offset > 0; s.offset-- {
+		row, err := s.stream.next()
+		if err != nil || row == nil {
+			return row, err
+		}
+	}
+	if s.count == 0 {
+		return nil, nil
+	}
+	s.count--
+	return s.stream.next()
+}
@@ -0,0 +1,126 @@
+package mysql
+
+import (
+	"testing"
+)
+
+// columnDef builds a column definition packet of a column with collation.
+func columnDef(name string, collation uint16) []byte {
+	var def []byte
+	for _, s := range []string{"def", "test", "t", "t", name, name} {
+		def = appendLengthEncodedString(def, []byte(s))
+	}
+	def = append(def, 0x0c, byte(collation), byte(collation>>8))
+	return append(def, 0, 0, 0, 0, 0xfd, 0, 0, 0, 0, 0)
+}
+
+func TestColumnCollation(t *testing.T) {
+	id, ok := columnCollation(columnDef("name", 255))
+	if !ok || id != 255 {
+		t.Fatalf("got %d %v, want 255", id, ok)
+	}
+	if _, ok := columnCollation([]byte{3, 'd', 'e'}); ok {
+		t.Fatal("truncated packet parsed")
+	}
+}
+
+func TestValueOrder(t *testing.T) {
+	tests := []struct {
+		order *valueOrder
+		a, b  string
+		want  int
+	}{
+		{numericOrder, "9", "10", -1},
+		{numericOrder, "-1.5", "-1.25", -1},
+		{binaryOrder, "B", "a", -1},
+		{collationOrder("utf8mb4_general_ci"), "a", "B", -1},
+		{collationOrder("utf8mb4_general_ci"), "abc", "ABC", 0},
+		{collationOrder("utf8mb4_general_ci"), "abc  ", "ABC", 0},
+		{collationOrder("utf8mb4_0900_ai_ci"), "é", "E", 0},
+		{collationOrder("utf8mb4_0900_ai_ci"), "abc ", "abc", 1},
+		{collationOrder("utf8mb4_0900_as_ci"), "é", "e", 1},
+		{collationOrder("utf8mb4_bin"), "B", "a", -1},
+	}
+	for _, tt := range tests {
+		if got := tt.order.compare([]byte(tt.a), []byte(tt.b)); sign(got) != tt.want {
+			t.Errorf("compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+	if c := binaryOrder.compare(nil, []byte{}); c != -1 {
+		t.Errorf("NULL compared %d to empty, want -1", c)
+	}
+}
+
+func sign(c int) int {
+	switch {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	}
+	return 0
+}
+
+type testStream struct {
+	rows [][][]byte
+}
+
+func (s *testStream) next() ([][]byte, error) {
+	if len(s.rows) == 0 {
+		return nil, nil
+	}
+	row := s.rows[0]
+	s.rows = s.rows[1:]
+	return row, nil
+}
+
+func rowsOf(values ...string) [][][]byte {
+	rows := make([][][]byte, len(values))
+	for i, v := range values {
+		rows[i] = [][]byte{[]byte(v)}
+	}
+	return rows
+}
+
+func TestMergeStream(t *testing.T) {
+	keys := []sortKey{{index: 0, order: collationOrder("utf8mb4_general_ci")}}
+	// each shard sorted its rows case insensitively
+	m := newMergeStream([]rowStream{
+		&testStream{rows: rowsOf("apple", "Cherry", "melon")},
+		&testStream{rows: rowsOf("Banana", "date")},
+	}, keys)
+	var got []string
+	for {
+		row, err := m.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row == nil {
+			break
+		}
+		got = append(got, string(row[0]))
+	}
+	want := []string{"apple", "Banana", "Cherry", "date", "melon"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	limited := &limitStream{stream: newMergeStream([]rowStream{
+		&testStream{rows: rowsOf("1", "4")},
+		&testStream{rows: rowsOf("2", "3")},
+	}, []sortKey{{index: 0, desc: false, order: numericOrder}}), offset: 1, count: 2}
+	for _, want := range []string{"2", "3"} {
+		row, err := limited.next()
+		if err != nil || row == nil || string(row[0]) != want {
+			t.Fatalf("got %q %v, want %s", row, err, want)
+		}
+	}
+	if row, _ := limited.next(); row != nil {
+		t.Fatalf("got %q past the limit", row)
+	}
+}
@@ -77,6 +77,11 @@ func (mc *MysqlConn) readPacket() ([]byte, error) {
 // Write packet buffer 'data'
 func (mc *MysqlConn) writePacket(data []byte) error {
 	pktLen := len(data) - 4
+	if mc.record != nil {
+		mc.record.add(data[4:])
+	}
+	mc.bytesSent += int64(pktLen)
+	defer func(start time.Time) { mc.writeTime += time.Since(start) }(time.Now())
 
 	if pktLen > mc.maxAllowedPacket {
 		return ErrPktTooLarge
@@ -165,6 +170,7 @@ func (mc *MysqlConn) writeOK(r *MysqlResult) error {
 	if r == nil {
 		r = &MysqlResult{Status: mc.status}
 	}
+	mc.rowsAffected += int64(r.AffectedRows)
 	data := make([]byte, 4, 32)
 	data = append(data, IOK)
 
@@ -203,25 +209,54 @@ func (mc *MysqlConn) writeEOF(status uint16) error {
 	data := make([]byte, 4, 9)
 	data = append(data, IEOF)
 	if mc.capability&ClientProtocol41 > 0 {
-		data = append(data, 0, 0)
+		warnings := mc.warningCount()
+		data = append(data, byte(warnings), byte(warnings>>8))
 		data = append(data, byte(status), byte(status>>8))
 	}
 	return mc.writePacket(data)
 }
 
 func (mc *MysqlConn) writeResultSet(r *sql.ExtendedRows) error {
-	data := make([]byte, 4, 512)
-	columns, err := r.Columns()
+	columnTypes, err := r.ColumnTypes()
 	if err != nil {
 		return err
 	}
-	columnTypes, err := r.ColumnTypes()
+	err = mc.writeColumns(columnTypes, r.Status)
 	if err != nil {
 		return err
 	}
+
+	// rows
+	row := newScanRow(len(columnTypes))
+	for r.Next() {
+		err = r.Scan(row.dest...)
+		if err != nil {
+			return err
+		}
+		err = mc.writeRow(row.values())
+		if err == errResultCut {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = r.Err(); err != nil {
+		return err
+	}
+
+	err = mc.writeEOF(r.Status)
+	return err
+}
+
+// writeColumns writes the column count and definitions of a result set,
+// terminated by an eof packet.
+func (mc *MysqlConn) writeColumns(columnTypes []*sql.ColumnType, status uint16) error {
+	mc.resultRows, mc.resultBytes = 0, 0
+	data := make([]byte, 4, 512)
 	// number of columns
-	data = appendLengthEncodedInteger(data, uint64(len(columns)))
-	err = mc.writePacket(data)
+	data = appendLengthEncodedInteger(data, uint64(len(columnTypes)))
+	err := mc.writePacket(data)
 	if err != nil {
 		return err
 	}
@@ -234,34 +269,67 @@ func (mc *MysqlConn) writeResultSet(r *sql.ExtendedRows) error {
 			return err
 		}
 	}
-	err = mc.writeEOF(r.Status)
+	return mc.writeEOF(status)
+}
+
+// columnDefinition returns the definition of a column of a result made by
+// the proxy.
+func columnDefinition(name string, typ fieldType, charset uint16, length uint32) []byte {
+	var def []byte
+	for _, s := range []string{"def", "", "", "", name, ""} {
+		def = appendLengthEncodedString(def, []byte(s))
+	}
+	// type, flags, decimals and filler follow the length
+	return append(def, 0x0c, byte(charset), byte(charset>>8),
+		byte(length), byte(length>>8), byte(length>>16), byte(length>>24),
+		byte(typ), 0, 0, 0, 0, 0)
+}
+
+// writeStream writes the rows of stream as a result set, values past the
+// given columns are dropped.
+func (mc *MysqlConn) writeStream(columnTypes []*sql.ColumnType, stream rowStream) error {
+	err := mc.writeColumns(columnTypes, uint16(mc.status))
 	if err != nil {
 		return err
 	}
-
-	// rows
-	for r.Next() {
-		rowData := make([]interface{}, len(columnTypes))
-		for i := range columnTypes {
-			var b []byte
-			rowData[i] = &b
-		}
-		err = r.Scan(rowData...)
+	for {
+		row, err := stream.next()
 		if err != nil {
 			return err
 		}
-		data = data[0:4]
-		for i := range columnTypes {
-			data = appendLengthEncodedString(data, *rowData[i].(*[]byte))
+		if row == nil {
+			break
+		}
+		err = mc.writeRow(row[:len(columnTypes)])
+		if err == errResultCut {
+			break
 		}
-		err = mc.writePacket(data)
 		if err != nil {
 			return err
 		}
 	}
+	return mc.writeEOF(uint16(mc.status))
+}
 
-	err = mc.writeEOF(r.Status)
-	return err
+// writeRow writes a text protocol row, nil values are sent as NULL.
+func (mc *MysqlConn) writeRow(values [][]byte) error {
+	data := make([]byte, 4, 512)
+	for _, v := range values {
+		if v == nil {
+			data = append(data, 0xfb)
+			continue
+		}
+		data = appendLengthEncodedString(data, v)
+	}
+	if p := mc.resultCap; p != nil {
+		mc.resultRows++
+		mc.resultBytes += int64(len(data) - 4)
+		if p.Capped(mc.resultRows, mc.resultBytes) {
+			return mc.capResult(p)
+		}
+	}
+	mc.rowsSent++
+	return mc.writePacket(data)
 }
 
 /******************************************************************************
@@ -346,7 +414,13 @@ func (mc *MysqlConn) readHandshakeResponse() error {
 	}
 
 	// check user
-	if mc.cfg.User != username {
+	if mc.cfg.Users != nil {
+		passwd, ok := mc.cfg.Users[username]
+		if !ok {
+			return NewFormattedError(ErAccessDeniedError, username, mc.netConn.RemoteAddr().String(), "Yes")
+		}
+		mc.cfg.User, mc.cfg.Passwd = username, passwd
+	} else if mc.cfg.User != username {
 		return NewFormattedError(ErAccessDeniedError, username, mc.netConn.RemoteAddr().String(), "Yes")
 	}
 
@@ -373,6 +447,41 @@ func (mc *MysqlConn) readHandshakeResponse() error {
 		mc.database = string(data[pos : pos+bytes.IndexByte(data[pos:], 0)])
 		pos += len(mc.database) + 1
 	}
-	// ignore auth plugin name and connect attrs
+	// skip auth plugin name
+	if mc.capability&ClientPluginAuth > 0 {
+		i := bytes.IndexByte(data[pos:], 0)
+		if i < 0 {
+			return nil
+		}
+		pos += i + 1
+	}
+	if mc.capability&ClientConnectAttrs > 0 && pos < len(data) {
+		mc.attrs = readConnectAttrs(data[pos:])
+	}
 	return nil
 }
+
+// readConnectAttrs reads the connection attributes of a handshake response,
+// what is malformed is dropped.
+func readConnectAttrs(data []byte) map[string]string {
+	size, _, n := readLengthEncodedInteger(data)
+	if n == 0 || uint64(len(data)-n) < size {
+		return nil
+	}
+	data = data[n : n+int(size)]
+	attrs := map[string]string{}
+	for len(data) > 0 {
+		key, _, n, err := readLengthEncodedString(data)
+		if err != nil {
+			return attrs
+		}
+		data = data[n:]
+		value, _, n, err := readLengthEncodedString(data)
+		if err != nil {
+			return attrs
+		}
+		data = data[n:]
+		attrs[string(key)] = string(value)
+	}
+	return attrs
+}
@@ -2,9 +2,11 @@ package mysql
 
 import (
 	"context"
+	"time"
 
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/qcache"
 	"github.com/u2takey/mysqlgate/pkg/sql"
-	"github.com/u2takey/mysqlgate/pkg/sql/driver"
 	parser "github.com/u2takey/sqlparser"
 	"github.com/u2takey/sqlparser/ast"
 	_ "github.com/u2takey/sqlparser/test_driver"
@@ -12,24 +14,49 @@ import (
 
 type QueryContext struct {
 	context.Context
-	mc   *MysqlConn
-	db   *sql.DB
-	data string
-	cmd  byte
+	// base is the context of the connection, the current query may run
+	// with a context derived from it.
+	base    context.Context
+	mc      *MysqlConn
+	rt      *Runtime
+	cluster *cluster.Cluster
+	data    string
+	cmd     byte
 
 	stmts     []ast.StmtNode
 	sqlParsed uint8
 
 	aborted bool
 	lastErr error
-}
-
-func NewQueryContext(ctx context.Context, db *sql.DB) *QueryContext {
-	return &QueryContext{Context: ctx, db: db}
+	// fill is set while the result of a select is recorded for the cache.
+	fill *cacheFill
+	// flight is set while the select leads the identical ones coalesced
+	// with it.
+	flight *qcache.Flight
+	// trace times the phases of the current query.
+	trace queryTrace
+	// normalized caches the normalized text of the current query.
+	normalized string
+	// timeout is set while the current query has an execution time limit.
+	timeout *queryTimeout
+	// release releases the current query from admission control.
+	release func()
+	// retry is set when the current statement may run again on a
+	// transient error.
+	retry bool
+	// picked is the backend the current statements run on, once chosen.
+	picked *cluster.Backend
+}
+
+func NewQueryContext(ctx context.Context, rt *Runtime) *QueryContext {
+	return &QueryContext{Context: ctx, base: ctx, rt: rt, cluster: rt.Clusters.Default()}
 }
 
 func (q *QueryContext) WithCmdData(cmd byte, data string) *QueryContext {
-	q.cmd, q.data = cmd, data
+	q.Context, q.cmd, q.data = q.base, cmd, data
+	q.stmts, q.sqlParsed = nil, 0
+	q.aborted, q.lastErr, q.retry, q.picked = false, nil, false, nil
+	q.trace, q.normalized = queryTrace{start: time.Now()}, ""
 	return q
 }
 
@@ -42,6 +69,69 @@ func (q *QueryContext) Abort() {
 	q.aborted = true
 }
 
+// queryBackend runs query on b with the session connection to b, timing it
+// for the cluster balancer. A statement failing on a transient error is run
+// again when the retry policy allows it.
+func (q *QueryContext) queryBackend(b *cluster.Backend, query string) (*sql.ExtendedRows, error) {
+	var rows *sql.ExtendedRows
+	for attempt := 1; ; attempt++ {
+		conn, err := q.mc.session.conn(q, b)
+		if err == nil {
+			if rows, err = q.queryConn(b, conn, query); err == nil {
+				break
+			}
+		}
+		d, ok := q.retryDelay(b, err, attempt)
+		if !ok {
+			return nil, err
+		}
+		q.dropConn(b)
+		if sleepContext(q, d) != nil {
+			return nil, err
+		}
+	}
+	q.mc.status = StatusFlag(rows.Status)
+	if q.mc.session.xa != nil {
+		q.mc.status |= StatusInTrans
+	}
+	return rows, nil
+}
+
+// dropConn gives back the session connection to b after a failed attempt,
+// no longer to be killed on timeout once another query may run on it.
+func (q *QueryContext) dropConn(b *cluster.Backend) {
+	if t := q.timeout; t != nil {
+		t.untrack(b)
+	}
+	q.mc.session.drop(b)
+}
+
+func (q *QueryContext) queryConn(b *cluster.Backend, conn *sql.Conn, query string) (*sql.ExtendedRows, error) {
+	q.trace.backend(b)
+	if t := q.timeout; t != nil {
+		t.track(b, conn)
+	}
+	start := b.Start()
+	rows, err := conn.QueryContextExtend(q, query)
+	b.Finish(start, err)
+	return rows, err
+}
+
+// backend returns the backend the current statements run on: reads outside
+// of a transaction go to a replica, anything else to the primary. It is
+// picked once per query, the plans looking at it first see the one the
+// query runs on.
+func (q *QueryContext) backend() *cluster.Backend {
+	if q.picked == nil {
+		if !q.mc.inTransaction() && isReadOnly(q.stmts) {
+			q.picked = q.cluster.PickReplica()
+		} else {
+			q.picked = q.cluster.Primary()
+		}
+	}
+	return q.picked
+}
+
 type QueryPlan interface {
 	Query(ctx *QueryContext) error
 	InitDB(ctx *QueryContext) error
@@ -55,6 +145,19 @@ func NewQueryPlan() QueryPlan {
 	return &aggregatedQueryPlan{
 		plans: []QueryPlan{
 			&parserPlan{},
+			&timeoutPlan{},
+			&priorityPlan{},
+			&admissionPlan{},
+			&firewallPlan{},
+			&guardrailPlan{},
+			&cachePlan{},
+			&coalescePlan{},
+			&costPlan{},
+			&limitPlan{},
+			&retryPlan{},
+			&xaPlan{},
+			&schemaPlan{},
+			&shardingPlan{},
 			&defaultQueryPlan{},
 		},
 	}
@@ -88,44 +191,43 @@ type defaultQueryPlan struct {
 }
 
 func (q *defaultQueryPlan) InitDB(ctx *QueryContext) error {
-	conn, err := ctx.db.Conn(ctx)
-	if err != nil {
-		return err
+	backends := ctx.mc.session.pinned()
+	if len(backends) == 0 {
+		backends = []*cluster.Backend{ctx.cluster.Primary()}
 	}
-	err = conn.Raw(func(driverConn interface{}) error {
-		if c, ok := driverConn.(driver.ConnExtend); !ok {
-			return NewCustomError(ErUnknownError, "init db not supported on backend driver")
-		} else {
-			if err := c.UseDb(ctx, ctx.data); err != nil {
-				return err
-			}
-			ctx.mc.database = ctx.data
-			return nil
+	for _, b := range backends {
+		conn, err := ctx.mc.session.conn(ctx, b)
+		if err != nil {
+			return err
+		}
+		if err := useDb(ctx, conn, ctx.data); err != nil {
+			return err
 		}
-	})
-	if err != nil {
-		return err
 	}
+	ctx.mc.database = ctx.data
 	return ctx.mc.writeOK(nil)
 }
 
 func (q *defaultQueryPlan) Query(ctx *QueryContext) error {
-	conn, err := ctx.db.Conn(ctx)
-	if err != nil {
-		return err
-	}
-	rows, err := conn.QueryContextExtend(ctx, ctx.data)
+	rows, err := ctx.queryBackend(ctx.backend(), ctx.data)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+	return ctx.writeResult(rows)
+}
+
+// writeResult sends rows to the client, as an ok packet when the statement
+// returned no column.
+func (q *QueryContext) writeResult(rows *sql.ExtendedRows) error {
 	if col, err := rows.Columns(); err == nil && len(col) == 0 {
-		return ctx.mc.writeOK(&MysqlResult{
+		return q.mc.writeOK(&MysqlResult{
 			Status:       StatusFlag(rows.Status),
 			AffectedRows: rows.AffectedRows,
 			InsertId:     rows.InsertId,
 		})
 	}
-	return ctx.mc.writeResultSet(rows)
+	return q.mc.writeResultSet(rows)
 }
 
 type parserPlan struct {
@@ -143,5 +245,6 @@ func (q *parserPlan) Query(ctx *QueryContext) error {
 	}
 	ctx.sqlParsed += 1
 	ctx.stmts = stmts
+	ctx.trace.parsed = time.Now()
 	return nil
 }
@@ -0,0 +1,23 @@
+package mysql
+
+import (
+	"github.com/u2takey/mysqlgate/pkg/priority"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+)
+
+// priorityPlan sets the priority the query waits with for a backend
+// connection when it is hinted, like /*+ priority(reporting) */, else the
+// one of the connection applies.
+type priorityPlan struct {
+}
+
+func (p *priorityPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *priorityPlan) Query(ctx *QueryContext) error {
+	if prio, ok := priority.Hint(ctx.data); ok {
+		ctx.Context = sql.WithPriority(ctx.Context, prio)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package mysql
+
+import (
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/sql/driver"
+	"github.com/u2takey/mysqlgate/pkg/sql/mysql"
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// retryPlan marks the statement safe to run again on a transient error: a
+// single select or write in autocommit, which the errors retried leave
+// without effect.
+type retryPlan struct {
+}
+
+func (p *retryPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *retryPlan) Query(ctx *QueryContext) error {
+	r := ctx.rt.Retry
+	if r == nil || !r.Applies(ctx.mc.cfg.User) || len(ctx.stmts) != 1 || ctx.mc.inTransaction() {
+		return nil
+	}
+	switch ctx.stmts[0].(type) {
+	case *ast.InsertStmt, *ast.UpdateStmt, *ast.DeleteStmt:
+		ctx.retry = true
+	default:
+		ctx.retry = isReadOnly(ctx.stmts)
+	}
+	return nil
+}
+
+// retryDelay returns how long to wait before running again on b the
+// statement that failed for the attempt-th time with err. ok is false when
+// it is not retried, always once the client got part of the result or in
+// a transaction.
+func (q *QueryContext) retryDelay(b *cluster.Backend, err error, attempt int) (d time.Duration, ok bool) {
+	if !q.retry || q.mc.bytesSent > 0 || q.mc.inTransaction() {
+		return 0, false
+	}
+	var code uint16
+	badConn := err == driver.ErrBadConn
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		code = e.Number
+	case *MySqlError:
+		code = e.Code
+	}
+	if code == 0 && !badConn {
+		return 0, false
+	}
+	if d, ok = q.rt.Retry.Delay(code, badConn, attempt); ok {
+		mLog.Log("msg", "retrying statement", "backend", b.Name, "attempt", attempt, "delay", d, "err", err.Error())
+	}
+	return d, ok
+}
+
+func sleepContext(q *QueryContext, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-q.Done():
+		return q.Err()
+	}
+}
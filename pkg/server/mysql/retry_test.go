@@ -0,0 +1,60 @@
+package mysql
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/retry"
+	"github.com/u2takey/mysqlgate/pkg/sql/driver"
+	"github.com/u2takey/mysqlgate/pkg/sql/mysql"
+)
+
+func TestRetryDelay(t *testing.T) {
+	policy, err := retry.New(retry.Config{Enabled: true, MaxAttempts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &cluster.Backend{Name: "db1"}
+	newQuery := func() *QueryContext {
+		return &QueryContext{
+			mc:    &MysqlConn{status: StatusInAutocommit, session: newSession()},
+			rt:    &Runtime{Retry: policy},
+			retry: true,
+		}
+	}
+	tests := []struct {
+		name    string
+		err     error
+		attempt int
+		setup   func(q *QueryContext)
+		want    bool
+	}{
+		{"deadlock", &mysql.MySQLError{Number: retry.CodeDeadlock}, 1, nil, true},
+		{"lock wait timeout", &mysql.MySQLError{Number: retry.CodeLockWaitTimeout}, 1, nil, true},
+		{"bad connection", driver.ErrBadConn, 1, nil, true},
+		{"proxy error", NewCustomError(retry.CodeDeadlock, "deadlock"), 1, nil, true},
+		{"syntax error", &mysql.MySQLError{Number: 1064}, 1, nil, false},
+		{"unknown error", errors.New("broken pipe"), 1, nil, false},
+		{"breaker open", NewFormattedError(ErBackendUnavailable, b.Name), 1, nil, false},
+		{"timed out", NewFormattedError(ErQueryTimeout), 1, nil, false},
+		{"last attempt", &mysql.MySQLError{Number: retry.CodeDeadlock}, 2, nil, false},
+		{"not retryable", &mysql.MySQLError{Number: retry.CodeDeadlock}, 1, func(q *QueryContext) { q.retry = false }, false},
+		{"result sent", &mysql.MySQLError{Number: retry.CodeDeadlock}, 1, func(q *QueryContext) { q.mc.bytesSent = 10 }, false},
+		{"in transaction", &mysql.MySQLError{Number: retry.CodeDeadlock}, 1, func(q *QueryContext) { q.mc.status |= StatusInTrans }, false},
+		{"autocommit off", &mysql.MySQLError{Number: retry.CodeDeadlock}, 1, func(q *QueryContext) { q.mc.status = 0 }, false},
+	}
+	for _, tt := range tests {
+		q := newQuery()
+		if tt.setup != nil {
+			tt.setup(q)
+		}
+		d, ok := q.retryDelay(b, tt.err, tt.attempt)
+		if ok != tt.want {
+			t.Errorf("%s: retried %v, want %v", tt.name, ok, tt.want)
+		}
+		if ok && (d <= 0 || d > retry.DefaultBackoff) {
+			t.Errorf("%s: delay %v, want at most %v", tt.name, d, retry.DefaultBackoff)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package mysql
+
+import (
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// sessionFuncs depend on the state of the backend session, a query calling
+// them has to run where the previous statements ran.
+var sessionFuncs = map[string]bool{
+	"last_insert_id": true,
+	"found_rows":     true,
+	"row_count":      true,
+	"get_lock":       true,
+	"release_lock":   true,
+	"is_used_lock":   true,
+	"is_free_lock":   true,
+	"connection_id":  true,
+}
+
+// isReadOnly reports whether stmts can be served by a replica: plain
+// selects that neither lock rows nor read session state.
+func isReadOnly(stmts []ast.StmtNode) bool {
+	if len(stmts) == 0 {
+		return false
+	}
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.SelectStmt:
+			if s.LockInfo != nil && s.LockInfo.LockType != ast.SelectLockNone {
+				return false
+			}
+			if s.SelectIntoOpt != nil {
+				return false
+			}
+		case *ast.SetOprStmt:
+		default:
+			return false
+		}
+		v := &sessionDependVisitor{}
+		stmt.Accept(v)
+		if v.found {
+			return false
+		}
+	}
+	return true
+}
+
+type sessionDependVisitor struct {
+	found bool
+}
+
+func (v *sessionDependVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	switch x := n.(type) {
+	case *ast.VariableExpr:
+		v.found = true
+	case *ast.FuncCallExpr:
+		if sessionFuncs[x.FnName.L] {
+			v.found = true
+		}
+	case *ast.SelectStmt:
+		if x.LockInfo != nil && x.LockInfo.LockType != ast.SelectLockNone {
+			v.found = true
+		}
+	}
+	return n, v.found
+}
+
+func (v *sessionDependVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	return n, !v.found
+}
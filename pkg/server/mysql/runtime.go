@@ -0,0 +1,54 @@
+package mysql
+
+import (
+	"github.com/u2takey/mysqlgate/pkg/admission"
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/costguard"
+	"github.com/u2takey/mysqlgate/pkg/digest"
+	"github.com/u2takey/mysqlgate/pkg/firewall"
+	"github.com/u2takey/mysqlgate/pkg/guardrail"
+	"github.com/u2takey/mysqlgate/pkg/qcache"
+	"github.com/u2takey/mysqlgate/pkg/resultlimit"
+	"github.com/u2takey/mysqlgate/pkg/retry"
+	"github.com/u2takey/mysqlgate/pkg/sequence"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/slowlog"
+	"github.com/u2takey/mysqlgate/pkg/timeout"
+	"github.com/u2takey/mysqlgate/pkg/xa"
+)
+
+// Runtime holds what the connections of a server share.
+type Runtime struct {
+	Clusters *cluster.Registry
+	// Router is nil when no table is sharded.
+	Router    *sharding.Router
+	Sequences *sequence.Registry
+	// XA is nil when transactions are not distributed.
+	XA *xa.Coordinator
+	// DDL tracks the ddl applied to the shards.
+	DDL *sharding.DDLLog
+	// Cache is nil when results are not cached.
+	Cache *qcache.Cache
+	// Coalesce is nil when identical selects are not coalesced.
+	Coalesce *qcache.Group
+	// Digests is nil when statements are not aggregated by digest.
+	Digests *digest.Store
+	// SlowLog is nil when slow queries are not logged.
+	SlowLog *slowlog.Log
+	// Firewall is nil when queries are not filtered.
+	Firewall *firewall.Firewall
+	// Guardrail is nil when dangerous statements are not checked.
+	Guardrail *guardrail.Guard
+	// CostGuard is nil when selects are not explained before they run.
+	CostGuard *costguard.Guard
+	// Limits is nil when results are neither limited nor capped.
+	Limits *resultlimit.Limiter
+	// Timeouts is nil when no execution time limit is configured, hints
+	// still apply.
+	Timeouts *timeout.Timeouts
+	// Admission is nil when queries are admitted without limits.
+	Admission *admission.Controller
+	// Retry is nil when statements failed on transient errors are not
+	// run again.
+	Retry *retry.Policy
+}
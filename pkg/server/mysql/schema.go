@@ -0,0 +1,275 @@
+package mysql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// schemaPlan makes the shards look like one database: ddl over sharded
+// tables is applied to every shard, and metadata is read from every cluster
+// and merged.
+type schemaPlan struct {
+}
+
+func (q *schemaPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (q *schemaPlan) Query(ctx *QueryContext) error {
+	if ctx.rt.Router == nil || len(ctx.stmts) != 1 {
+		return nil
+	}
+	switch stmt := ctx.stmts[0].(type) {
+	case ast.DDLNode:
+		return q.ddl(ctx, stmt)
+	case *ast.ShowStmt:
+		return q.show(ctx, stmt)
+	case *ast.ExplainStmt:
+		if show, ok := stmt.Stmt.(*ast.ShowStmt); ok {
+			return q.show(ctx, show)
+		}
+	case *ast.SelectStmt:
+		return q.informationSchema(ctx, stmt)
+	}
+	return nil
+}
+
+// ddl runs a ddl statement over sharded tables on every cluster holding
+// one of their shards, concurrently, and reports the shards it failed on.
+func (q *schemaPlan) ddl(ctx *QueryContext, stmt ast.DDLNode) error {
+	shards := ctx.rt.Router.DDLShards(sharding.TableRefs(stmt))
+	if len(shards) == 0 {
+		return nil
+	}
+	ctx.Abort()
+	if ctx.mc.session.xa != nil {
+		return NewFormattedError(ErNotSupportedYet, "ddl over sharded tables in a distributed transaction")
+	}
+	backends := make([]*cluster.Backend, len(shards))
+	for i, s := range shards {
+		b, err := ctx.shardBackend(s, false)
+		if err != nil {
+			return err
+		}
+		backends[i] = b
+	}
+
+	job := ctx.rt.DDL.Start(ctx.data, shards)
+	mLog.Log("msg", "running ddl", "job", job.ID, "shards", len(shards), "query", ctx.data)
+	start := time.Now()
+	results, errs := ctx.queryEach(backends, ctx.data)
+	closeRows(results)
+	var failed, applied []string
+	for i, s := range shards {
+		ctx.rt.DDL.Update(job, i, errs[i])
+		if errs[i] != nil {
+			mLog.Error("msg", "ddl failed", "job", job.ID, "shard", s.Name, "cluster", s.Cluster, "err", errs[i])
+			failed = append(failed, s.Name+" ("+errs[i].Error()+")")
+			continue
+		}
+		mLog.Log("msg", "ddl applied", "job", job.ID, "shard", s.Name, "cluster", s.Cluster)
+		applied = append(applied, s.Name)
+	}
+	mLog.Log("msg", "ddl finished", "job", job.ID, "failed", len(failed), "took", time.Since(start))
+
+	if len(failed) == len(shards) {
+		// nothing changed, the error of the backend says it best
+		return errs[0]
+	}
+	if len(failed) > 0 {
+		msg := "ddl failed on shards " + strings.Join(failed, ", ")
+		if len(applied) > 0 {
+			msg += ", applied on " + strings.Join(applied, ", ")
+		}
+		return NewCustomError(ErUnknownError, msg)
+	}
+	return ctx.mc.writeOK(&MysqlResult{Status: ctx.mc.status})
+}
+
+// show answers listings with the de-duplicated rows of every cluster and
+// the description of a sharded table with the one of its first shard.
+func (q *schemaPlan) show(ctx *QueryContext, stmt *ast.ShowStmt) error {
+	read := !ctx.mc.inTransaction()
+	switch stmt.Tp {
+	case ast.ShowDatabases, ast.ShowTables, ast.ShowTableStatus:
+		ctx.Abort()
+		backends, err := ctx.allBackends(read)
+		if err != nil {
+			return err
+		}
+		results, err := ctx.queryAll(backends, ctx.data)
+		if err != nil {
+			return err
+		}
+		defer closeRows(results)
+		return ctx.writeMerged(results, []sortKey{{index: 0, order: binaryOrder}}, nil, 0, dedupeColumns(0))
+	case ast.ShowCreateTable, ast.ShowColumns, ast.ShowIndex:
+		if stmt.Table == nil {
+			return nil
+		}
+		t, ok := ctx.rt.Router.Table(stmt.Table.Name.O)
+		if !ok {
+			return nil
+		}
+		ctx.Abort()
+		b, err := ctx.shardBackend(t.Shards[0], read)
+		if err != nil {
+			return err
+		}
+		rows, err := ctx.queryBackend(b, ctx.data)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return ctx.writeResult(rows)
+	}
+	return nil
+}
+
+// informationSchemaKeys are the columns identifying a row of the
+// information_schema tables, rows of several clusters with the same values
+// describe the same logical object.
+var informationSchemaKeys = []string{
+	"TABLE_SCHEMA", "TABLE_NAME", "COLUMN_NAME", "INDEX_NAME", "SEQ_IN_INDEX", "CONSTRAINT_NAME",
+}
+
+// informationSchema runs a select reading only information_schema on every
+// cluster and merges the rows.
+func (q *schemaPlan) informationSchema(ctx *QueryContext, stmt *ast.SelectStmt) error {
+	refs := sharding.TableRefs(stmt)
+	if len(refs) == 0 || sharding.IsAggregate(stmt) {
+		return nil
+	}
+	for _, ref := range refs {
+		if !strings.EqualFold(ref.Schema, "information_schema") {
+			return nil
+		}
+	}
+	plan, err := sharding.PlanScatter(stmt)
+	if err != nil {
+		return nil
+	}
+	ctx.Abort()
+	backends, err := ctx.allBackends(!ctx.mc.inTransaction())
+	if err != nil {
+		return err
+	}
+	results, err := ctx.queryAll(backends, plan.Query)
+	if err != nil {
+		return err
+	}
+	defer closeRows(results)
+	columnTypes, err := results[0].ColumnTypes()
+	if err != nil {
+		return err
+	}
+	keys, err := resolveSortKeys(plan.OrderBy, columnTypes)
+	if err != nil {
+		return err
+	}
+	visible := columnTypes[:len(columnTypes)-plan.Hidden]
+	var identity []int
+	for i, ct := range visible {
+		for _, name := range informationSchemaKeys {
+			if strings.EqualFold(ct.Name(), name) {
+				identity = append(identity, i)
+			}
+		}
+	}
+	if len(identity) == 0 {
+		identity = dedupeColumns(len(visible))
+	}
+	var limit *limitStream
+	if plan.HasLimit {
+		limit = &limitStream{offset: plan.Offset, count: plan.Count}
+	}
+	return ctx.writeMerged(results, keys, limit, plan.Hidden, identity)
+}
+
+// writeMerged merges results ordered by keys, drops the rows whose identity
+// columns were already sent and applies limit.
+func (q *QueryContext) writeMerged(results []*sql.ExtendedRows, keys []sortKey, limit *limitStream, hidden int, identity []int) error {
+	columnTypes, err := results[0].ColumnTypes()
+	if err != nil {
+		return err
+	}
+	streams := make([]rowStream, len(results))
+	for i, r := range results {
+		streams[i] = newRowsStream(r, len(columnTypes))
+	}
+	var stream rowStream = &concatStream{streams: streams}
+	if len(keys) > 0 {
+		stream = newMergeStream(streams, keys)
+	}
+	stream = &dedupeStream{stream: stream, columns: identity, seen: map[string]bool{}}
+	if limit != nil {
+		limit.stream = stream
+		stream = limit
+	}
+	return q.mc.writeStream(columnTypes[:len(columnTypes)-hidden], stream)
+}
+
+// allBackends returns a backend of every cluster, replicas when read is
+// set.
+func (q *QueryContext) allBackends(read bool) ([]*cluster.Backend, error) {
+	clusters := q.rt.Clusters.All()
+	backends := make([]*cluster.Backend, len(clusters))
+	for i, c := range clusters {
+		b, err := q.clusterBackend(c.Name, read)
+		if err != nil {
+			return nil, err
+		}
+		backends[i] = b
+	}
+	return backends, nil
+}
+
+// dedupeColumns returns the indexes of the first n columns, or of the first
+// one when n is 0.
+func dedupeColumns(n int) []int {
+	if n == 0 {
+		n = 1
+	}
+	columns := make([]int, n)
+	for i := range columns {
+		columns[i] = i
+	}
+	return columns
+}
+
+// dedupeStream drops the rows of its stream equal on columns to a row
+// returned before.
+type dedupeStream struct {
+	stream  rowStream
+	columns []int
+	seen    map[string]bool
+}
+
+func (s *dedupeStream) next() ([][]byte, error) {
+	for {
+		row, err := s.stream.next()
+		if err != nil || row == nil {
+			return row, err
+		}
+		var key strings.Builder
+		for _, i := range s.columns {
+			if row[i] == nil {
+				key.WriteString("-;")
+				continue
+			}
+			key.WriteString(strconv.Itoa(len(row[i])))
+			key.WriteByte(':')
+			key.Write(row[i])
+		}
+		if !s.seen[key.String()] {
+			s.seen[key.String()] = true
+			return row, nil
+		}
+	}
+}
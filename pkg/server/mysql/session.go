@@ -0,0 +1,163 @@
+package mysql
+
+import (
+	"context"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/mysqlgate/pkg/sql/driver"
+	"github.com/u2takey/mysqlgate/pkg/xa"
+)
+
+// session holds the backend connections of a client connection. They go
+// back to their pool once a command is done, unless the client is inside a
+// transaction, then they stay pinned until it ends.
+type session struct {
+	conns map[*cluster.Backend]*sql.Conn
+	// xa is the distributed transaction the connections are branches of,
+	// nil outside of one.
+	xa *xaTxn
+	// writes end the writes of the transaction when it ends: they release
+	// the sharded tables registered for writing and drop again the cached
+	// results of the tables written.
+	writes []func()
+}
+
+type xaTxn struct {
+	coord    *xa.Coordinator
+	gtrid    string
+	branches []xa.Branch
+}
+
+// sessionBranch is the branch of a distributed transaction on a session
+// connection.
+type sessionBranch struct {
+	b    *cluster.Backend
+	conn *sql.Conn
+}
+
+func (sb *sessionBranch) Name() string {
+	return sb.b.Name
+}
+
+func (sb *sessionBranch) Exec(ctx context.Context, query string) error {
+	start := sb.b.Start()
+	rows, err := sb.conn.QueryContextExtend(ctx, query)
+	sb.b.Finish(start, err)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+func newSession() *session {
+	return &session{conns: map[*cluster.Backend]*sql.Conn{}}
+}
+
+// conn returns the connection to b, taking one from the pool when the
+// session has none yet. Taking one fails fast while the breaker of b is
+// open, with ErBackendUnavailable.
+func (s *session) conn(ctx *QueryContext, b *cluster.Backend) (*sql.Conn, error) {
+	if c, ok := s.conns[b]; ok {
+		return c, nil
+	}
+	if err := b.Allow(); err != nil {
+		return nil, NewFormattedError(ErBackendUnavailable, b.Name)
+	}
+	c, err := b.DB().Conn(ctx)
+	if err != nil {
+		b.Fail(err)
+		return nil, err
+	}
+	if ctx.mc.database != "" {
+		if err := useDb(ctx, c, ctx.mc.database); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	if s.xa != nil {
+		branch := &sessionBranch{b: b, conn: c}
+		if err := s.xa.coord.Start(ctx, s.xa.gtrid, branch); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		s.xa.branches = append(s.xa.branches, branch)
+	}
+	s.conns[b] = c
+	return c, nil
+}
+
+// drop gives back the connection to b, for the statement to run again on
+// a new one.
+func (s *session) drop(b *cluster.Backend) {
+	if c, ok := s.conns[b]; ok {
+		_ = c.Close()
+		delete(s.conns, b)
+	}
+}
+
+// discard closes the backend connections of the session without reading
+// the results they are still sending. Their pool drops them once released,
+// the rows read from them fail to close instead of draining.
+func (s *session) discard() {
+	for _, c := range s.conns {
+		_ = c.Raw(func(driverConn interface{}) error {
+			if dc, ok := driverConn.(driver.Conn); ok {
+				return dc.Close()
+			}
+			return nil
+		})
+	}
+}
+
+// pinned returns the backends the session holds a connection to.
+func (s *session) pinned() []*cluster.Backend {
+	backends := make([]*cluster.Backend, 0, len(s.conns))
+	for b := range s.conns {
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+// release gives the connections back to their pool, unless inTrans.
+func (s *session) release(inTrans bool) {
+	if inTrans {
+		return
+	}
+	s.close()
+}
+
+// abort ends the transaction of the session after one of its connections
+// was lost: the others roll back as they are closed unread, like the
+// branches of a distributed one, which are not prepared yet.
+func (s *session) abort() {
+	s.discard()
+	s.xa = nil
+	s.close()
+}
+
+func (s *session) close() {
+	if s.xa != nil {
+		// the client left in the middle of a distributed transaction
+		_ = s.xa.coord.Rollback(context.Background(), s.xa.gtrid, s.xa.branches)
+		s.xa = nil
+	}
+	for b, c := range s.conns {
+		_ = c.Close()
+		delete(s.conns, b)
+	}
+	for _, done := range s.writes {
+		done()
+	}
+	s.writes = nil
+}
+
+func useDb(ctx *QueryContext, c *sql.Conn, dbName string) error {
+	return c.Raw(func(driverConn interface{}) error {
+		ce, ok := driverConn.(driver.ConnExtend)
+		if !ok {
+			return NewCustomError(ErUnknownError, "init db not supported on backend driver")
+		}
+		return ce.UseDb(ctx, dbName)
+	})
+}
@@ -0,0 +1,471 @@
+package mysql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// shardingPlan runs statements over sharded tables on their shards, other
+// statements are left to the next plans.
+type shardingPlan struct {
+}
+
+func (q *shardingPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (q *shardingPlan) Query(ctx *QueryContext) error {
+	if ctx.rt.Router == nil {
+		return nil
+	}
+	if len(ctx.stmts) != 1 {
+		// rejected before any write registers or id is generated
+		for _, stmt := range ctx.stmts {
+			for _, ref := range sharding.TableRefs(stmt) {
+				if _, ok := ctx.rt.Router.Table(ref.Name); ok {
+					return NewFormattedError(ErNotSupportedYet, "multiple statements over sharded tables")
+				}
+			}
+		}
+		return nil
+	}
+	stmt := ctx.stmts[0]
+	switch stmt.(type) {
+	case *ast.InsertStmt, *ast.UpdateStmt, *ast.DeleteStmt:
+		// before routing, a resharding may change the shards meanwhile
+		if err := ctx.enterWrites(stmt); err != nil {
+			return err
+		}
+	}
+	var generatedId int64
+	if insert, ok := stmt.(*ast.InsertStmt); ok {
+		id, err := ctx.fillAutoIncrement(insert)
+		if err != nil {
+			return err
+		}
+		generatedId = id
+	}
+	route, err := ctx.rt.Router.Route(stmt)
+	if err != nil {
+		return err
+	}
+	if route == nil {
+		return nil
+	}
+	ctx.Abort()
+
+	read := !ctx.mc.inTransaction() && isReadOnly(ctx.stmts)
+	if route.Lookup != nil {
+		if err := ctx.resolveLookup(route); err != nil {
+			return err
+		}
+	}
+	switch stmt := ctx.stmts[0].(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt:
+		if len(route.Shards) != 1 {
+			if stmt, ok := stmt.(*ast.SelectStmt); ok {
+				if sharding.IsAggregate(stmt) {
+					return q.aggregate(ctx, stmt, route, read)
+				}
+				return q.scatter(ctx, stmt, route, read)
+			}
+			return NewFormattedError(ErNotSupportedYet, "union over several shards")
+		}
+		b, err := ctx.shardBackend(route.Shards[0], read)
+		if err != nil {
+			return err
+		}
+		query, err := route.Table.Filter(route.Shards[0], ctx.data)
+		if err != nil {
+			return err
+		}
+		rows, err := ctx.queryBackend(b, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return ctx.writeResult(rows)
+	case *ast.InsertStmt:
+		if generatedId != 0 && route.Queries == nil {
+			// the statement changed, it can not be sent as received
+			query, err := sharding.Restore(stmt)
+			if err != nil {
+				return err
+			}
+			route.Queries = map[*sharding.Shard]string{}
+			for _, s := range route.Shards {
+				route.Queries[s] = query
+			}
+		}
+		return q.write(ctx, stmt, route, generatedId)
+	case *ast.UpdateStmt, *ast.DeleteStmt:
+		return q.write(ctx, stmt, route, 0)
+	default:
+		return NewFormattedError(ErNotSupportedYet, "this statement on sharded tables")
+	}
+}
+
+// scatter runs a select on every shard of route and merges the results.
+func (q *shardingPlan) scatter(ctx *QueryContext, stmt *ast.SelectStmt, route *sharding.Route, read bool) error {
+	plan, err := sharding.PlanScatter(stmt)
+	if err != nil {
+		return err
+	}
+	results, err := ctx.queryShards(route.Table, route.Shards, plan.Query, read)
+	if err != nil {
+		return err
+	}
+	defer closeRows(results)
+
+	columnTypes, err := results[0].ColumnTypes()
+	if err != nil {
+		return err
+	}
+	keys, err := resolveSortKeys(plan.OrderBy, columnTypes)
+	if err != nil {
+		return err
+	}
+	streams := make([]rowStream, len(results))
+	for i, r := range results {
+		streams[i] = newRowsStream(r, len(columnTypes))
+	}
+	var stream rowStream = &concatStream{streams: streams}
+	if len(keys) > 0 {
+		stream = newMergeStream(streams, keys)
+	}
+	if plan.HasLimit {
+		stream = &limitStream{stream: stream, offset: plan.Offset, count: plan.Count}
+	}
+	return ctx.mc.writeStream(columnTypes[:len(columnTypes)-plan.Hidden], stream)
+}
+
+// aggregate runs a grouping select on every shard of route and merges the
+// partial aggregates by group.
+func (q *shardingPlan) aggregate(ctx *QueryContext, stmt *ast.SelectStmt, route *sharding.Route, read bool) error {
+	plan, err := sharding.PlanAggregate(stmt)
+	if err != nil {
+		return err
+	}
+	results, err := ctx.queryShards(route.Table, route.Shards, plan.Query, read)
+	if err != nil {
+		return err
+	}
+	defer closeRows(results)
+
+	columnTypes, err := results[0].ColumnTypes()
+	if err != nil {
+		return err
+	}
+	a := newAggregator(plan, columnTypes, ctx.rt.Router.MaxGroups, ctx.rt.Router.SpillDir)
+	defer a.close()
+	for _, r := range results {
+		rows := newRowsStream(r, len(columnTypes))
+		for {
+			row, err := rows.next()
+			if err != nil {
+				return err
+			}
+			if row == nil {
+				break
+			}
+			if err := a.add(row); err != nil {
+				return err
+			}
+		}
+	}
+	stream, err := a.result()
+	if err != nil {
+		return err
+	}
+	if plan.HasLimit {
+		stream = &limitStream{stream: stream, offset: plan.Offset, count: plan.Count}
+	}
+	visible := make([]*sql.ColumnType, plan.Visible)
+	for i, col := range plan.Columns[:plan.Visible] {
+		visible[i] = columnTypes[col.Index]
+	}
+	return ctx.mc.writeStream(visible, stream)
+}
+
+// write runs a dml statement on every shard of route and answers with the
+// summed up result, generatedId is the first id the proxy generated for an
+// insert.
+func (q *shardingPlan) write(ctx *QueryContext, stmt ast.StmtNode, route *sharding.Route, generatedId int64) error {
+	var result *MysqlResult
+	var err error
+	if ownTransaction(ctx, route) {
+		result, err = q.writeInXA(ctx, stmt, route)
+	} else {
+		result, err = q.writeLookups(ctx, stmt, route)
+	}
+	if err != nil {
+		return err
+	}
+	if generatedId != 0 {
+		result.InsertId = uint64(generatedId)
+	}
+	return ctx.mc.writeOK(result)
+}
+
+// ownTransaction tells whether the write of route runs in a distributed
+// transaction of its own: the copies of a reference table must not diverge,
+// and outside of a transaction a write over several shards applies on all
+// or none, and the lookup tables are kept in the transaction of the write,
+// whose locks hold the rows read meanwhile.
+func ownTransaction(ctx *QueryContext, route *sharding.Route) bool {
+	if ctx.mc.session.xa != nil {
+		return false
+	}
+	if route.Table.Reference {
+		return len(route.Shards) > 1
+	}
+	return !ctx.mc.inTransaction() && (len(route.Shards) > 1 || len(route.Table.Lookups) > 0)
+}
+
+// writeInXA runs the write of route in a distributed transaction of its
+// own.
+func (q *shardingPlan) writeInXA(ctx *QueryContext, stmt ast.StmtNode, route *sharding.Route) (*MysqlResult, error) {
+	if ctx.rt.XA == nil {
+		return nil, NewFormattedError(ErNotSupportedYet, "write over several shards outside of a transaction without xa log")
+	}
+	if err := ctx.beginXA(); err != nil {
+		return nil, err
+	}
+	result, err := q.writeLookups(ctx, stmt, route)
+	if err != nil {
+		_ = ctx.rollbackXA()
+		return nil, err
+	}
+	if err := ctx.commitXA(); err != nil {
+		return nil, err
+	}
+	result.Status = ctx.mc.status
+	return result, nil
+}
+
+// writeLookups runs the write of route on its shards, keeping the lookup
+// tables of the table up to date.
+func (q *shardingPlan) writeLookups(ctx *QueryContext, stmt ast.StmtNode, route *sharding.Route) (*MysqlResult, error) {
+	lw, err := ctx.prepareLookups(stmt, route)
+	if err != nil {
+		return nil, err
+	}
+	result, err := q.writeShards(ctx, route)
+	if err != nil {
+		lw.rollback(ctx)
+		return nil, err
+	}
+	if err := lw.commit(ctx); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (q *shardingPlan) writeShards(ctx *QueryContext, route *sharding.Route) (*MysqlResult, error) {
+	result := &MysqlResult{}
+	for i, s := range route.Shards {
+		query, ok := route.Queries[s]
+		if !ok {
+			query = ctx.data
+		}
+		b, err := ctx.shardBackend(s, false)
+		if err != nil {
+			return nil, err
+		}
+		if query, err = route.Table.Filter(s, query); err != nil {
+			return nil, err
+		}
+		rows, err := ctx.queryBackend(b, query)
+		if err != nil {
+			return nil, err
+		}
+		_ = rows.Close()
+		if route.Table.Reference && i > 0 {
+			// the copies answer the same
+			continue
+		}
+		result.AffectedRows += rows.AffectedRows
+		if result.InsertId == 0 {
+			result.InsertId = rows.InsertId
+		}
+	}
+	result.Status = ctx.mc.status
+	return result, nil
+}
+
+// enterWrites registers the writes of stmt on sharded tables with the
+// session, a resharding freezing one of them waits for the transaction of
+// the write to end, and lets the transaction write the table again.
+func (q *QueryContext) enterWrites(stmt ast.StmtNode) error {
+	for _, ref := range sharding.TableRefs(stmt) {
+		if _, ok := q.rt.Router.Table(ref.Name); !ok {
+			continue
+		}
+		done, err := q.rt.Router.EnterWrite(q, ref.Name, q.mc.session)
+		if err != nil {
+			return err
+		}
+		q.mc.session.writes = append(q.mc.session.writes, done)
+	}
+	return nil
+}
+
+// fillAutoIncrement fills the ids of an insert into a sharded table from
+// the sequence of its auto increment column.
+func (q *QueryContext) fillAutoIncrement(stmt *ast.InsertStmt) (int64, error) {
+	refs := sharding.TableRefs(stmt.Table)
+	if len(refs) == 0 {
+		return 0, nil
+	}
+	t, ok := q.rt.Router.Table(refs[0].Name)
+	if !ok || t.AutoIncrement == nil {
+		return 0, nil
+	}
+	seq, ok := q.rt.Sequences.Get(t.AutoIncrement.Sequence)
+	if !ok {
+		return 0, NewCustomError(ErUnknownError, "unknown sequence "+t.AutoIncrement.Sequence)
+	}
+	return t.FillAutoIncrement(stmt, func(n int) ([]int64, error) {
+		return seq.Next(q, n)
+	})
+}
+
+// shardBackend returns the backend of the cluster holding s, a replica when
+// read is set.
+func (q *QueryContext) shardBackend(s *sharding.Shard, read bool) (*cluster.Backend, error) {
+	return q.clusterBackend(s.Cluster, read)
+}
+
+// clusterBackend returns the primary of the cluster called name, a replica
+// when read is set.
+func (q *QueryContext) clusterBackend(name string, read bool) (*cluster.Backend, error) {
+	c, ok := q.rt.Clusters.Get(name)
+	if !ok {
+		return nil, NewCustomError(ErUnknownError, "unknown cluster "+name)
+	}
+	if read {
+		return c.PickReplica(), nil
+	}
+	return c.Primary(), nil
+}
+
+// queryShards runs query on every shard of t concurrently. The results are
+// either all returned or all closed on error.
+func (q *QueryContext) queryShards(t *sharding.Table, shards []*sharding.Shard, query string, read bool) ([]*sql.ExtendedRows, error) {
+	backends := make([]*cluster.Backend, len(shards))
+	queries := make([]string, len(shards))
+	for i, s := range shards {
+		b, err := q.shardBackend(s, read)
+		if err != nil {
+			return nil, err
+		}
+		if queries[i], err = t.Filter(s, query); err != nil {
+			return nil, err
+		}
+		backends[i] = b
+	}
+	return q.queryEachAll(backends, queries)
+}
+
+// queryAll runs query on every backend concurrently. The results are
+// either all returned or all closed on error.
+func (q *QueryContext) queryAll(backends []*cluster.Backend, query string) ([]*sql.ExtendedRows, error) {
+	return q.queryEachAll(backends, repeat(query, len(backends)))
+}
+
+// queryEachAll runs the queries on their backend concurrently. The results
+// are either all returned or all closed on error.
+func (q *QueryContext) queryEachAll(backends []*cluster.Backend, queries []string) ([]*sql.ExtendedRows, error) {
+	results, errs := q.queryEachQuery(backends, queries)
+	for _, err := range errs {
+		if err != nil {
+			closeRows(results)
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// queryEach runs query on every backend concurrently and returns the result
+// or error of each.
+func (q *QueryContext) queryEach(backends []*cluster.Backend, query string) ([]*sql.ExtendedRows, []error) {
+	return q.queryEachQuery(backends, repeat(query, len(backends)))
+}
+
+func repeat(query string, n int) []string {
+	queries := make([]string, n)
+	for i := range queries {
+		queries[i] = query
+	}
+	return queries
+}
+
+// queryEachQuery runs the queries on their backend concurrently and returns
+// the result or error of each. The backends failing on a transient error
+// run their query again when the retry policy allows it, like in
+// queryBackend.
+func (q *QueryContext) queryEachQuery(backends []*cluster.Backend, queries []string) ([]*sql.ExtendedRows, []error) {
+	results := make([]*sql.ExtendedRows, len(backends))
+	errs := make([]error, len(backends))
+	conns := make([]*sql.Conn, len(backends))
+	pending := make([]int, len(backends))
+	for i := range backends {
+		pending[i] = i
+	}
+	for attempt := 1; ; attempt++ {
+		// the session is not safe for concurrent use, the connections are
+		// taken first
+		for _, i := range pending {
+			conns[i], errs[i] = q.mc.session.conn(q, backends[i])
+		}
+		var wg sync.WaitGroup
+		for _, i := range pending {
+			if errs[i] != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], errs[i] = q.queryConn(backends[i], conns[i], queries[i])
+			}(i)
+		}
+		wg.Wait()
+
+		var retried []int
+		var delay time.Duration
+		for _, i := range pending {
+			if errs[i] == nil {
+				continue
+			}
+			if d, ok := q.retryDelay(backends[i], errs[i], attempt); ok {
+				retried = append(retried, i)
+				if d > delay {
+					delay = d
+				}
+			}
+		}
+		if len(retried) == 0 {
+			return results, errs
+		}
+		for _, i := range retried {
+			q.dropConn(backends[i])
+		}
+		if sleepContext(q, delay) != nil {
+			return results, errs
+		}
+		pending = retried
+	}
+}
+
+func closeRows(results []*sql.ExtendedRows) {
+	for _, r := range results {
+		if r != nil {
+			_ = r.Close()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package mysql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/slowlog"
+	parser "github.com/u2takey/sqlparser"
+)
+
+// queryTrace times the phases of a query: parsing, planning up to the
+// first backend query, then the backends, less the time spent writing to
+// the client.
+type queryTrace struct {
+	start  time.Time
+	parsed time.Time
+
+	mu sync.Mutex // protects following fields, scatters query concurrently
+	// first is when the first backend query started.
+	first    time.Time
+	backends []string
+}
+
+// backend records a query to b.
+func (t *queryTrace) backend(b *cluster.Backend) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.first.IsZero() {
+		t.first = time.Now()
+	}
+	for _, name := range t.backends {
+		if name == b.Name {
+			return
+		}
+	}
+	t.backends = append(t.backends, b.Name)
+}
+
+// logSlow writes the current query to the slow log when it is slow, err is
+// the error it failed with.
+func (q *QueryContext) logSlow(err error) {
+	l := q.rt.SlowLog
+	if l == nil {
+		return
+	}
+	t := &q.trace
+	total := time.Since(t.start)
+	if !l.Slow(total) {
+		return
+	}
+	e := &slowlog.Entry{
+		Time:         t.start,
+		ConnectionID: q.mc.connectionId,
+		User:         q.mc.cfg.User,
+		Client:       q.mc.netConn.RemoteAddr().String(),
+		Database:     q.mc.database,
+		Query:        q.data,
+		Digest:       parser.DigestNormalized(q.normalize()).String(),
+		QueryTime:    total,
+		WriteTime:    q.mc.writeTime,
+		RowsSent:     q.mc.rowsSent,
+		RowsAffected: q.mc.rowsAffected,
+		BytesSent:    q.mc.bytesSent,
+	}
+	if l.Normalize() {
+		e.Query = q.normalize()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.mu.Lock()
+	first := t.first
+	e.Backends = append(e.Backends, t.backends...)
+	t.mu.Unlock()
+	if t.parsed.IsZero() {
+		e.ParseTime = total
+	} else {
+		e.ParseTime = t.parsed.Sub(t.start)
+	}
+	if first.IsZero() {
+		e.PlanTime = total - e.ParseTime - e.WriteTime
+	} else {
+		e.PlanTime = first.Sub(t.start) - e.ParseTime
+		e.BackendTime = total - first.Sub(t.start) - e.WriteTime
+	}
+	if e.PlanTime < 0 {
+		e.PlanTime = 0
+	}
+	if e.BackendTime < 0 {
+		e.BackendTime = 0
+	}
+	if err := l.Write(e); err != nil {
+		mLog.Error("method", "logSlow", "msg", "writing slow log", "err", err.Error())
+	}
+}
@@ -0,0 +1,147 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/sql"
+	"github.com/u2takey/mysqlgate/pkg/sql/driver"
+	"github.com/u2takey/mysqlgate/pkg/timeout"
+	parser "github.com/u2takey/sqlparser"
+)
+
+// killTimeout bounds the KILL QUERY sent for a query past its limit.
+const killTimeout = 5 * time.Second
+
+// timeoutPlan bounds the execution time of the query, from when the proxy
+// received it, to the limit of the config or of its max_execution_time
+// hint, whichever is lower.
+type timeoutPlan struct {
+}
+
+func (p *timeoutPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (p *timeoutPlan) Query(ctx *QueryContext) error {
+	limit := timeout.Hint(ctx.data)
+	if t := ctx.rt.Timeouts; t != nil {
+		d := t.Limit(ctx.mc.cfg.User, parser.DigestNormalized(ctx.normalize()).String())
+		if d > 0 && (limit == 0 || d < limit) {
+			limit = d
+		}
+	}
+	if limit > 0 {
+		ctx.startTimeout(ctx.trace.start.Add(limit))
+	}
+	return nil
+}
+
+// queryTimeout is the limit of the current query: its context is
+// cancelled at the deadline and the backend queries it runs are killed.
+type queryTimeout struct {
+	parent context.Context
+	cancel context.CancelFunc
+	// watched is closed once the queries are killed or the query ended.
+	watched chan struct{}
+
+	mu      sync.Mutex // protects running
+	running []runningQuery
+}
+
+// runningQuery is a backend connection a query runs on.
+type runningQuery struct {
+	backend *cluster.Backend
+	id      uint32
+}
+
+func (q *QueryContext) startTimeout(deadline time.Time) {
+	ctx, cancel := context.WithDeadline(q.Context, deadline)
+	t := &queryTimeout{parent: q.Context, cancel: cancel, watched: make(chan struct{})}
+	q.Context, q.timeout = ctx, t
+	go func() {
+		defer close(t.watched)
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			t.kill()
+		}
+	}()
+}
+
+// stopTimeout ends the limit of the current query once it returned err,
+// the error the client gets being 3024 when it failed past the deadline.
+// The backend connection the driver dropped on cancel is then gone, with
+// the transaction it was in: the whole transaction of the client is rolled
+// back and it is told so.
+func (q *QueryContext) stopTimeout(err error) error {
+	t := q.timeout
+	if t == nil {
+		return err
+	}
+	timedOut := q.Context.Err() == context.DeadlineExceeded
+	t.cancel()
+	<-t.watched
+	q.Context, q.timeout = t.parent, nil
+	if timedOut && err != nil {
+		mLog.Log("msg", "query timed out", "user", q.mc.cfg.User, "query", q.data, "err", err.Error())
+		if q.mc.inTransaction() {
+			q.mc.session.abort()
+			q.mc.status &^= StatusInTrans
+			return NewCustomError(ErQueryTimeout, MySQLErrName[ErQueryTimeout]+", the transaction was rolled back")
+		}
+		return NewFormattedError(ErQueryTimeout)
+	}
+	return err
+}
+
+// track records that the query runs on conn of b, to kill it on timeout.
+func (t *queryTimeout) track(b *cluster.Backend, conn *sql.Conn) {
+	var id uint32
+	err := conn.Raw(func(driverConn interface{}) error {
+		ce, ok := driverConn.(driver.ConnExtend)
+		if !ok {
+			return fmt.Errorf("connection id not supported on backend driver")
+		}
+		id = ce.ConnectionID()
+		return nil
+	})
+	if err != nil {
+		mLog.Error("method", "track", "backend", b.Name, "err", err.Error())
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running = append(t.running, runningQuery{backend: b, id: id})
+}
+
+// untrack forgets the queries on b, whose connection is given back.
+func (t *queryTimeout) untrack(b *cluster.Backend) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	running := t.running[:0]
+	for _, r := range t.running {
+		if r.backend != b {
+			running = append(running, r)
+		}
+	}
+	t.running = running
+}
+
+// kill stops the queries on the backends, which go on running after the
+// driver dropped their connection.
+func (t *queryTimeout) kill() {
+	t.mu.Lock()
+	running := append([]runningQuery(nil), t.running...)
+	t.mu.Unlock()
+	for _, r := range running {
+		ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+		err := r.backend.Kill(ctx, r.id)
+		cancel()
+		if err != nil {
+			mLog.Error("method", "kill", "backend", r.backend.Name, "connection", r.id, "err", err.Error())
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package mysql
+
+import (
+	"github.com/u2takey/sqlparser/ast"
+)
+
+// xaPlan runs the explicit transactions of clients as xa transactions when
+// a coordinator is configured: every backend the transaction touches is a
+// branch, and commit prepares all of them before committing any, so a
+// transaction over several shards commits everywhere or nowhere.
+type xaPlan struct {
+}
+
+func (q *xaPlan) InitDB(ctx *QueryContext) error {
+	return nil
+}
+
+func (q *xaPlan) Query(ctx *QueryContext) error {
+	if ctx.rt.XA == nil || len(ctx.stmts) != 1 {
+		return nil
+	}
+	s := ctx.mc.session
+	switch ctx.stmts[0].(type) {
+	case *ast.BeginStmt:
+		ctx.Abort()
+		// begin commits the current transaction, like mysql does
+		if err := ctx.commitXA(); err != nil {
+			return err
+		}
+		if err := ctx.beginXA(); err != nil {
+			return err
+		}
+		return ctx.mc.writeOK(nil)
+	case *ast.CommitStmt:
+		if s.xa == nil {
+			return nil
+		}
+		ctx.Abort()
+		if err := ctx.commitXA(); err != nil {
+			return err
+		}
+		return ctx.mc.writeOK(nil)
+	case *ast.RollbackStmt:
+		if s.xa == nil {
+			return nil
+		}
+		ctx.Abort()
+		if err := ctx.rollbackXA(); err != nil {
+			return err
+		}
+		return ctx.mc.writeOK(nil)
+	}
+	return nil
+}
+
+// beginXA starts a distributed transaction, the session connections taken
+// from now on are branches of it.
+func (q *QueryContext) beginXA() error {
+	if q.rt.XA == nil {
+		return NewFormattedError(ErNotSupportedYet, "distributed transaction without xa log")
+	}
+	if len(q.mc.session.conns) > 0 {
+		return NewFormattedError(ErNotSupportedYet, "distributed transaction with autocommit off")
+	}
+	q.mc.session.xa = &xaTxn{coord: q.rt.XA, gtrid: q.rt.XA.NewGtrid()}
+	q.mc.status |= StatusInTrans
+	return nil
+}
+
+// rollbackXA rolls back the distributed transaction of the session and
+// releases its connections.
+func (q *QueryContext) rollbackXA() error {
+	txn := q.mc.session.xa
+	if txn == nil {
+		return nil
+	}
+	q.mc.session.xa = nil
+	q.mc.status &^= StatusInTrans
+	err := txn.coord.Rollback(q, txn.gtrid, txn.branches)
+	q.mc.session.close()
+	return err
+}
+
+// commitXA commits the distributed transaction of the session if any. The
+// transaction is over whatever the outcome and its connections are
+// released.
+func (q *QueryContext) commitXA() error {
+	txn := q.mc.session.xa
+	if txn == nil {
+		return nil
+	}
+	q.mc.session.xa = nil
+	q.mc.status &^= StatusInTrans
+	err := txn.coord.Commit(q, txn.gtrid, txn.branches)
+	q.mc.session.close()
+	return err
+}
@@ -3,57 +3,263 @@ package server
 import (
 	"context"
 	"crypto/rand"
+	"fmt"
 	"net"
 
+	"github.com/u2takey/mysqlgate/pkg/admin"
+	"github.com/u2takey/mysqlgate/pkg/admission"
+	"github.com/u2takey/mysqlgate/pkg/cdc"
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/config"
+	"github.com/u2takey/mysqlgate/pkg/costguard"
+	"github.com/u2takey/mysqlgate/pkg/digest"
+	"github.com/u2takey/mysqlgate/pkg/firewall"
+	"github.com/u2takey/mysqlgate/pkg/guardrail"
 	"github.com/u2takey/mysqlgate/pkg/log"
+	"github.com/u2takey/mysqlgate/pkg/priority"
+	"github.com/u2takey/mysqlgate/pkg/qcache"
+	"github.com/u2takey/mysqlgate/pkg/reshard"
+	"github.com/u2takey/mysqlgate/pkg/resultlimit"
+	"github.com/u2takey/mysqlgate/pkg/retry"
+	"github.com/u2takey/mysqlgate/pkg/sequence"
 	"github.com/u2takey/mysqlgate/pkg/server/mysql"
+	"github.com/u2takey/mysqlgate/pkg/sharding"
+	"github.com/u2takey/mysqlgate/pkg/slowlog"
 	"github.com/u2takey/mysqlgate/pkg/sql"
-	_ "github.com/u2takey/mysqlgate/pkg/sql/mysql"
+	"github.com/u2takey/mysqlgate/pkg/timeout"
+	"github.com/u2takey/mysqlgate/pkg/xa"
 )
 
 var mLog = log.ModuleLogger("server")
 
 type Server struct {
-	listenAddr    string
-	defaultDbAddr string
-	db            *sql.DB
+	listenAddr string
+	rt         *mysql.Runtime
+	// admin is nil when no admin address is configured.
+	admin *admin.Server
+	// reshard is nil when no table is sharded.
+	reshard *reshard.Manager
+	// cdc is nil when no change stream is configured.
+	cdc *cdc.Manager
 
 	listener net.Listener
+	// listeners are the listeners besides the main one, with the priority
+	// of the connections they accept.
+	listeners map[net.Listener]sql.Priority
+	// priorities is nil when connections have no priority set.
+	priorities *priority.Priorities
+	// users are the passwords of the proxy users.
+	users map[string]string
 }
 
-func NewServer(addr, defaultDbAddr string) (*Server, error) {
+func NewServer(cfg *config.Config) (*Server, error) {
 	var err error
 	s := &Server{
-		listenAddr:    addr,
-		defaultDbAddr: defaultDbAddr,
+		listenAddr: cfg.Addr,
+		users:      map[string]string{"root": "root"},
 	}
-	s.db, err = sql.Open("mysql", defaultDbAddr)
+	if len(cfg.Users) > 0 {
+		s.users = map[string]string{}
+		for _, u := range cfg.Users {
+			if _, ok := s.users[u.Name]; ok || u.Name == "" {
+				return nil, fmt.Errorf("users: missing or duplicate name %q", u.Name)
+			}
+			s.users[u.Name] = u.Password
+		}
+	}
+	s.rt = &mysql.Runtime{}
+	s.rt.Clusters, err = cluster.NewRegistry(cfg.Clusters)
 	if err != nil {
 		return nil, err
 	}
-	s.listener, err = net.Listen("tcp", addr)
-	return s, err
+	if s.rt.Sequences, err = sequence.NewRegistry(cfg.Sequences, s.rt.Clusters); err != nil {
+		return nil, err
+	}
+	if len(cfg.Sharding.Tables) > 0 {
+		if err := reshard.ApplyShardMap(cfg.Reshard, &cfg.Sharding); err != nil {
+			return nil, err
+		}
+		if s.rt.Router, err = sharding.NewRouter(cfg.Sharding); err != nil {
+			return nil, err
+		}
+		for _, name := range s.rt.Router.Clusters() {
+			if _, ok := s.rt.Clusters.Get(name); !ok {
+				return nil, fmt.Errorf("sharding: unknown cluster %s", name)
+			}
+		}
+		for _, name := range s.rt.Router.Sequences() {
+			if _, ok := s.rt.Sequences.Get(name); !ok {
+				return nil, fmt.Errorf("sharding: unknown sequence %s", name)
+			}
+		}
+		for _, t := range cfg.Sharding.Tables {
+			// writes to reference tables commit on every copy at once
+			if t.Reference && cfg.XA.Log == "" {
+				return nil, fmt.Errorf("sharding: reference table %s needs the xa log", t.Name)
+			}
+			// and so do the writes keeping the lookup tables
+			if len(t.Lookups) > 0 && cfg.XA.Log == "" {
+				return nil, fmt.Errorf("sharding: lookups of table %s need the xa log", t.Name)
+			}
+		}
+		s.rt.DDL = sharding.NewDDLLog()
+		if s.reshard, err = reshard.NewManager(cfg.Reshard, s.rt.Router, s.rt.Clusters); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.XA.Log != "" {
+		if s.rt.XA, err = xa.NewCoordinator(cfg.XA); err != nil {
+			return nil, err
+		}
+		// transactions a crash left prepared hold locks, finish them before
+		// serving, backends down now are retried by Run
+		_ = s.rt.XA.Recover(context.Background(), s.rt.Clusters)
+	}
+	if cfg.Cache.Enabled {
+		if s.rt.Cache, err = qcache.New(cfg.Cache); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Digest.Enabled {
+		s.rt.Digests = digest.NewStore(cfg.Digest)
+	}
+	if cfg.SlowLog.Path != "" {
+		if s.rt.SlowLog, err = slowlog.Open(cfg.SlowLog); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Firewall.Rules != "" {
+		if s.rt.Firewall, err = firewall.New(cfg.Firewall); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Guardrail.Policies) > 0 {
+		if s.rt.Guardrail, err = guardrail.New(cfg.Guardrail); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.CostGuard.Users) > 0 {
+		if s.rt.CostGuard, err = costguard.New(cfg.CostGuard); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.ResultLimit.Policies) > 0 {
+		if s.rt.Limits, err = resultlimit.New(cfg.ResultLimit); err != nil {
+			return nil, err
+		}
+	}
+	if t := cfg.Timeout; t.Default != "" || len(t.Users) > 0 || len(t.Digests) > 0 {
+		if s.rt.Timeouts, err = timeout.New(t); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Admission.Rules) > 0 {
+		if s.rt.Admission, err = admission.New(cfg.Admission); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Retry.Enabled {
+		if s.rt.Retry, err = retry.New(cfg.Retry); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Coalesce.Enabled {
+		s.rt.Coalesce = qcache.NewGroup(cfg.Coalesce)
+	}
+	if len(cfg.CDC.Streams) > 0 {
+		if s.cdc, err = cdc.NewManager(cfg.CDC, s.rt.Clusters); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Admin.Addr != "" {
+		if s.admin, err = admin.NewServer(cfg.Admin); err != nil {
+			return nil, err
+		}
+		s.registerAdmin()
+	}
+	if len(cfg.Priority.Users) > 0 || len(cfg.Priority.Listeners) > 0 {
+		if s.priorities, err = priority.New(cfg.Priority); err != nil {
+			return nil, err
+		}
+		s.listeners = map[net.Listener]sql.Priority{}
+		for addr, prio := range s.priorities.Listeners() {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				s.closeListeners()
+				return nil, err
+			}
+			s.listeners[l] = prio
+		}
+	}
+	if s.listener, err = net.Listen("tcp", cfg.Addr); err != nil {
+		s.closeListeners()
+		return nil, err
+	}
+	return s, nil
+}
+
+// closeListeners closes the listeners opened by a NewServer that failed.
+func (s *Server) closeListeners() {
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
 }
 
 func (s *Server) Run(ctx context.Context) error {
+	if s.rt.XA != nil {
+		go s.rt.XA.Run(ctx, s.rt.Clusters)
+	}
+	if s.cdc != nil {
+		go func() {
+			s.cdc.Run(ctx)
+			// the streams are stopped, their sinks can be closed
+			if err := s.cdc.Close(); err != nil {
+				mLog.Error("method", "Run", "msg", "closing cdc sinks failed", "err", err.Error())
+			}
+		}()
+	}
+	if s.rt.Firewall != nil {
+		go s.rt.Firewall.Run(ctx)
+	}
+	if s.admin != nil {
+		go func() {
+			if err := s.admin.Run(ctx); err != nil {
+				mLog.Error("method", "Run", "msg", "admin server failed", "err", err.Error())
+			}
+		}()
+	}
+	for l, prio := range s.listeners {
+		go func(l net.Listener, prio sql.Priority) {
+			_ = s.serve(ctx, l, prio)
+		}(l, prio)
+	}
+	return s.serve(ctx, s.listener, sql.PriorityInteractive)
+}
+
+// serve accepts the connections of l, whose queries wait with priority
+// prio for backend connections unless their user has one.
+func (s *Server) serve(ctx context.Context, l net.Listener, prio sql.Priority) error {
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			conn, err := s.listener.Accept()
+			conn, err := l.Accept()
 			if err != nil {
 				mLog.Error("method", "Run", "msg", "accept failed", "err", err.Error())
 				continue
 			}
-			go s.onConn(conn)
+			go s.onConn(conn, prio)
 		}
 	}
 }
 
-func (s *Server) onConn(c net.Conn) {
+func (s *Server) onConn(c net.Conn, prio sql.Priority) {
 	cfg := mysql.NewConfig()
-	cfg.User, cfg.Passwd = "root", "root"
+	cfg.Users = s.users
 	cfg.Salt = make([]byte, 20)
 	_, _ = rand.Read(cfg.Salt)
 	connector := mysql.NewConnector(cfg)
@@ -77,7 +283,14 @@ func (s *Server) onConn(c net.Conn) {
 		return
 	}
 	mLog.Debug("method", "onConn", "msg", "connect success")
-	err = conn.Run(mysql.NewQueryContext(context.Background(), s.db))
+	if s.priorities != nil {
+		prio = s.priorities.Connection(cfg.User, prio)
+	}
+	base := context.Background()
+	if prio != sql.PriorityInteractive {
+		base = sql.WithPriority(base, prio)
+	}
+	err = conn.Run(mysql.NewQueryContext(base, s.rt))
 	if err != nil {
 		mLog.Error("method", "onConn", "err", err.Error(), "msg", "conn break")
 	}
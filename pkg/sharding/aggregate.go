@@ -0,0 +1,257 @@
+package sharding
+
+import (
+	"strings"
+
+	"github.com/u2takey/sqlparser/ast"
+	"github.com/u2takey/sqlparser/model"
+)
+
+type AggKind int
+
+const (
+	// AggGroup is a group key column.
+	AggGroup AggKind = iota
+	// AggAny is a column outside of the group key, any value of the group
+	// is valid and the first one is kept.
+	AggAny
+	AggCount
+	AggSum
+	AggMin
+	AggMax
+	// AggAvg is merged from a partial sum and count.
+	AggAvg
+)
+
+// AggColumn is a column of a merged aggregation.
+type AggColumn struct {
+	Kind AggKind
+	// Index is the shard result column holding the partial value, the
+	// partial sum for AggAvg.
+	Index int
+	// CountIndex is the shard result column holding the partial count of
+	// AggAvg.
+	CountIndex int
+
+	text  string
+	alias string
+}
+
+// AggregatePlan is a grouping select run on several shards. Shards compute
+// partial aggregates per group that the proxy merges by group key before
+// applying having, order by and limit.
+type AggregatePlan struct {
+	// Query is the statement sent to each shard.
+	Query string
+	// Columns are the merged columns, the Visible first ones are sent to
+	// the client and the others only feed having and order by.
+	Columns []AggColumn
+	Visible int
+	// GroupBy are the shard result columns making the group key.
+	GroupBy []int
+	Having  ast.ExprNode
+	// OrderBy keys index Columns.
+	OrderBy  []OrderKey
+	HasLimit bool
+	Offset   uint64
+	Count    uint64
+
+	shardFields []*ast.SelectField
+}
+
+// IsAggregate reports whether stmt groups rows, which has to be merged with
+// PlanAggregate when run on several shards.
+func IsAggregate(stmt *ast.SelectStmt) bool {
+	return stmt.GroupBy != nil || stmt.Having != nil || stmt.Distinct || hasAggregate(stmt.Fields)
+}
+
+// PlanAggregate rewrites a grouping select into partial aggregates for the
+// shards, avg becomes a sum and a count.
+func PlanAggregate(stmt *ast.SelectStmt) (*AggregatePlan, error) {
+	if hasWildcard(stmt.Fields.Fields) {
+		return nil, ErrAggregateUnsupported
+	}
+	if stmt.Distinct && (stmt.GroupBy != nil || hasAggregate(stmt.Fields)) {
+		return nil, ErrAggregateUnsupported
+	}
+	p := &AggregatePlan{}
+	for _, f := range stmt.Fields.Fields {
+		name := f.AsName.O
+		if name == "" {
+			name = f.Text()
+		}
+		if _, err := p.addColumn(f.Expr, f.AsName.L, name); err != nil {
+			return nil, err
+		}
+	}
+	p.Visible = len(p.Columns)
+
+	var groupBy []*ast.ByItem
+	if stmt.GroupBy != nil {
+		groupBy = stmt.GroupBy.Items
+	} else if stmt.Distinct {
+		for _, f := range stmt.Fields.Fields {
+			groupBy = append(groupBy, &ast.ByItem{Expr: f.Expr})
+		}
+	}
+	for _, item := range groupBy {
+		i, err := p.resolve(item.Expr, true)
+		if err != nil {
+			return nil, err
+		}
+		if p.Columns[i].Kind != AggAny && p.Columns[i].Kind != AggGroup {
+			return nil, ErrAggregateUnsupported
+		}
+		p.Columns[i].Kind = AggGroup
+		p.GroupBy = append(p.GroupBy, p.Columns[i].Index)
+	}
+
+	if stmt.Having != nil {
+		p.Having = stmt.Having.Expr
+		v := &havingVisitor{plan: p}
+		p.Having.Accept(v)
+		if v.err != nil {
+			return nil, v.err
+		}
+	}
+	if stmt.OrderBy != nil {
+		for _, item := range stmt.OrderBy.Items {
+			i, err := p.resolve(item.Expr, true)
+			if err != nil {
+				return nil, err
+			}
+			p.OrderBy = append(p.OrderBy, OrderKey{Index: i, Desc: item.Desc})
+		}
+	}
+	if stmt.Limit != nil {
+		var ok bool
+		if p.Count, ok = limitValue(stmt.Limit.Count); !ok {
+			return nil, ErrAggregateUnsupported
+		}
+		if stmt.Limit.Offset != nil {
+			if p.Offset, ok = limitValue(stmt.Limit.Offset); !ok {
+				return nil, ErrAggregateUnsupported
+			}
+		}
+		p.HasLimit = true
+	}
+
+	rewritten := *stmt
+	rewritten.Fields = &ast.FieldList{Fields: p.shardFields}
+	rewritten.Having, rewritten.OrderBy, rewritten.Limit = nil, nil, nil
+	query, err := Restore(&rewritten)
+	if err != nil {
+		return nil, err
+	}
+	p.Query = query
+	return p, nil
+}
+
+// Resolve returns the column of an expression of the having clause.
+func (p *AggregatePlan) Resolve(e ast.ExprNode) (int, bool) {
+	if c, ok := e.(*ast.ColumnNameExpr); ok && c.Name.Table.L == "" {
+		for i, col := range p.Columns {
+			if col.alias != "" && col.alias == c.Name.Name.L {
+				return i, true
+			}
+		}
+	}
+	text, err := Restore(e)
+	if err != nil {
+		return 0, false
+	}
+	for i, col := range p.Columns {
+		if col.text == text {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// resolve returns the column of e, adding a hidden one when missing.
+func (p *AggregatePlan) resolve(e ast.ExprNode, add bool) (int, error) {
+	if pos, ok := e.(*ast.PositionExpr); ok {
+		if pos.P != nil || pos.N < 1 || pos.N > p.Visible {
+			return 0, ErrAggregateUnsupported
+		}
+		return pos.N - 1, nil
+	}
+	if i, ok := p.Resolve(e); ok {
+		return i, nil
+	}
+	if !add {
+		return 0, ErrAggregateUnsupported
+	}
+	return p.addColumn(e, "", "")
+}
+
+// addColumn adds the merged column of e and the shard fields it is merged
+// from. Shard fields of visible columns get name as alias so the client
+// sees the columns it asked for.
+func (p *AggregatePlan) addColumn(e ast.ExprNode, alias, name string) (int, error) {
+	text, err := Restore(e)
+	if err != nil {
+		return 0, err
+	}
+	col := AggColumn{Kind: AggAny, text: text, alias: alias}
+	if agg, ok := e.(*ast.AggregateFuncExpr); ok {
+		f := strings.ToLower(agg.F)
+		if agg.Distinct && f != ast.AggFuncMin && f != ast.AggFuncMax {
+			return 0, ErrAggregateUnsupported
+		}
+		switch f {
+		case ast.AggFuncCount:
+			col.Kind = AggCount
+		case ast.AggFuncSum:
+			col.Kind = AggSum
+		case ast.AggFuncMin:
+			col.Kind = AggMin
+		case ast.AggFuncMax:
+			col.Kind = AggMax
+		case ast.AggFuncAvg:
+			col.Kind = AggAvg
+			col.Index = p.addShardField(&ast.AggregateFuncExpr{F: ast.AggFuncSum, Args: agg.Args}, name)
+			col.CountIndex = p.addShardField(&ast.AggregateFuncExpr{F: ast.AggFuncCount, Args: agg.Args}, "")
+			p.Columns = append(p.Columns, col)
+			return len(p.Columns) - 1, nil
+		default:
+			return 0, ErrAggregateUnsupported
+		}
+	} else if hasAggregate(&ast.FieldList{Fields: []*ast.SelectField{{Expr: e}}}) {
+		// aggregates inside expressions can not be merged
+		return 0, ErrAggregateUnsupported
+	}
+	col.Index = p.addShardField(e, name)
+	p.Columns = append(p.Columns, col)
+	return len(p.Columns) - 1, nil
+}
+
+func (p *AggregatePlan) addShardField(e ast.ExprNode, name string) int {
+	f := &ast.SelectField{Expr: e}
+	if name != "" {
+		f.AsName = model.NewCIStr(name)
+	}
+	p.shardFields = append(p.shardFields, f)
+	return len(p.shardFields) - 1
+}
+
+// havingVisitor adds the columns the having clause needs.
+type havingVisitor struct {
+	plan *AggregatePlan
+	err  error
+}
+
+func (v *havingVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	switch x := n.(type) {
+	case *ast.AggregateFuncExpr, *ast.ColumnNameExpr:
+		if _, err := v.plan.resolve(x.(ast.ExprNode), true); err != nil {
+			v.err = err
+		}
+		return n, true
+	}
+	return n, false
+}
+
+func (v *havingVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	return n, v.err == nil
+}
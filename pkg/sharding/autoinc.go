@@ -0,0 +1,100 @@
+package sharding
+
+import (
+	"strings"
+
+	"github.com/u2takey/sqlparser/ast"
+	"github.com/u2takey/sqlparser/model"
+)
+
+type AutoIncrementConfig struct {
+	Column string `json:"column"`
+	// Sequence names the sequence the ids come from.
+	Sequence string `json:"sequence"`
+}
+
+// AutoIncrement is a column the proxy fills from a sequence, as shards
+// would generate colliding ids.
+type AutoIncrement struct {
+	Column   string
+	Sequence string
+}
+
+// FillAutoIncrement sets the auto increment column of the rows of stmt that
+// leave it out, NULL or 0 to ids from next. It returns the first id set, 0
+// when stmt has all its ids.
+func (t *Table) FillAutoIncrement(stmt *ast.InsertStmt, next func(n int) ([]int64, error)) (int64, error) {
+	if t.AutoIncrement == nil || stmt.Select != nil {
+		return 0, nil
+	}
+	column := t.AutoIncrement.Column
+
+	if len(stmt.Setlist) > 0 {
+		var target *ast.Assignment
+		for _, a := range stmt.Setlist {
+			if a.Column.Name.L == column {
+				target = a
+			}
+		}
+		if target != nil && !needsId(target.Expr) {
+			return 0, nil
+		}
+		ids, err := next(1)
+		if err != nil {
+			return 0, err
+		}
+		if target == nil {
+			target = &ast.Assignment{Column: &ast.ColumnName{Name: model.NewCIStr(column)}}
+			stmt.Setlist = append(stmt.Setlist, target)
+		}
+		target.Expr = ast.NewValueExpr(ids[0], "", "")
+		return ids[0], nil
+	}
+
+	if len(stmt.Columns) == 0 {
+		// without column list the position of the column is unknown
+		return 0, nil
+	}
+	idx := -1
+	for i, c := range stmt.Columns {
+		if c.Name.L == column {
+			idx = i
+		}
+	}
+	var rows []int
+	for i, row := range stmt.Lists {
+		if idx < 0 || (idx < len(row) && needsId(row[idx])) {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	ids, err := next(len(rows))
+	if err != nil {
+		return 0, err
+	}
+	if idx < 0 {
+		stmt.Columns = append(stmt.Columns, &ast.ColumnName{Name: model.NewCIStr(column)})
+		for i := range stmt.Lists {
+			stmt.Lists[i] = append(stmt.Lists[i], nil)
+		}
+		idx = len(stmt.Columns) - 1
+	}
+	for i, row := range rows {
+		stmt.Lists[row][idx] = ast.NewValueExpr(ids[i], "", "")
+	}
+	return ids[0], nil
+}
+
+// needsId tells whether mysql would generate an auto increment value for e.
+func needsId(e ast.ExprNode) bool {
+	if _, ok := e.(*ast.DefaultExpr); ok {
+		return true
+	}
+	if v, ok := e.(ast.ValueExpr); ok && v.GetValue() == nil {
+		return true
+	}
+	v, ok := Literal(e)
+	return ok && strings.TrimLeft(v, "0") == ""
+}
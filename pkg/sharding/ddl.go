@@ -0,0 +1,112 @@
+package sharding
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DDLPending = "pending"
+	DDLDone    = "done"
+	DDLFailed  = "failed"
+)
+
+// maxDDLJobs is the number of ddl jobs DDLLog remembers.
+const maxDDLJobs = 100
+
+// DDLJob is a ddl statement applied to every shard of its tables.
+type DDLJob struct {
+	ID       int64       `json:"id"`
+	Query    string      `json:"query"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished,omitempty"`
+	Shards   []*DDLShard `json:"shards"`
+}
+
+// DDLShard is the progress of a ddl job on one shard.
+type DDLShard struct {
+	Shard   string `json:"shard"`
+	Cluster string `json:"cluster"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DDLLog tracks the recent ddl jobs for operators.
+type DDLLog struct {
+	mu   sync.Mutex
+	next int64
+	jobs []*DDLJob
+}
+
+func NewDDLLog() *DDLLog {
+	return &DDLLog{}
+}
+
+// Start records a new job of query on shards.
+func (l *DDLLog) Start(query string, shards []*Shard) *DDLJob {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next++
+	job := &DDLJob{ID: l.next, Query: query, Started: time.Now()}
+	for _, s := range shards {
+		job.Shards = append(job.Shards, &DDLShard{Shard: s.Name, Cluster: s.Cluster, State: DDLPending})
+	}
+	l.jobs = append(l.jobs, job)
+	if len(l.jobs) > maxDDLJobs {
+		l.jobs = l.jobs[1:]
+	}
+	return job
+}
+
+// Update sets the outcome of shard i of job.
+func (l *DDLLog) Update(job *DDLJob, i int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	job.Shards[i].State = DDLDone
+	if err != nil {
+		job.Shards[i].State, job.Shards[i].Error = DDLFailed, err.Error()
+	}
+	for _, s := range job.Shards {
+		if s.State == DDLPending {
+			return
+		}
+	}
+	job.Finished = time.Now()
+}
+
+// Jobs returns a copy of the recent jobs, the latest first.
+func (l *DDLLog) Jobs() []DDLJob {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	jobs := make([]DDLJob, 0, len(l.jobs))
+	for i := len(l.jobs) - 1; i >= 0; i-- {
+		job := *l.jobs[i]
+		job.Shards = make([]*DDLShard, len(l.jobs[i].Shards))
+		for j, s := range l.jobs[i].Shards {
+			shard := *s
+			job.Shards[j] = &shard
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// DDLShards returns the shards a ddl statement over tables has to run on,
+// one per cluster, nil when no table is sharded.
+func (r *Router) DDLShards(tables []*TableRef) []*Shard {
+	var shards []*Shard
+	seen := map[string]bool{}
+	for _, ref := range tables {
+		t, ok := r.Table(ref.Name)
+		if !ok {
+			continue
+		}
+		for _, s := range t.Shards {
+			if !seen[s.Cluster] {
+				seen[s.Cluster] = true
+				shards = append(shards, s)
+			}
+		}
+	}
+	return shards
+}
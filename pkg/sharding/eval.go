@@ -0,0 +1,208 @@
+package sharding
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/u2takey/sqlparser/ast"
+	"github.com/u2takey/sqlparser/opcode"
+)
+
+// Eval evaluates e against a merged row, resolve returns the row value of a
+// column or aggregate of e. Values are nil for NULL, *big.Rat for numbers
+// and string otherwise.
+func Eval(e ast.ExprNode, resolve func(ast.ExprNode) ([]byte, bool)) (interface{}, error) {
+	if v, ok := resolve(e); ok {
+		if v == nil {
+			return nil, nil
+		}
+		if r, ok := new(big.Rat).SetString(string(v)); ok {
+			return r, nil
+		}
+		return string(v), nil
+	}
+	switch x := e.(type) {
+	case ast.ValueExpr:
+		switch v := x.GetValue().(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return v, nil
+		case []byte:
+			return string(v), nil
+		default:
+			if r, ok := new(big.Rat).SetString(fmt.Sprint(v)); ok {
+				return r, nil
+			}
+			return fmt.Sprint(v), nil
+		}
+	case *ast.ParenthesesExpr:
+		return Eval(x.Expr, resolve)
+	case *ast.UnaryOperationExpr:
+		v, err := Eval(x.V, resolve)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		switch x.Op {
+		case opcode.Not, opcode.Not2:
+			return boolValue(!Truth(v)), nil
+		case opcode.Minus:
+			return new(big.Rat).Neg(number(v)), nil
+		case opcode.Plus:
+			return v, nil
+		}
+	case *ast.IsNullExpr:
+		v, err := Eval(x.Expr, resolve)
+		if err != nil {
+			return nil, err
+		}
+		return boolValue((v == nil) != x.Not), nil
+	case *ast.PatternInExpr:
+		if x.Sel != nil {
+			break
+		}
+		v, err := Eval(x.Expr, resolve)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		for _, item := range x.List {
+			iv, err := Eval(item, resolve)
+			if err != nil {
+				return nil, err
+			}
+			if iv != nil && compare(v, iv) == 0 {
+				return boolValue(!x.Not), nil
+			}
+		}
+		return boolValue(x.Not), nil
+	case *ast.BetweenExpr:
+		v, err := Eval(x.Expr, resolve)
+		if err != nil {
+			return nil, err
+		}
+		l, err := Eval(x.Left, resolve)
+		if err != nil {
+			return nil, err
+		}
+		r, err := Eval(x.Right, resolve)
+		if err != nil || v == nil || l == nil || r == nil {
+			return nil, err
+		}
+		in := compare(v, l) >= 0 && compare(v, r) <= 0
+		return boolValue(in != x.Not), nil
+	case *ast.BinaryOperationExpr:
+		return evalBinary(x, resolve)
+	}
+	text, _ := Restore(e)
+	return nil, fmt.Errorf("can not evaluate %s on merged rows", text)
+}
+
+func evalBinary(x *ast.BinaryOperationExpr, resolve func(ast.ExprNode) ([]byte, bool)) (interface{}, error) {
+	l, err := Eval(x.L, resolve)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Eval(x.R, resolve)
+	if err != nil {
+		return nil, err
+	}
+	switch x.Op {
+	case opcode.LogicAnd:
+		if (l != nil && !Truth(l)) || (r != nil && !Truth(r)) {
+			return boolValue(false), nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return boolValue(true), nil
+	case opcode.LogicOr:
+		if (l != nil && Truth(l)) || (r != nil && Truth(r)) {
+			return boolValue(true), nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return boolValue(false), nil
+	case opcode.NullEQ:
+		if l == nil || r == nil {
+			return boolValue(l == nil && r == nil), nil
+		}
+		return boolValue(compare(l, r) == 0), nil
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	switch x.Op {
+	case opcode.LogicXor:
+		return boolValue(Truth(l) != Truth(r)), nil
+	case opcode.EQ:
+		return boolValue(compare(l, r) == 0), nil
+	case opcode.NE:
+		return boolValue(compare(l, r) != 0), nil
+	case opcode.LT:
+		return boolValue(compare(l, r) < 0), nil
+	case opcode.LE:
+		return boolValue(compare(l, r) <= 0), nil
+	case opcode.GT:
+		return boolValue(compare(l, r) > 0), nil
+	case opcode.GE:
+		return boolValue(compare(l, r) >= 0), nil
+	case opcode.Plus:
+		return new(big.Rat).Add(number(l), number(r)), nil
+	case opcode.Minus:
+		return new(big.Rat).Sub(number(l), number(r)), nil
+	case opcode.Mul:
+		return new(big.Rat).Mul(number(l), number(r)), nil
+	case opcode.Div:
+		d := number(r)
+		if d.Sign() == 0 {
+			return nil, nil
+		}
+		return new(big.Rat).Quo(number(l), d), nil
+	}
+	return nil, fmt.Errorf("can not evaluate operator %s on merged rows", x.Op)
+}
+
+// Truth is the boolean value of an evaluated expression, NULL is false.
+func Truth(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	return number(v).Sign() != 0
+}
+
+func boolValue(b bool) *big.Rat {
+	if b {
+		return big.NewRat(1, 1)
+	}
+	return new(big.Rat)
+}
+
+// number converts v like mysql does, strings not starting with a number are
+// zero.
+func number(v interface{}) *big.Rat {
+	switch x := v.(type) {
+	case *big.Rat:
+		return x
+	case string:
+		s := strings.TrimSpace(x)
+		for end := len(s); end > 0; end-- {
+			if r, ok := new(big.Rat).SetString(s[:end]); ok {
+				return r
+			}
+		}
+	}
+	return new(big.Rat)
+}
+
+// compare compares numbers by value when either side is a number and
+// strings case insensitively otherwise.
+func compare(a, b interface{}) int {
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return strings.Compare(strings.ToLower(as), strings.ToLower(bs))
+	}
+	return number(a).Cmp(number(b))
+}
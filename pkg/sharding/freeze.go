@@ -0,0 +1,110 @@
+package sharding
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// writeGate counts the writes in flight on a table and holds new ones back
+// while the table is frozen.
+type writeGate struct {
+	mu sync.Mutex // protects following fields
+	// writers counts the writes in flight by the owner that registered
+	// them.
+	writers map[interface{}]int
+	// drained is closed once no write is in flight, nil when no freeze
+	// waits for it.
+	drained chan struct{}
+	// thawed is closed when a freeze ends, nil while not frozen.
+	thawed chan struct{}
+}
+
+func (r *Router) gate(name string) *writeGate {
+	name = strings.ToLower(name)
+	r.mu.RLock()
+	g, ok := r.gates[name]
+	r.mu.RUnlock()
+	if ok {
+		return g
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, ok = r.gates[name]; !ok {
+		g = &writeGate{writers: map[interface{}]int{}}
+		r.gates[name] = g
+	}
+	return g
+}
+
+// EnterWrite waits until table name is not frozen and registers a write on
+// it by owner, done must be called once the write is committed or rolled
+// back. An owner with writes in flight, like a transaction writing the
+// table again, does not wait: the freeze waits for it instead.
+func (r *Router) EnterWrite(ctx context.Context, name string, owner interface{}) (done func(), err error) {
+	g := r.gate(name)
+	g.mu.Lock()
+	for g.thawed != nil && g.writers[owner] == 0 {
+		thawed := g.thawed
+		g.mu.Unlock()
+		select {
+		case <-thawed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		g.mu.Lock()
+	}
+	g.writers[owner]++
+	g.mu.Unlock()
+	var once sync.Once
+	return func() { once.Do(func() { g.exit(owner) }) }, nil
+}
+
+func (g *writeGate) exit(owner interface{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.writers[owner]--; g.writers[owner] <= 0 {
+		delete(g.writers, owner)
+	}
+	if len(g.writers) == 0 && g.drained != nil {
+		close(g.drained)
+		g.drained = nil
+	}
+}
+
+// Freeze holds back the new writes on table name and waits for the ones in
+// flight, or until ctx is done. The table stays frozen until Thaw either
+// way.
+func (r *Router) Freeze(ctx context.Context, name string) error {
+	g := r.gate(name)
+	g.mu.Lock()
+	if g.thawed == nil {
+		g.thawed = make(chan struct{})
+	}
+	if len(g.writers) == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.drained == nil {
+		g.drained = make(chan struct{})
+	}
+	drained := g.drained
+	g.mu.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Thaw lets the writes held back by Freeze through.
+func (r *Router) Thaw(name string) {
+	g := r.gate(name)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.thawed != nil {
+		close(g.thawed)
+		g.thawed = nil
+	}
+}
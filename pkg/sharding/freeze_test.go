@@ -0,0 +1,66 @@
+package sharding
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFreeze(t *testing.T) {
+	r := newTestRouter(t, customersTable)
+	ctx := context.Background()
+	tx1, tx2 := new(int), new(int)
+	done1, err := r.EnterWrite(ctx, "customers", tx1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a freeze timing out leaves the table frozen and the gate usable
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := r.Freeze(short, "customers"); err != context.DeadlineExceeded {
+		t.Fatalf("freeze with a write in flight: %v", err)
+	}
+
+	// the transaction in flight writes again without waiting
+	again, err := r.EnterWrite(ctx, "Customers", tx1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := make(chan error, 1)
+	go func() {
+		done2, err := r.EnterWrite(ctx, "customers", tx2)
+		if err == nil {
+			done2()
+		}
+		held <- err
+	}()
+	select {
+	case err := <-held:
+		t.Fatalf("new write entered a frozen table: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	frozen := make(chan error, 1)
+	go func() { frozen <- r.Freeze(ctx, "customers") }()
+	done1()
+	done1()
+	select {
+	case err := <-frozen:
+		t.Fatalf("freeze ended with a write in flight: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	again()
+	if err := <-frozen; err != nil {
+		t.Fatal(err)
+	}
+
+	r.Thaw("customers")
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Freeze(ctx, "customers"); err != nil {
+		t.Fatalf("freeze of an idle table: %v", err)
+	}
+	r.Thaw("customers")
+}
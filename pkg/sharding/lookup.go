@@ -0,0 +1,247 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/u2takey/sqlparser/ast"
+	"github.com/u2takey/sqlparser/format"
+	"github.com/u2takey/sqlparser/model"
+)
+
+var (
+	ErrLookupValue      = errors.New("lookup column must be set to a literal")
+	ErrLookupMultiTable = errors.New("multi table dml on a table with lookup columns is not supported")
+	ErrLookupReplace    = errors.New("replace into a table with lookup columns is not supported")
+)
+
+type LookupConfig struct {
+	// Column is the secondary column routed through the lookup table.
+	Column string `json:"column"`
+	// Cluster and Table locate the lookup table, it has a column named like
+	// Column and one named like the shard key of the sharded table.
+	Cluster string `json:"cluster"`
+	Table   string `json:"table"`
+	// Unique lookups reject a value already mapped to a shard key.
+	Unique bool `json:"unique,omitempty"`
+}
+
+// Lookup routes predicates on a secondary column of a sharded table with a
+// lookup table mapping its values to shard keys.
+type Lookup struct {
+	Column  string
+	Cluster string
+	Table   string
+	Unique  bool
+	key     string
+}
+
+// LookupRow is a mapping of a lookup table.
+type LookupRow struct {
+	Value string
+	Key   string
+}
+
+func newLookup(cfg LookupConfig, t *Table) (*Lookup, error) {
+	if cfg.Column == "" || cfg.Cluster == "" || cfg.Table == "" {
+		return nil, fmt.Errorf("table %s: lookup needs a column, a cluster and a table", t.Name)
+	}
+	if strings.EqualFold(cfg.Column, t.Column) {
+		return nil, fmt.Errorf("table %s: lookup on the shard key column", t.Name)
+	}
+	return &Lookup{
+		Column:  strings.ToLower(cfg.Column),
+		Cluster: cfg.Cluster,
+		Table:   cfg.Table,
+		Unique:  cfg.Unique,
+		key:     t.Column,
+	}, nil
+}
+
+// SelectQuery returns the query reading the shard keys of values.
+func (l *Lookup) SelectQuery(values []string) string {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	ctx.WriteKeyWord("SELECT DISTINCT ")
+	ctx.WriteName(l.key)
+	ctx.WriteKeyWord(" FROM ")
+	ctx.WriteName(l.Table)
+	ctx.WriteKeyWord(" WHERE ")
+	ctx.WriteName(l.Column)
+	ctx.WriteKeyWord(" IN ")
+	ctx.WritePlain("(")
+	for i, v := range values {
+		if i > 0 {
+			ctx.WritePlain(",")
+		}
+		ctx.WriteString(v)
+	}
+	ctx.WritePlain(")")
+	return sb.String()
+}
+
+// InsertQuery returns the query adding rows, mappings already present are
+// ignored unless the lookup is unique.
+func (l *Lookup) InsertQuery(rows []LookupRow) string {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	ctx.WriteKeyWord("INSERT ")
+	if !l.Unique {
+		ctx.WriteKeyWord("IGNORE ")
+	}
+	ctx.WriteKeyWord("INTO ")
+	ctx.WriteName(l.Table)
+	ctx.WritePlain("(")
+	ctx.WriteName(l.Column)
+	ctx.WritePlain(",")
+	ctx.WriteName(l.key)
+	ctx.WritePlain(")")
+	ctx.WriteKeyWord(" VALUES ")
+	writeLookupRows(ctx, rows)
+	return sb.String()
+}
+
+// RemainingQuery returns the query reading which of rows the sharded table
+// called table still has, locking them. Rows of a non unique lookup may be
+// shared by several rows of the table.
+func (l *Lookup) RemainingQuery(table string, rows []LookupRow) string {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	ctx.WriteKeyWord("SELECT DISTINCT ")
+	ctx.WriteName(l.Column)
+	ctx.WritePlain(",")
+	ctx.WriteName(l.key)
+	ctx.WriteKeyWord(" FROM ")
+	ctx.WriteName(table)
+	ctx.WriteKeyWord(" WHERE ")
+	ctx.WritePlain("(")
+	ctx.WriteName(l.Column)
+	ctx.WritePlain(",")
+	ctx.WriteName(l.key)
+	ctx.WritePlain(")")
+	ctx.WriteKeyWord(" IN ")
+	ctx.WritePlain("(")
+	writeLookupRows(ctx, rows)
+	ctx.WritePlain(")")
+	ctx.WriteKeyWord(" FOR UPDATE")
+	return sb.String()
+}
+
+// DeleteQuery returns the query removing rows.
+func (l *Lookup) DeleteQuery(rows []LookupRow) string {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	ctx.WriteKeyWord("DELETE FROM ")
+	ctx.WriteName(l.Table)
+	ctx.WriteKeyWord(" WHERE ")
+	ctx.WritePlain("(")
+	ctx.WriteName(l.Column)
+	ctx.WritePlain(",")
+	ctx.WriteName(l.key)
+	ctx.WritePlain(")")
+	ctx.WriteKeyWord(" IN ")
+	ctx.WritePlain("(")
+	writeLookupRows(ctx, rows)
+	ctx.WritePlain(")")
+	return sb.String()
+}
+
+func writeLookupRows(ctx *format.RestoreCtx, rows []LookupRow) {
+	for i, r := range rows {
+		if i > 0 {
+			ctx.WritePlain(",")
+		}
+		ctx.WritePlain("(")
+		ctx.WriteString(r.Value)
+		ctx.WritePlain(",")
+		ctx.WriteString(r.Key)
+		ctx.WritePlain(")")
+	}
+}
+
+// Narrow restricts a route found through a lookup to the shards of keys.
+func (r *Route) Narrow(keys []string) error {
+	r.Shards, r.Scatter = nil, false
+	seen := map[*Shard]bool{}
+	for _, key := range keys {
+		s, err := r.Table.Shard(key)
+		if err != nil {
+			return err
+		}
+		if !seen[s] {
+			seen[s] = true
+			r.Shards = append(r.Shards, s)
+		}
+	}
+	if len(r.Shards) == 0 {
+		// no mapping, no row: any shard answers that
+		r.Shards = r.Table.Shards[:1]
+	}
+	return nil
+}
+
+// LookupSelect returns the query reading the current values of the lookup
+// columns of the rows a delete or update changes, followed by their shard
+// key, and the lookups of those columns. The rows are locked until the
+// statement commits. The query is empty when the statement changes no
+// lookup column.
+func (r *Route) LookupSelect(stmt ast.StmtNode) (string, []*Lookup, error) {
+	sel := &ast.SelectStmt{
+		Kind:           ast.SelectStmtKindSelect,
+		SelectStmtOpts: &ast.SelectStmtOpts{SQLCache: true},
+		LockInfo:       &ast.SelectLockInfo{LockType: ast.SelectLockForUpdate},
+	}
+	var lookups []*Lookup
+	switch s := stmt.(type) {
+	case *ast.DeleteStmt:
+		if len(r.Table.Lookups) == 0 {
+			return "", nil, nil
+		}
+		if s.IsMultiTable {
+			return "", nil, ErrLookupMultiTable
+		}
+		lookups = r.Table.Lookups
+		sel.From, sel.Where, sel.OrderBy, sel.Limit = s.TableRefs, s.Where, s.Order, s.Limit
+	case *ast.UpdateStmt:
+		for _, l := range r.Table.Lookups {
+			if _, ok := r.LookupUpdates[l]; ok {
+				lookups = append(lookups, l)
+			}
+		}
+		if len(lookups) == 0 {
+			return "", nil, nil
+		}
+		if s.MultipleTable {
+			return "", nil, ErrLookupMultiTable
+		}
+		sel.From, sel.Where, sel.OrderBy, sel.Limit = s.TableRefs, s.Where, s.Order, s.Limit
+	default:
+		return "", nil, nil
+	}
+	fields := make([]*ast.SelectField, 0, len(lookups)+1)
+	for _, l := range lookups {
+		fields = append(fields, columnField(l.Column))
+	}
+	fields = append(fields, columnField(r.Table.Column))
+	sel.Fields = &ast.FieldList{Fields: fields}
+	query, err := Restore(sel)
+	return query, lookups, err
+}
+
+func columnField(name string) *ast.SelectField {
+	return &ast.SelectField{Expr: &ast.ColumnNameExpr{Name: &ast.ColumnName{Name: model.NewCIStr(name)}}}
+}
+
+// lookupValue returns the value a lookup column is set to, null when set to
+// NULL which has no mapping.
+func lookupValue(e ast.ExprNode) (value string, null bool, err error) {
+	if v, ok := e.(ast.ValueExpr); ok && v.GetValue() == nil {
+		return "", true, nil
+	}
+	value, ok := Literal(e)
+	if !ok {
+		return "", false, ErrLookupValue
+	}
+	return value, false, nil
+}
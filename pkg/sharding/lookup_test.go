@@ -0,0 +1,98 @@
+package sharding
+
+import (
+	"strings"
+	"testing"
+
+	parser "github.com/u2takey/sqlparser"
+	"github.com/u2takey/sqlparser/ast"
+	_ "github.com/u2takey/sqlparser/test_driver"
+)
+
+func newTestRouter(t *testing.T, tables ...TableConfig) *Router {
+	t.Helper()
+	r, err := NewRouter(Config{Tables: tables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func parse(t *testing.T, query string) ast.StmtNode {
+	t.Helper()
+	stmt, err := parser.New().ParseOneStmt(query, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stmt
+}
+
+var ordersTable = TableConfig{
+	Name:      "orders",
+	Column:    "customer_id",
+	Algorithm: AlgorithmHash,
+	Shards:    []ShardConfig{{Name: "s0", Cluster: "c0"}, {Name: "s1", Cluster: "c1"}},
+	Lookups:   []LookupConfig{{Column: "email", Cluster: "c0", Table: "orders_email"}},
+}
+
+func TestLookupSelect(t *testing.T) {
+	r := newTestRouter(t, ordersTable)
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"DELETE FROM orders WHERE id = 1", "SELECT `email`,`customer_id` FROM `orders` WHERE `id`=1 FOR UPDATE"},
+		{"UPDATE orders SET email = 'a@b' WHERE id = 1", "SELECT `email`,`customer_id` FROM `orders` WHERE `id`=1 FOR UPDATE"},
+		{"UPDATE orders SET status = 1 WHERE id = 1", ""},
+	}
+	for _, tt := range tests {
+		stmt := parse(t, tt.query)
+		route, err := r.Route(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, _, err := route.LookupSelect(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != tt.want {
+			t.Errorf("%s: lookup select %q, want %q", tt.query, query, tt.want)
+		}
+	}
+}
+
+func TestLookupQueries(t *testing.T) {
+	r := newTestRouter(t, ordersTable)
+	orders, _ := r.Table("orders")
+	l := orders.Lookups[0]
+	rows := []LookupRow{{Value: "a@b", Key: "7"}, {Value: "c'd", Key: "8"}}
+	for _, tt := range []struct{ got, want string }{
+		{l.SelectQuery([]string{"a@b"}), "SELECT DISTINCT `customer_id` FROM `orders_email` WHERE `email` IN ('a@b')"},
+		{l.InsertQuery(rows), "INSERT IGNORE INTO `orders_email`(`email`,`customer_id`) VALUES ('a@b','7'),('c''d','8')"},
+		{l.DeleteQuery(rows), "DELETE FROM `orders_email` WHERE (`email`,`customer_id`) IN (('a@b','7'),('c''d','8'))"},
+		{l.RemainingQuery(orders.Name, rows), "SELECT DISTINCT `email`,`customer_id` FROM `orders` WHERE (`email`,`customer_id`) IN (('a@b','7'),('c''d','8')) FOR UPDATE"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestLookupRoute(t *testing.T) {
+	r := newTestRouter(t, ordersTable)
+	route, err := r.Route(parse(t, "SELECT * FROM orders WHERE email = 'a@b'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Lookup == nil || strings.Join(route.LookupValues, ",") != "a@b" {
+		t.Fatalf("route %+v, want a lookup of a@b", route)
+	}
+	if err := route.Narrow([]string{"7", "7"}); err != nil {
+		t.Fatal(err)
+	}
+	orders, _ := r.Table("orders")
+	want, _ := orders.Shard("7")
+	if len(route.Shards) != 1 || route.Shards[0] != want {
+		t.Fatalf("narrowed to %v, want %v", route.Shards, want)
+	}
+}
@@ -0,0 +1,555 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/u2takey/sqlparser/ast"
+	"github.com/u2takey/sqlparser/format"
+	"github.com/u2takey/sqlparser/opcode"
+)
+
+var (
+	ErrCrossShardJoin   = errors.New("statement joins sharded tables living on different shards")
+	ErrShardKeyUpdate   = errors.New("shard key column can not be updated")
+	ErrInsertColumnList = errors.New("insert into a sharded table needs a column list with the shard key")
+	ErrInsertSelect     = errors.New("insert ... select into a sharded table is not supported")
+	ErrReferenceCopy    = errors.New("reference table has no copy on a shard the statement runs on")
+)
+
+// Route is where a statement runs.
+type Route struct {
+	Table *Table
+	// Shards the statement runs on.
+	Shards []*Shard
+	// Scatter is set when the statement has no shard key predicate and has
+	// to run on every shard.
+	Scatter bool
+	// Queries holds the statement rewritten for each shard, set when the
+	// statement differs between shards like the rows of a multi row insert.
+	Queries map[*Shard]string
+	// Lookup is set when the statement has no shard key predicate but pins
+	// a lookup column to LookupValues, Narrow then restricts Shards to the
+	// shards the lookup table maps them to.
+	Lookup       *Lookup
+	LookupValues []string
+	// LookupInserts are the mappings the rows of an insert add.
+	LookupInserts map[*Lookup][]LookupRow
+	// LookupUpdates are the values an update sets lookup columns to, nil
+	// for NULL.
+	LookupUpdates map[*Lookup]*string
+}
+
+// Route returns where stmt runs, nil when stmt touches no sharded table.
+func (r *Router) Route(stmt ast.StmtNode) (*Route, error) {
+	refs := TableRefs(stmt)
+	from, sources, ok := fromTables(stmt)
+	var (
+		routes     []*Route
+		references []*Table
+	)
+	for i, ref := range refs {
+		t, found := r.Table(ref.Name)
+		if !found {
+			continue
+		}
+		if t.Reference {
+			if route, err := r.routeReferenceWrite(stmt, t, i == 0); route != nil || err != nil {
+				return route, err
+			}
+			references = append(references, t)
+			continue
+		}
+		if ok && !from[ref.key()] {
+			// only read by a subquery, the predicates of the statement do
+			// not restrict it
+			routes = append(routes, &Route{Table: t, Shards: t.Shards, Scatter: true})
+			continue
+		}
+		// unqualified columns belong to the table when it is the only one
+		// the statement reads from
+		route, err := routeTable(stmt, t, ref.names(!ok || sources == 1))
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	var route *Route
+	switch len(routes) {
+	case 0:
+		if len(references) == 0 {
+			return nil, nil
+		}
+		return r.routeReferenceRead(references)
+	case 1:
+		route = routes[0]
+	default:
+		// statements over several sharded tables run as is when every
+		// table resolves to one shard of the same cluster
+		for _, route := range routes {
+			if len(route.Shards) != 1 || route.Queries != nil ||
+				route.Shards[0].Cluster != routes[0].Shards[0].Cluster {
+				return nil, ErrCrossShardJoin
+			}
+		}
+		route = routes[0]
+	}
+	// reference tables are read from their copy next to the sharded rows,
+	// shards found through a lookup are only known later so all are checked
+	for _, t := range references {
+		for _, s := range route.Shards {
+			if t.shardIn(s.Cluster) == nil {
+				return nil, ErrReferenceCopy
+			}
+		}
+	}
+	return route, nil
+}
+
+// routeReferenceWrite returns the route of stmt when it writes the
+// reference table t, every copy is written. first is set when t is the
+// first table of stmt, the one written by single table dml. Multi table
+// statements only read reference tables.
+func (r *Router) routeReferenceWrite(stmt ast.StmtNode, t *Table, first bool) (*Route, error) {
+	switch s := stmt.(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt:
+		return nil, nil
+	case *ast.InsertStmt:
+		if !first {
+			return nil, nil
+		}
+		if s.Select != nil {
+			// each copy is filled from the rows of its own shard, which
+			// only works when they are copies too
+			for _, ref := range TableRefs(s.Select) {
+				if from, ok := r.Table(ref.Name); !ok || !from.Reference {
+					return nil, ErrInsertSelect
+				}
+			}
+		}
+	case *ast.UpdateStmt:
+		if !first || s.MultipleTable {
+			return nil, nil
+		}
+	case *ast.DeleteStmt:
+		if !first || s.IsMultiTable {
+			return nil, nil
+		}
+	default:
+		return &Route{Table: t, Shards: t.Shards, Scatter: true}, nil
+	}
+	return &Route{Table: t, Shards: t.Shards}, nil
+}
+
+// routeReferenceRead routes a read of reference tables only to a cluster
+// holding a copy of all of them, rotating over the candidates.
+func (r *Router) routeReferenceRead(references []*Table) (*Route, error) {
+	var candidates []*Shard
+	for _, s := range references[0].Shards {
+		ok := true
+		for _, t := range references[1:] {
+			ok = ok && t.shardIn(s.Cluster) != nil
+		}
+		if ok {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrCrossShardJoin
+	}
+	s := candidates[atomic.AddUint64(&r.reads, 1)%uint64(len(candidates))]
+	return &Route{Table: references[0], Shards: []*Shard{s}}, nil
+}
+
+func routeTable(stmt ast.StmtNode, t *Table, names map[string]bool) (*Route, error) {
+	var where ast.ExprNode
+	var updates map[*Lookup]*string
+	switch s := stmt.(type) {
+	case *ast.SelectStmt:
+		where = s.Where
+	case *ast.UpdateStmt:
+		for _, a := range s.List {
+			// an unqualified column may be of t whatever the other tables
+			if a.Column.Table.L != "" && !qualifies(a.Column, names) {
+				continue
+			}
+			if a.Column.Name.L == t.Column {
+				return nil, ErrShardKeyUpdate
+			}
+			if l := t.lookup(a.Column.Name.L); l != nil {
+				value, null, err := lookupValue(a.Expr)
+				if err != nil {
+					return nil, err
+				}
+				if updates == nil {
+					updates = map[*Lookup]*string{}
+				}
+				updates[l] = &value
+				if null {
+					updates[l] = nil
+				}
+			}
+		}
+		where = s.Where
+	case *ast.DeleteStmt:
+		where = s.Where
+	case *ast.InsertStmt:
+		return routeInsert(s, t)
+	default:
+		return &Route{Table: t, Shards: t.Shards, Scatter: true}, nil
+	}
+
+	keys, ok := keyValues(where, t.Column, names)
+	if !ok {
+		route := &Route{Table: t, Shards: t.Shards, Scatter: true, LookupUpdates: updates}
+		for _, l := range t.Lookups {
+			if values, ok := keyValues(where, l.Column, names); ok {
+				route.Lookup, route.LookupValues = l, values
+				break
+			}
+		}
+		return route, nil
+	}
+	route := &Route{Table: t, LookupUpdates: updates}
+	seen := map[*Shard]bool{}
+	for _, key := range keys {
+		s, err := t.Shard(key)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[s] {
+			seen[s] = true
+			route.Shards = append(route.Shards, s)
+		}
+	}
+	if len(route.Shards) == 0 {
+		// contradicting predicates match no row, any shard answers that
+		route.Shards = t.Shards[:1]
+	}
+	return route, nil
+}
+
+func routeInsert(stmt *ast.InsertStmt, t *Table) (*Route, error) {
+	if stmt.Select != nil {
+		return nil, ErrInsertSelect
+	}
+	for _, a := range stmt.OnDuplicate {
+		if a.Column.Name.L == t.Column {
+			return nil, ErrShardKeyUpdate
+		}
+		if t.lookup(a.Column.Name.L) != nil {
+			return nil, ErrLookupValue
+		}
+	}
+	if stmt.IsReplace && len(t.Lookups) > 0 {
+		return nil, ErrLookupReplace
+	}
+	if len(stmt.Setlist) > 0 {
+		columns := make([]*ast.ColumnName, len(stmt.Setlist))
+		row := make([]ast.ExprNode, len(stmt.Setlist))
+		for i, a := range stmt.Setlist {
+			columns[i], row[i] = a.Column, a.Expr
+		}
+		for i, c := range columns {
+			if c.Name.L != t.Column {
+				continue
+			}
+			key, ok := Literal(row[i])
+			if !ok {
+				return nil, fmt.Errorf("table %s: shard key must be a literal", t.Name)
+			}
+			s, err := t.Shard(key)
+			if err != nil {
+				return nil, err
+			}
+			route := &Route{Table: t, Shards: []*Shard{s}}
+			return route, route.addLookupInserts(columns, row, key)
+		}
+		return nil, ErrInsertColumnList
+	}
+
+	idx := -1
+	for i, c := range stmt.Columns {
+		if c.Name.L == t.Column {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil, ErrInsertColumnList
+	}
+	route := &Route{Table: t}
+	rows := map[*Shard][][]ast.ExprNode{}
+	for _, row := range stmt.Lists {
+		if idx >= len(row) {
+			return nil, ErrInsertColumnList
+		}
+		key, ok := Literal(row[idx])
+		if !ok {
+			return nil, fmt.Errorf("table %s: shard key must be a literal", t.Name)
+		}
+		s, err := t.Shard(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := rows[s]; !ok {
+			route.Shards = append(route.Shards, s)
+		}
+		rows[s] = append(rows[s], row)
+		if err := route.addLookupInserts(stmt.Columns, row, key); err != nil {
+			return nil, err
+		}
+	}
+	if len(route.Shards) < 2 {
+		return route, nil
+	}
+	route.Queries = map[*Shard]string{}
+	for _, s := range route.Shards {
+		split := *stmt
+		split.Lists = rows[s]
+		query, err := Restore(&split)
+		if err != nil {
+			return nil, err
+		}
+		route.Queries[s] = query
+	}
+	return route, nil
+}
+
+// addLookupInserts adds the mappings of an inserted row to the lookups of
+// its table.
+func (r *Route) addLookupInserts(columns []*ast.ColumnName, row []ast.ExprNode, key string) error {
+	for i, c := range columns {
+		l := r.Table.lookup(c.Name.L)
+		if l == nil || i >= len(row) {
+			continue
+		}
+		value, null, err := lookupValue(row[i])
+		if err != nil {
+			return err
+		}
+		if null {
+			continue
+		}
+		if r.LookupInserts == nil {
+			r.LookupInserts = map[*Lookup][]LookupRow{}
+		}
+		r.LookupInserts[l] = append(r.LookupInserts[l], LookupRow{Value: value, Key: key})
+	}
+	return nil
+}
+
+// keyValues returns the shard key values where restricts column to, ok is
+// false when where does not pin the shard key to a set of literals.
+func keyValues(where ast.ExprNode, column string, names map[string]bool) ([]string, bool) {
+	switch e := where.(type) {
+	case *ast.ParenthesesExpr:
+		return keyValues(e.Expr, column, names)
+	case *ast.BinaryOperationExpr:
+		switch e.Op {
+		case opcode.EQ:
+			if isColumn(e.L, column, names) {
+				v, ok := Literal(e.R)
+				return []string{v}, ok
+			}
+			if isColumn(e.R, column, names) {
+				v, ok := Literal(e.L)
+				return []string{v}, ok
+			}
+		case opcode.LogicAnd:
+			l, lok := keyValues(e.L, column, names)
+			r, rok := keyValues(e.R, column, names)
+			if lok && rok {
+				return intersect(l, r), true
+			}
+			if lok {
+				return l, true
+			}
+			return r, rok
+		case opcode.LogicOr:
+			l, lok := keyValues(e.L, column, names)
+			r, rok := keyValues(e.R, column, names)
+			if lok && rok {
+				return append(l, r...), true
+			}
+		}
+	case *ast.PatternInExpr:
+		if e.Not || e.Sel != nil || !isColumn(e.Expr, column, names) {
+			return nil, false
+		}
+		values := make([]string, 0, len(e.List))
+		for _, item := range e.List {
+			v, ok := Literal(item)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, v)
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+func intersect(a, b []string) []string {
+	set := map[string]bool{}
+	for _, v := range b {
+		set[v] = true
+	}
+	var out []string
+	for _, v := range a {
+		if set[v] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func isColumn(e ast.ExprNode, column string, names map[string]bool) bool {
+	c, ok := e.(*ast.ColumnNameExpr)
+	return ok && c.Name.Name.L == column && qualifies(c.Name, names)
+}
+
+func qualifies(c *ast.ColumnName, names map[string]bool) bool {
+	return names[c.Table.L]
+}
+
+// Literal returns the text of a constant expression.
+func Literal(e ast.ExprNode) (string, bool) {
+	switch x := e.(type) {
+	case ast.ValueExpr:
+		switch v := x.GetValue().(type) {
+		case nil:
+			return "", false
+		case []byte:
+			return string(v), true
+		case string:
+			return v, true
+		default:
+			return fmt.Sprint(v), true
+		}
+	case *ast.UnaryOperationExpr:
+		if x.Op == opcode.Minus {
+			if v, ok := Literal(x.V); ok {
+				return "-" + v, true
+			}
+		}
+	case *ast.ParenthesesExpr:
+		return Literal(x.Expr)
+	}
+	return "", false
+}
+
+// TableRef is a table a statement reads or writes.
+type TableRef struct {
+	Schema  string
+	Name    string
+	Aliases []string
+}
+
+// names returns the names columns of t are qualified with, the empty one
+// when unqualified is set.
+func (t *TableRef) names(unqualified bool) map[string]bool {
+	names := map[string]bool{strings.ToLower(t.Name): true}
+	for _, a := range t.Aliases {
+		names[strings.ToLower(a)] = true
+	}
+	if unqualified {
+		names[""] = true
+	}
+	return names
+}
+
+func (t *TableRef) key() string {
+	return strings.ToLower(t.Schema) + "." + strings.ToLower(t.Name)
+}
+
+// fromTables returns the tables in the FROM clause of a select, update or
+// delete, keyed like TableRef.key, and the number of table sources it has.
+// Tables of subqueries are not in it. ok is false for other statements.
+func fromTables(stmt ast.StmtNode) (tables map[string]bool, sources int, ok bool) {
+	var refs *ast.TableRefsClause
+	switch s := stmt.(type) {
+	case *ast.SelectStmt:
+		refs = s.From
+	case *ast.UpdateStmt:
+		refs = s.TableRefs
+	case *ast.DeleteStmt:
+		refs = s.TableRefs
+	default:
+		return nil, 0, false
+	}
+	tables = map[string]bool{}
+	if refs != nil {
+		sources = addFromTables(refs.TableRefs, tables)
+	}
+	return tables, sources, true
+}
+
+func addFromTables(n ast.ResultSetNode, tables map[string]bool) int {
+	switch x := n.(type) {
+	case *ast.Join:
+		sources := addFromTables(x.Left, tables)
+		if x.Right != nil {
+			sources += addFromTables(x.Right, tables)
+		}
+		return sources
+	case *ast.TableSource:
+		if name, ok := x.Source.(*ast.TableName); ok {
+			tables[name.Schema.L+"."+name.Name.L] = true
+		}
+		// a derived table is a source whose tables are a subquery's
+		return 1
+	}
+	return 0
+}
+
+// TableRefs returns the tables stmt references, in order of appearance.
+func TableRefs(stmt ast.Node) []*TableRef {
+	v := &tableRefVisitor{seen: map[string]*TableRef{}}
+	stmt.Accept(v)
+	return v.refs
+}
+
+type tableRefVisitor struct {
+	refs []*TableRef
+	seen map[string]*TableRef
+}
+
+func (v *tableRefVisitor) add(name *ast.TableName, alias string) {
+	key := name.Schema.L + "." + name.Name.L
+	ref, ok := v.seen[key]
+	if !ok {
+		ref = &TableRef{Schema: name.Schema.O, Name: name.Name.O}
+		v.seen[key] = ref
+		v.refs = append(v.refs, ref)
+	}
+	if alias != "" {
+		ref.Aliases = append(ref.Aliases, alias)
+	}
+}
+
+func (v *tableRefVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	switch x := n.(type) {
+	case *ast.TableSource:
+		if name, ok := x.Source.(*ast.TableName); ok {
+			v.add(name, x.AsName.O)
+		}
+	case *ast.TableName:
+		v.add(x, "")
+	}
+	return n, false
+}
+
+func (v *tableRefVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
+
+// Restore formats node back to sql text.
+func Restore(node ast.Node) (string, error) {
+	var sb strings.Builder
+	if err := node.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,163 @@
+package sharding
+
+import (
+	"reflect"
+	"testing"
+)
+
+func int64p(v int64) *int64 {
+	return &v
+}
+
+var (
+	customersTable = TableConfig{
+		Name:      "customers",
+		Column:    "id",
+		Algorithm: AlgorithmRange,
+		Shards: []ShardConfig{
+			{Name: "c0", Cluster: "c0", Max: int64p(100)},
+			{Name: "c1", Cluster: "c1", Min: int64p(100)},
+		},
+	}
+	regionsTable = TableConfig{
+		Name:      "regions",
+		Algorithm: AlgorithmList,
+		Reference: true,
+		Shards:    []ShardConfig{{Name: "r0", Cluster: "c0"}, {Name: "r1", Cluster: "c1"}},
+	}
+)
+
+func shardNames(route *Route) []string {
+	var names []string
+	for _, s := range route.Shards {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestRoute(t *testing.T) {
+	r := newTestRouter(t, customersTable, regionsTable, TableConfig{
+		Name:      "orders",
+		Column:    "customer_id",
+		Algorithm: AlgorithmRange,
+		Shards: []ShardConfig{
+			{Name: "o0", Cluster: "c0", Max: int64p(100)},
+			{Name: "o1", Cluster: "c1", Min: int64p(100)},
+		},
+	})
+	tests := []struct {
+		query   string
+		shards  []string
+		scatter bool
+		err     error
+	}{
+		{"SELECT * FROM customers WHERE id = 5", []string{"c0"}, false, nil},
+		{"SELECT * FROM customers WHERE 150 = id", []string{"c1"}, false, nil},
+		{"SELECT * FROM customers WHERE id IN (5, 150)", []string{"c0", "c1"}, false, nil},
+		{"SELECT * FROM customers WHERE id = 5 OR id = 6", []string{"c0"}, false, nil},
+		{"SELECT * FROM customers WHERE id = 5 AND name = 'x'", []string{"c0"}, false, nil},
+		{"SELECT * FROM customers WHERE id = 5 AND id = 150", []string{"c0"}, false, nil},
+		{"SELECT * FROM customers WHERE id = 5 OR name = 'x'", []string{"c0", "c1"}, true, nil},
+		{"SELECT * FROM customers WHERE id > 5", []string{"c0", "c1"}, true, nil},
+		{"SELECT * FROM customers c WHERE c.id = 150", []string{"c1"}, false, nil},
+		{"SELECT * FROM customers WHERE other.id = 150", []string{"c0", "c1"}, true, nil},
+		// a table read only by a subquery is not restricted by the outer
+		// predicates
+		{"SELECT * FROM customers WHERE id = 5 AND region IN (SELECT region FROM orders)", nil, false, ErrCrossShardJoin},
+		{"SELECT * FROM regions WHERE id = 5 AND region IN (SELECT region FROM orders)", []string{"o0", "o1"}, true, nil},
+		{"SELECT * FROM regions WHERE customer_id = 5 AND region IN (SELECT region FROM orders)", []string{"o0", "o1"}, true, nil},
+		// unqualified columns are ambiguous with several tables
+		{"SELECT * FROM customers c JOIN orders o ON o.customer_id = c.id WHERE id = 5", nil, false, ErrCrossShardJoin},
+		{"SELECT * FROM customers c JOIN orders o ON o.customer_id = c.id WHERE c.id = 5 AND o.customer_id = 5", []string{"c0"}, false, nil},
+		{"SELECT * FROM customers c JOIN orders o ON o.customer_id = c.id WHERE c.id = 5 AND o.customer_id = 150", nil, false, ErrCrossShardJoin},
+		{"SELECT * FROM customers c JOIN regions r ON r.id = c.region WHERE c.id = 150", []string{"c1"}, false, nil},
+		{"UPDATE customers SET name = 'x' WHERE id = 150", []string{"c1"}, false, nil},
+		{"UPDATE customers SET id = 1 WHERE id = 150", nil, false, ErrShardKeyUpdate},
+		{"UPDATE customers c JOIN orders o ON o.customer_id = c.id SET id = 1 WHERE c.id = 5 AND o.customer_id = 5", nil, false, ErrShardKeyUpdate},
+		{"DELETE FROM customers WHERE id IN (1, 2)", []string{"c0"}, false, nil},
+		{"INSERT INTO customers (id, name) VALUES (150, 'x')", []string{"c1"}, false, nil},
+		{"INSERT INTO customers SET id = 5, name = 'x'", []string{"c0"}, false, nil},
+		{"INSERT INTO customers VALUES (5, 'x')", nil, false, ErrInsertColumnList},
+		{"INSERT INTO customers (id) SELECT id FROM other", nil, false, ErrInsertSelect},
+		{"INSERT INTO regions (id, name) VALUES (1, 'eu')", []string{"r0", "r1"}, false, nil},
+		{"SELECT * FROM other WHERE id = 5", nil, false, nil},
+	}
+	for _, tt := range tests {
+		route, err := r.Route(parse(t, tt.query))
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.query, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if route == nil {
+			if tt.shards != nil {
+				t.Errorf("%s: not routed, want %v", tt.query, tt.shards)
+			}
+			continue
+		}
+		if got := shardNames(route); !reflect.DeepEqual(got, tt.shards) || route.Scatter != tt.scatter {
+			t.Errorf("%s: routed to %v scatter %v, want %v scatter %v", tt.query, got, route.Scatter, tt.shards, tt.scatter)
+		}
+	}
+}
+
+func TestRouteInsertSplit(t *testing.T) {
+	r := newTestRouter(t, customersTable)
+	route, err := r.Route(parse(t, "INSERT INTO customers (id, score) VALUES (1, 10), (150, 20), (2, 30)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"c0": "INSERT INTO `customers` (`id`,`score`) VALUES (1,10),(2,30)",
+		"c1": "INSERT INTO `customers` (`id`,`score`) VALUES (150,20)",
+	}
+	if len(route.Queries) != len(want) {
+		t.Fatalf("queries %v, want %v", route.Queries, want)
+	}
+	for s, query := range route.Queries {
+		if query != want[s.Name] {
+			t.Errorf("shard %s: %q, want %q", s.Name, query, want[s.Name])
+		}
+	}
+}
+
+func TestShardAlgorithms(t *testing.T) {
+	r := newTestRouter(t, customersTable, TableConfig{
+		Name:      "events",
+		Column:    "kind",
+		Algorithm: AlgorithmList,
+		Shards:    []ShardConfig{{Name: "e0", Cluster: "c0", Values: []string{"a", "b"}}, {Name: "e1", Cluster: "c1", Values: []string{"c"}}},
+	}, TableConfig{
+		Name:      "logs",
+		Column:    "id",
+		Algorithm: AlgorithmHash,
+		Shards:    []ShardConfig{{Name: "l0", Cluster: "c0"}, {Name: "l1", Cluster: "c1"}},
+	})
+	tests := []struct {
+		table, key, shard string
+		err               bool
+	}{
+		{"customers", "99", "c0", false},
+		{"customers", "100", "c1", false},
+		{"customers", "-5", "c0", false},
+		{"customers", "x", "", true},
+		{"events", "b", "e0", false},
+		{"events", "c", "e1", false},
+		{"events", "d", "", true},
+	}
+	for _, tt := range tests {
+		table, _ := r.Table(tt.table)
+		s, err := table.Shard(tt.key)
+		if (err != nil) != tt.err || (err == nil && s.Name != tt.shard) {
+			t.Errorf("%s %s: shard %v err %v, want %s err %v", tt.table, tt.key, s, err, tt.shard, tt.err)
+		}
+	}
+	logs, _ := r.Table("logs")
+	a, _ := logs.Shard("42")
+	b, _ := logs.Shard("42")
+	if a != b {
+		t.Error("hash shard of a key changed")
+	}
+}
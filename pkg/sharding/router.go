@@ -0,0 +1,398 @@
+package sharding
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	AlgorithmHash  = "hash"
+	AlgorithmRange = "range"
+	AlgorithmList  = "list"
+)
+
+// DefaultMaxGroups is the number of groups a merge of cross shard
+// aggregates keeps in memory before spilling to disk.
+const DefaultMaxGroups = 100000
+
+type Config struct {
+	Tables []TableConfig `json:"tables"`
+	// MaxGroups bounds the groups of a cross shard aggregation held in
+	// memory, more are spilled to temp files in SpillDir.
+	MaxGroups int    `json:"max_groups,omitempty"`
+	SpillDir  string `json:"spill_dir,omitempty"`
+}
+
+type TableConfig struct {
+	Name string `json:"name"`
+	// Column is the shard key column.
+	Column    string        `json:"column"`
+	Algorithm string        `json:"algorithm"`
+	Shards    []ShardConfig `json:"shards"`
+	// Lookups route predicates on secondary columns.
+	Lookups []LookupConfig `json:"lookups,omitempty"`
+	// AutoIncrement is the column filled from a sequence on insert.
+	AutoIncrement *AutoIncrementConfig `json:"auto_increment,omitempty"`
+	// Reference tables are copied whole to every shard so that sharded
+	// tables can join them anywhere, they have no shard key.
+	Reference bool `json:"reference,omitempty"`
+}
+
+type ShardConfig struct {
+	Name    string `json:"name"`
+	Cluster string `json:"cluster"`
+	// Min and Max bound the keys of a range shard, Min inclusive and Max
+	// exclusive, a missing bound is unbounded.
+	Min *int64 `json:"min,omitempty"`
+	Max *int64 `json:"max,omitempty"`
+	// Values are the keys of a list shard.
+	Values []string `json:"values,omitempty"`
+	// Stale is set on the source shard of a split until the rows moved
+	// away are deleted from it.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// Shard is a part of a sharded table, stored in a cluster under the same
+// table name.
+type Shard struct {
+	Name    string
+	Cluster string
+	min     *int64
+	max     *int64
+	// stale shards still hold rows of keys out of their range, Filter
+	// restricts the queries on them to their range.
+	stale bool
+}
+
+// Range returns the bounds of a range shard, Min inclusive and Max
+// exclusive, nil when unbounded.
+func (s *Shard) Range() (min, max *int64) {
+	return s.min, s.max
+}
+
+func (s *Shard) contains(key int64) bool {
+	return (s.min == nil || key >= *s.min) && (s.max == nil || key < *s.max)
+}
+
+// Table is a sharded table.
+type Table struct {
+	Name      string
+	Column    string
+	Algorithm string
+	Shards    []*Shard
+	Lookups   []*Lookup
+	// AutoIncrement is nil when the shards generate their own ids.
+	AutoIncrement *AutoIncrement
+	// Reference is set for tables copied to every shard.
+	Reference bool
+	list      map[string]*Shard
+}
+
+// shardIn returns the shard of t in cluster, nil when t has none there.
+func (t *Table) shardIn(cluster string) *Shard {
+	for _, s := range t.Shards {
+		if s.Cluster == cluster {
+			return s
+		}
+	}
+	return nil
+}
+
+// lookup returns the lookup of column, nil when column has none.
+func (t *Table) lookup(column string) *Lookup {
+	for _, l := range t.Lookups {
+		if l.Column == column {
+			return l
+		}
+	}
+	return nil
+}
+
+// Shard returns the shard key belongs to, key is the literal text of the
+// shard key value.
+func (t *Table) Shard(key string) (*Shard, error) {
+	switch t.Algorithm {
+	case AlgorithmHash:
+		return t.Shards[crc32.ChecksumIEEE([]byte(key))%uint32(len(t.Shards))], nil
+	case AlgorithmRange:
+		k, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: range shard key %q is not an integer", t.Name, key)
+		}
+		for _, s := range t.Shards {
+			if s.contains(k) {
+				return s, nil
+			}
+		}
+	case AlgorithmList:
+		if s, ok := t.list[key]; ok {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("table %s: no shard for key %q", t.Name, key)
+}
+
+// Router knows the sharded tables, tables missing from it are not sharded.
+// Tables are never changed in place, a resharding replaces them, so routes
+// keep the table they were made with.
+type Router struct {
+	MaxGroups int
+	SpillDir  string
+
+	mu     sync.RWMutex // protects following fields
+	tables map[string]*Table
+	gates  map[string]*writeGate
+	// reads rotates the reads of reference tables over their copies.
+	reads uint64
+}
+
+func NewRouter(cfg Config) (*Router, error) {
+	r := &Router{
+		MaxGroups: cfg.MaxGroups,
+		SpillDir:  cfg.SpillDir,
+		tables:    map[string]*Table{},
+		gates:     map[string]*writeGate{},
+	}
+	if r.MaxGroups <= 0 {
+		r.MaxGroups = DefaultMaxGroups
+	}
+	for _, tc := range cfg.Tables {
+		t, err := newTable(tc)
+		if err != nil {
+			return nil, err
+		}
+		r.tables[strings.ToLower(t.Name)] = t
+	}
+	return r, nil
+}
+
+func newTable(cfg TableConfig) (*Table, error) {
+	if cfg.Column == "" && !cfg.Reference {
+		return nil, fmt.Errorf("table %s: missing shard key column", cfg.Name)
+	}
+	if len(cfg.Shards) == 0 {
+		return nil, fmt.Errorf("table %s: no shard", cfg.Name)
+	}
+	t := &Table{
+		Name:      cfg.Name,
+		Column:    strings.ToLower(cfg.Column),
+		Algorithm: cfg.Algorithm,
+		Reference: cfg.Reference,
+		list:      map[string]*Shard{},
+	}
+	switch {
+	case t.Reference:
+		if t.Column != "" || len(cfg.Lookups) > 0 {
+			return nil, fmt.Errorf("table %s: reference table with a shard key or lookups", cfg.Name)
+		}
+	case t.Algorithm == AlgorithmHash, t.Algorithm == AlgorithmRange, t.Algorithm == AlgorithmList:
+	default:
+		return nil, fmt.Errorf("table %s: unknown algorithm %q", cfg.Name, cfg.Algorithm)
+	}
+	clusters := make([]string, 0, len(cfg.Shards))
+	for _, sc := range cfg.Shards {
+		if sc.Cluster == "" {
+			return nil, fmt.Errorf("table %s: shard %s has no cluster", cfg.Name, sc.Name)
+		}
+		clusters = append(clusters, sc.Cluster)
+	}
+	if err := checkClusters(cfg.Name, clusters); err != nil {
+		return nil, err
+	}
+	for _, sc := range cfg.Shards {
+		s := &Shard{Name: sc.Name, Cluster: sc.Cluster, min: sc.Min, max: sc.Max, stale: sc.Stale}
+		for _, v := range sc.Values {
+			t.list[v] = s
+		}
+		t.Shards = append(t.Shards, s)
+	}
+	for _, lc := range cfg.Lookups {
+		l, err := newLookup(lc, t)
+		if err != nil {
+			return nil, err
+		}
+		t.Lookups = append(t.Lookups, l)
+	}
+	if ac := cfg.AutoIncrement; ac != nil {
+		if ac.Column == "" || ac.Sequence == "" {
+			return nil, fmt.Errorf("table %s: auto increment needs a column and a sequence", cfg.Name)
+		}
+		t.AutoIncrement = &AutoIncrement{Column: strings.ToLower(ac.Column), Sequence: ac.Sequence}
+	}
+	return t, nil
+}
+
+// Table returns the sharded table called name.
+func (r *Router) Table(name string) (*Table, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tables[strings.ToLower(name)]
+	return t, ok
+}
+
+// Clusters returns the clusters holding shards or lookup tables of any
+// table.
+func (r *Router) Clusters() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := map[string]bool{}
+	var clusters []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			clusters = append(clusters, name)
+		}
+	}
+	for _, t := range r.tables {
+		for _, s := range t.Shards {
+			add(s.Cluster)
+		}
+		for _, l := range t.Lookups {
+			add(l.Cluster)
+		}
+	}
+	sort.Strings(clusters)
+	return clusters
+}
+
+// Sequences returns the sequences auto increment columns are filled from.
+func (r *Router) Sequences() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := map[string]bool{}
+	var sequences []string
+	for _, t := range r.tables {
+		if t.AutoIncrement != nil && !seen[t.AutoIncrement.Sequence] {
+			seen[t.AutoIncrement.Sequence] = true
+			sequences = append(sequences, t.AutoIncrement.Sequence)
+		}
+	}
+	sort.Strings(sequences)
+	return sequences
+}
+
+// SplitShard moves the keys from at up of the range shard called shard of
+// table name to a new shard, it returns the table as routed from now on.
+func (r *Router) SplitShard(name, shard string, at int64, cfg ShardConfig) (*Table, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tables[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("table %s is not sharded", name)
+	}
+	split, err := t.Split(shard, at, cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.tables[strings.ToLower(name)] = split
+	return split, nil
+}
+
+// CleanShard marks the shard called shard of table name as holding only
+// the rows of its range, once the rows a split moved away are deleted. It
+// returns the table as routed from now on.
+func (r *Router) CleanShard(name, shard string) (*Table, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tables[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("table %s is not sharded", name)
+	}
+	clean := *t
+	clean.Shards = make([]*Shard, len(t.Shards))
+	for i, s := range t.Shards {
+		if s.Name == shard && s.stale {
+			c := *s
+			c.stale = false
+			s = &c
+		}
+		clean.Shards[i] = s
+	}
+	r.tables[strings.ToLower(name)] = &clean
+	return &clean, nil
+}
+
+// Split returns t with the keys from at up of shard moved to a new shard,
+// t itself is left as it is. The source shard is stale until the moved
+// rows are deleted from it.
+func (t *Table) Split(shard string, at int64, cfg ShardConfig) (*Table, error) {
+	if err := t.CheckSplit(shard, at, cfg); err != nil {
+		return nil, err
+	}
+	split := *t
+	split.Shards = nil
+	for _, s := range t.Shards {
+		if s.Name != shard {
+			split.Shards = append(split.Shards, s)
+			continue
+		}
+		at := at
+		split.Shards = append(split.Shards,
+			&Shard{Name: s.Name, Cluster: s.Cluster, min: s.min, max: &at, stale: true},
+			&Shard{Name: cfg.Name, Cluster: cfg.Cluster, min: &at, max: s.max})
+	}
+	return &split, nil
+}
+
+// ShardConfigs returns the configuration of the shards of a range table.
+func (t *Table) ShardConfigs() []ShardConfig {
+	shards := make([]ShardConfig, len(t.Shards))
+	for i, s := range t.Shards {
+		shards[i] = ShardConfig{Name: s.Name, Cluster: s.Cluster, Min: s.min, Max: s.max, Stale: s.stale}
+	}
+	return shards
+}
+
+// CheckSplit tells whether SplitShard would accept a split.
+func (t *Table) CheckSplit(shard string, at int64, cfg ShardConfig) error {
+	if t.Algorithm != AlgorithmRange {
+		return fmt.Errorf("table %s: only range shards can be split", t.Name)
+	}
+	if cfg.Name == "" || cfg.Cluster == "" {
+		return fmt.Errorf("table %s: the new shard needs a name and a cluster", t.Name)
+	}
+	var source *Shard
+	for _, s := range t.Shards {
+		if s.Name == cfg.Name {
+			return fmt.Errorf("table %s: shard %s exists", t.Name, cfg.Name)
+		}
+		if s.Name == shard {
+			source = s
+		}
+	}
+	if source == nil {
+		return fmt.Errorf("table %s: no shard %s", t.Name, shard)
+	}
+	if source.stale {
+		return fmt.Errorf("table %s: shard %s still holds the rows of a previous split", t.Name, shard)
+	}
+	clusters := []string{cfg.Cluster}
+	for _, s := range t.Shards {
+		clusters = append(clusters, s.Cluster)
+	}
+	if err := checkClusters(t.Name, clusters); err != nil {
+		return err
+	}
+	if !source.contains(at) || (source.min != nil && *source.min == at) {
+		return fmt.Errorf("table %s: shard %s can not be split at %d", t.Name, shard, at)
+	}
+	return nil
+}
+
+// checkClusters fails when two of the shards of table, in clusters, are in
+// the same cluster. Shards keep the table name, two of them in a cluster
+// would be the same table.
+func checkClusters(table string, clusters []string) error {
+	seen := map[string]bool{}
+	for _, c := range clusters {
+		if seen[c] {
+			return fmt.Errorf("table %s: several shards in cluster %s", table, c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package sharding
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/u2takey/sqlparser/ast"
+)
+
+var (
+	ErrScatterUnsupported   = errors.New("select over several shards only supports plain selects with order by and limit")
+	ErrAggregateUnsupported = errors.New("select over several shards only merges count, sum, min, max and avg grouped by plain expressions")
+)
+
+// OrderKey is a sort key of a scattered select.
+type OrderKey struct {
+	// Index is the column of the key in the shard results, counted from
+	// the end of the row when negative.
+	Index int
+	// Name is set instead of Index when the key has to be found among the
+	// columns a wildcard expands to.
+	Name string
+	Desc bool
+}
+
+// ScatterPlan is a select run on several shards and merged by the proxy.
+type ScatterPlan struct {
+	// Query is the statement sent to each shard.
+	Query   string
+	OrderBy []OrderKey
+	// Offset and Count is the limit applied to the merged rows, shards get
+	// the first Offset+Count rows.
+	HasLimit bool
+	Offset   uint64
+	Count    uint64
+	// Hidden is the number of trailing columns added to the shard query for
+	// the proxy, they are not sent to the client.
+	Hidden int
+}
+
+// PlanScatter rewrites stmt for running on every shard: the limit is pushed
+// down including the offset and order by expressions missing from the
+// select list are added as hidden columns.
+func PlanScatter(stmt *ast.SelectStmt) (*ScatterPlan, error) {
+	if stmt.Distinct || stmt.GroupBy != nil || stmt.Having != nil || hasAggregate(stmt.Fields) {
+		return nil, ErrScatterUnsupported
+	}
+	plan := &ScatterPlan{}
+	rewritten := *stmt
+	fields := append([]*ast.SelectField{}, stmt.Fields.Fields...)
+
+	if stmt.OrderBy != nil {
+		for _, item := range stmt.OrderBy.Items {
+			key, field, err := orderKey(item, fields)
+			if err != nil {
+				return nil, err
+			}
+			if field != nil {
+				fields = append(fields, field)
+				key.Index = len(fields) - 1
+				plan.Hidden++
+			}
+			plan.OrderBy = append(plan.OrderBy, key)
+		}
+		if plan.Hidden > 0 && hasWildcard(fields) {
+			// hidden columns are counted from the end of the row, which
+			// does not move with the width of the wildcard
+			for i := range plan.OrderBy {
+				if plan.OrderBy[i].Index >= len(stmt.Fields.Fields) {
+					plan.OrderBy[i].Index -= len(fields)
+				}
+			}
+		}
+		rewritten.Fields = &ast.FieldList{Fields: fields}
+	}
+
+	if stmt.Limit != nil {
+		count, ok := limitValue(stmt.Limit.Count)
+		if !ok {
+			return nil, ErrScatterUnsupported
+		}
+		var offset uint64
+		if stmt.Limit.Offset != nil {
+			if offset, ok = limitValue(stmt.Limit.Offset); !ok {
+				return nil, ErrScatterUnsupported
+			}
+		}
+		plan.HasLimit, plan.Offset, plan.Count = true, offset, count
+		rewritten.Limit = &ast.Limit{Count: ast.NewValueExpr(offset+count, "", "")}
+	}
+
+	query, err := Restore(&rewritten)
+	if err != nil {
+		return nil, err
+	}
+	plan.Query = query
+	return plan, nil
+}
+
+// orderKey resolves an order by item against the select fields, field is
+// set when the item has to be added as a hidden column.
+func orderKey(item *ast.ByItem, fields []*ast.SelectField) (key OrderKey, field *ast.SelectField, err error) {
+	key = OrderKey{Desc: item.Desc}
+	if p, ok := item.Expr.(*ast.PositionExpr); ok {
+		if p.P != nil || p.N < 1 || p.N > len(fields) || hasWildcard(fields[:p.N]) {
+			return key, nil, ErrScatterUnsupported
+		}
+		key.Index = p.N - 1
+		return key, nil, nil
+	}
+	text, err := Restore(item.Expr)
+	if err != nil {
+		return key, nil, err
+	}
+	col, isColumn := item.Expr.(*ast.ColumnNameExpr)
+	for i, f := range fields {
+		if f.WildCard != nil {
+			continue
+		}
+		if isColumn && col.Name.Table.L == "" && f.AsName.L == col.Name.Name.L {
+			key.Index = i
+			return key, nil, nil
+		}
+		if f.AsName.L == "" {
+			if fieldText, err := Restore(f.Expr); err == nil && strings.EqualFold(fieldText, text) {
+				key.Index = i
+				return key, nil, nil
+			}
+		}
+	}
+	if isColumn && hasWildcard(fields) {
+		key.Name = col.Name.Name.O
+		return key, nil, nil
+	}
+	return key, &ast.SelectField{Expr: item.Expr}, nil
+}
+
+func hasWildcard(fields []*ast.SelectField) bool {
+	for _, f := range fields {
+		if f.WildCard != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func limitValue(e ast.ExprNode) (uint64, bool) {
+	v, ok := e.(ast.ValueExpr)
+	if !ok {
+		return 0, false
+	}
+	switch n := v.GetValue().(type) {
+	case uint64:
+		return n, true
+	case int64:
+		return uint64(n), n >= 0
+	}
+	return 0, false
+}
+
+func hasAggregate(fields *ast.FieldList) bool {
+	v := &aggregateVisitor{}
+	fields.Accept(v)
+	return v.found
+}
+
+type aggregateVisitor struct {
+	found bool
+}
+
+func (v *aggregateVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	if _, ok := n.(*ast.AggregateFuncExpr); ok {
+		v.found = true
+	}
+	return n, v.found
+}
+
+func (v *aggregateVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	return n, !v.found
+}
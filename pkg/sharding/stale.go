@@ -0,0 +1,82 @@
+package sharding
+
+import (
+	"strings"
+
+	parser "github.com/u2takey/sqlparser"
+	"github.com/u2takey/sqlparser/ast"
+	"github.com/u2takey/sqlparser/model"
+	"github.com/u2takey/sqlparser/opcode"
+)
+
+// Filter returns query, a statement on t run on s, restricted to the keys
+// of the range of s when s is stale: the rows a split moved away are not
+// to be read, counted or written on it too.
+func (t *Table) Filter(s *Shard, query string) (string, error) {
+	if !s.stale || (s.min == nil && s.max == nil) {
+		return query, nil
+	}
+	stmt, err := parser.New().ParseOneStmt(query, "", "")
+	if err != nil {
+		return "", err
+	}
+	var (
+		where *ast.ExprNode
+		from  *ast.TableRefsClause
+	)
+	switch x := stmt.(type) {
+	case *ast.SelectStmt:
+		where, from = &x.Where, x.From
+	case *ast.UpdateStmt:
+		where, from = &x.Where, x.TableRefs
+	case *ast.DeleteStmt:
+		where, from = &x.Where, x.TableRefs
+	default:
+		return query, nil
+	}
+	column := &ast.ColumnName{Name: model.NewCIStr(t.Column)}
+	if from != nil {
+		column.Table = model.NewCIStr(t.qualifier(from.TableRefs))
+	}
+	var cond ast.ExprNode
+	and := func(e ast.ExprNode) {
+		if cond == nil {
+			cond = e
+			return
+		}
+		cond = &ast.BinaryOperationExpr{Op: opcode.LogicAnd, L: cond, R: e}
+	}
+	if s.min != nil {
+		and(&ast.BinaryOperationExpr{Op: opcode.GE, L: &ast.ColumnNameExpr{Name: column}, R: ast.NewValueExpr(*s.min, "", "")})
+	}
+	if s.max != nil {
+		and(&ast.BinaryOperationExpr{Op: opcode.LT, L: &ast.ColumnNameExpr{Name: column}, R: ast.NewValueExpr(*s.max, "", "")})
+	}
+	if *where != nil {
+		cond = &ast.BinaryOperationExpr{Op: opcode.LogicAnd, L: &ast.ParenthesesExpr{Expr: *where}, R: cond}
+	}
+	*where = cond
+	return Restore(stmt)
+}
+
+// qualifier returns the name the columns of t are qualified with in the
+// from clause n, empty when t is not in it.
+func (t *Table) qualifier(n ast.ResultSetNode) string {
+	switch x := n.(type) {
+	case *ast.Join:
+		if q := t.qualifier(x.Left); q != "" {
+			return q
+		}
+		if x.Right != nil {
+			return t.qualifier(x.Right)
+		}
+	case *ast.TableSource:
+		if name, ok := x.Source.(*ast.TableName); ok && strings.EqualFold(name.Name.O, t.Name) {
+			if x.AsName.O != "" {
+				return x.AsName.O
+			}
+			return name.Name.O
+		}
+	}
+	return ""
+}
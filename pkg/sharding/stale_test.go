@@ -0,0 +1,53 @@
+package sharding
+
+import "testing"
+
+func TestFilter(t *testing.T) {
+	r := newTestRouter(t, customersTable)
+	if _, err := r.SplitShard("customers", "c0", 50, ShardConfig{Name: "c2", Cluster: "c2"}); err != nil {
+		t.Fatal(err)
+	}
+	table, _ := r.Table("customers")
+	shards := map[string]*Shard{}
+	for _, s := range table.Shards {
+		shards[s.Name] = s
+	}
+	tests := []struct {
+		shard string
+		query string
+		want  string
+	}{
+		{"c0", "SELECT COUNT(*) FROM customers", "SELECT COUNT(1) FROM `customers` WHERE `customers`.`id`<50"},
+		{"c0", "SELECT * FROM customers c JOIN regions r ON c.region = r.id WHERE r.id = 1",
+			"SELECT * FROM `customers` AS `c` JOIN `regions` AS `r` ON `c`.`region`=`r`.`id` WHERE (`r`.`id`=1) AND `c`.`id`<50"},
+		{"c0", "UPDATE customers SET name = 1 WHERE age > 3", "UPDATE `customers` SET `name`=1 WHERE (`age`>3) AND `customers`.`id`<50"},
+		{"c0", "DELETE FROM customers", "DELETE FROM `customers` WHERE `customers`.`id`<50"},
+		{"c0", "INSERT INTO customers (id) VALUES (1)", "INSERT INTO customers (id) VALUES (1)"},
+		{"c1", "SELECT COUNT(*) FROM customers", "SELECT COUNT(*) FROM customers"},
+		{"c2", "SELECT COUNT(*) FROM customers", "SELECT COUNT(*) FROM customers"},
+	}
+	for _, test := range tests {
+		got, err := table.Filter(shards[test.shard], test.query)
+		if err != nil {
+			t.Errorf("%s on %s: %v", test.query, test.shard, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s on %s: got %s, want %s", test.query, test.shard, got, test.want)
+		}
+	}
+
+	clean, err := r.CleanShard("customers", "c0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := clean.Filter(clean.Shards[0], "SELECT 1 FROM customers"); got != "SELECT 1 FROM customers" {
+		t.Errorf("filtered after cleanup: %s", got)
+	}
+	if _, err := clean.Split("c0", 20, ShardConfig{Name: "c3", Cluster: "c3"}); err != nil {
+		t.Errorf("split after cleanup: %v", err)
+	}
+	if _, err := table.Split("c0", 20, ShardConfig{Name: "c3", Cluster: "c3"}); err == nil {
+		t.Error("split of a stale shard")
+	}
+}
@@ -0,0 +1,282 @@
+// Package slowlog writes the statements slower than a threshold, in the
+// slow query log format of mysql or as json lines.
+package slowlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/log"
+)
+
+var mLog = log.ModuleLogger("slowlog")
+
+const (
+	FormatMySQL = "mysql"
+	FormatJSON  = "json"
+
+	DefaultThreshold = time.Second
+	// rotatedLayout suffixes the name of rotated files.
+	rotatedLayout = "20060102-150405.000"
+)
+
+type Config struct {
+	// Path is the log file, the slow log is off when empty.
+	Path string `json:"path"`
+	// Format is mysql, readable by pt-query-digest, or json.
+	Format string `json:"format,omitempty"`
+	// Threshold is the time past which a statement is slow, like "1s".
+	Threshold string `json:"threshold,omitempty"`
+	// SampleRate is the fraction of the slow statements logged, all when
+	// zero.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	// Normalize logs the statements with their values replaced by ?.
+	Normalize bool `json:"normalize,omitempty"`
+	// The file is rotated once larger than MaxSize bytes or older than
+	// RotateEvery, like "24h", and MaxBackups rotated files are kept, all
+	// when zero.
+	MaxSize     int64  `json:"max_size,omitempty"`
+	RotateEvery string `json:"rotate_every,omitempty"`
+	MaxBackups  int    `json:"max_backups,omitempty"`
+}
+
+// Entry is a slow statement, its durations are nanoseconds in json.
+type Entry struct {
+	Time         time.Time     `json:"time"`
+	ConnectionID uint32        `json:"connection_id"`
+	User         string        `json:"user"`
+	Client       string        `json:"client"`
+	Database     string        `json:"database,omitempty"`
+	Query        string        `json:"query"`
+	Digest       string        `json:"digest"`
+	Backends     []string      `json:"backends,omitempty"`
+	QueryTime    time.Duration `json:"query_time"`
+	ParseTime    time.Duration `json:"parse_time"`
+	PlanTime     time.Duration `json:"plan_time"`
+	BackendTime  time.Duration `json:"backend_time"`
+	WriteTime    time.Duration `json:"write_time"`
+	RowsSent     int64         `json:"rows_sent"`
+	RowsAffected int64         `json:"rows_affected"`
+	BytesSent    int64         `json:"bytes_sent"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// Log is a slow query log, its threshold and sample rate can be changed
+// while it is written.
+type Log struct {
+	path        string
+	format      string
+	normalize   bool
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+
+	threshold  int64  // nanoseconds, accessed atomically
+	sampleRate uint64 // float64 bits, accessed atomically
+
+	mu     sync.Mutex // protects following fields
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func Open(cfg Config) (*Log, error) {
+	l := &Log{
+		path:       cfg.Path,
+		format:     cfg.Format,
+		normalize:  cfg.Normalize,
+		maxSize:    cfg.MaxSize,
+		maxBackups: cfg.MaxBackups,
+	}
+	switch l.format {
+	case "":
+		l.format = FormatMySQL
+	case FormatMySQL, FormatJSON:
+	default:
+		return nil, fmt.Errorf("slow log: unknown format %q", cfg.Format)
+	}
+	threshold := DefaultThreshold
+	if cfg.Threshold != "" {
+		d, err := time.ParseDuration(cfg.Threshold)
+		if err != nil {
+			return nil, fmt.Errorf("slow log: threshold: %v", err)
+		}
+		threshold = d
+	}
+	l.SetThreshold(threshold)
+	rate := cfg.SampleRate
+	if rate == 0 {
+		rate = 1
+	}
+	if err := l.SetSampleRate(rate); err != nil {
+		return nil, err
+	}
+	if cfg.RotateEvery != "" {
+		d, err := time.ParseDuration(cfg.RotateEvery)
+		if err != nil {
+			return nil, fmt.Errorf("slow log: rotate every: %v", err)
+		}
+		l.rotateEvery = d
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size, l.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (l *Log) Threshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.threshold))
+}
+
+func (l *Log) SetThreshold(d time.Duration) {
+	atomic.StoreInt64(&l.threshold, int64(d))
+}
+
+func (l *Log) SampleRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&l.sampleRate))
+}
+
+// SetSampleRate sets the fraction of the slow statements logged.
+func (l *Log) SetSampleRate(rate float64) error {
+	if rate <= 0 || rate > 1 {
+		return fmt.Errorf("slow log: sample rate %v not in (0, 1]", rate)
+	}
+	atomic.StoreUint64(&l.sampleRate, math.Float64bits(rate))
+	return nil
+}
+
+// Normalize tells whether statements are logged normalized.
+func (l *Log) Normalize() bool {
+	return l.normalize
+}
+
+// Slow tells whether a statement that took d is logged, sampled.
+func (l *Log) Slow(d time.Duration) bool {
+	if d < l.Threshold() {
+		return false
+	}
+	rate := l.SampleRate()
+	return rate >= 1 || rand.Float64() < rate
+}
+
+func (l *Log) Write(e *Entry) error {
+	var data []byte
+	if l.format == FormatJSON {
+		var err error
+		if data, err = json.Marshal(e); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	} else {
+		data = []byte(formatMySQL(e))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	if (l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize) ||
+		(l.rotateEvery > 0 && time.Since(l.opened) >= l.rotateEvery) {
+		if err := l.rotate(); err != nil {
+			// tried again once as much is written to the old file
+			mLog.Error("msg", "rotating slow log", "path", l.path, "err", err)
+			l.size, l.opened = 0, time.Now()
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// formatMySQL formats e like mysqld does, with the figures of the proxy as
+// extra attributes.
+func formatMySQL(e *Entry) string {
+	var sb strings.Builder
+	ip := e.Client
+	if i := strings.LastIndexByte(ip, ':'); i >= 0 {
+		ip = ip[:i]
+	}
+	fmt.Fprintf(&sb, "# Time: %s\n", e.Time.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	fmt.Fprintf(&sb, "# User@Host: %s[%s] @  [%s]  Id: %d\n", e.User, e.User, ip, e.ConnectionID)
+	fmt.Fprintf(&sb, "# Query_time: %.6f  Lock_time: 0.000000 Rows_sent: %d  Rows_examined: 0  Rows_affected: %d  Bytes_sent: %d\n",
+		e.QueryTime.Seconds(), e.RowsSent, e.RowsAffected, e.BytesSent)
+	backends := strings.Join(e.Backends, ",")
+	if backends == "" {
+		backends = "none"
+	}
+	fmt.Fprintf(&sb, "# Digest: %s  Backends: %s  Parse_time: %.6f  Plan_time: %.6f  Backend_time: %.6f  Write_time: %.6f\n",
+		e.Digest, backends, e.ParseTime.Seconds(), e.PlanTime.Seconds(), e.BackendTime.Seconds(), e.WriteTime.Seconds())
+	if e.Error != "" {
+		fmt.Fprintf(&sb, "# Error: %s\n", strings.ReplaceAll(e.Error, "\n", " "))
+	}
+	if e.Database != "" {
+		fmt.Fprintf(&sb, "use %s;\n", e.Database)
+	}
+	fmt.Fprintf(&sb, "SET timestamp=%d;\n", e.Time.Unix())
+	sb.WriteString(strings.TrimRight(e.Query, "; \n"))
+	sb.WriteString(";\n")
+	return sb.String()
+}
+
+// rotate renames the file with the time as suffix and opens a new one. The
+// file is kept open until the new one is, so a failed rotation leaves the
+// entries going to the old one.
+func (l *Log) rotate() error {
+	old := l.file
+	if err := os.Rename(l.path, l.path+"."+time.Now().Format(rotatedLayout)); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	_ = old.Close()
+	if l.maxBackups <= 0 {
+		return nil
+	}
+	rotated, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return err
+	}
+	// the suffixes sort by time
+	sort.Strings(rotated)
+	for len(rotated) > l.maxBackups {
+		_ = os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,144 @@
+package slowlog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestLog(t *testing.T, cfg Config) *Log {
+	t.Helper()
+	cfg.Path = filepath.Join(t.TempDir(), "slow.log")
+	l, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		cfg Config
+		err bool
+	}{
+		{Config{}, false},
+		{Config{Format: FormatJSON, Threshold: "100ms", SampleRate: 0.5, RotateEvery: "24h"}, false},
+		{Config{Format: "csv"}, true},
+		{Config{Threshold: "slow"}, true},
+		{Config{SampleRate: 2}, true},
+		{Config{SampleRate: -0.1}, true},
+		{Config{RotateEvery: "daily"}, true},
+	}
+	for _, test := range tests {
+		test.cfg.Path = filepath.Join(t.TempDir(), "slow.log")
+		l, err := Open(test.cfg)
+		if (err != nil) != test.err {
+			t.Errorf("%+v: error %v", test.cfg, err)
+		}
+		if err == nil {
+			l.Close()
+		}
+	}
+}
+
+func TestSlow(t *testing.T) {
+	l := openTestLog(t, Config{Threshold: "100ms"})
+	tests := []struct {
+		d    time.Duration
+		slow bool
+	}{
+		{99 * time.Millisecond, false},
+		{100 * time.Millisecond, true},
+		{time.Second, true},
+	}
+	for _, test := range tests {
+		if got := l.Slow(test.d); got != test.slow {
+			t.Errorf("%v: slow %v, want %v", test.d, got, test.slow)
+		}
+	}
+	l.SetThreshold(time.Second)
+	if l.Slow(500 * time.Millisecond) {
+		t.Error("threshold change ignored")
+	}
+	if err := l.SetSampleRate(0); err == nil {
+		t.Error("sample rate 0 accepted")
+	}
+}
+
+func TestFormatMySQL(t *testing.T) {
+	e := &Entry{
+		Time:         time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		ConnectionID: 7,
+		User:         "app",
+		Client:       "10.0.0.1:5000",
+		Database:     "shop",
+		Query:        "SELECT 1; ",
+		Digest:       "d1",
+		Backends:     []string{"b1", "b2"},
+		QueryTime:    1500 * time.Millisecond,
+		RowsSent:     1,
+		Error:        "line\nbreak",
+	}
+	want := "# Time: 2024-03-01T12:00:00.000000Z\n" +
+		"# User@Host: app[app] @  [10.0.0.1]  Id: 7\n" +
+		"# Query_time: 1.500000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 0  Rows_affected: 0  Bytes_sent: 0\n" +
+		"# Digest: d1  Backends: b1,b2  Parse_time: 0.000000  Plan_time: 0.000000  Backend_time: 0.000000  Write_time: 0.000000\n" +
+		"# Error: line break\n" +
+		"use shop;\n" +
+		"SET timestamp=1709294400;\n" +
+		"SELECT 1;\n"
+	if got := formatMySQL(e); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	l := openTestLog(t, Config{Format: FormatJSON})
+	if err := l.Write(&Entry{User: "app", Query: "SELECT 1", QueryTime: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.User != "app" || e.Query != "SELECT 1" || e.QueryTime != time.Second {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	l := openTestLog(t, Config{Format: FormatJSON, MaxSize: 10, MaxBackups: 2})
+	for i := 0; i < 5; i++ {
+		if err := l.Write(&Entry{Query: "SELECT 1"}); err != nil {
+			t.Fatal(err)
+		}
+		// the rotated files are named by the millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+	rotated, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Errorf("got %d rotated files, want 2", len(rotated))
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 1 {
+		t.Errorf("got %d entries in the current file, want 1", n)
+	}
+	l.Close()
+	if err := l.Write(&Entry{}); err != os.ErrClosed {
+		t.Errorf("write after close got %v", err)
+	}
+}
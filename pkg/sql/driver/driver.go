@@ -255,6 +255,7 @@ type ConnExtend interface {
 	RowsAffected() uint64
 	Status() uint16
 	ServerVersion() string
+	ConnectionID() uint32
 	UseDb(ctx context.Context, dbName string) error
 }
 
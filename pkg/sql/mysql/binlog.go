@@ -0,0 +1,398 @@
+package mysql
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Binlog event types
+// https://dev.mysql.com/doc/internals/en/binlog-event-type.html
+const (
+	BinlogQueryEvent             byte = 0x02
+	BinlogRotateEvent            byte = 0x04
+	BinlogFormatDescriptionEvent byte = 0x0f
+	BinlogXidEvent               byte = 0x10
+	BinlogTableMapEvent          byte = 0x13
+	BinlogWriteRowsEventV1       byte = 0x17
+	BinlogUpdateRowsEventV1      byte = 0x18
+	BinlogDeleteRowsEventV1      byte = 0x19
+	BinlogHeartbeatEvent         byte = 0x1b
+	BinlogWriteRowsEvent         byte = 0x1e
+	BinlogUpdateRowsEvent        byte = 0x1f
+	BinlogDeleteRowsEvent        byte = 0x20
+	BinlogGTIDEvent              byte = 0x21
+	BinlogAnonymousGTIDEvent     byte = 0x22
+	BinlogPreviousGTIDsEvent     byte = 0x23
+)
+
+// comBinlogDumpGTID is COM_BINLOG_DUMP_GTID, binlogThroughGTID the flag
+// telling it carries a gtid set.
+const (
+	comBinlogDumpGTID byte = 0x1e
+	binlogThroughGTID      = 0x04
+)
+
+const (
+	binlogEventHeaderSize = 19
+	binlogChecksumSize    = 4
+)
+
+// BinlogConfig tells where a binlog stream starts.
+type BinlogConfig struct {
+	// ServerID identifies the stream as a replica of the server, it must
+	// differ from the ids of the servers and of their other replicas.
+	ServerID uint32
+	File     string
+	Position uint32
+	// GTIDSet, when set, starts the stream after these transactions
+	// instead of at File and Position. It needs gtid_mode=ON.
+	GTIDSet string
+	// Heartbeat is the period of the heartbeats the server sends while
+	// there is no event, defaults to 10s.
+	Heartbeat time.Duration
+}
+
+// BinlogPosition is a position in the binary logs of a server. GTIDSet are
+// the transactions before it when the server has gtids.
+type BinlogPosition struct {
+	File     string `json:"file"`
+	Position uint32 `json:"position"`
+	GTIDSet  string `json:"gtid_set,omitempty"`
+}
+
+func (p BinlogPosition) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Position)
+}
+
+// Compare orders positions of the same server, binlog file names sort in
+// the order the server wrote them.
+func (p BinlogPosition) Compare(o BinlogPosition) int {
+	switch {
+	case p.File < o.File:
+		return -1
+	case p.File > o.File:
+		return 1
+	case p.Position < o.Position:
+		return -1
+	case p.Position > o.Position:
+		return 1
+	}
+	return 0
+}
+
+// BinlogEvent is an event of the binary log.
+type BinlogEvent struct {
+	Type      byte
+	Timestamp uint32
+	ServerID  uint32
+	// Position is the position following the event.
+	Position BinlogPosition
+	// Rows is set for row events.
+	Rows *RowsEvent
+	// Query is set for query events, statements and the BEGIN of
+	// transactions.
+	Query *QueryEvent
+	// GTID is set for gtid events, the id of the next transaction.
+	GTID *GTIDEvent
+	// XID is the id of the transaction a xid event commits.
+	XID uint64
+}
+
+// QueryEvent is a statement logged as text.
+// https://dev.mysql.com/doc/internals/en/query-event.html
+type QueryEvent struct {
+	Schema    string
+	Query     string
+	ErrorCode uint16
+}
+
+// GTIDEvent is the global id of the transaction following it.
+type GTIDEvent struct {
+	SID string
+	GNO int64
+}
+
+// BinlogStreamer reads the binary log of a server the way a replica does.
+type BinlogStreamer struct {
+	mc       *MysqlConn
+	pos      BinlogPosition
+	checksum bool
+	tables   map[uint64]*TableMap
+
+	// gtids are the transactions committed so far, nil without gtids,
+	// next the one in progress.
+	gtids *GTIDSet
+	next  *GTIDEvent
+	// committed is the position following the last transaction.
+	committed BinlogPosition
+}
+
+// OpenBinlog connects to the server of dsn and starts streaming its binary
+// log from the position of cfg. The server needs binlog_format=ROW for row
+// events and the user the REPLICATION SLAVE privilege.
+func OpenBinlog(ctx context.Context, dsn string, cfg BinlogConfig) (*BinlogStreamer, error) {
+	dcfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := (&connector{cfg: dcfg}).Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mc := conn.(*MysqlConn)
+	s := &BinlogStreamer{
+		mc:     mc,
+		pos:    BinlogPosition{File: cfg.File, Position: cfg.Position},
+		tables: map[uint64]*TableMap{},
+	}
+	if cfg.GTIDSet != "" {
+		if s.gtids, err = ParseGTIDSet(cfg.GTIDSet); err != nil {
+			mc.Close()
+			return nil, err
+		}
+		s.pos = BinlogPosition{GTIDSet: s.gtids.String()}
+	}
+	s.committed = s.pos
+	if err := s.start(cfg); err != nil {
+		mc.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BinlogStreamer) start(cfg BinlogConfig) error {
+	mc := s.mc
+	checksum, err := mc.getSystemVar("global.binlog_checksum")
+	if err != nil {
+		return err
+	}
+	if s.checksum = !strings.EqualFold(string(checksum), "NONE"); s.checksum {
+		// servers only send checksums to replicas announcing they check them
+		if err := mc.exec("SET @master_binlog_checksum = @@global.binlog_checksum"); err != nil {
+			return err
+		}
+	}
+	heartbeat := cfg.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = 10 * time.Second
+	}
+	if err := mc.exec(fmt.Sprintf("SET @master_heartbeat_period = %d", heartbeat.Nanoseconds())); err != nil {
+		return err
+	}
+	if err := s.registerReplica(cfg.ServerID); err != nil {
+		return err
+	}
+	if s.gtids != nil {
+		return s.dumpGTID(cfg.ServerID)
+	}
+	return s.dump(cfg.ServerID)
+}
+
+// registerReplica sends COM_REGISTER_SLAVE
+// https://dev.mysql.com/doc/internals/en/com-register-slave.html
+func (s *BinlogStreamer) registerReplica(serverID uint32) error {
+	mc := s.mc
+	host, _ := os.Hostname()
+	if len(host) > 255 {
+		host = host[:255]
+	}
+	data := make([]byte, 4+1, 4+1+4+1+len(host)+1+len(mc.cfg.User)+1+2+4+4)
+	data[4] = ComRegisterSlave
+	data = appendUint32(data, serverID)
+	data = append(data, byte(len(host)))
+	data = append(data, host...)
+	data = append(data, byte(len(mc.cfg.User)))
+	data = append(data, mc.cfg.User...)
+	// password and port are only shown in SHOW SLAVE HOSTS
+	data = append(data, 0)
+	data = appendUint16(data, 0)
+	// replication rank and master id, both ignored
+	data = appendUint32(data, 0)
+	data = appendUint32(data, 0)
+
+	mc.sequence = 0
+	if err := mc.writePacket(data); err != nil {
+		return err
+	}
+	return mc.readResultOK()
+}
+
+// dump sends COM_BINLOG_DUMP
+// https://dev.mysql.com/doc/internals/en/com-binlog-dump.html
+func (s *BinlogStreamer) dump(serverID uint32) error {
+	mc := s.mc
+	data := make([]byte, 4+1, 4+1+4+2+4+len(s.pos.File))
+	data[4] = ComBinlogDump
+	data = appendUint32(data, s.pos.Position)
+	// flags, 0 blocks at the end of the log
+	data = appendUint16(data, 0)
+	data = appendUint32(data, serverID)
+	data = append(data, s.pos.File...)
+
+	mc.sequence = 0
+	return mc.writePacket(data)
+}
+
+// dumpGTID sends COM_BINLOG_DUMP_GTID
+// https://dev.mysql.com/doc/internals/en/com-binlog-dump-gtid.html
+func (s *BinlogStreamer) dumpGTID(serverID uint32) error {
+	mc := s.mc
+	set := s.gtids.encode()
+	data := make([]byte, 4+1, 4+1+2+4+4+8+4+len(set))
+	data[4] = comBinlogDumpGTID
+	data = appendUint16(data, binlogThroughGTID)
+	data = appendUint32(data, serverID)
+	// no file name, the server finds the file from the gtid set
+	data = appendUint32(data, 0)
+	data = appendUint64(data, 4)
+	data = appendUint32(data, uint32(len(set)))
+	data = append(data, set...)
+
+	mc.sequence = 0
+	return mc.writePacket(data)
+}
+
+// Position returns the position following the last event read.
+func (s *BinlogStreamer) Position() BinlogPosition {
+	return s.pos
+}
+
+// Committed returns the position following the last transaction read, a
+// stream opened there resumes where s left off without missing the table
+// maps of the rows events.
+func (s *BinlogStreamer) Committed() BinlogPosition {
+	return s.committed
+}
+
+// Next blocks until the next event of the log. Heartbeats, format
+// descriptions and table maps are returned too, the rows events that follow
+// a table map refer to it.
+func (s *BinlogStreamer) Next() (*BinlogEvent, error) {
+	data, err := s.mc.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	switch data[0] {
+	case IOK:
+	case IERR:
+		return nil, s.mc.handleErrorPacket(data)
+	case IEOF:
+		return nil, ErrInvalidConn
+	default:
+		return nil, ErrMalformPkt
+	}
+	// the packet is only valid until the next read
+	return s.parseEvent(append([]byte(nil), data[1:]...))
+}
+
+// parseEvent parses the event in data and moves the position of s past it.
+func (s *BinlogStreamer) parseEvent(data []byte) (*BinlogEvent, error) {
+	var err error
+	if len(data) < binlogEventHeaderSize {
+		return nil, ErrMalformPkt
+	}
+	ev := &BinlogEvent{
+		Timestamp: binary.LittleEndian.Uint32(data[0:]),
+		Type:      data[4],
+		ServerID:  binary.LittleEndian.Uint32(data[5:]),
+	}
+	logPos := binary.LittleEndian.Uint32(data[13:])
+	body := data[binlogEventHeaderSize:]
+	if s.checksum {
+		if len(body) < binlogChecksumSize {
+			return nil, ErrMalformPkt
+		}
+		body = body[:len(body)-binlogChecksumSize]
+	}
+
+	switch ev.Type {
+	case BinlogRotateEvent:
+		if len(body) < 8 {
+			return nil, ErrMalformPkt
+		}
+		// the gtids executed do not change with the file
+		s.pos.File, s.pos.Position = string(body[8:]), uint32(binary.LittleEndian.Uint64(body))
+		logPos = 0
+	case BinlogTableMapEvent:
+		tm, err := parseTableMap(body)
+		if err != nil {
+			return nil, err
+		}
+		s.tables[tm.ID] = tm
+	case BinlogWriteRowsEventV1, BinlogUpdateRowsEventV1, BinlogDeleteRowsEventV1,
+		BinlogWriteRowsEvent, BinlogUpdateRowsEvent, BinlogDeleteRowsEvent:
+		if ev.Rows, err = s.parseRows(ev.Type, body); err != nil {
+			return nil, err
+		}
+	case BinlogQueryEvent:
+		if ev.Query, err = parseQuery(body); err != nil {
+			return nil, err
+		}
+	case BinlogXidEvent:
+		if len(body) < 8 {
+			return nil, ErrMalformPkt
+		}
+		ev.XID = binary.LittleEndian.Uint64(body)
+	case BinlogGTIDEvent:
+		// flags, server uuid, transaction number
+		if len(body) < 1+16+8 {
+			return nil, ErrMalformPkt
+		}
+		ev.GTID = &GTIDEvent{SID: formatUUID(body[1:17]), GNO: int64(binary.LittleEndian.Uint64(body[17:]))}
+		s.next = ev.GTID
+	}
+	// artificial events, like the rotate starting a stream, have no
+	// position
+	if logPos != 0 {
+		s.pos.Position = logPos
+	}
+	// transactions end with a xid, or are a single statement that is not
+	// the BEGIN of the following row events
+	if ev.Type == BinlogXidEvent || (ev.Query != nil && !strings.EqualFold(ev.Query.Query, "BEGIN")) {
+		if s.next != nil && s.gtids != nil {
+			s.gtids.Add(s.next.SID, s.next.GNO)
+			s.pos.GTIDSet = s.gtids.String()
+		}
+		s.next = nil
+		s.committed = s.pos
+	}
+	ev.Position = s.pos
+	return ev, nil
+}
+
+// parseQuery parses the body of a query event.
+func parseQuery(data []byte) (*QueryEvent, error) {
+	// thread id, execution time, schema length, error code, status
+	// variables length
+	if len(data) < 4+4+1+2+2 {
+		return nil, ErrMalformPkt
+	}
+	schemaLen := int(data[8])
+	ev := &QueryEvent{ErrorCode: binary.LittleEndian.Uint16(data[9:])}
+	pos := 13 + int(binary.LittleEndian.Uint16(data[11:]))
+	if len(data) < pos+schemaLen+1 {
+		return nil, ErrMalformPkt
+	}
+	ev.Schema = string(data[pos : pos+schemaLen])
+	// the schema is followed by a 0
+	ev.Query = string(data[pos+schemaLen+1:])
+	return ev, nil
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n), byte(n>>8))
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+}
+
+// Close stops the stream, it may be called while Next is blocked.
+func (s *BinlogStreamer) Close() error {
+	s.mc.cleanup()
+	return nil
+}
@@ -0,0 +1,566 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// column types only found in the binary log
+const (
+	binlogTypeTimestamp2 fieldType = 0x11
+	binlogTypeDatetime2  fieldType = 0x12
+	binlogTypeTime2      fieldType = 0x13
+)
+
+var errBinlogJSON = errors.New("binlog: json columns are not supported")
+
+// TableMap describes the table of the rows events following it.
+// https://dev.mysql.com/doc/internals/en/table-map-event.html
+type TableMap struct {
+	ID     uint64
+	Schema string
+	Table  string
+	types  []fieldType
+	meta   []uint16
+}
+
+// Columns returns the number of columns of the table.
+func (tm *TableMap) Columns() int {
+	return len(tm.types)
+}
+
+// RowsEvent are the rows a statement inserted, updated or deleted in a
+// table.
+type RowsEvent struct {
+	Table *TableMap
+	// Rows are the row images, Before is nil for inserted rows and After
+	// for deleted rows. Values are nil for NULL, int64 for integers, enums
+	// and sets, uint64 for bits, float32 or float64 for floats, []byte for
+	// strings and blobs, and string otherwise. Integers are read as signed,
+	// see Unsigned. Timestamps are in UTC.
+	Rows []RowChange
+}
+
+// RowChange is a row of a rows event.
+type RowChange struct {
+	Before []interface{}
+	After  []interface{}
+}
+
+// Unsigned returns the value of an unsigned integer column i that v was
+// read from as signed.
+func (tm *TableMap) Unsigned(i int, v int64) uint64 {
+	switch tm.types[i] {
+	case fieldTypeTiny:
+		return uint64(uint8(v))
+	case fieldTypeShort:
+		return uint64(uint16(v))
+	case fieldTypeInt24:
+		return uint64(v) & 0xffffff
+	case fieldTypeLong:
+		return uint64(uint32(v))
+	}
+	return uint64(v)
+}
+
+func parseTableMap(data []byte) (*TableMap, error) {
+	if len(data) < 8 {
+		return nil, ErrMalformPkt
+	}
+	tm := &TableMap{ID: readUint48(data)}
+	// table id, flags
+	pos := 8
+	var ok bool
+	if tm.Schema, pos, ok = readBinlogName(data, pos); !ok {
+		return nil, ErrMalformPkt
+	}
+	if tm.Table, pos, ok = readBinlogName(data, pos); !ok {
+		return nil, ErrMalformPkt
+	}
+	count, _, n := readLengthEncodedInteger(data[pos:])
+	pos += n
+	if pos+int(count) > len(data) {
+		return nil, ErrMalformPkt
+	}
+	tm.types = make([]fieldType, count)
+	for i := range tm.types {
+		tm.types[i] = fieldType(data[pos+i])
+	}
+	pos += int(count)
+	metaLen, _, n := readLengthEncodedInteger(data[pos:])
+	pos += n
+	if pos+int(metaLen) > len(data) {
+		return nil, ErrMalformPkt
+	}
+	meta := data[pos : pos+int(metaLen)]
+	tm.meta = make([]uint16, count)
+	for i, t := range tm.types {
+		size := metaSize(t)
+		if len(meta) < size {
+			return nil, ErrMalformPkt
+		}
+		switch size {
+		case 1:
+			tm.meta[i] = uint16(meta[0])
+		case 2:
+			if t == fieldTypeString || t == fieldTypeEnum || t == fieldTypeSet || t == fieldTypeNewDecimal {
+				// real type or precision first
+				tm.meta[i] = uint16(meta[0])<<8 | uint16(meta[1])
+			} else {
+				tm.meta[i] = binary.LittleEndian.Uint16(meta)
+			}
+		}
+		meta = meta[size:]
+	}
+	return tm, nil
+}
+
+// metaSize is the size of the table map metadata of a column of type t.
+func metaSize(t fieldType) int {
+	switch t {
+	case fieldTypeFloat, fieldTypeDouble, fieldTypeTinyBLOB, fieldTypeMediumBLOB,
+		fieldTypeLongBLOB, fieldTypeBLOB, fieldTypeGeometry, fieldTypeJSON,
+		binlogTypeTimestamp2, binlogTypeDatetime2, binlogTypeTime2:
+		return 1
+	case fieldTypeNewDecimal, fieldTypeVarChar, fieldTypeVarString, fieldTypeString,
+		fieldTypeEnum, fieldTypeSet, fieldTypeBit:
+		return 2
+	}
+	return 0
+}
+
+func readBinlogName(data []byte, pos int) (string, int, bool) {
+	if pos >= len(data) {
+		return "", pos, false
+	}
+	n := int(data[pos])
+	// length, name, trailing 0
+	if pos+1+n+1 > len(data) {
+		return "", pos, false
+	}
+	return string(data[pos+1 : pos+1+n]), pos + 1 + n + 1, true
+}
+
+func readUint48(b []byte) uint64 {
+	return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 |
+		uint64(b[3])<<24 | uint64(b[4])<<32 | uint64(b[5])<<40
+}
+
+// parseRows parses a rows event
+// https://dev.mysql.com/doc/internals/en/rows-event.html
+func (s *BinlogStreamer) parseRows(typ byte, data []byte) (*RowsEvent, error) {
+	if len(data) < 8 {
+		return nil, ErrMalformPkt
+	}
+	tm, ok := s.tables[readUint48(data)]
+	if !ok {
+		return nil, fmt.Errorf("binlog: rows event of an unknown table %d", readUint48(data))
+	}
+	pos := 8
+	if typ >= BinlogWriteRowsEvent {
+		// extra data, its length includes itself
+		if len(data) < pos+2 {
+			return nil, ErrMalformPkt
+		}
+		pos += int(binary.LittleEndian.Uint16(data[pos:]))
+	}
+	if pos > len(data) {
+		return nil, ErrMalformPkt
+	}
+	count, _, n := readLengthEncodedInteger(data[pos:])
+	pos += n
+	if int(count) != len(tm.types) {
+		return nil, fmt.Errorf("binlog: rows event of %s.%s has %d columns, its table map %d", tm.Schema, tm.Table, count, len(tm.types))
+	}
+	bitmapLen := (int(count) + 7) / 8
+	update := typ == BinlogUpdateRowsEvent || typ == BinlogUpdateRowsEventV1
+	if len(data) < pos+bitmapLen {
+		return nil, ErrMalformPkt
+	}
+	present := data[pos : pos+bitmapLen]
+	pos += bitmapLen
+	presentAfter := present
+	if update {
+		if len(data) < pos+bitmapLen {
+			return nil, ErrMalformPkt
+		}
+		presentAfter = data[pos : pos+bitmapLen]
+		pos += bitmapLen
+	}
+
+	ev := &RowsEvent{Table: tm}
+	for pos < len(data) {
+		row, n, err := tm.decodeRow(data[pos:], present)
+		if err != nil {
+			return nil, err
+		}
+		pos += n
+		switch typ {
+		case BinlogWriteRowsEvent, BinlogWriteRowsEventV1:
+			ev.Rows = append(ev.Rows, RowChange{After: row})
+		case BinlogDeleteRowsEvent, BinlogDeleteRowsEventV1:
+			ev.Rows = append(ev.Rows, RowChange{Before: row})
+		default:
+			after, n, err := tm.decodeRow(data[pos:], presentAfter)
+			if err != nil {
+				return nil, err
+			}
+			pos += n
+			ev.Rows = append(ev.Rows, RowChange{Before: row, After: after})
+		}
+	}
+	return ev, nil
+}
+
+func bitSet(bitmap []byte, i int) bool {
+	return bitmap[i/8]&(1<<uint(i%8)) != 0
+}
+
+// decodeRow decodes a row image, the columns missing from present are nil.
+func (tm *TableMap) decodeRow(data []byte, present []byte) ([]interface{}, int, error) {
+	columns := 0
+	for i := range tm.types {
+		if bitSet(present, i) {
+			columns++
+		}
+	}
+	nullsLen := (columns + 7) / 8
+	if len(data) < nullsLen {
+		return nil, 0, ErrMalformPkt
+	}
+	nulls := data[:nullsLen]
+	pos := nullsLen
+	row := make([]interface{}, len(tm.types))
+	j := 0
+	for i, t := range tm.types {
+		if !bitSet(present, i) {
+			continue
+		}
+		null := bitSet(nulls, j)
+		j++
+		if null {
+			continue
+		}
+		v, n, err := decodeValue(data[pos:], t, tm.meta[i])
+		if err != nil {
+			return nil, 0, fmt.Errorf("binlog: column %d of %s.%s: %w", i, tm.Schema, tm.Table, err)
+		}
+		row[i] = v
+		pos += n
+	}
+	return row, pos, nil
+}
+
+// decodeValue decodes a value of type t from a row image, it returns the
+// value and its size.
+func decodeValue(data []byte, t fieldType, meta uint16) (interface{}, int, error) {
+	need := func(n int) error {
+		if len(data) < n {
+			return ErrMalformPkt
+		}
+		return nil
+	}
+	switch t {
+	case fieldTypeTiny:
+		if err := need(1); err != nil {
+			return nil, 0, err
+		}
+		return int64(int8(data[0])), 1, nil
+	case fieldTypeShort:
+		if err := need(2); err != nil {
+			return nil, 0, err
+		}
+		return int64(int16(binary.LittleEndian.Uint16(data))), 2, nil
+	case fieldTypeInt24:
+		if err := need(3); err != nil {
+			return nil, 0, err
+		}
+		v := int64(data[0]) | int64(data[1])<<8 | int64(data[2])<<16
+		if v&0x800000 != 0 {
+			v -= 1 << 24
+		}
+		return v, 3, nil
+	case fieldTypeLong:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		return int64(int32(binary.LittleEndian.Uint32(data))), 4, nil
+	case fieldTypeLongLong:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return int64(binary.LittleEndian.Uint64(data)), 8, nil
+	case fieldTypeFloat:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(data)), 4, nil
+	case fieldTypeDouble:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), 8, nil
+	case fieldTypeYear:
+		if err := need(1); err != nil {
+			return nil, 0, err
+		}
+		if data[0] == 0 {
+			return int64(0), 1, nil
+		}
+		return int64(data[0]) + 1900, 1, nil
+	case fieldTypeNewDecimal:
+		return decodeDecimal(data, int(meta>>8), int(meta&0xff))
+	case fieldTypeVarChar, fieldTypeVarString:
+		return decodeString(data, int(meta))
+	case fieldTypeString, fieldTypeEnum, fieldTypeSet:
+		realType, length := fieldType(meta>>8), int(meta&0xff)
+		if realType&0x30 != 0x30 {
+			// lengths above 255 keep their high bits in the real type
+			length |= int((realType&0x30)^0x30) << 4
+			realType |= 0x30
+		}
+		switch realType {
+		case fieldTypeEnum, fieldTypeSet:
+			if err := need(length); err != nil {
+				return nil, 0, err
+			}
+			var v uint64
+			for i := length - 1; i >= 0; i-- {
+				v = v<<8 | uint64(data[i])
+			}
+			return int64(v), length, nil
+		}
+		return decodeString(data, length)
+	case fieldTypeTinyBLOB, fieldTypeMediumBLOB, fieldTypeLongBLOB, fieldTypeBLOB, fieldTypeGeometry:
+		size := int(meta)
+		if err := need(size); err != nil {
+			return nil, 0, err
+		}
+		var length int
+		for i := size - 1; i >= 0; i-- {
+			length = length<<8 | int(data[i])
+		}
+		if err := need(size + length); err != nil {
+			return nil, 0, err
+		}
+		return data[size : size+length], size + length, nil
+	case fieldTypeJSON:
+		return nil, 0, errBinlogJSON
+	case fieldTypeBit:
+		length := int(meta>>8) + int(meta&0xff+7)/8
+		if err := need(length); err != nil {
+			return nil, 0, err
+		}
+		var v uint64
+		for _, b := range data[:length] {
+			v = v<<8 | uint64(b)
+		}
+		return v, length, nil
+	case fieldTypeDate, fieldTypeNewDate:
+		if err := need(3); err != nil {
+			return nil, 0, err
+		}
+		v := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+		return fmt.Sprintf("%04d-%02d-%02d", v>>9, (v>>5)&15, v&31), 3, nil
+	case fieldTypeTime:
+		if err := need(3); err != nil {
+			return nil, 0, err
+		}
+		v := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		if v&0x800000 != 0 {
+			v -= 1 << 24
+		}
+		sign := ""
+		if v < 0 {
+			sign, v = "-", -v
+		}
+		return fmt.Sprintf("%s%02d:%02d:%02d", sign, v/10000, v/100%100, v%100), 3, nil
+	case fieldTypeDateTime:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		v := binary.LittleEndian.Uint64(data)
+		d, t := v/1000000, v%1000000
+		return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d",
+			d/10000, d/100%100, d%100, t/10000, t/100%100, t%100), 8, nil
+	case fieldTypeTimestamp:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		sec := binary.LittleEndian.Uint32(data)
+		return formatTimestamp(int64(sec), 0, 0), 4, nil
+	case binlogTypeTimestamp2:
+		fsp := int(meta)
+		if err := need(4 + (fsp+1)/2); err != nil {
+			return nil, 0, err
+		}
+		sec := binary.BigEndian.Uint32(data)
+		frac := readFraction(data[4:], fsp)
+		return formatTimestamp(int64(sec), frac, fsp), 4 + (fsp+1)/2, nil
+	case binlogTypeDatetime2:
+		fsp := int(meta)
+		if err := need(5 + (fsp+1)/2); err != nil {
+			return nil, 0, err
+		}
+		v := readUintBE(data[:5]) - 0x8000000000
+		ymd, hms := v>>17, v&(1<<17-1)
+		ym := ymd >> 5
+		s := fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d",
+			ym/13, ym%13, ymd&31, hms>>12, (hms>>6)&63, hms&63)
+		return appendFraction(s, readFraction(data[5:], fsp), fsp), 5 + (fsp+1)/2, nil
+	case binlogTypeTime2:
+		return decodeTime2(data, int(meta))
+	}
+	return nil, 0, fmt.Errorf("type %d is not supported", t)
+}
+
+func decodeString(data []byte, max int) (interface{}, int, error) {
+	size := 1
+	if max > 255 {
+		size = 2
+	}
+	if len(data) < size {
+		return nil, 0, ErrMalformPkt
+	}
+	length := int(data[0])
+	if size == 2 {
+		length = int(binary.LittleEndian.Uint16(data))
+	}
+	if len(data) < size+length {
+		return nil, 0, ErrMalformPkt
+	}
+	return data[size : size+length], size + length, nil
+}
+
+func readUintBE(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// readFraction reads the fractional seconds of precision fsp as
+// microseconds.
+func readFraction(data []byte, fsp int) int {
+	switch fsp {
+	case 1, 2:
+		return int(data[0]) * 10000
+	case 3, 4:
+		return int(binary.BigEndian.Uint16(data)) * 100
+	case 5, 6:
+		return int(readUintBE(data[:3]))
+	}
+	return 0
+}
+
+func appendFraction(s string, micros, fsp int) string {
+	if fsp == 0 {
+		return s
+	}
+	return s + "." + fmt.Sprintf("%06d", micros)[:fsp]
+}
+
+func formatTimestamp(sec int64, micros, fsp int) string {
+	if sec == 0 {
+		return appendFraction("0000-00-00 00:00:00", 0, fsp)
+	}
+	s := time.Unix(sec, 0).UTC().Format("2006-01-02 15:04:05")
+	return appendFraction(s, micros, fsp)
+}
+
+// decodeTime2 decodes a TIME2 value, the fraction of negative times is
+// stored as a complement.
+func decodeTime2(data []byte, fsp int) (interface{}, int, error) {
+	size := 3 + (fsp+1)/2
+	if len(data) < size {
+		return nil, 0, ErrMalformPkt
+	}
+	var intPart, frac int64
+	switch fsp {
+	case 1, 2:
+		intPart = int64(readUintBE(data[:3])) - 0x800000
+		frac = int64(int8(data[3]))
+		if intPart < 0 && frac != 0 {
+			intPart++
+			frac -= 0x100
+		}
+		frac *= 10000
+	case 3, 4:
+		intPart = int64(readUintBE(data[:3])) - 0x800000
+		frac = int64(int16(binary.BigEndian.Uint16(data[3:])))
+		if intPart < 0 && frac != 0 {
+			intPart++
+			frac -= 0x10000
+		}
+		frac *= 100
+	case 5, 6:
+		v := int64(readUintBE(data[:6])) - 0x800000000000
+		intPart, frac = v>>24, v%(1<<24)
+	default:
+		intPart = int64(readUintBE(data[:3])) - 0x800000
+	}
+	sign := ""
+	if intPart < 0 || frac < 0 {
+		sign, intPart, frac = "-", -intPart, -frac
+	}
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, (intPart>>12)&0x3ff, (intPart>>6)&63, intPart&63)
+	return appendFraction(s, int(frac), fsp), size, nil
+}
+
+// decodeDecimal decodes a DECIMAL(precision, scale), stored as groups of
+// nine digits in four bytes, the leading and trailing partial groups in
+// fewer bytes. The sign is the inverted high bit, negative values have all
+// their bits inverted.
+func decodeDecimal(data []byte, precision, scale int) (interface{}, int, error) {
+	digitBytes := [10]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+	integral := precision - scale
+	fullIntegral, partIntegral := integral/9, integral%9
+	fullFraction, partFraction := scale/9, scale%9
+	size := fullIntegral*4 + digitBytes[partIntegral] + fullFraction*4 + digitBytes[partFraction]
+	if len(data) < size {
+		return nil, 0, ErrMalformPkt
+	}
+	b := append([]byte(nil), data[:size]...)
+	negative := b[0]&0x80 == 0
+	b[0] ^= 0x80
+	if negative {
+		for i := range b {
+			b[i] ^= 0xff
+		}
+	}
+
+	var integralDigits, fractionDigits strings.Builder
+	pos := 0
+	group := func(sb *strings.Builder, n, digits int) {
+		fmt.Fprintf(sb, "%0*d", digits, readUintBE(b[pos:pos+n]))
+		pos += n
+	}
+	if n := digitBytes[partIntegral]; n > 0 {
+		group(&integralDigits, n, partIntegral)
+	}
+	for i := 0; i < fullIntegral; i++ {
+		group(&integralDigits, 4, 9)
+	}
+	for i := 0; i < fullFraction; i++ {
+		group(&fractionDigits, 4, 9)
+	}
+	if n := digitBytes[partFraction]; n > 0 {
+		group(&fractionDigits, n, partFraction)
+	}
+	s := strings.TrimLeft(integralDigits.String(), "0")
+	if s == "" {
+		s = "0"
+	}
+	if scale > 0 {
+		s += "." + fractionDigits.String()
+	}
+	if negative && strings.Trim(s, "0.") != "" {
+		s = "-" + s
+	}
+	return s, size, nil
+}
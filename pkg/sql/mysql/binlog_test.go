@@ -0,0 +1,51 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// binlogEvent builds an event of type typ with body, ending at logPos.
+func binlogEvent(typ byte, logPos uint32, body []byte) []byte {
+	data := make([]byte, binlogEventHeaderSize, binlogEventHeaderSize+len(body))
+	data[4] = typ
+	binary.LittleEndian.PutUint32(data[9:], uint32(binlogEventHeaderSize+len(body)))
+	binary.LittleEndian.PutUint32(data[13:], logPos)
+	return append(data, body...)
+}
+
+func TestBinlogRotateKeepsGTIDs(t *testing.T) {
+	const sid = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	gtids, err := ParseGTIDSet(sid + ":1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &BinlogStreamer{
+		pos:    BinlogPosition{File: "mysql-bin.000001", Position: 4, GTIDSet: gtids.String()},
+		tables: map[uint64]*TableMap{},
+		gtids:  gtids,
+	}
+
+	gtid := make([]byte, 1+16+8)
+	copy(gtid[1:], []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62})
+	binary.LittleEndian.PutUint64(gtid[17:], 6)
+	rotate := make([]byte, 8, 8+16)
+	binary.LittleEndian.PutUint64(rotate, 4)
+	rotate = append(rotate, "mysql-bin.000002"...)
+	for _, data := range [][]byte{
+		binlogEvent(BinlogGTIDEvent, 200, gtid),
+		binlogEvent(BinlogXidEvent, 300, make([]byte, 8)),
+		binlogEvent(BinlogRotateEvent, 0, rotate),
+	} {
+		if _, err := s.parseEvent(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := BinlogPosition{File: "mysql-bin.000002", Position: 4, GTIDSet: sid + ":1-6"}
+	if s.pos != want {
+		t.Fatalf("position %+v, want %+v", s.pos, want)
+	}
+	if s.committed.GTIDSet != want.GTIDSet {
+		t.Fatalf("committed gtids %q, want %q", s.committed.GTIDSet, want.GTIDSet)
+	}
+}
@@ -37,6 +37,7 @@ type MysqlConn struct {
 	parseTime        bool
 	reset            bool // set when the Go SQL package calls ResetSession
 	serverVersion    string
+	connectionID     uint32
 
 	// for context support (Go 1.8+)
 	watching bool
@@ -655,6 +656,12 @@ func (mc *MysqlConn) ServerVersion() string {
 	return mc.serverVersion
 }
 
+// ConnectionID is the id of the connection on the server, as KILL takes
+// it.
+func (mc *MysqlConn) ConnectionID() uint32 {
+	return mc.connectionID
+}
+
 func (mc *MysqlConn) LastInsertId() uint64 {
 	return mc.insertId
 }
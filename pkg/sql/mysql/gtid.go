@@ -0,0 +1,163 @@
+package mysql
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GTIDSet is a set of global transaction ids, like @@global.gtid_executed.
+type GTIDSet struct {
+	// sets are the transaction numbers of each server uuid, as sorted and
+	// disjoint intervals, Start inclusive and End exclusive.
+	sets map[string][]gtidInterval
+}
+
+type gtidInterval struct {
+	Start, End int64
+}
+
+// ParseGTIDSet parses a set formatted like
+// "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:7,...".
+func ParseGTIDSet(s string) (*GTIDSet, error) {
+	g := &GTIDSet{sets: map[string][]gtidInterval{}}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ":")
+		sid, err := parseUUID(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields[1:] {
+			bounds := strings.SplitN(f, "-", 2)
+			start, err := strconv.ParseInt(bounds[0], 10, 64)
+			if err != nil || start < 1 {
+				return nil, fmt.Errorf("gtid set: bad interval %q", f)
+			}
+			end := start
+			if len(bounds) == 2 {
+				if end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || end < start {
+					return nil, fmt.Errorf("gtid set: bad interval %q", f)
+				}
+			}
+			g.addInterval(sid, gtidInterval{Start: start, End: end + 1})
+		}
+	}
+	return g, nil
+}
+
+// parseUUID returns the canonical form of a server uuid.
+func parseUUID(s string) (string, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(s), "-", ""))
+	if err != nil || len(b) != 16 {
+		return "", fmt.Errorf("gtid set: bad server uuid %q", s)
+	}
+	return formatUUID(b), nil
+}
+
+func formatUUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// Add adds transaction gno of server sid to g.
+func (g *GTIDSet) Add(sid string, gno int64) {
+	if g.sets == nil {
+		g.sets = map[string][]gtidInterval{}
+	}
+	g.addInterval(sid, gtidInterval{Start: gno, End: gno + 1})
+}
+
+func (g *GTIDSet) addInterval(sid string, iv gtidInterval) {
+	merged := make([]gtidInterval, 0, len(g.sets[sid])+1)
+	for _, cur := range g.sets[sid] {
+		switch {
+		case cur.End < iv.Start:
+			merged = append(merged, cur)
+		case iv.End < cur.Start:
+			merged = append(merged, iv)
+			iv = cur
+		default:
+			if cur.Start < iv.Start {
+				iv.Start = cur.Start
+			}
+			if cur.End > iv.End {
+				iv.End = cur.End
+			}
+		}
+	}
+	g.sets[sid] = append(merged, iv)
+}
+
+// Contains tells whether transaction gno of server sid is in g.
+func (g *GTIDSet) Contains(sid string, gno int64) bool {
+	for _, iv := range g.sets[sid] {
+		if gno >= iv.Start && gno < iv.End {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GTIDSet) sids() []string {
+	sids := make([]string, 0, len(g.sets))
+	for sid := range g.sets {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+	return sids
+}
+
+func (g *GTIDSet) String() string {
+	var sb strings.Builder
+	for i, sid := range g.sids() {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(sid)
+		for _, iv := range g.sets[sid] {
+			sb.WriteByte(':')
+			sb.WriteString(strconv.FormatInt(iv.Start, 10))
+			if iv.End-1 > iv.Start {
+				sb.WriteByte('-')
+				sb.WriteString(strconv.FormatInt(iv.End-1, 10))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// Clone returns a copy of g.
+func (g *GTIDSet) Clone() *GTIDSet {
+	c := &GTIDSet{sets: make(map[string][]gtidInterval, len(g.sets))}
+	for sid, ivs := range g.sets {
+		c.sets[sid] = append([]gtidInterval(nil), ivs...)
+	}
+	return c
+}
+
+// encode returns the binary form of g sent with COM_BINLOG_DUMP_GTID.
+func (g *GTIDSet) encode() []byte {
+	var b []byte
+	sids := g.sids()
+	b = appendUint64(b, uint64(len(sids)))
+	for _, sid := range sids {
+		raw, _ := hex.DecodeString(strings.ReplaceAll(sid, "-", ""))
+		b = append(b, raw...)
+		b = appendUint64(b, uint64(len(g.sets[sid])))
+		for _, iv := range g.sets[sid] {
+			b = appendUint64(b, uint64(iv.Start))
+			b = appendUint64(b, uint64(iv.End))
+		}
+	}
+	return b
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(n)), uint32(n>>32))
+}
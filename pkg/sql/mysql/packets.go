@@ -214,7 +214,9 @@ func (mc *MysqlConn) readHandshakePacket() (data []byte, plugin string, err erro
 	pos := 1
 	nullPos := bytes.IndexByte(data[pos:], 0x00)
 	mc.serverVersion = string(data[pos : nullPos+1])
-	pos += nullPos + 1 + 4
+	pos += nullPos + 1
+	mc.connectionID = binary.LittleEndian.Uint32(data[pos : pos+4])
+	pos += 4
 
 	// first part of the password cipher [8 bytes]
 	authData := data[pos : pos+8]
@@ -0,0 +1,96 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Priority orders the requests waiting for a connection of a full pool,
+// the lower first.
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota
+	PriorityBatch
+	PriorityReporting
+)
+
+// DefaultPriorityAging is how long a request waits before it is served as
+// if its priority was one level higher.
+const DefaultPriorityAging = 500 * time.Millisecond
+
+var priorityNames = []string{"interactive", "batch", "reporting"}
+
+func (p Priority) String() string {
+	if p >= 0 && int(p) < len(priorityNames) {
+		return priorityNames[p]
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// ParsePriority parses interactive, batch or reporting.
+func ParsePriority(s string) (Priority, error) {
+	for i, name := range priorityNames {
+		if strings.EqualFold(s, name) {
+			return Priority(i), nil
+		}
+	}
+	return 0, fmt.Errorf("sql: unknown priority %q", s)
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx whose connection requests wait with
+// priority p, interactive when none is set.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityFrom(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// connWaiter is a request waiting for a connection.
+type connWaiter struct {
+	req      chan connRequest
+	priority Priority
+	since    time.Time
+}
+
+// rank is the priority of w aged by its wait, the lower served first.
+func (w *connWaiter) rank(now time.Time, aging time.Duration) float64 {
+	return float64(w.priority) - float64(now.Sub(w.since))/float64(aging)
+}
+
+// SetPriorityAging sets how long a request waits before it is served as if
+// its priority was one level higher, so that low priority requests go on
+// being served while high priority ones keep coming. DefaultPriorityAging
+// applies when d is not positive.
+func (db *DB) SetPriorityAging(d time.Duration) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.priorityAging = d
+}
+
+// nextWaiterLocked returns the key of the request served next: the best
+// ranked, the oldest among equals.
+func (db *DB) nextWaiterLocked() uint64 {
+	now := nowFunc()
+	aging := db.priorityAging
+	if aging <= 0 {
+		aging = DefaultPriorityAging
+	}
+	first := true
+	var best uint64
+	var bestRank float64
+	for key, w := range db.connRequests {
+		rank := w.rank(now, aging)
+		if first || rank < bestRank || (rank == bestRank && key < best) {
+			first, best, bestRank = false, key, rank
+		}
+	}
+	return best
+}
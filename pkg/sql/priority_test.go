@@ -0,0 +1,52 @@
+package sql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextWaiter(t *testing.T) {
+	now := time.Now()
+	defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+	nowFunc = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		waiters map[uint64]connWaiter
+		want    uint64
+	}{
+		{"priority first", map[uint64]connWaiter{
+			1: {priority: PriorityReporting, since: now},
+			2: {priority: PriorityBatch, since: now},
+			3: {priority: PriorityInteractive, since: now},
+		}, 3},
+		{"oldest among equals", map[uint64]connWaiter{
+			4: {priority: PriorityBatch, since: now},
+			2: {priority: PriorityBatch, since: now},
+			3: {priority: PriorityBatch, since: now},
+		}, 2},
+		{"aged past a level", map[uint64]connWaiter{
+			1: {priority: PriorityBatch, since: now.Add(-2 * DefaultPriorityAging)},
+			2: {priority: PriorityInteractive, since: now},
+		}, 1},
+		{"not aged enough", map[uint64]connWaiter{
+			1: {priority: PriorityReporting, since: now.Add(-DefaultPriorityAging)},
+			2: {priority: PriorityInteractive, since: now},
+		}, 2},
+	}
+	for _, tt := range tests {
+		db := &DB{connRequests: tt.waiters}
+		if got := db.nextWaiterLocked(); got != tt.want {
+			t.Errorf("%s: served %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	db := &DB{connRequests: map[uint64]connWaiter{
+		1: {priority: PriorityBatch, since: now.Add(-time.Second)},
+		2: {priority: PriorityInteractive, since: now},
+	}}
+	db.SetPriorityAging(10 * time.Second)
+	if got := db.nextWaiterLocked(); got != 2 {
+		t.Errorf("with a longer aging served %d, want 2", got)
+	}
+}
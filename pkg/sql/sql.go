@@ -467,7 +467,7 @@ type DB struct {
 
 	mu           sync.Mutex // protects following fields
 	freeConn     []*driverConn
-	connRequests map[uint64]chan connRequest
+	connRequests map[uint64]connWaiter
 	nextRequest  uint64 // Next key to use in connRequests.
 	numOpen      int    // number of opened and pending open connections
 	// Used to signal the need for new connections
@@ -488,6 +488,9 @@ type DB struct {
 	maxIdleClosed     int64 // Total number of connections closed due to idle count.
 	maxIdleTimeClosed int64 // Total number of connections closed due to idle time.
 	maxLifetimeClosed int64 // Total number of connections closed due to max connection lifetime limit.
+	// priorityAging raises the priority of the waiting requests, zero
+	// means DefaultPriorityAging.
+	priorityAging time.Duration
 
 	stop func() // stop cancels the connection opener.
 }
@@ -788,7 +791,7 @@ func OpenDB(c driver.Connector) *DB {
 		connector:    c,
 		openerCh:     make(chan struct{}, connectionRequestQueueSize),
 		lastPut:      make(map[*driverConn]string),
-		connRequests: make(map[uint64]chan connRequest),
+		connRequests: make(map[uint64]connWaiter),
 		stop:         cancel,
 	}
 
@@ -897,8 +900,8 @@ func (db *DB) Close() error {
 	}
 	db.freeConn = nil
 	db.closed = true
-	for _, req := range db.connRequests {
-		close(req)
+	for _, w := range db.connRequests {
+		close(w.req)
 	}
 	db.mu.Unlock()
 	for _, fn := range fns {
@@ -1303,7 +1306,7 @@ func (db *DB) conn(ctx context.Context, strategy connReuseStrategy) (*driverConn
 		// connectionOpener doesn't block while waiting for the req to be read.
 		req := make(chan connRequest, 1)
 		reqKey := db.nextRequestKeyLocked()
-		db.connRequests[reqKey] = req
+		db.connRequests[reqKey] = connWaiter{req: req, priority: priorityFrom(ctx), since: nowFunc()}
 		db.waitCount++
 		db.mu.Unlock()
 
@@ -1481,11 +1484,8 @@ func (db *DB) putConnDBLocked(dc *driverConn, err error) bool {
 		return false
 	}
 	if c := len(db.connRequests); c > 0 {
-		var req chan connRequest
-		var reqKey uint64
-		for reqKey, req = range db.connRequests {
-			break
-		}
+		reqKey := db.nextWaiterLocked()
+		req := db.connRequests[reqKey].req
 		delete(db.connRequests, reqKey) // Remove from pending requests.
 		if err == nil {
 			dc.inUse = true
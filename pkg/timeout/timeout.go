@@ -0,0 +1,84 @@
+// Package timeout chooses the execution time limit of statements by
+// digest and user, enforced by the proxy whatever the backend version.
+package timeout
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// hint is the max_execution_time optimizer hint, in milliseconds.
+var hint = regexp.MustCompile(`(?i)/\*\+[^*]*?\bmax_execution_time\s*\(\s*(\d+)\s*\)`)
+
+type Config struct {
+	// Default is the limit of the statements no other limit applies to,
+	// like "30s", none when empty.
+	Default string `json:"default,omitempty"`
+	// Users and Digests are limits by user and by statement digest, the
+	// limit of the digest applies before the one of the user.
+	Users   map[string]string `json:"users,omitempty"`
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+type Timeouts struct {
+	def     time.Duration
+	users   map[string]time.Duration
+	digests map[string]time.Duration
+}
+
+func New(cfg Config) (*Timeouts, error) {
+	t := &Timeouts{users: map[string]time.Duration{}, digests: map[string]time.Duration{}}
+	var err error
+	if cfg.Default != "" {
+		if t.def, err = parse(cfg.Default); err != nil {
+			return nil, err
+		}
+	}
+	for u, s := range cfg.Users {
+		if t.users[u], err = parse(s); err != nil {
+			return nil, err
+		}
+	}
+	for d, s := range cfg.Digests {
+		if t.digests[d], err = parse(s); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func parse(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("timeout: bad limit %q", s)
+	}
+	return d, nil
+}
+
+// Limit returns the limit of a statement of user with digest, zero when
+// none applies.
+func (t *Timeouts) Limit(user, digest string) time.Duration {
+	if d, ok := t.digests[digest]; ok {
+		return d
+	}
+	if d, ok := t.users[user]; ok {
+		return d
+	}
+	return t.def
+}
+
+// Hint returns the limit set by the max_execution_time hint of query, zero
+// when it has none.
+func Hint(query string) time.Duration {
+	m := hint.FindStringSubmatch(query)
+	if m == nil {
+		return 0
+	}
+	ms, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,71 @@
+package timeout
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		cfg Config
+		err bool
+	}{
+		{Config{}, false},
+		{Config{Default: "30s", Users: map[string]string{"app": "1m"}, Digests: map[string]string{"d1": "500ms"}}, false},
+		{Config{Default: "soon"}, true},
+		{Config{Default: "0s"}, true},
+		{Config{Users: map[string]string{"app": "-1s"}}, true},
+		{Config{Digests: map[string]string{"d1": "10"}}, true},
+	}
+	for _, test := range tests {
+		if _, err := New(test.cfg); (err != nil) != test.err {
+			t.Errorf("%+v: error %v", test.cfg, err)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	tt, err := New(Config{
+		Default: "30s",
+		Users:   map[string]string{"report": "5m"},
+		Digests: map[string]string{"d1": "100ms"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, digest string
+		want         time.Duration
+	}{
+		{"app", "d2", 30 * time.Second},
+		{"report", "d2", 5 * time.Minute},
+		{"report", "d1", 100 * time.Millisecond},
+		{"app", "d1", 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := tt.Limit(test.user, test.digest); got != test.want {
+			t.Errorf("%s %s: got %v, want %v", test.user, test.digest, got, test.want)
+		}
+	}
+	if none, _ := New(Config{}); none.Limit("app", "d1") != 0 {
+		t.Error("limit without any configured")
+	}
+}
+
+func TestHint(t *testing.T) {
+	tests := []struct {
+		query string
+		want  time.Duration
+	}{
+		{"SELECT * FROM t", 0},
+		{"SELECT /*+ MAX_EXECUTION_TIME(1500) */ * FROM t", 1500 * time.Millisecond},
+		{"SELECT /*+ BKA(t) max_execution_time( 20 ) */ * FROM t", 20 * time.Millisecond},
+		{"SELECT /*+ MAX_EXECUTION_TIME(0) */ * FROM t", 0},
+		{"SELECT /* MAX_EXECUTION_TIME(100) */ * FROM t", 0},
+	}
+	for _, test := range tests {
+		if got := Hint(test.query); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Package xa coordinates transactions spanning several backends with XA
+// two phase commit.
+package xa
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+	"github.com/u2takey/mysqlgate/pkg/log"
+)
+
+var mLog = log.ModuleLogger("xa")
+
+// gtridPrefix starts the global transaction ids of the proxy, xids without
+// it belong to someone else and are left alone by recovery.
+const gtridPrefix = "mysqlgate-"
+
+// RecoverInterval is how often in-doubt transactions are looked for.
+const RecoverInterval = time.Minute
+
+type Config struct {
+	// Log is the path of the decision log, xa is off when empty.
+	Log string `json:"log"`
+	// Instance tells apart the proxies sharing backends, it defaults to the
+	// host name and must not change across restarts.
+	Instance string `json:"instance,omitempty"`
+}
+
+// Branch is the part of a transaction on one backend.
+type Branch interface {
+	// Name is the branch qualifier, unique within the transaction.
+	Name() string
+	Exec(ctx context.Context, query string) error
+}
+
+// Coordinator runs the two phase commit of transactions and recovers the
+// ones a crash left prepared.
+type Coordinator struct {
+	log      *Log
+	instance string
+	boot     string
+	seq      uint64
+
+	mu sync.Mutex // protects inflight
+	// inflight are the logged transactions whose branches are committing,
+	// recovery leaves them to Commit.
+	inflight map[string]bool
+}
+
+func NewCoordinator(cfg Config) (*Coordinator, error) {
+	instance := cfg.Instance
+	if instance == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		instance = host
+	}
+	if strings.ContainsAny(instance, "-'") {
+		return nil, fmt.Errorf("xa: instance %q must not contain - or '", instance)
+	}
+	l, err := OpenLog(cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+	return &Coordinator{
+		log:      l,
+		instance: instance,
+		boot:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		inflight: map[string]bool{},
+	}, nil
+}
+
+// NewGtrid returns the global id of a new transaction.
+func (c *Coordinator) NewGtrid() string {
+	return fmt.Sprintf("%s%s-%s-%d", gtridPrefix, c.instance, c.boot, atomic.AddUint64(&c.seq, 1))
+}
+
+// Xid formats the xid of the branch bqual of gtrid for XA statements.
+func Xid(gtrid, bqual string) string {
+	return quote(gtrid) + "," + quote(bqual)
+}
+
+func quote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// Start begins the branch b of gtrid.
+func (c *Coordinator) Start(ctx context.Context, gtrid string, b Branch) error {
+	return b.Exec(ctx, "XA START "+Xid(gtrid, b.Name()))
+}
+
+// Commit commits gtrid on branches. A single branch commits in one phase,
+// otherwise every branch is prepared and the decision logged before the
+// branches commit. Once logged the transaction is committed even when a
+// branch fails to, recovery finishes it.
+func (c *Coordinator) Commit(ctx context.Context, gtrid string, branches []Branch) error {
+	for _, b := range branches {
+		if err := b.Exec(ctx, "XA END "+Xid(gtrid, b.Name())); err != nil {
+			c.Rollback(ctx, gtrid, branches)
+			return err
+		}
+	}
+	switch len(branches) {
+	case 0:
+		return nil
+	case 1:
+		return branches[0].Exec(ctx, "XA COMMIT "+Xid(gtrid, branches[0].Name())+" ONE PHASE")
+	}
+
+	names := make([]string, len(branches))
+	for i, b := range branches {
+		names[i] = b.Name()
+		if err := b.Exec(ctx, "XA PREPARE "+Xid(gtrid, b.Name())); err != nil {
+			c.Rollback(ctx, gtrid, branches)
+			return err
+		}
+	}
+	c.setInflight(gtrid, true)
+	defer c.setInflight(gtrid, false)
+	if err := c.log.Commit(gtrid, names); err != nil {
+		c.Rollback(ctx, gtrid, branches)
+		return err
+	}
+	done := true
+	for _, b := range branches {
+		if err := b.Exec(ctx, "XA COMMIT "+Xid(gtrid, b.Name())); err != nil {
+			mLog.Error("msg", "commit left to recovery", "gtrid", gtrid, "branch", b.Name(), "err", err)
+			done = false
+		}
+	}
+	if done {
+		if err := c.log.Done(gtrid); err != nil {
+			mLog.Error("msg", "logging done", "gtrid", gtrid, "err", err)
+		}
+	}
+	return nil
+}
+
+func (c *Coordinator) setInflight(gtrid string, on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if on {
+		c.inflight[gtrid] = true
+	} else {
+		delete(c.inflight, gtrid)
+	}
+}
+
+func (c *Coordinator) isInflight(gtrid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inflight[gtrid]
+}
+
+// Rollback rolls gtrid back on branches, whatever state they reached.
+func (c *Coordinator) Rollback(ctx context.Context, gtrid string, branches []Branch) error {
+	var err error
+	for _, b := range branches {
+		xid := Xid(gtrid, b.Name())
+		// ending an ended branch fails, which is fine
+		_ = b.Exec(ctx, "XA END "+xid)
+		if e := b.Exec(ctx, "XA ROLLBACK "+xid); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Recover finishes the prepared transactions of the proxy found on the
+// primaries of clusters: logged ones are committed, the ones of a previous
+// run of the proxy that never got logged are rolled back. Prepared
+// transactions of the current run may still be in flight and are left.
+func (c *Coordinator) Recover(ctx context.Context, clusters *cluster.Registry) error {
+	own := gtridPrefix + c.instance + "-"
+	current := own + c.boot + "-"
+	// transactions logged during the scan may be prepared on clusters
+	// scanned already without showing up, only the ones logged before are
+	// known to be done when not seen
+	pending := c.log.Pending()
+	seen := map[string]bool{}
+	var firstErr error
+	for _, cl := range clusters.All() {
+		xids, err := recoverXids(ctx, cl.Primary())
+		if err != nil {
+			mLog.Error("msg", "xa recover", "cluster", cl.Name, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, x := range xids {
+			if !strings.HasPrefix(x.gtrid, own) {
+				continue
+			}
+			seen[x.gtrid] = true
+			if c.isInflight(x.gtrid) {
+				continue
+			}
+			var query string
+			switch {
+			case c.log.Committed(x.gtrid):
+				query = "XA COMMIT " + Xid(x.gtrid, x.bqual)
+			case !strings.HasPrefix(x.gtrid, current):
+				query = "XA ROLLBACK " + Xid(x.gtrid, x.bqual)
+			default:
+				continue
+			}
+			mLog.Log("msg", "recovering", "cluster", cl.Name, "query", query)
+			if _, err := cl.Primary().DB().ExecContext(ctx, query); err != nil {
+				mLog.Error("msg", "recovering", "cluster", cl.Name, "query", query, "err", err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	// every cluster answered, logged transactions no longer prepared
+	// anywhere are committed everywhere
+	for _, gtrid := range pending {
+		if !seen[gtrid] && !c.isInflight(gtrid) {
+			if err := c.log.Done(gtrid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Run recovers transactions every RecoverInterval until ctx is done.
+func (c *Coordinator) Run(ctx context.Context, clusters *cluster.Registry) {
+	ticker := time.NewTicker(RecoverInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = c.Recover(ctx, clusters)
+		}
+	}
+}
+
+func (c *Coordinator) Close() error {
+	return c.log.Close()
+}
+
+type xid struct {
+	gtrid string
+	bqual string
+}
+
+func recoverXids(ctx context.Context, b *cluster.Backend) ([]xid, error) {
+	rows, err := b.DB().QueryContext(ctx, "XA RECOVER")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xids []xid
+	for rows.Next() {
+		var (
+			formatID, gtridLen, bqualLen int
+			data                         []byte
+		)
+		if err := rows.Scan(&formatID, &gtridLen, &bqualLen, &data); err != nil {
+			return nil, err
+		}
+		if gtridLen+bqualLen > len(data) {
+			continue
+		}
+		xids = append(xids, xid{gtrid: string(data[:gtridLen]), bqual: string(data[gtridLen : gtridLen+bqualLen])})
+	}
+	return xids, rows.Err()
+}
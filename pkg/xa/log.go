@@ -0,0 +1,147 @@
+package xa
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/u2takey/mysqlgate/pkg/atomicfile"
+)
+
+const (
+	decisionCommit = "commit"
+	decisionDone   = "done"
+)
+
+type logEntry struct {
+	Gtrid    string   `json:"gtrid"`
+	Decision string   `json:"decision"`
+	Branches []string `json:"branches,omitempty"`
+}
+
+// Log is the durable record of commit decisions. A transaction is logged
+// once all its branches are prepared, before the first of them commits,
+// and marked done once all of them committed. Transactions not logged are
+// rolled back by recovery.
+type Log struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	pending map[string][]string
+}
+
+// OpenLog opens the log at path, keeping only the decisions of transactions
+// not done yet.
+func OpenLog(path string) (*Log, error) {
+	l := &Log{path: path, pending: map[string][]string{}}
+	if err := l.replay(); err != nil {
+		return nil, err
+	}
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	return l, nil
+}
+
+func (l *Log) replay() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a torn last line was never acknowledged
+			continue
+		}
+		switch e.Decision {
+		case decisionCommit:
+			l.pending[e.Gtrid] = e.Branches
+		case decisionDone:
+			delete(l.pending, e.Gtrid)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the log with the pending decisions only.
+func (l *Log) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for gtrid, branches := range l.pending {
+		if err := enc.Encode(&logEntry{Gtrid: gtrid, Decision: decisionCommit, Branches: branches}); err != nil {
+			return err
+		}
+	}
+	return atomicfile.WriteFile(l.path, buf.Bytes(), 0o600)
+}
+
+func (l *Log) append(e *logEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Commit durably records the decision to commit gtrid.
+func (l *Log) Commit(gtrid string, branches []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.append(&logEntry{Gtrid: gtrid, Decision: decisionCommit, Branches: branches}); err != nil {
+		return err
+	}
+	l.pending[gtrid] = branches
+	return nil
+}
+
+// Done records that every branch of gtrid committed.
+func (l *Log) Done(gtrid string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.append(&logEntry{Gtrid: gtrid, Decision: decisionDone}); err != nil {
+		return err
+	}
+	delete(l.pending, gtrid)
+	return nil
+}
+
+// Committed reports whether gtrid has a commit decision not done yet.
+func (l *Log) Committed(gtrid string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.pending[gtrid]
+	return ok
+}
+
+// Pending returns the transactions decided to commit and not done.
+func (l *Log) Pending() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	gtrids := make([]string, 0, len(l.pending))
+	for gtrid := range l.pending {
+		gtrids = append(gtrids, gtrid)
+	}
+	return gtrids
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
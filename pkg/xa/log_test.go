@@ -0,0 +1,98 @@
+package xa
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/u2takey/mysqlgate/pkg/cluster"
+)
+
+func TestLogRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xa.log")
+	l, err := OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gtrid := range []string{"g1", "g2"} {
+		if err := l.Commit(gtrid, []string{"a", "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Done("g1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a crash while logging g3 left half a line
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"gtrid":"g3","decis`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err = OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := l.Pending(); !reflect.DeepEqual(got, []string{"g2"}) {
+		t.Fatalf("pending %v, want [g2]", got)
+	}
+	if !l.Committed("g2") || l.Committed("g1") || l.Committed("g3") {
+		t.Fatal("only g2 should be committed")
+	}
+	if !reflect.DeepEqual(l.pending["g2"], []string{"a", "b"}) {
+		t.Fatalf("branches of g2 %v, want [a b]", l.pending["g2"])
+	}
+
+	// the log was compacted to the pending decision
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	want := []string{`{"gtrid":"g2","decision":"commit","branches":["a","b"]}`}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("log %q, want %q", lines, want)
+	}
+}
+
+func TestXid(t *testing.T) {
+	if got, want := Xid(`a'b`, `c\d`), `'a\'b','c\\d'`; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestRecoverLeavesInflight(t *testing.T) {
+	c, err := NewCoordinator(Config{Log: filepath.Join(t.TempDir(), "xa.log"), Instance: "p1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	done, committing := c.NewGtrid(), c.NewGtrid()
+	for _, gtrid := range []string{done, committing} {
+		if err := c.log.Commit(gtrid, []string{"a", "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.setInflight(committing, true)
+	if err := c.Recover(context.Background(), &cluster.Registry{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.log.Pending(); !reflect.DeepEqual(got, []string{committing}) {
+		t.Fatalf("pending %v, want the in flight %s only", got, committing)
+	}
+}